@@ -0,0 +1,396 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// permUsersAdmin allows calling the user administration endpoints on the admin server
+	permUsersAdmin = "users:admin"
+
+	defaultUserSearchLimit = 25
+	maxUserSearchLimit     = 100
+)
+
+// userAdmin serves the user administration endpoints mounted on the admin HTTP server.
+//
+// Callers authenticate with a cookie or personal access token of an active user with the
+// users:admin permission (which the admin role has). Personal access tokens also need the
+// users:admin scope.
+type userAdmin struct {
+	logger log.Logger
+
+	auth   authable
+	users  userRepository
+	roles  roleRepository
+	tokens personalTokenRepository
+	oauth  *oauth
+
+	deletions *userDeleter
+
+	// notifier emails password reset codes to users, when set
+	notifier Notifier
+
+	// audit records each change made by admins, when set
+	audit auditLog
+
+	// webhooks manages webhook subscriptions, their endpoints are registered when it's set
+	webhooks *webhookDispatcher
+}
+
+// adminHandler is an endpoint called by adminId, a user with the users:admin permission.
+type adminHandler func(w http.ResponseWriter, r *http.Request, adminId string)
+
+// register adds each endpoint with add, which is usually (*admin.Server).AddHandler.
+// The admin server doesn't route by method so each handler checks it.
+func (a *userAdmin) register(add func(path string, fn http.HandlerFunc)) {
+	add("/users", a.methods(map[string]adminHandler{"GET": a.searchUsers}))
+	add("/users/{userId}", a.methods(map[string]adminHandler{"GET": a.getUser}))
+	add("/users/{userId}/status", a.methods(map[string]adminHandler{"GET": a.getStatusHistory, "PUT": a.updateStatus}))
+	add("/users/{userId}/logout", a.methods(map[string]adminHandler{"POST": a.logoutUser}))
+	add("/users/{userId}/clients", a.methods(map[string]adminHandler{"DELETE": a.revokeClients}))
+	add("/users/{userId}/tokens", a.methods(map[string]adminHandler{"DELETE": a.revokeTokens}))
+	add("/users/{userId}/password-reset", a.methods(map[string]adminHandler{"POST": a.resetPassword}))
+	add("/users/{userId}/deletion", a.methods(map[string]adminHandler{"GET": a.getDeletion}))
+	add("/audit", a.methods(map[string]adminHandler{"GET": a.searchAudit}))
+	if a.webhooks != nil {
+		a.registerWebhooks(add)
+	}
+}
+
+// methods authenticates the caller and dispatches to the handler for the request method.
+func (a *userAdmin) methods(handlers map[string]adminHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "userAdmin")
+
+		fn, ok := handlers[r.Method]
+		if !ok {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		adminId, err := a.callerId(r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		allowed, err := a.roles.hasPermission(adminId, "", permUsersAdmin)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fn(w, r, adminId)
+	}
+}
+
+// callerId returns the userId of a personal access token or cookie on r. Personal access tokens
+// need the users:admin scope and the caller must be an active user.
+func (a *userAdmin) callerId(r *http.Request) (string, error) {
+	var userId string
+	if secret := personalTokenFromRequest(r); secret != "" {
+		pat, err := a.tokens.lookup(secret)
+		if err != nil {
+			return "", err
+		}
+		if pat == nil {
+			return "", errInvalidPersonalToken
+		}
+		if !containsScope(pat.Scopes, permUsersAdmin) {
+			return "", fmt.Errorf("personal access token=%s is missing the %s scope", pat.ID, permUsersAdmin)
+		}
+		userId = pat.UserID
+	} else {
+		id, err := extractUserId(a.auth, r)
+		if err != nil {
+			return "", err
+		}
+		userId = id
+	}
+	user, err := a.users.lookupByUserId(userId)
+	if err != nil {
+		return "", err
+	}
+	if user == nil || !user.canAccess() {
+		return "", fmt.Errorf("userId=%s can't access the admin API", userId)
+	}
+	return userId, nil
+}
+
+// targetUser returns the route's {userId}, writing a 404 if they don't exist.
+func (a *userAdmin) targetUser(w http.ResponseWriter, r *http.Request) *User {
+	user, err := a.users.lookupByUserId(mux.Vars(r)["userId"])
+	if err != nil {
+		internalError(w, err)
+		return nil
+	}
+	if user == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return user
+}
+
+func (a *userAdmin) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		internalError(w, err)
+	}
+}
+
+func (a *userAdmin) searchUsers(w http.ResponseWriter, r *http.Request, adminId string) {
+	limit := defaultUserSearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxUserSearchLimit {
+			moovhttp.Problem(w, fmt.Errorf("limit must be between 1 and %d", maxUserSearchLimit))
+			return
+		}
+		limit = n
+	}
+	users, err := a.users.search(r.URL.Query().Get("query"), limit)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if users == nil {
+		users = []*User{}
+	}
+	a.writeJSON(w, users)
+}
+
+func (a *userAdmin) getUser(w http.ResponseWriter, r *http.Request, adminId string) {
+	if user := a.targetUser(w, r); user != nil {
+		a.writeJSON(w, user)
+	}
+}
+
+type updateUserStatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// updateStatus moves a user to another lifecycle state, users who can no longer login are signed out.
+func (a *userAdmin) updateStatus(w http.ResponseWriter, r *http.Request, adminId string) {
+	user := a.targetUser(w, r)
+	if user == nil {
+		return
+	}
+	var req updateUserStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		moovhttp.Problem(w, err)
+		return
+	}
+	if !validUserStatus(req.Status) {
+		moovhttp.Problem(w, fmt.Errorf("unknown status %q", req.Status))
+		return
+	}
+	if !canTransition(user.Status, req.Status) {
+		moovhttp.Problem(w, fmt.Errorf("%v: %s to %s", errInvalidStatusTransition, user.Status, req.Status))
+		return
+	}
+	if err := a.users.transitionStatus(user.ID, req.Status, req.Reason, adminId); err != nil {
+		internalError(w, err)
+		return
+	}
+	user.Status = req.Status
+	if !user.canLogin() {
+		// Sign the user out everywhere, tokens would otherwise work again if they're reactivated
+		if err := a.auth.invalidateCookies(user.ID); err != nil {
+			internalError(w, err)
+			return
+		}
+		if _, err := revokeUserAccess(a.oauth, a.tokens, user.ID); err != nil {
+			internalError(w, fmt.Errorf("problem revoking tokens of userId=%s: %v", user.ID, err))
+			return
+		}
+	}
+	a.logger.Log("admin", fmt.Sprintf("adminId=%s set userId=%s status=%s reason=%q", adminId, user.ID, req.Status, req.Reason))
+	recordAudit(a.audit, r, auditUserStatusChanged, adminId, user.ID, map[string]string{"status": req.Status, "reason": req.Reason})
+
+	a.writeJSON(w, user)
+}
+
+func (a *userAdmin) getStatusHistory(w http.ResponseWriter, r *http.Request, adminId string) {
+	user := a.targetUser(w, r)
+	if user == nil {
+		return
+	}
+	history, err := a.users.statusHistory(user.ID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if history == nil {
+		history = []*userStatusTransition{}
+	}
+	a.writeJSON(w, history)
+}
+
+func (a *userAdmin) logoutUser(w http.ResponseWriter, r *http.Request, adminId string) {
+	user := a.targetUser(w, r)
+	if user == nil {
+		return
+	}
+	if err := a.auth.invalidateCookies(user.ID); err != nil {
+		internalError(w, err)
+		return
+	}
+	authInactivations.With("method", "admin").Add(1)
+	a.logger.Log("admin", fmt.Sprintf("adminId=%s signed out userId=%s", adminId, user.ID))
+	recordAudit(a.audit, r, auditUserSessionsRevoked, adminId, user.ID, nil)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type revokedResponse struct {
+	Revoked int64 `json:"revoked"`
+}
+
+// revokeClients deletes every OAuth2 client of a user and the tokens issued to them.
+func (a *userAdmin) revokeClients(w http.ResponseWriter, r *http.Request, adminId string) {
+	user := a.targetUser(w, r)
+	if user == nil {
+		return
+	}
+	clients, err := a.oauth.existingClients(user.ID, "")
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	for i := range clients {
+		if err := a.oauth.clientStore.DeleteByID(clients[i].GetID()); err != nil {
+			internalError(w, err)
+			return
+		}
+		if remover, ok := a.oauth.tokenStore.(clientTokenRemover); ok {
+			if err := remover.RemoveByClientID(clients[i].GetID()); err != nil {
+				internalError(w, fmt.Errorf("problem revoking tokens for OAuth2 client %s: %v", clients[i].GetID(), err))
+				return
+			}
+		}
+		recordAudit(a.audit, r, auditClientDeleted, adminId, user.ID, map[string]string{"clientId": clients[i].GetID()})
+	}
+	a.logger.Log("admin", fmt.Sprintf("adminId=%s revoked %d OAuth2 clients of userId=%s", adminId, len(clients), user.ID))
+
+	a.writeJSON(w, revokedResponse{Revoked: int64(len(clients))})
+}
+
+// revokeTokens revokes every OAuth2 token issued to a user and their personal access tokens.
+func (a *userAdmin) revokeTokens(w http.ResponseWriter, r *http.Request, adminId string) {
+	user := a.targetUser(w, r)
+	if user == nil {
+		return
+	}
+	n, err := revokeUserAccess(a.oauth, a.tokens, user.ID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	a.logger.Log("admin", fmt.Sprintf("adminId=%s revoked OAuth2 tokens and %d personal access tokens of userId=%s", adminId, n, user.ID))
+	recordAudit(a.audit, r, auditTokensRevoked, adminId, user.ID, map[string]string{"personalTokens": strconv.FormatInt(n, 10)})
+
+	a.writeJSON(w, revokedResponse{Revoked: n})
+}
+
+// revokeUserAccess revokes every OAuth2 token and personal access token of userId, returning
+// how many personal access tokens were revoked.
+func revokeUserAccess(o *oauth, tokens personalTokenRepository, userId string) (int64, error) {
+	if o != nil {
+		remover, ok := o.tokenStore.(userTokenRemover)
+		if !ok {
+			return 0, errors.New("OAuth2 token store can't revoke tokens by user")
+		}
+		if err := remover.RemoveByUserID(userId); err != nil {
+			return 0, err
+		}
+	}
+	if tokens == nil {
+		return 0, nil
+	}
+	return tokens.revokeUserTokens(userId)
+}
+
+type passwordResetResponse struct {
+	// Code is only returned when there's no notifier to send it to the user
+	Code      string    `json:"code,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// resetPassword creates a password reset code for the user to set a new password with
+// POST /users/password/reset. The code is sent to the user, admins only see it when no
+// notifier is configured.
+func (a *userAdmin) resetPassword(w http.ResponseWriter, r *http.Request, adminId string) {
+	user := a.targetUser(w, r)
+	if user == nil {
+		return
+	}
+	code, expires, err := a.auth.createPasswordReset(user.ID, adminId)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	a.logger.Log("admin", fmt.Sprintf("adminId=%s started a password reset for userId=%s", adminId, user.ID))
+	recordAudit(a.audit, r, auditPasswordResetCreated, adminId, user.ID, nil)
+	if a.notifier != nil {
+		data := map[string]interface{}{
+			"Code":      code,
+			"ExpiresAt": expires.Format(time.RFC1123),
+		}
+		if err := a.notifier.Notify(user.Email, "password_reset", data); err != nil {
+			internalError(w, fmt.Errorf("problem notifying userId=%s of their password reset: %v", user.ID, err))
+			return
+		}
+		a.writeJSON(w, passwordResetResponse{ExpiresAt: expires})
+		return
+	}
+
+	a.writeJSON(w, passwordResetResponse{Code: code, ExpiresAt: expires})
+}
+
+// getDeletion returns a user's deletion and its report, which outlives the user once they're purged.
+func (a *userAdmin) getDeletion(w http.ResponseWriter, r *http.Request, adminId string) {
+	deletion, err := a.deletions.get(mux.Vars(r)["userId"])
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if deletion == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	a.writeJSON(w, deletion)
+}
+
+// searchAudit lists audit events of every user, optionally filtered by userId and actorId.
+func (a *userAdmin) searchAudit(w http.ResponseWriter, r *http.Request, adminId string) {
+	if a.audit == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	filter, err := readAuditFilter(r)
+	if err != nil {
+		moovhttp.Problem(w, err)
+		return
+	}
+	filter.UserID = r.URL.Query().Get("userId")
+	filter.ActorID = r.URL.Query().Get("actorId")
+	writeAuditPage(w, a.audit, filter)
+}
@@ -0,0 +1,268 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestUserAdmin(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	roleRepo := &sqliteRoleRepository{db: repo.db, log: log.NewNopLogger()}
+	tokens := &sqlitePersonalTokenRepository{db: repo.db, log: log.NewNopLogger()}
+
+	a := &userAdmin{
+		logger: log.NewNopLogger(),
+		auth:   auth,
+		users:  repo,
+		roles:  roleRepo,
+		tokens: tokens,
+		oauth:  o.svc,
+
+		deletions: &userDeleter{db: repo.db, logger: log.NewNopLogger(), auth: auth, users: repo, oauth: o.svc},
+		notifier:  &mockNotifier{},
+		audit:     &sqliteAuditLog{db: repo.db, log: log.NewNopLogger()},
+	}
+	router := mux.NewRouter()
+	a.register(func(path string, fn http.HandlerFunc) {
+		router.HandleFunc(path, fn)
+	})
+
+	admin, user := createTestUser(t, repo, "admin@moov.io"), createTestUser(t, repo, "jane@moov.io")
+	if err := roleRepo.assignRole(admin.ID, adminRole, ""); err != nil {
+		t.Fatal(err)
+	}
+	secret := personalTokenPrefix + generateID()
+	if err := tokens.createToken(&personalToken{ID: generateID(), UserID: admin.ID, Name: "admin", Scopes: []string{permUsersAdmin}, CreatedAt: base.NewTime(time.Now())}, secret); err != nil {
+		t.Fatal(err)
+	}
+	unscoped := personalTokenPrefix + generateID()
+	if err := tokens.createToken(&personalToken{ID: generateID(), UserID: admin.ID, Name: "ci", CreatedAt: base.NewTime(time.Now())}, unscoped); err != nil {
+		t.Fatal(err)
+	}
+	userCookie, err := createCookie(user.ID, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		r := httptest.NewRequest(method, path, &buf)
+		r.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	// only admins can call the API
+	r := httptest.NewRequest("GET", "/users", nil)
+	r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", userCookie.Value))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("POST", "/users", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got %d", w.Code)
+	}
+	r = httptest.NewRequest("GET", "/users", nil)
+	r.Header.Set("Authorization", "Bearer "+unscoped)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected token without the %s scope to be rejected, got %d", permUsersAdmin, w.Code)
+	}
+
+	// search
+	w = do("GET", "/users?query=JANE@", nil)
+	var users []*User
+	if err := json.NewDecoder(w.Body).Decode(&users); err != nil || len(users) != 1 || users[0].ID != user.ID {
+		t.Fatalf("unexpected users=%#v err=%v", users, err)
+	}
+	if w := do("GET", "/users?limit=1000", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("GET", "/users/"+generateID(), nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("GET", fmt.Sprintf("/users/%s/deletion", user.ID), nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// suspending signs the user out and revokes their tokens
+	client, token := createOAuthClient(t, o, user.ID)
+	userSecret := personalTokenPrefix + generateID()
+	if err := tokens.createToken(&personalToken{ID: generateID(), UserID: user.ID, Name: "ci", CreatedAt: base.NewTime(time.Now())}, userSecret); err != nil {
+		t.Fatal(err)
+	}
+	checkPersonalToken := func() int {
+		r := httptest.NewRequest("GET", "/auth/check", nil)
+		r.Header.Set("Authorization", "Bearer "+userSecret)
+		w := httptest.NewRecorder()
+		checkAuth(log.NewNopLogger(), auth, o.svc, repo, nil, tokens)(w, r)
+		return w.Code
+	}
+	if code := checkPersonalToken(); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	w = do("PUT", fmt.Sprintf("/users/%s/status", user.ID), updateUserStatusRequest{Status: userStatusSuspended, Reason: "abuse"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if id, _ := auth.findUserId(userCookie.Value); id != "" {
+		t.Errorf("expected cookie to be invalidated, found userId=%s", id)
+	}
+	r = httptest.NewRequest("GET", "/auth/check", nil)
+	r.Header.Set("Authorization", "Bearer "+token.Access)
+	w = httptest.NewRecorder()
+	checkAuth(log.NewNopLogger(), auth, o.svc, repo, nil, nil)(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected suspended user's token to be rejected, got %d", w.Code)
+	}
+	if code := checkPersonalToken(); code != http.StatusForbidden {
+		t.Errorf("expected suspended user's personal access token to be rejected, got %d", code)
+	}
+	if pats, err := tokens.getUserTokens(user.ID); err != nil || len(pats) != 0 {
+		t.Errorf("expected personal access tokens to be revoked, got %d err=%v", len(pats), err)
+	}
+	if w := do("PUT", fmt.Sprintf("/users/%s/status", user.ID), updateUserStatusRequest{Status: "other"}); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("PUT", fmt.Sprintf("/users/%s/status", user.ID), updateUserStatusRequest{Status: userStatusLocked}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected suspended user to not be locked, got %d", w.Code)
+	}
+	w = do("PUT", fmt.Sprintf("/users/%s/status", user.ID), updateUserStatusRequest{Status: userStatusActive})
+	if u, _ := repo.lookupByUserId(user.ID); w.Code != http.StatusOK || u.Status != userStatusActive {
+		t.Errorf("got %d status=%s", w.Code, u.Status)
+	}
+	if code := checkPersonalToken(); code != http.StatusForbidden {
+		t.Errorf("expected revoked personal access token to stay rejected after reactivation, got %d", code)
+	}
+	w = do("GET", fmt.Sprintf("/users/%s/status", user.ID), nil)
+	var history []*userStatusTransition
+	if err := json.NewDecoder(w.Body).Decode(&history); err != nil || len(history) != 2 {
+		t.Fatalf("unexpected history=%#v err=%v", history, err)
+	}
+	if h := history[0]; h.From != userStatusActive || h.To != userStatusSuspended || h.Reason != "abuse" || h.ChangedBy != admin.ID {
+		t.Errorf("unexpected transition: %#v", h)
+	}
+
+	// revoke tokens and clients
+	if w := do("DELETE", fmt.Sprintf("/users/%s/tokens", user.ID), nil); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if ti, err := o.svc.tokenStore.GetByAccess(token.Access); err != nil || ti != nil {
+		t.Errorf("expected revoked token, got ti=%v err=%v", ti, err)
+	}
+	w = do("DELETE", fmt.Sprintf("/users/%s/clients", user.ID), nil)
+	var revoked revokedResponse
+	if err := json.NewDecoder(w.Body).Decode(&revoked); err != nil || revoked.Revoked != 1 {
+		t.Errorf("unexpected response=%#v err=%v", revoked, err)
+	}
+	if clients, err := o.svc.existingClients(user.ID, ""); err != nil || len(clients) != 0 {
+		t.Errorf("expected client=%s to be deleted, got %d clients err=%v", client.ID, len(clients), err)
+	}
+
+	// password reset
+	w = do("POST", fmt.Sprintf("/users/%s/password-reset", user.ID), nil)
+	var reset passwordResetResponse
+	if err := json.NewDecoder(w.Body).Decode(&reset); err != nil || reset.Code != "" || reset.ExpiresAt.IsZero() {
+		t.Fatalf("expected the code to only be sent to the user, response=%#v err=%v", reset, err)
+	}
+	sent := a.notifier.(*mockNotifier).sent
+	if len(sent) != 1 || sent[0].to != user.Email || sent[0].data["Code"] == "" {
+		t.Fatalf("expected reset code to be sent to the user: %#v", sent)
+	}
+	reset.Code = sent[0].data["Code"].(string)
+
+	_, token = createOAuthClient(t, o, user.ID)
+	if err := tokens.createToken(&personalToken{ID: generateID(), UserID: user.ID, Name: "ci", CreatedAt: base.NewTime(time.Now())}, generateID()); err != nil {
+		t.Fatal(err)
+	}
+	resetRouter := mux.NewRouter()
+	addPasswordResetRoutes(resetRouter, log.NewNopLogger(), auth, o.svc, tokens, nil)
+	resetWith := func(code string) int {
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(resetPasswordRequest{Code: code, Password: "new-password"})
+		w := httptest.NewRecorder()
+		resetRouter.ServeHTTP(w, httptest.NewRequest("POST", "/users/password/reset", &buf))
+		return w.Code
+	}
+	if code := resetWith(generateID()); code != http.StatusBadRequest {
+		t.Errorf("got %d", code)
+	}
+	if code := resetWith(reset.Code); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	if code := resetWith(reset.Code); code != http.StatusBadRequest {
+		t.Errorf("expected used code to be rejected, got %d", code)
+	}
+	if err := auth.checkPassword(user.ID, "new-password"); err != nil {
+		t.Error(err)
+	}
+	if ti, err := o.svc.tokenStore.GetByAccess(token.Access); err != nil || ti != nil {
+		t.Errorf("expected the reset to revoke OAuth2 tokens, got ti=%v err=%v", ti, err)
+	}
+	if pats, err := tokens.getUserTokens(user.ID); err != nil || len(pats) != 0 {
+		t.Errorf("expected the reset to revoke personal access tokens, got %#v err=%v", pats, err)
+	}
+
+	// each change was audited
+	w = do("GET", fmt.Sprintf("/audit?userId=%s&actorId=%s", user.ID, admin.ID), nil)
+	var page auditPage
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, e := range page.Events {
+		types = append(types, e.Type)
+	}
+	expected := []string{auditPasswordResetCreated, auditClientDeleted, auditTokensRevoked, auditUserStatusChanged, auditUserStatusChanged}
+	if fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Errorf("got events %v", types)
+	}
+	if w := do("GET", "/audit?limit=1000", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// suspended admins lose access
+	if err := repo.transitionStatus(admin.ID, userStatusSuspended, "compromised", ""); err != nil {
+		t.Fatal(err)
+	}
+	if w := do("GET", "/users", nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected suspended admin to be rejected, got %d", w.Code)
+	}
+}
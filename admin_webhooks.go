@@ -0,0 +1,138 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/gorilla/mux"
+)
+
+// registerWebhooks adds the webhook subscription endpoints with add, see register.
+func (a *userAdmin) registerWebhooks(add func(path string, fn http.HandlerFunc)) {
+	add("/webhooks", a.methods(map[string]adminHandler{"GET": a.listWebhooks, "POST": a.createWebhook}))
+	add("/webhooks/{webhookId}", a.methods(map[string]adminHandler{"DELETE": a.deleteWebhook}))
+	add("/webhook-deliveries", a.methods(map[string]adminHandler{"GET": a.listWebhookDeliveries}))
+	add("/webhook-deliveries/{deliveryId}/retry", a.methods(map[string]adminHandler{"POST": a.retryWebhookDelivery}))
+}
+
+func (a *userAdmin) listWebhooks(w http.ResponseWriter, r *http.Request, adminId string) {
+	webhooks, err := a.webhooks.webhooks()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if webhooks == nil {
+		webhooks = []*webhook{}
+	}
+	a.writeJSON(w, webhooks)
+}
+
+type createWebhookRequest struct {
+	URL string `json:"url"`
+
+	// Events are the identity event types delivered, every type is delivered when empty.
+	Events []string `json:"events"`
+}
+
+// createWebhook subscribes a URL to identity events, the response includes the secret which signs deliveries.
+func (a *userAdmin) createWebhook(w http.ResponseWriter, r *http.Request, adminId string) {
+	var req createWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		moovhttp.Problem(w, err)
+		return
+	}
+	hook := &webhook{
+		URL:       strings.TrimSpace(req.URL),
+		Events:    req.Events,
+		CreatedBy: adminId,
+	}
+	if hook.Events == nil {
+		hook.Events = []string{}
+	}
+	if err := validateWebhook(hook); err != nil {
+		moovhttp.Problem(w, err)
+		return
+	}
+	if err := a.webhooks.createWebhook(hook); err != nil {
+		internalError(w, err)
+		return
+	}
+	a.logger.Log("admin", fmt.Sprintf("adminId=%s created webhook %s", adminId, hook.ID))
+
+	a.writeJSON(w, hook)
+}
+
+func (a *userAdmin) deleteWebhook(w http.ResponseWriter, r *http.Request, adminId string) {
+	webhookId := mux.Vars(r)["webhookId"]
+	found, err := a.webhooks.deleteWebhook(webhookId)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	a.logger.Log("admin", fmt.Sprintf("adminId=%s deleted webhook %s", adminId, webhookId))
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// listWebhookDeliveries is the delivery history, optionally of one webhook (webhookId) and status.
+// The dead-letter list is ?status=failed.
+func (a *userAdmin) listWebhookDeliveries(w http.ResponseWriter, r *http.Request, adminId string) {
+	q := r.URL.Query()
+	filter := webhookDeliveryFilter{
+		WebhookID: q.Get("webhookId"),
+		Status:    q.Get("status"),
+		Limit:     defaultWebhookDeliveryLimit,
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxWebhookDeliveryLimit {
+			moovhttp.Problem(w, fmt.Errorf("limit must be between 1 and %d", maxWebhookDeliveryLimit))
+			return
+		}
+		filter.Limit = n
+	}
+	switch filter.Status {
+	case "", webhookDeliveryPending, webhookDeliveryDelivered, webhookDeliveryFailed:
+	default:
+		moovhttp.Problem(w, fmt.Errorf("unknown delivery status %q", filter.Status))
+		return
+	}
+	deliveries, err := a.webhooks.deliveries(filter)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*webhookDelivery{}
+	}
+	a.writeJSON(w, deliveries)
+}
+
+// retryWebhookDelivery queues a delivery from the dead-letter list again.
+func (a *userAdmin) retryWebhookDelivery(w http.ResponseWriter, r *http.Request, adminId string) {
+	deliveryId := mux.Vars(r)["deliveryId"]
+	if err := a.webhooks.retry(deliveryId); err != nil {
+		if err == errWebhookDeliveryNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			internalError(w, err)
+		}
+		return
+	}
+	a.logger.Log("admin", fmt.Sprintf("adminId=%s retried webhook delivery %s", adminId, deliveryId))
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,417 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// Audit event types
+const (
+	auditLoginSucceeded       = "login.succeeded"
+	auditLoginFailed          = "login.failed"
+	auditLoginDisowned        = "login.disowned"
+	auditLogout               = "logout"
+	auditSignup               = "signup"
+	auditPasswordChanged      = "password.changed"
+	auditPasswordResetCreated = "password.reset_created"
+	auditClientCreated        = "oauth2.client_created"
+	auditClientDeleted        = "oauth2.client_deleted"
+	auditClientSecretRotated  = "oauth2.client_secret_rotated"
+	auditTokenIssued          = "oauth2.token_issued"
+	auditTokensRevoked        = "oauth2.tokens_revoked"
+	auditRefreshTokenReused   = "oauth2.refresh_token_reused"
+	auditPersonalTokenCreated = "personal_token.created"
+	auditPersonalTokenRevoked = "personal_token.revoked"
+	auditUserStatusChanged    = "user.status_changed"
+	auditUserSessionsRevoked  = "user.sessions_revoked"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+)
+
+var (
+	errInvalidAuditCursor = errors.New("invalid audit cursor")
+
+	// trustedProxies are the networks of our load balancers and proxies, forwarding headers are
+	// only read from them. Set TRUSTED_PROXIES to a comma separated list of CIDRs or addresses.
+	trustedProxies []*net.IPNet
+)
+
+// readAuditConfig updates the audit settings from their environment variables if set.
+func readAuditConfig() error {
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		nets, err := parseTrustedProxies(v)
+		if err != nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES=%q: %v", v, err)
+		}
+		trustedProxies = nets
+	}
+	return nil
+}
+
+// parseTrustedProxies reads a comma separated list of CIDRs, single addresses are
+// treated as a /32 (or /128).
+func parseTrustedProxies(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trustedProxy returns true if addr is one of our trustedProxies.
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for i := range trustedProxies {
+		if trustedProxies[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// auditEvent is a security relevant action, ActorID did something to UserID's account.
+// They're the same user for most self-service actions and ActorID is empty when nobody
+// is signed in (i.e. a failed login).
+type auditEvent struct {
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	ActorID   string            `json:"actorId,omitempty"`
+	UserID    string            `json:"userId,omitempty"`
+	IP        string            `json:"ip,omitempty"`
+	UserAgent string            `json:"userAgent,omitempty"`
+	RequestID string            `json:"requestId,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+
+	seq int64
+}
+
+// auditFilter limits which events are returned, empty fields match every event.
+type auditFilter struct {
+	UserID  string
+	ActorID string
+	Type    string
+	Since   time.Time
+	Until   time.Time
+
+	// Cursor continues from the last page, events are returned newest first
+	Cursor string
+	Limit  int
+}
+
+type auditLog interface {
+	// record saves event, filling in its ID and CreatedAt.
+	record(event *auditEvent) error
+
+	// search returns events matching filter, newest first, and the cursor of the next page
+	// which is empty on the last page.
+	search(filter auditFilter) ([]*auditEvent, string, error)
+}
+
+// newAuditEvent returns an event of the request's client, the caller fills in who did what.
+func newAuditEvent(r *http.Request, eventType, actorId, userId string) *auditEvent {
+	return &auditEvent{
+		Type:      eventType,
+		ActorID:   actorId,
+		UserID:    userId,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		RequestID: moovhttp.GetRequestId(r),
+	}
+}
+
+// recordAudit records an event of the request. Failures are logged so the request can still complete.
+func recordAudit(a auditLog, r *http.Request, eventType, actorId, userId string, details map[string]string) {
+	if a == nil {
+		return
+	}
+	event := newAuditEvent(r, eventType, actorId, userId)
+	event.Details = details
+	if err := a.record(event); err != nil && logger != nil {
+		logger.Log("audit", fmt.Sprintf("problem recording %s event for userId=%s: %v", eventType, userId, err))
+	}
+}
+
+// clientIP returns the address of the client. Forwarding headers are only read when the
+// connection comes from one of our trustedProxies, then the right-most X-Forwarded-For hop
+// which isn't a trusted proxy is the client. Hops left of it could be set by anyone.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	if v := r.Header.Get("X-Forwarded-For"); v != "" {
+		hops := strings.Split(v, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			if !trustedProxy(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+	if v := strings.TrimSpace(r.Header.Get("X-Real-Ip")); v != "" {
+		return v
+	}
+	return host
+}
+
+type sqliteAuditLog struct {
+	db  *sql.DB
+	log log.Logger
+
+	// mu serializes writes so each event is chained to the one before it
+	mu sync.Mutex
+}
+
+func (a *sqliteAuditLog) record(event *auditEvent) error {
+	if event.ID == "" {
+		event.ID = generateID()
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	var details string
+	if len(event.Details) > 0 {
+		bs, err := json.Marshal(event.Details)
+		if err != nil {
+			return err
+		}
+		details = string(bs)
+	}
+	createdAt := event.CreatedAt.Format(serializedTimestampFormat)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	prev, err := lastAuditLink(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	seq := prev.seq + 1
+	salt := generateID()
+	if salt == "" {
+		tx.Rollback()
+		return errors.New("problem generating audit event salt")
+	}
+	hash := auditEventHash(prev.hash, seq, event, details, createdAt, auditPersonalDigest(salt, event, details))
+
+	query := `insert into audit_events (seq, event_id, type, actor_id, user_id, ip, user_agent, request_id, details, created_at, prev_hash, hash) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, seq, event.ID, event.Type, event.ActorID, event.UserID, event.IP, event.UserAgent, event.RequestID, details, createdAt, prev.hash, hash); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem writing %s audit event, err=%v, rollback err=%v", event.Type, err, e)
+	}
+	if _, err := tx.Exec(`insert into audit_event_salts (event_id, salt) values (?, ?)`, event.ID, salt); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem writing %s audit event salt, err=%v, rollback err=%v", event.Type, err, e)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	event.seq = seq
+	return nil
+}
+
+func (a *sqliteAuditLog) search(filter auditFilter) ([]*auditEvent, string, error) {
+	var where []string
+	var args []interface{}
+	if filter.UserID != "" {
+		where, args = append(where, "user_id = ?"), append(args, filter.UserID)
+	}
+	if filter.ActorID != "" {
+		where, args = append(where, "actor_id = ?"), append(args, filter.ActorID)
+	}
+	if filter.Type != "" {
+		where, args = append(where, "type = ?"), append(args, filter.Type)
+	}
+	if !filter.Since.IsZero() {
+		where, args = append(where, "created_at >= ?"), append(args, filter.Since.Local().Format(serializedTimestampFormat))
+	}
+	if !filter.Until.IsZero() {
+		where, args = append(where, "created_at < ?"), append(args, filter.Until.Local().Format(serializedTimestampFormat))
+	}
+	if filter.Cursor != "" {
+		seq, err := strconv.ParseInt(filter.Cursor, 10, 64)
+		if err != nil || seq < 1 {
+			return nil, "", errInvalidAuditCursor
+		}
+		where, args = append(where, "seq < ?"), append(args, seq)
+	}
+	if filter.Limit < 1 {
+		filter.Limit = defaultAuditLimit
+	}
+
+	query := `select seq, event_id, type, actor_id, user_id, ip, user_agent, request_id, details, created_at from audit_events`
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += " order by seq desc limit ?"
+	args = append(args, filter.Limit+1) // one more to know if there's a next page
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var events []*auditEvent
+	for rows.Next() {
+		var details, createdAt string
+		e := &auditEvent{}
+		if err := rows.Scan(&e.seq, &e.ID, &e.Type, &e.ActorID, &e.UserID, &e.IP, &e.UserAgent, &e.RequestID, &details, &createdAt); err != nil {
+			return nil, "", err
+		}
+		if details != "" {
+			if err := json.Unmarshal([]byte(details), &e.Details); err != nil {
+				a.log.Log("audit", fmt.Sprintf("bad details of audit event %s: %v", e.ID, err))
+			}
+		}
+		e.CreatedAt = parseTimestamp(createdAt)
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+		next = strconv.FormatInt(events[len(events)-1].seq, 10)
+	}
+	return events, next, nil
+}
+
+// auditPage is a page of audit events, NextCursor is passed as cursor for the following page.
+type auditPage struct {
+	Events     []*auditEvent `json:"events"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+// readAuditFilter reads the type, since, until, cursor and limit query parameters.
+func readAuditFilter(r *http.Request) (auditFilter, error) {
+	q := r.URL.Query()
+	filter := auditFilter{
+		Type:   q.Get("type"),
+		Cursor: q.Get("cursor"),
+		Limit:  defaultAuditLimit,
+	}
+	for _, v := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if s := q.Get(v.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s, expected an RFC 3339 timestamp: %v", v.name, err)
+			}
+			*v.t = t
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxAuditLimit)
+		}
+		filter.Limit = n
+	}
+	return filter, nil
+}
+
+func writeAuditPage(w http.ResponseWriter, a auditLog, filter auditFilter) {
+	events, next, err := a.search(filter)
+	if err != nil {
+		if err == errInvalidAuditCursor {
+			moovhttp.Problem(w, err)
+		} else {
+			internalError(w, err)
+		}
+		return
+	}
+	if events == nil {
+		events = []*auditEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(auditPage{Events: events, NextCursor: next}); err != nil {
+		internalError(w, err)
+		return
+	}
+}
+
+func addAuditRoutes(router *mux.Router, logger log.Logger, auth authable, a auditLog) {
+	router.Methods("GET").Path("/users/{user_id}/audit").HandlerFunc(getUserAuditEvents(logger, auth, a))
+}
+
+// getUserAuditEvents lists the events of the signed in user's account.
+func getUserAuditEvents(logger log.Logger, auth authable, a auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "getUserAuditEvents")
+
+		userId, err := signedInUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		filter, err := readAuditFilter(r)
+		if err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		filter.UserID = userId
+		writeAuditPage(w, a, filter)
+	}
+}
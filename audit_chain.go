@@ -0,0 +1,475 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/crypto/ed25519"
+)
+
+// auditLink is the seq and hash of an audit event, the next event is chained to it.
+type auditLink struct {
+	seq  int64
+	hash string
+}
+
+// lastAuditLink returns the newest event's link, which is empty before the first event.
+func lastAuditLink(tx *sql.Tx) (auditLink, error) {
+	var link auditLink
+	var hash sql.NullString
+	if err := tx.QueryRow(`select seq, hash from audit_events order by seq desc limit 1`).Scan(&link.seq, &hash); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return link, nil
+		}
+		return link, err
+	}
+	link.hash = hash.String
+	return link, nil
+}
+
+// auditEventHash chains an event to the one before it, changing any field of the event, its
+// seq or an earlier event changes the hash.
+//
+// The IP, User-Agent and details of events with a salt are covered by personal (their
+// auditPersonalDigest) instead, so they can be erased without breaking the chain. Events
+// recorded before salts were added have an empty personal.
+func auditEventHash(prevHash string, seq int64, e *auditEvent, details, createdAt, personal string) string {
+	fields := []string{
+		prevHash, strconv.FormatInt(seq, 10), e.ID, e.Type, e.ActorID, e.UserID, e.IP, e.UserAgent, e.RequestID, details, createdAt,
+	}
+	if personal != "" {
+		fields = []string{
+			prevHash, strconv.FormatInt(seq, 10), e.ID, e.Type, e.ActorID, e.UserID, e.RequestID, createdAt, personal,
+		}
+	}
+	bs, _ := json.Marshal(fields)
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditPersonalDigest covers the personal data of an event. The random salt keeps the digest
+// from being reversed by guessing the data (i.e. trying every IPv4 address), it's erased along
+// with the data.
+func auditPersonalDigest(salt string, e *auditEvent, details string) string {
+	bs, _ := json.Marshal([]string{salt, e.IP, e.UserAgent, details})
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+
+// eraseAuditPersonalData erases the IP, User-Agent and details of events userId did or which
+// were about them, keeping the digest each event's hash covers. Events recorded before salts
+// were added can't be erased without breaking the chain and are left as they are.
+func eraseAuditPersonalData(tx *sql.Tx, userId string, now time.Time) (int64, error) {
+	query := `select e.event_id, e.ip, e.user_agent, e.details, s.salt from audit_events as e
+inner join audit_event_salts as s on e.event_id = s.event_id
+where (e.user_id = ? or e.actor_id = ?) and s.salt != ''`
+	rows, err := tx.Query(query, userId, userId)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	digests := make(map[string]string)
+	for rows.Next() {
+		var ip, userAgent, details sql.NullString
+		var eventId, salt string
+		if err := rows.Scan(&eventId, &ip, &userAgent, &details, &salt); err != nil {
+			return 0, err
+		}
+		digests[eventId] = auditPersonalDigest(salt, &auditEvent{IP: ip.String, UserAgent: userAgent.String}, details.String)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	erasedAt := now.Format(serializedTimestampFormat)
+	for eventId, digest := range digests {
+		if _, err := tx.Exec(`update audit_events set ip = '', user_agent = '', details = '' where event_id = ?`, eventId); err != nil {
+			return 0, fmt.Errorf("problem erasing audit event %s: %v", eventId, err)
+		}
+		query = `update audit_event_salts set salt = '', digest = ?, erased_at = ? where event_id = ?`
+		if _, err := tx.Exec(query, digest, erasedAt, eventId); err != nil {
+			return 0, fmt.Errorf("problem erasing audit event %s: %v", eventId, err)
+		}
+	}
+	return int64(len(digests)), nil
+}
+
+// auditCheckpoint is a signed statement of the hash at seq. Removing events up to a checkpoint,
+// or rewriting the chain before it, no longer matches the signature.
+type auditCheckpoint struct {
+	Seq       int64     `json:"seq"`
+	Hash      string    `json:"hash"`
+	Signature string    `json:"signature"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func auditCheckpointMessage(seq int64, hash, createdAt string) []byte {
+	return []byte(fmt.Sprintf("moov-auth-audit-checkpoint:%d:%s:%s", seq, hash, createdAt))
+}
+
+// checkpoint signs the newest event's hash with key, nothing is written if no events were
+// recorded since the last checkpoint.
+func (a *sqliteAuditLog) checkpoint(key ed25519.PrivateKey, now time.Time) (*auditCheckpoint, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	last, err := lastAuditLink(tx)
+	if err != nil {
+		return nil, err
+	}
+	var checkpointed sql.NullInt64
+	if err := tx.QueryRow(`select max(seq) from audit_checkpoints`).Scan(&checkpointed); err != nil {
+		return nil, err
+	}
+	if last.seq == 0 || last.seq <= checkpointed.Int64 {
+		return nil, nil
+	}
+
+	createdAt := now.Format(serializedTimestampFormat)
+	sig := ed25519.Sign(key, auditCheckpointMessage(last.seq, last.hash, createdAt))
+	cp := &auditCheckpoint{
+		Seq:       last.seq,
+		Hash:      last.hash,
+		Signature: base64.StdEncoding.EncodeToString(sig),
+		CreatedAt: parseTimestamp(createdAt),
+	}
+	query := `insert into audit_checkpoints (seq, hash, signature, created_at) values (?, ?, ?, ?)`
+	if _, err := tx.Exec(query, cp.Seq, cp.Hash, cp.Signature, createdAt); err != nil {
+		return nil, fmt.Errorf("problem writing audit checkpoint at seq=%d: %v", cp.Seq, err)
+	}
+	return cp, tx.Commit()
+}
+
+// auditCheckpointer signs a checkpoint of the audit log every interval.
+type auditCheckpointer struct {
+	audit    *sqliteAuditLog
+	logger   log.Logger
+	key      ed25519.PrivateKey
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// readAuditSigningKey reads the base64 encoded 32 byte Ed25519 seed in AUDIT_SIGNING_KEY,
+// a nil key is returned when it's unset.
+func readAuditSigningKey() (ed25519.PrivateKey, error) {
+	v := os.Getenv("AUDIT_SIGNING_KEY")
+	if v == "" {
+		return nil, nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid AUDIT_SIGNING_KEY, expected a base64 encoded %d byte seed", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// readAuditVerifyKey reads the base64 encoded Ed25519 public key in AUDIT_VERIFY_KEY, falling
+// back to the public key of AUDIT_SIGNING_KEY. A nil key is returned when neither is set.
+func readAuditVerifyKey() (ed25519.PublicKey, error) {
+	if v := os.Getenv("AUDIT_VERIFY_KEY"); v != "" {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid AUDIT_VERIFY_KEY, expected a base64 encoded %d byte public key", ed25519.PublicKeySize)
+		}
+		return ed25519.PublicKey(key), nil
+	}
+	key, err := readAuditSigningKey()
+	if key == nil || err != nil {
+		return nil, err
+	}
+	return key.Public().(ed25519.PublicKey), nil
+}
+
+// readAuditCheckpointInterval reads AUDIT_CHECKPOINT_INTERVAL, which defaults to an hour.
+func readAuditCheckpointInterval() (time.Duration, error) {
+	v := os.Getenv("AUDIT_CHECKPOINT_INTERVAL")
+	if v == "" {
+		return time.Hour, nil
+	}
+	dur, err := time.ParseDuration(v)
+	if err != nil || dur <= 0 {
+		return 0, fmt.Errorf("invalid AUDIT_CHECKPOINT_INTERVAL=%q", v)
+	}
+	return dur, nil
+}
+
+// setupAuditCheckpointer returns nil when AUDIT_SIGNING_KEY is unset, the audit log is still
+// chained but no checkpoints are signed.
+func setupAuditCheckpointer(logger log.Logger, audit *sqliteAuditLog) (*auditCheckpointer, error) {
+	key, err := readAuditSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		logger.Log("audit", "AUDIT_SIGNING_KEY is unset, audit checkpoints are disabled")
+		return nil, nil
+	}
+	interval, err := readAuditCheckpointInterval()
+	if err != nil {
+		return nil, err
+	}
+	return &auditCheckpointer{
+		audit:    audit,
+		logger:   logger,
+		key:      key,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+func (c *auditCheckpointer) start() {
+	if c == nil {
+		return
+	}
+	c.logger.Log("audit", fmt.Sprintf("signing audit checkpoints every %v", c.interval))
+	go func() {
+		defer close(c.done)
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.run()
+			case <-c.stop:
+				c.run() // cover the events recorded since the last tick
+				return
+			}
+		}
+	}()
+}
+
+func (c *auditCheckpointer) run() {
+	cp, err := c.audit.checkpoint(c.key, time.Now())
+	if err != nil {
+		c.logger.Log("audit", fmt.Sprintf("problem signing audit checkpoint: %v", err))
+		return
+	}
+	if cp != nil {
+		// Checkpoints are logged in full so a copy lives outside the database they protect,
+		// restoring them from the logs recovers checkpoints which were deleted.
+		c.logger.Log("audit", fmt.Sprintf("signed audit checkpoint at seq=%d", cp.Seq),
+			"seq", cp.Seq, "hash", cp.Hash, "signature", cp.Signature, "createdAt", cp.CreatedAt.Format(serializedTimestampFormat))
+	}
+}
+
+// shutdown signs a final checkpoint and stops.
+func (c *auditCheckpointer) shutdown() {
+	if c == nil {
+		return
+	}
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	<-c.done
+}
+
+// auditVerification is the result of checking the audit log's chain and checkpoints.
+type auditVerification struct {
+	Events      int64
+	Checkpoints int64
+	Problems    []string
+}
+
+func (v *auditVerification) problem(format string, args ...interface{}) {
+	v.Problems = append(v.Problems, fmt.Sprintf(format, args...))
+}
+
+// auditCheckpointGrace allows for the time signing a checkpoint takes past its interval.
+const auditCheckpointGrace = time.Minute
+
+// verifyAuditChain recomputes each event's hash in seq order and checks every checkpoint.
+// Gaps in seq, edited events, broken links and events removed after a checkpoint are reported
+// as problems. Checkpoint signatures are only checked when key is set.
+//
+// When interval is set every event after the first checkpoint must be covered by a checkpoint
+// signed within interval of the event, otherwise a checkpoint is missing. Events before the
+// first checkpoint were recorded before checkpoints were enabled. Events after the last
+// checkpoint are compared to the newest event, so verifying an older copy of the database
+// doesn't report them.
+func verifyAuditChain(db *sql.DB, key ed25519.PublicKey, interval time.Duration) (*auditVerification, error) {
+	checkpoints := make(map[int64][]*auditCheckpoint)
+	var ordered []*auditCheckpoint // the first checkpoint of each seq, in seq order
+	var lastCheckpoint int64
+	v := &auditVerification{}
+
+	rows, err := db.Query(`select seq, hash, signature, created_at from audit_checkpoints order by seq asc`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var createdAt string
+		cp := &auditCheckpoint{}
+		if err := rows.Scan(&cp.Seq, &cp.Hash, &cp.Signature, &createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		v.Checkpoints++
+		if key != nil {
+			sig, err := base64.StdEncoding.DecodeString(cp.Signature)
+			if err != nil || !ed25519.Verify(key, auditCheckpointMessage(cp.Seq, cp.Hash, createdAt), sig) {
+				v.problem("checkpoint at seq=%d has an invalid signature", cp.Seq)
+			}
+		}
+		cp.CreatedAt = parseTimestamp(createdAt)
+		if len(checkpoints[cp.Seq]) == 0 {
+			ordered = append(ordered, cp)
+		}
+		checkpoints[cp.Seq] = append(checkpoints[cp.Seq], cp)
+		if cp.Seq > lastCheckpoint {
+			lastCheckpoint = cp.Seq
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var newest sql.NullString
+	if err := db.QueryRow(`select created_at from audit_events order by seq desc limit 1`).Scan(&newest); err != nil && !strings.Contains(err.Error(), "no rows in result set") {
+		return nil, err
+	}
+	newestAt := parseTimestamp(newest.String)
+
+	rows, err = db.Query(`select e.seq, e.event_id, e.type, e.actor_id, e.user_id, e.ip, e.user_agent, e.request_id, e.details, e.created_at, e.prev_hash, e.hash, s.salt, s.digest
+from audit_events as e left join audit_event_salts as s on e.event_id = s.event_id order by e.seq asc`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prev auditLink
+	var next int          // index in ordered of the checkpoint covering the current event
+	var uncovered []int64 // first and last seq of events since the last checkpoint which weren't covered in time
+	reportUncovered := func() {
+		if len(uncovered) > 0 {
+			v.problem("events seq=%d to seq=%d weren't checkpointed within %v, a checkpoint is missing", uncovered[0], uncovered[1], interval)
+			uncovered = nil
+		}
+	}
+	for rows.Next() {
+		var seq int64
+		var details, createdAt, prevHash, hash, salt, digest sql.NullString
+		e := &auditEvent{}
+		if err := rows.Scan(&seq, &e.ID, &e.Type, &e.ActorID, &e.UserID, &e.IP, &e.UserAgent, &e.RequestID, &details, &createdAt, &prevHash, &hash, &salt, &digest); err != nil {
+			return nil, err
+		}
+		v.Events++
+
+		var personal string
+		switch {
+		case digest.String != "":
+			// the event's personal data was erased, only its digest is left
+			if e.IP != "" || e.UserAgent != "" || details.String != "" || salt.String != "" {
+				v.problem("event seq=%d was modified", seq)
+			}
+			personal = digest.String
+		case salt.String != "":
+			personal = auditPersonalDigest(salt.String, e, details.String)
+		}
+
+		if seq != prev.seq+1 {
+			v.problem("events seq=%d to seq=%d are missing", prev.seq+1, seq-1)
+		} else if prevHash.String != prev.hash {
+			v.problem("event seq=%d isn't linked to the previous event", seq)
+		}
+		if auditEventHash(prevHash.String, seq, e, details.String, createdAt.String, personal) != hash.String {
+			v.problem("event seq=%d was modified", seq)
+		}
+		for _, cp := range checkpoints[seq] {
+			if cp.Hash != hash.String {
+				v.problem("event seq=%d doesn't match its checkpoint", seq)
+			}
+		}
+		prev = auditLink{seq: seq, hash: hash.String}
+
+		if interval <= 0 {
+			continue
+		}
+		for next < len(ordered) && ordered[next].Seq < seq {
+			next++
+			reportUncovered()
+		}
+		if len(ordered) > 0 && seq <= ordered[0].Seq {
+			continue
+		}
+		deadline := parseTimestamp(createdAt.String).Add(interval + auditCheckpointGrace)
+		covered := !newestAt.After(deadline)
+		if next < len(ordered) {
+			covered = !ordered[next].CreatedAt.After(deadline)
+		}
+		if !covered {
+			if len(uncovered) == 0 {
+				uncovered = []int64{seq, seq}
+			}
+			uncovered[1] = seq
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	reportUncovered()
+	if lastCheckpoint > prev.seq {
+		v.problem("events after seq=%d are missing, the last checkpoint is at seq=%d", prev.seq, lastCheckpoint)
+	}
+	return v, nil
+}
+
+var errAuditVerificationFailed = errors.New("audit log verification failed")
+
+// runAuditVerification verifies the audit log for the -audit.verify flag, logging each problem.
+func runAuditVerification(logger log.Logger, db *sql.DB) error {
+	key, err := readAuditVerifyKey()
+	if err != nil {
+		return err
+	}
+	// checkpoints are only expected every interval when they're signed
+	var interval time.Duration
+	if key == nil {
+		logger.Log("audit", "AUDIT_VERIFY_KEY and AUDIT_SIGNING_KEY are unset, checkpoint signatures aren't checked")
+	} else {
+		interval, err = readAuditCheckpointInterval()
+		if err != nil {
+			return err
+		}
+	}
+	v, err := verifyAuditChain(db, key, interval)
+	if err != nil {
+		return err
+	}
+	for _, p := range v.Problems {
+		logger.Log("audit", p)
+	}
+	logger.Log("audit", fmt.Sprintf("checked %d events and %d checkpoints, found %d problems", v.Events, v.Checkpoints, len(v.Problems)))
+	if len(v.Problems) > 0 {
+		return errAuditVerificationFailed
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/crypto/ed25519"
+)
+
+var testAuditSeed = bytes.Repeat([]byte{7}, ed25519.SeedSize)
+
+// createTestAuditChain returns an audit log of n login events, checkpointed after each of checkpoints.
+func createTestAuditChain(t *testing.T, n int, checkpoints ...int) (*sqliteAuditLog, func() error) {
+	t.Helper()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &sqliteAuditLog{db: repo.db, log: log.NewNopLogger()}
+	key := ed25519.NewKeyFromSeed(testAuditSeed)
+	r := httptest.NewRequest("POST", "/users/login", nil)
+	for i := 1; i <= n; i++ {
+		recordAudit(a, r, auditLoginSucceeded, "jane", "jane", map[string]string{"n": strconv.Itoa(i)})
+		for _, c := range checkpoints {
+			if c == i {
+				if _, err := a.checkpoint(key, time.Now()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	return a, repo.cleanup
+}
+
+func verifyTestAuditChain(t *testing.T, a *sqliteAuditLog) []string {
+	t.Helper()
+
+	v, err := verifyAuditChain(a.db, ed25519.NewKeyFromSeed(testAuditSeed).Public().(ed25519.PublicKey), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.Problems
+}
+
+func TestAuditChain__verify(t *testing.T) {
+	a, cleanup := createTestAuditChain(t, 5, 3)
+	defer cleanup()
+
+	v, err := verifyAuditChain(a.db, ed25519.NewKeyFromSeed(testAuditSeed).Public().(ed25519.PublicKey), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Events != 5 || v.Checkpoints != 1 || len(v.Problems) != 0 {
+		t.Errorf("unexpected verification: %#v", v)
+	}
+
+	// checkpoints are only written for new events
+	key := ed25519.NewKeyFromSeed(testAuditSeed)
+	if cp, err := a.checkpoint(key, time.Now()); err != nil || cp == nil || cp.Seq != 5 {
+		t.Fatalf("unexpected checkpoint=%#v err=%v", cp, err)
+	}
+	if cp, err := a.checkpoint(key, time.Now()); err != nil || cp != nil {
+		t.Errorf("unexpected checkpoint=%#v err=%v", cp, err)
+	}
+	if problems := verifyTestAuditChain(t, a); len(problems) != 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+
+	// another key's signatures aren't accepted
+	other, _, _ := ed25519.GenerateKey(nil)
+	if v, err := verifyAuditChain(a.db, other, 0); err != nil || len(v.Problems) != 2 {
+		t.Errorf("unexpected verification=%#v err=%v", v, err)
+	}
+}
+
+func TestAuditChain__tampering(t *testing.T) {
+	cases := map[string]struct {
+		query    string
+		expected string
+	}{
+		"modified": {
+			query:    `update audit_events set ip = '10.1.1.1' where seq = 2`,
+			expected: "event seq=2 was modified",
+		},
+		"salt removed": {
+			query:    `delete from audit_event_salts where event_id = (select event_id from audit_events where seq = 2)`,
+			expected: "event seq=2 was modified",
+		},
+		"partly erased": {
+			query:    `update audit_event_salts set digest = 'abc' where event_id = (select event_id from audit_events where seq = 2)`,
+			expected: "event seq=2 was modified",
+		},
+		"removed": {
+			query:    `delete from audit_events where seq = 2`,
+			expected: "events seq=2 to seq=2 are missing",
+		},
+		"truncated": {
+			query:    `delete from audit_events where seq > 2`,
+			expected: "events after seq=2 are missing, the last checkpoint is at seq=3",
+		},
+		"resigned": {
+			query:    `update audit_checkpoints set hash = 'abc'`,
+			expected: "checkpoint at seq=3 has an invalid signature",
+		},
+	}
+	for name, tc := range cases {
+		a, cleanup := createTestAuditChain(t, 5, 3)
+		if _, err := a.db.Exec(tc.query); err != nil {
+			t.Fatal(err)
+		}
+		problems := verifyTestAuditChain(t, a)
+		if len(problems) == 0 || problems[0] != tc.expected {
+			t.Errorf("%s: unexpected problems: %v", name, problems)
+		}
+		cleanup()
+	}
+}
+
+func TestAuditChain__missingCheckpoints(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	a := &sqliteAuditLog{db: repo.db, log: log.NewNopLogger()}
+	key := ed25519.NewKeyFromSeed(testAuditSeed)
+
+	// an event every hour, checkpointed shortly after each except the last
+	start := time.Now().Add(-24 * time.Hour)
+	for i := 0; i < 4; i++ {
+		at := start.Add(time.Duration(i) * time.Hour)
+		if err := a.record(&auditEvent{Type: auditLoginSucceeded, UserID: "jane", CreatedAt: at}); err != nil {
+			t.Fatal(err)
+		}
+		if i < 3 {
+			if _, err := a.checkpoint(key, at.Add(30*time.Second)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	verify := func() []string {
+		v, err := verifyAuditChain(a.db, key.Public().(ed25519.PublicKey), 30*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.Problems
+	}
+	if problems := verify(); len(problems) != 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+
+	if _, err := a.db.Exec(`delete from audit_checkpoints where seq = 2`); err != nil {
+		t.Fatal(err)
+	}
+	if problems := verify(); len(problems) != 1 || problems[0] != "events seq=2 to seq=2 weren't checkpointed within 30m0s, a checkpoint is missing" {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+
+	// events after the last checkpoint are compared to the newest event
+	if err := a.record(&auditEvent{Type: auditLoginSucceeded, UserID: "jane", CreatedAt: start.Add(5 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if problems := verify(); len(problems) != 2 || problems[1] != "events seq=4 to seq=4 weren't checkpointed within 30m0s, a checkpoint is missing" {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+}
+
+func TestAuditChain__runAuditVerification(t *testing.T) {
+	a, cleanup := createTestAuditChain(t, 3, 3)
+	defer cleanup()
+
+	os.Setenv("AUDIT_VERIFY_KEY", base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(testAuditSeed).Public().(ed25519.PublicKey)))
+	defer os.Unsetenv("AUDIT_VERIFY_KEY")
+	if err := runAuditVerification(log.NewNopLogger(), a.db); err != nil {
+		t.Error(err)
+	}
+	if _, err := a.db.Exec(`delete from audit_events where seq = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if err := runAuditVerification(log.NewNopLogger(), a.db); err != errAuditVerificationFailed {
+		t.Errorf("expected errAuditVerificationFailed, got %v", err)
+	}
+	os.Setenv("AUDIT_VERIFY_KEY", "short")
+	if err := runAuditVerification(log.NewNopLogger(), a.db); err == nil || !strings.Contains(err.Error(), "AUDIT_VERIFY_KEY") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAuditChain__checkpointer(t *testing.T) {
+	a, cleanup := createTestAuditChain(t, 2)
+	defer cleanup()
+
+	if c, err := setupAuditCheckpointer(log.NewNopLogger(), a); err != nil || c != nil {
+		t.Errorf("expected checkpoints to be disabled, got %#v err=%v", c, err)
+	}
+	os.Setenv("AUDIT_SIGNING_KEY", base64.StdEncoding.EncodeToString(testAuditSeed))
+	defer os.Unsetenv("AUDIT_SIGNING_KEY")
+	os.Setenv("AUDIT_CHECKPOINT_INTERVAL", "0s")
+	if _, err := setupAuditCheckpointer(log.NewNopLogger(), a); err == nil {
+		t.Error("expected error")
+	}
+	os.Unsetenv("AUDIT_CHECKPOINT_INTERVAL")
+
+	c, err := setupAuditCheckpointer(log.NewNopLogger(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.start()
+	c.shutdown() // signs a final checkpoint
+	if v, err := verifyAuditChain(a.db, nil, time.Hour); err != nil || v.Checkpoints != 1 || len(v.Problems) != 0 {
+		t.Errorf("unexpected verification=%#v err=%v", v, err)
+	}
+
+	os.Setenv("AUDIT_SIGNING_KEY", "c2hvcnQ=")
+	if _, err := setupAuditCheckpointer(log.NewNopLogger(), a); err == nil {
+		t.Error("expected error")
+	}
+}
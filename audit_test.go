@@ -0,0 +1,206 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestAudit__clientIP(t *testing.T) {
+	defer func() { trustedProxies = nil }()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:4567"
+	r.Header.Set("X-Real-Ip", " 192.168.1.1 ")
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7, 10.0.0.2")
+
+	// forwarding headers are ignored from untrusted clients
+	if ip := clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("got %q", ip)
+	}
+
+	nets, err := parseTrustedProxies("10.0.0.0/24, 192.0.2.1")
+	if err != nil || len(nets) != 2 {
+		t.Fatalf("nets=%v err=%v", nets, err)
+	}
+	trustedProxies = nets
+
+	// the right-most untrusted hop is the client, 198.51.100.1 could be forged
+	if ip := clientIP(r); ip != "203.0.113.7" {
+		t.Errorf("got %q", ip)
+	}
+	r.Header.Set("X-Forwarded-For", "10.0.0.3, 10.0.0.2")
+	if ip := clientIP(r); ip != "10.0.0.3" {
+		t.Errorf("got %q", ip)
+	}
+	r.Header.Del("X-Forwarded-For")
+	if ip := clientIP(r); ip != "192.168.1.1" {
+		t.Errorf("got %q", ip)
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := parseTrustedProxies("proxy.internal"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestAudit__search(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	a := &sqliteAuditLog{db: repo.db, log: log.NewNopLogger()}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "moov-test")
+	r.Header.Set("X-Request-Id", "request-1")
+	start := time.Now().Add(-time.Minute)
+	for i := 0; i < 5; i++ {
+		recordAudit(a, r, auditLoginSucceeded, "jane", "jane", nil)
+	}
+	recordAudit(a, r, auditUserStatusChanged, "admin", "jane", map[string]string{"status": userStatusSuspended})
+	recordAudit(a, r, auditLoginFailed, "", "other", map[string]string{"reason": "invalid password"})
+
+	events, next, err := a.search(auditFilter{UserID: "jane", Limit: 10})
+	if err != nil || len(events) != 6 || next != "" {
+		t.Fatalf("got %d events next=%q err=%v", len(events), next, err)
+	}
+	e := events[0]
+	if e.Type != auditUserStatusChanged || e.ActorID != "admin" || e.Details["status"] != userStatusSuspended {
+		t.Errorf("expected newest event first: %#v", e)
+	}
+	if e.ID == "" || e.UserAgent != "moov-test" || e.RequestID != "request-1" || e.IP == "" || e.CreatedAt.Before(start) {
+		t.Errorf("missing request details: %#v", e)
+	}
+
+	if events, _, err := a.search(auditFilter{ActorID: "admin"}); err != nil || len(events) != 1 {
+		t.Errorf("got %d events err=%v", len(events), err)
+	}
+	if events, _, err := a.search(auditFilter{Type: auditLoginFailed}); err != nil || len(events) != 1 || events[0].UserID != "other" {
+		t.Errorf("unexpected events=%#v err=%v", events, err)
+	}
+	if events, _, err := a.search(auditFilter{Since: start, Until: time.Now().Add(time.Minute)}); err != nil || len(events) != 7 {
+		t.Errorf("got %d events err=%v", len(events), err)
+	}
+	if events, _, err := a.search(auditFilter{Since: time.Now().Add(time.Minute)}); err != nil || len(events) != 0 {
+		t.Errorf("got %d events err=%v", len(events), err)
+	}
+
+	// pages continue from the cursor without repeating events
+	seen := make(map[string]bool)
+	filter := auditFilter{UserID: "jane", Limit: 4}
+	for pages := 1; ; pages++ {
+		events, next, err := a.search(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range events {
+			if seen[e.ID] {
+				t.Errorf("event %s returned twice", e.ID)
+			}
+			seen[e.ID] = true
+		}
+		if next == "" {
+			if pages != 2 {
+				t.Errorf("got %d pages", pages)
+			}
+			break
+		}
+		filter.Cursor = next
+	}
+	if len(seen) != 6 {
+		t.Errorf("got %d events", len(seen))
+	}
+	if _, _, err := a.search(auditFilter{Cursor: "abc"}); err != errInvalidAuditCursor {
+		t.Errorf("expected errInvalidAuditCursor, got %v", err)
+	}
+}
+
+func TestAudit__userRoutes(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	auth := &auth{db: repo.db, log: log.NewNopLogger()}
+	a := &sqliteAuditLog{db: repo.db, log: log.NewNopLogger()}
+
+	router := mux.NewRouter()
+	addLoginRoutes(router, log.NewNopLogger(), auth, repo, a, nil)
+	addAuditRoutes(router, log.NewNopLogger(), auth, a)
+
+	user, other := createTestUser(t, repo, "jane@moov.io"), createTestUser(t, repo, "other@moov.io")
+	if err := auth.writePassword(user.ID, "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(password string) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(loginRequest{Email: user.Email, Password: password})
+		r := httptest.NewRequest("POST", "/users/login", &buf)
+		r.RemoteAddr = "203.0.113.7:4567"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	if w := login("wrong horse battery"); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	w := login("correct horse battery")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	cookie := w.Result().Cookies()[0]
+
+	list := func(userId string, query url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", fmt.Sprintf("/users/%s/audit?%s", userId, query.Encode()), nil)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	// users only see their own events
+	if w := list(other.ID, nil); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	w = list(user.ID, nil)
+	var page auditPage
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil || len(page.Events) != 2 {
+		t.Fatalf("unexpected page=%#v err=%v", page, err)
+	}
+	if e := page.Events[0]; e.Type != auditLoginSucceeded || e.ActorID != user.ID || e.IP != "203.0.113.7" {
+		t.Errorf("unexpected event: %#v", e)
+	}
+	if e := page.Events[1]; e.Type != auditLoginFailed || e.ActorID != "" || e.Details["reason"] == "" {
+		t.Errorf("unexpected event: %#v", e)
+	}
+
+	w = list(user.ID, url.Values{"type": []string{auditLoginFailed}, "limit": []string{"1"}})
+	page = auditPage{}
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil || len(page.Events) != 1 || page.NextCursor != "" {
+		t.Errorf("unexpected page=%#v err=%v", page, err)
+	}
+	for _, q := range []url.Values{{"limit": []string{"0"}}, {"since": []string{"yesterday"}}, {"cursor": []string{"x"}}} {
+		if w := list(user.ID, q); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: got %d", q, w.Code)
+		}
+	}
+}
@@ -8,9 +8,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
 
 	"github.com/go-kit/kit/log"
 	"github.com/gorilla/mux"
+	"gopkg.in/oauth2.v3"
 )
 
 var (
@@ -35,11 +39,11 @@ func extractUserId(auth authable, r *http.Request) (string, error) {
 	return userId, nil
 }
 
-func addAuthRoutes(router *mux.Router, logger log.Logger, auth authable, o *oauth, repo userRepository) {
-	router.Methods("GET").Path("/auth/check").HandlerFunc(checkAuth(logger, auth, o, repo))
+func addAuthRoutes(router *mux.Router, logger log.Logger, auth authable, o *oauth, repo userRepository, roleRepo roleRepository, tokens personalTokenRepository) {
+	router.Methods("GET").Path("/auth/check").HandlerFunc(checkAuth(logger, auth, o, repo, roleRepo, tokens))
 }
 
-func checkAuth(logger log.Logger, auth authable, o *oauth, repo userRepository) http.HandlerFunc {
+func checkAuth(logger log.Logger, auth authable, o *oauth, repo userRepository, roleRepo roleRepository, tokens personalTokenRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w = wrapResponseWriter(w, r, "checkAuth")
 
@@ -48,7 +52,21 @@ func checkAuth(logger log.Logger, auth authable, o *oauth, repo userRepository)
 		}
 
 		user, _ := getUserFromCookie(auth, repo, r)
-		token, err := o.requestHasValidOAuthToken(r)
+
+		var token oauth2.TokenInfo
+		var pat *personalToken
+		var err error
+		if secret := personalTokenFromRequest(r); secret != "" && tokens != nil {
+			pat, err = tokens.lookup(secret)
+			if err == nil && pat == nil {
+				err = errInvalidPersonalToken
+			}
+			if err != nil {
+				authFailures.With("method", "personal_token").Add(1)
+			}
+		} else {
+			token, err = o.requestHasValidOAuthToken(r)
+		}
 
 		if user == nil && err != nil { // no user from cookie and no oauth credentials
 			w.WriteHeader(http.StatusForbidden)
@@ -59,8 +77,30 @@ func checkAuth(logger log.Logger, auth authable, o *oauth, repo userRepository)
 		if user != nil && user.ID != "" {
 			userId = user.ID
 		}
+		var scopes []string
+		viaOAuth, viaToken := false, false
 		if token != nil && userId == "" {
+			viaOAuth, viaToken = true, true
 			userId = token.GetUserID()
+			scopes = parseScopes(token.GetScope())
+		}
+		if pat != nil && userId == "" {
+			viaToken = true
+			userId = pat.UserID
+			scopes = pat.Scopes
+		}
+
+		// Only tokens are limited by scopes, cookies carry all of a user's access.
+		if viaToken {
+			if required := requiredScopes(r); !scopesAllowed(scopes, required) {
+				if viaOAuth {
+					authFailures.With("method", "oauth2").Add(1)
+				} else {
+					authFailures.With("method", "personal_token").Add(1)
+				}
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
 		}
 
 		if userId == "" {
@@ -68,8 +108,84 @@ func checkAuth(logger log.Logger, auth authable, o *oauth, repo userRepository)
 			return
 		}
 
+		// Only active users are authorized, pending users can login but not use our APIs.
+		// Tokens also outlive a user being suspended.
+		if user == nil {
+			user, err = repo.lookupByUserId(userId)
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+		}
+		if user != nil && !user.canAccess() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		orgId, err := activeOrganization(o, r, userId, token, viaOAuth)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if orgId != "" {
+			w.Header().Set("X-Organization-Id", orgId)
+		}
+
+		roles, err := roleNames(roleRepo, userId, orgId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if !scopesAllowed(roles.global, requiredRoles(r)) || !scopesAllowed(roles.org, requiredOrganizationRoles(r)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if len(roles.global) > 0 {
+			w.Header().Set("X-Roles", strings.Join(roles.global, " "))
+		}
+		if len(roles.org) > 0 {
+			w.Header().Set("X-Organization-Roles", strings.Join(roles.org, " "))
+		}
+
+		if viaToken {
+			w.Header().Set("X-Scopes", strings.Join(scopes, " "))
+		}
+		if pat != nil {
+			w.Header().Set("X-Personal-Token-Id", pat.ID)
+		}
 		w.Header().Set("X-User-Id", userId)
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// activeOrganization returns the organization a /auth/check request is acting in.
+//
+// Tokens of an organization's OAuth2 client are always in that organization. Otherwise the
+// organization is read from the request. Either way userId must still be one of its members.
+func activeOrganization(o *oauth, r *http.Request, userId string, token oauth2.TokenInfo, viaOAuth bool) (string, error) {
+	requested := requestedOrganization(r)
+	if viaOAuth {
+		cli, err := o.clientStore.GetByID(token.GetClientID())
+		if err != nil {
+			return "", err
+		}
+		if c, ok := cli.(*oauthdb.Client); ok && c.OrganizationID != "" {
+			if requested != "" && requested != c.OrganizationID {
+				return "", errNotOrgMember
+			}
+			requested = c.OrganizationID
+		}
+	}
+	if requested == "" {
+		return "", nil
+	}
+	member, err := isOrgMember(o.orgs, requested, userId)
+	if err != nil {
+		return "", err
+	}
+	if !member {
+		return "", errNotOrgMember
+	}
+	return requested, nil
+}
@@ -82,7 +82,7 @@ func TestAuth__checkAuth(t *testing.T) {
 	r := httptest.NewRequest("GET", "/auth/check", nil)
 
 	// Make HTTP request
-	checkAuth(log.NewNopLogger(), auth, o.svc, repo)(w, r)
+	checkAuth(log.NewNopLogger(), auth, o.svc, repo, nil, nil)(w, r)
 	w.Flush()
 
 	// Since no auth information was provided we should 403
@@ -121,7 +121,7 @@ func TestAuth__forwardedPreflight(t *testing.T) {
 	r.Header.Set("Origin", "http://localhost:8080")
 	r.Header.Set("X-Forwarded-Method", "OPTIONS")
 
-	checkAuth(log.NewNopLogger(), auth, o.svc, repo)(w, r)
+	checkAuth(log.NewNopLogger(), auth, o.svc, repo, nil, nil)(w, r)
 	w.Flush()
 
 	// Check response
@@ -132,3 +132,62 @@ func TestAuth__forwardedPreflight(t *testing.T) {
 		t.Errorf("got %s", v)
 	}
 }
+
+func TestAuth__checkAuthScopes(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	userId := generateID()
+	_, token := createOAuthClient(t, o, userId)
+	token.Scope = "read write"
+	if err := o.tokenStore.Create(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// token scopes are returned
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/auth/check?scopes=read", nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.Access))
+	checkAuth(log.NewNopLogger(), auth, o.svc, repo, nil, nil)(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if v := w.Header().Get("X-User-Id"); v != userId {
+		t.Errorf("got X-User-Id: %q", v)
+	}
+	if v := w.Header().Get("X-Scopes"); v != "read write" {
+		t.Errorf("got X-Scopes: %q", v)
+	}
+
+	// missing a required scope
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/auth/check", nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.Access))
+	r.Header.Set("X-Required-Scopes", "admin")
+	checkAuth(log.NewNopLogger(), auth, o.svc, repo, nil, nil)(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if v := w.Header().Get("X-User-Id"); v != "" {
+		t.Errorf("expected empty X-User-Id: %q", v)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// authCacheTTL is the longest a lookup for /auth/check is cached, zero disables caching.
+	authCacheTTL = 30 * time.Second
+
+	// authCacheSize is how many entries each cache holds before evicting the least recently used.
+	authCacheSize = 10000
+)
+
+// readCacheConfig updates the cache settings from their environment variables if set.
+func readCacheConfig() error {
+	if v := os.Getenv("AUTH_CACHE_TTL"); v != "" {
+		dur, err := time.ParseDuration(v)
+		if err != nil || dur < 0 {
+			return fmt.Errorf("invalid AUTH_CACHE_TTL=%q", v)
+		}
+		authCacheTTL = dur
+	}
+	if v := os.Getenv("AUTH_CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid AUTH_CACHE_SIZE=%q", v)
+		}
+		authCacheSize = n
+	}
+	return nil
+}
+
+// ttlCache is a bounded in-memory cache where each entry expires after a TTL. Entries are
+// tagged (e.g. with their userId) so every entry of a user or client can be invalidated at once.
+//
+// Invalidations are sent to other replicas when sessions or tokens are kept in Redis (see
+// cacheInvalidator), otherwise they only apply to this process.
+//
+// A nil *ttlCache is valid and caches nothing.
+type ttlCache struct {
+	name string
+	ttl  time.Duration
+	size int
+
+	invalidator *cacheInvalidator
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+	tags    map[string]map[string]struct{}
+}
+
+type cacheEntry struct {
+	key       string
+	value     interface{}
+	tags      []string
+	expiresAt time.Time
+}
+
+// newTTLCache returns a cache using authCacheTTL and authCacheSize, or nil when caching is disabled.
+func newTTLCache(name string) *ttlCache {
+	if authCacheTTL <= 0 {
+		return nil
+	}
+	c := &ttlCache{
+		name:    name,
+		ttl:     authCacheTTL,
+		size:    authCacheSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		tags:    make(map[string]map[string]struct{}),
+	}
+	authCacheInvalidations.register(c)
+	return c
+}
+
+// get returns the unexpired value stored for key.
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elm, ok := c.entries[key]; ok {
+		entry := elm.Value.(*cacheEntry)
+		if time.Now().Before(entry.expiresAt) {
+			c.order.MoveToFront(elm)
+			authCacheHits.With("cache", c.name).Add(1)
+			return entry.value, true
+		}
+		c.removeElement(elm)
+	}
+	authCacheMisses.With("cache", c.name).Add(1)
+	return nil, false
+}
+
+// set stores value for the cache's TTL, or ttl if that's shorter.
+func (c *ttlCache) set(key string, value interface{}, ttl time.Duration, tags ...string) {
+	if c == nil {
+		return
+	}
+	if ttl <= 0 || ttl > c.ttl {
+		ttl = c.ttl
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elm, ok := c.entries[key]; ok {
+		c.removeElement(elm)
+	}
+	entry := &cacheEntry{
+		key:       key,
+		value:     value,
+		tags:      tags,
+		expiresAt: time.Now().Add(ttl),
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for _, tag := range tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = make(map[string]struct{})
+		}
+		c.tags[tag][key] = struct{}{}
+	}
+	for len(c.entries) > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// remove drops key from the cache.
+func (c *ttlCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.removeLocal(key)
+	c.invalidator.publish(c.name, "remove", key)
+}
+
+func (c *ttlCache) removeLocal(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elm, ok := c.entries[key]; ok {
+		c.removeElement(elm)
+	}
+}
+
+// removeTagged drops every entry stored with tag.
+func (c *ttlCache) removeTagged(tag string) {
+	if c == nil {
+		return
+	}
+	c.removeTaggedLocal(tag)
+	c.invalidator.publish(c.name, "removeTagged", tag)
+}
+
+func (c *ttlCache) removeTaggedLocal(tag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.tags[tag] {
+		if elm, ok := c.entries[key]; ok {
+			c.removeElement(elm)
+		}
+	}
+}
+
+// clear drops every entry.
+func (c *ttlCache) clear() {
+	if c == nil {
+		return
+	}
+	c.clearLocal()
+	c.invalidator.publish(c.name, "clear", "")
+}
+
+func (c *ttlCache) clearLocal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.tags = make(map[string]map[string]struct{})
+}
+
+func (c *ttlCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// removeElement must be called with c.mu held.
+func (c *ttlCache) removeElement(elm *list.Element) {
+	entry := c.order.Remove(elm).(*cacheEntry)
+	delete(c.entries, entry.key)
+	for _, tag := range entry.tags {
+		delete(c.tags[tag], entry.key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-redis/redis"
+)
+
+const cacheInvalidationChannel = "auth:cache-invalidations"
+
+// authCacheInvalidations is set when sessions or OAuth2 tokens are shared through Redis, caches
+// created with newTTLCache then send their invalidations to every other replica.
+var authCacheInvalidations *cacheInvalidator
+
+// cacheInvalidation is the message published for each invalidation.
+type cacheInvalidation struct {
+	Origin string `json:"origin"`
+	Cache  string `json:"cache"`
+	Op     string `json:"op"` // remove, removeTagged or clear
+	Key    string `json:"key,omitempty"`
+}
+
+// cacheInvalidator publishes cache invalidations over Redis pub/sub and applies those of other
+// replicas to the local caches with the same name.
+//
+// Pub/sub messages aren't stored, so every cache is cleared after reconnecting to Redis. An
+// invalidation can still be missed if publishing it fails, in which case other replicas serve
+// the stale entry until it expires (at most AUTH_CACHE_TTL).
+type cacheInvalidator struct {
+	client *redis.Client
+	logger log.Logger
+	origin string
+
+	mu     sync.Mutex
+	caches map[string][]*ttlCache
+
+	pubsub *redis.PubSub
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// setupCacheInvalidator connects to the first Redis DSN, nil is returned when none of the
+// DSNs are Redis or caching is disabled.
+func setupCacheInvalidator(logger log.Logger, dsns ...string) (*cacheInvalidator, error) {
+	if authCacheTTL <= 0 {
+		return nil, nil
+	}
+	for _, dsn := range dsns {
+		if !strings.HasPrefix(dsn, "redis://") && !strings.HasPrefix(dsn, "rediss://") {
+			continue
+		}
+		opts, err := redis.ParseURL(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("problem parsing redis URL: %v", err)
+		}
+		client := redis.NewClient(opts)
+		if err := client.Ping().Err(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("problem with Ping against redis %s: %v", opts.Addr, err)
+		}
+		return newCacheInvalidator(logger, client)
+	}
+	return nil, nil
+}
+
+func newCacheInvalidator(logger log.Logger, client *redis.Client) (*cacheInvalidator, error) {
+	origin := generateID()
+	if origin == "" {
+		return nil, errors.New("problem generating cache invalidation origin")
+	}
+	return &cacheInvalidator{
+		client: client,
+		logger: logger,
+		origin: origin,
+		caches: make(map[string][]*ttlCache),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// register sends the invalidations of c to other replicas and applies theirs to c.
+func (ci *cacheInvalidator) register(c *ttlCache) {
+	if ci == nil || c == nil {
+		return
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	c.invalidator = ci
+	ci.caches[c.name] = append(ci.caches[c.name], c)
+}
+
+func (ci *cacheInvalidator) publish(cache, op, key string) {
+	if ci == nil {
+		return
+	}
+	bs, err := json.Marshal(cacheInvalidation{Origin: ci.origin, Cache: cache, Op: op, Key: key})
+	if err != nil {
+		return
+	}
+	if err := ci.client.Publish(cacheInvalidationChannel, string(bs)).Err(); err != nil {
+		authCacheInvalidationErrors.Add(1)
+		ci.logger.Log("cache", fmt.Sprintf("problem publishing %s cache invalidation: %v", cache, err))
+	}
+}
+
+// apply invalidates the local caches named in a message from another replica.
+func (ci *cacheInvalidator) apply(payload string) {
+	var msg cacheInvalidation
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil || msg.Origin == ci.origin {
+		return
+	}
+	ci.mu.Lock()
+	caches := ci.caches[msg.Cache]
+	ci.mu.Unlock()
+
+	for _, c := range caches {
+		switch msg.Op {
+		case "remove":
+			c.removeLocal(msg.Key)
+		case "removeTagged":
+			c.removeTaggedLocal(msg.Key)
+		default:
+			c.clearLocal()
+		}
+	}
+}
+
+func (ci *cacheInvalidator) clearAll() {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	for _, caches := range ci.caches {
+		for _, c := range caches {
+			c.clearLocal()
+		}
+	}
+}
+
+// start subscribes to invalidations until shutdown is called.
+func (ci *cacheInvalidator) start() {
+	if ci == nil {
+		return
+	}
+	ci.pubsub = ci.client.Subscribe(cacheInvalidationChannel)
+	ci.logger.Log("cache", "receiving cache invalidations from other replicas over redis")
+	go func() {
+		defer close(ci.done)
+
+		subscribed := false
+		for {
+			msg, err := ci.pubsub.Receive()
+			if err != nil {
+				if ci.stopping() {
+					return
+				}
+				ci.logger.Log("cache", fmt.Sprintf("problem receiving cache invalidations: %v", err))
+				select {
+				case <-ci.stop:
+					return
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+			switch m := msg.(type) {
+			case *redis.Subscription:
+				if subscribed {
+					ci.clearAll() // invalidations sent while disconnected were missed
+				}
+				subscribed = true
+			case *redis.Message:
+				ci.apply(m.Payload)
+			}
+		}
+	}()
+}
+
+func (ci *cacheInvalidator) stopping() bool {
+	select {
+	case <-ci.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ci *cacheInvalidator) shutdown() {
+	if ci == nil {
+		return
+	}
+	select {
+	case <-ci.stop:
+	default:
+		close(ci.stop)
+	}
+	if ci.pubsub != nil {
+		ci.pubsub.Close()
+		<-ci.done
+	}
+	ci.client.Close()
+}
@@ -0,0 +1,282 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-kit/kit/log"
+	"github.com/moov-io/base"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestCache(t *testing.T) {
+	c := newTTLCache("test")
+	c.size = 2
+
+	if _, ok := c.get("a"); ok {
+		t.Error("expected miss")
+	}
+	c.set("a", 1, 0, "user1")
+	c.set("b", 2, 0, "user1")
+	if v, ok := c.get("a"); !ok || v.(int) != 1 {
+		t.Errorf("got v=%v ok=%v", v, ok)
+	}
+
+	// "b" is the least recently used
+	c.set("c", 3, 0, "user2")
+	if _, ok := c.get("b"); ok {
+		t.Error("expected b to be evicted")
+	}
+	if n := c.len(); n != 2 {
+		t.Errorf("got %d entries", n)
+	}
+
+	// invalidate by tag
+	c.removeTagged("user1")
+	if _, ok := c.get("a"); ok {
+		t.Error("expected a to be removed")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Error("expected c")
+	}
+
+	// entries expire
+	c.set("d", 4, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get("d"); ok {
+		t.Error("expected d to be expired")
+	}
+
+	c.clear()
+	if n := c.len(); n != 0 {
+		t.Errorf("got %d entries", n)
+	}
+
+	// a nil cache caches nothing
+	var nilCache *ttlCache
+	nilCache.set("a", 1, 0)
+	if _, ok := nilCache.get("a"); ok {
+		t.Error("expected miss")
+	}
+}
+
+func TestCache__readCacheConfig(t *testing.T) {
+	ttl, size := authCacheTTL, authCacheSize
+	defer func() {
+		authCacheTTL, authCacheSize = ttl, size
+		os.Unsetenv("AUTH_CACHE_TTL")
+		os.Unsetenv("AUTH_CACHE_SIZE")
+	}()
+
+	os.Setenv("AUTH_CACHE_TTL", "1m")
+	os.Setenv("AUTH_CACHE_SIZE", "100")
+	if err := readCacheConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if authCacheTTL != time.Minute || authCacheSize != 100 {
+		t.Errorf("unexpected config: ttl=%v size=%d", authCacheTTL, authCacheSize)
+	}
+
+	// zero disables caching
+	os.Setenv("AUTH_CACHE_TTL", "0s")
+	if err := readCacheConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if c := newTTLCache("test"); c != nil {
+		t.Errorf("expected no cache, got %#v", c)
+	}
+
+	os.Setenv("AUTH_CACHE_SIZE", "0")
+	if err := readCacheConfig(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestCache__sessions(t *testing.T) {
+	a, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.cleanup()
+	a.cache = newTTLCache("sessions")
+
+	userId := generateID()
+	cookie, err := createCookie(userId, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := a.findUserId(cookie.Value); err != nil || id != userId {
+		t.Fatalf("expected userId=%s, got %s err=%v", userId, id, err)
+	}
+	if n := a.cache.len(); n != 1 {
+		t.Fatalf("expected cached session, got %d entries", n)
+	}
+
+	// logout removes it
+	if err := a.invalidateCookies(userId); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := a.findUserId(cookie.Value); err != nil || id != "" {
+		t.Errorf("expected no session, got %s err=%v", id, err)
+	}
+
+	// so does a password change
+	cookie, _ = createCookie(userId, a)
+	a.findUserId(cookie.Value)
+	if err := a.writePassword(userId, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if n := a.cache.len(); n != 0 {
+		t.Errorf("expected empty cache, got %d entries", n)
+	}
+}
+
+func TestCache__users(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	repo.cache = newTTLCache("users")
+
+	u := &User{
+		ID:        generateID(),
+		Email:     "test@moov.io",
+		FirstName: "Jane",
+		LastName:  "Doe",
+		CreatedAt: base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	user, err := repo.lookupByUserId(u.ID)
+	if err != nil || user == nil {
+		t.Fatalf("expected user, got user=%v err=%v", user, err)
+	}
+
+	// changes to the returned User don't change the cache
+	user.FirstName = "John"
+	if cached, _ := repo.lookupByUserId(u.ID); cached.FirstName != "Jane" {
+		t.Errorf("got %q", cached.FirstName)
+	}
+
+	// upsert clears the cache
+	if err := repo.upsert(user); err != nil {
+		t.Fatal(err)
+	}
+	if updated, _ := repo.lookupByUserId(u.ID); updated.FirstName != "John" {
+		t.Errorf("got %q", updated.FirstName)
+	}
+}
+
+func TestCache__tokens(t *testing.T) {
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	store, ok := o.svc.tokenStore.(*cachedTokenStore)
+	if !ok {
+		t.Fatalf("unexpected token store: %T", o.svc.tokenStore)
+	}
+
+	token := &models.Token{
+		ClientID:         generateID(),
+		UserID:           generateID(),
+		Access:           generateID(),
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  30 * time.Minute,
+		Refresh:          generateID(),
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: time.Hour,
+	}
+	if err := store.Create(token); err != nil {
+		t.Fatal(err)
+	}
+	if ti, err := store.GetByAccess(token.Access); err != nil || ti == nil {
+		t.Fatalf("expected token, got ti=%v err=%v", ti, err)
+	}
+	if n := store.cache.len(); n != 1 {
+		t.Fatalf("expected cached token, got %d entries", n)
+	}
+
+	// revoking the refresh token removes the access token
+	if err := store.RemoveByRefresh(token.Refresh); err != nil {
+		t.Fatal(err)
+	}
+	if ti, err := store.GetByAccess(token.Access); err != nil || ti != nil {
+		t.Errorf("expected no token, got ti=%v err=%v", ti, err)
+	}
+
+	// revoking a client removes its tokens
+	token.Access, token.Refresh = generateID(), generateID()
+	if err := store.Create(token); err != nil {
+		t.Fatal(err)
+	}
+	store.GetByAccess(token.Access)
+	if err := store.RemoveByClientID(token.ClientID); err != nil {
+		t.Fatal(err)
+	}
+	if ti, err := store.GetByAccess(token.Access); err != nil || ti != nil {
+		t.Errorf("expected no token, got ti=%v err=%v", ti, err)
+	}
+}
+
+func TestCache__invalidations(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if ci, err := setupCacheInvalidator(log.NewNopLogger(), "", "file:oauth2_tokens.db"); err != nil || ci != nil {
+		t.Fatalf("expected no invalidator, got %#v (err=%v)", ci, err)
+	}
+
+	// two replicas sharing redis
+	var replicas []*ttlCache
+	for i := 0; i < 2; i++ {
+		ci, err := setupCacheInvalidator(log.NewNopLogger(), "", "redis://"+server.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ci.start()
+		defer ci.shutdown()
+
+		c := newTTLCache("sessions")
+		ci.register(c)
+		c.set("a", 1, 0, "user1")
+		c.set("b", 2, 0, "user2")
+		c.set("c", 3, 0, "user2")
+		replicas = append(replicas, c)
+	}
+	waitFor := func(c *ttlCache, n int) {
+		t.Helper()
+		for i := 0; i < 100 && c.len() != n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if c.len() != n {
+			t.Fatalf("expected %d entries, got %d", n, c.len())
+		}
+	}
+	for i := 0; i < 100 && server.PubSubNumSub(cacheInvalidationChannel)[cacheInvalidationChannel] < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	replicas[0].remove("a")
+	waitFor(replicas[1], 2)
+	replicas[1].removeTagged("user2")
+	waitFor(replicas[0], 0)
+	waitFor(replicas[1], 0)
+
+	replicas[1].set("d", 4, 0)
+	replicas[0].clear()
+	waitFor(replicas[1], 0)
+}
@@ -2,7 +2,9 @@ module github.com/moov-io/auth
 
 require (
 	github.com/VividCortex/gohistogram v1.0.0 // indirect
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/go-kit/kit v0.8.0
+	github.com/go-redis/redis v6.15.2+incompatible
 	github.com/go-logfmt/logfmt v0.4.0 // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/gorilla/mux v1.7.0
@@ -0,0 +1,164 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// purgeFunc permanently deletes up to limit rows which expired (or were deleted) before the given time.
+// It returns how many rows were deleted.
+type purgeFunc func(before time.Time, limit int) (int64, error)
+
+// expiredTokenPurger is implemented by token stores which can purge expired tokens.
+type expiredTokenPurger interface {
+	PurgeExpired(before time.Time, limit int) (int64, error)
+}
+
+type sweeper struct {
+	table string
+	purge purgeFunc
+}
+
+// janitor periodically purges expired and soft-deleted rows which are only kept around
+// for the retention period.
+type janitor struct {
+	interval  time.Duration
+	retention time.Duration
+	batchSize int
+
+	sweepers []sweeper
+	logger   log.Logger
+
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newJanitor reads the janitor's config from JANITOR_INTERVAL, JANITOR_RETENTION and
+// JANITOR_BATCH_SIZE, falling back to defaults for any that aren't set.
+func newJanitor(logger log.Logger) (*janitor, error) {
+	j := &janitor{
+		interval:  1 * time.Hour,
+		retention: 7 * 24 * time.Hour,
+		batchSize: 1000,
+		logger:    logger,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if v := os.Getenv("JANITOR_INTERVAL"); v != "" {
+		if v == "off" {
+			j.interval = 0
+		} else {
+			dur, err := time.ParseDuration(v)
+			if err != nil || dur <= 0 {
+				return nil, fmt.Errorf("invalid JANITOR_INTERVAL=%q", v)
+			}
+			j.interval = dur
+		}
+	}
+	if v := os.Getenv("JANITOR_RETENTION"); v != "" {
+		dur, err := time.ParseDuration(v)
+		if err != nil || dur < 0 {
+			return nil, fmt.Errorf("invalid JANITOR_RETENTION=%q", v)
+		}
+		j.retention = dur
+	}
+	if v := os.Getenv("JANITOR_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid JANITOR_BATCH_SIZE=%q", v)
+		}
+		j.batchSize = n
+	}
+	return j, nil
+}
+
+// add registers a table to purge rows from on each sweep.
+func (j *janitor) add(table string, fn purgeFunc) {
+	j.sweepers = append(j.sweepers, sweeper{table: table, purge: fn})
+}
+
+// start runs a sweep every interval until shutdown is called. Nothing is started when
+// the janitor is disabled with JANITOR_INTERVAL=off.
+func (j *janitor) start() {
+	j.started = true
+	if j.interval <= 0 {
+		j.logger.Log("janitor", "disabled")
+		close(j.done)
+		return
+	}
+	j.logger.Log("janitor", fmt.Sprintf("purging expired rows every %v with %v retention", j.interval, j.retention))
+	go func() {
+		defer close(j.done)
+
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				j.sweep()
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+// sweep purges each table in batches until a batch comes back short or shutdown is called.
+func (j *janitor) sweep() {
+	before := time.Now().Add(-1 * j.retention)
+	for _, s := range j.sweepers {
+		var total int64
+		for {
+			n, err := s.purge(before, j.batchSize)
+			if n > 0 {
+				total += n
+				janitorRowsRemoved.With("table", s.table).Add(float64(n))
+			}
+			if err != nil {
+				janitorErrors.With("table", s.table).Add(1)
+				j.logger.Log("janitor", fmt.Sprintf("problem purging %s: %v", s.table, err))
+				break
+			}
+			if n < int64(j.batchSize) || j.stopping() {
+				break
+			}
+		}
+		if total > 0 {
+			j.logger.Log("janitor", fmt.Sprintf("purged %d rows from %s", total, s.table))
+		}
+		if j.stopping() {
+			return
+		}
+	}
+}
+
+func (j *janitor) stopping() bool {
+	select {
+	case <-j.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops the janitor and waits for an in-progress batch to finish.
+func (j *janitor) shutdown() {
+	if j == nil || !j.started {
+		return
+	}
+	select {
+	case <-j.stop:
+	default:
+		close(j.stop)
+	}
+	<-j.done
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestJanitor__config(t *testing.T) {
+	j, err := newJanitor(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.interval != time.Hour || j.retention != 7*24*time.Hour || j.batchSize != 1000 {
+		t.Errorf("unexpected defaults: %#v", j)
+	}
+
+	os.Setenv("JANITOR_INTERVAL", "5m")
+	os.Setenv("JANITOR_RETENTION", "1h")
+	os.Setenv("JANITOR_BATCH_SIZE", "10")
+	defer func() {
+		os.Unsetenv("JANITOR_INTERVAL")
+		os.Unsetenv("JANITOR_RETENTION")
+		os.Unsetenv("JANITOR_BATCH_SIZE")
+	}()
+	j, err = newJanitor(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.interval != 5*time.Minute || j.retention != time.Hour || j.batchSize != 10 {
+		t.Errorf("unexpected config: %#v", j)
+	}
+
+	os.Setenv("JANITOR_BATCH_SIZE", "0")
+	if _, err := newJanitor(log.NewNopLogger()); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestJanitor__sweep(t *testing.T) {
+	j, err := newJanitor(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.batchSize = 10
+	j.retention = time.Hour
+
+	// 25 rows are purged over three batches
+	rows, calls := 25, 0
+	j.add("tokens", func(before time.Time, limit int) (int64, error) {
+		calls++
+		if limit != 10 || time.Since(before) < time.Hour {
+			t.Errorf("limit=%d before=%v", limit, before)
+		}
+		n := limit
+		if rows < n {
+			n = rows
+		}
+		rows -= n
+		return int64(n), nil
+	})
+	// errors don't stop other tables
+	j.add("broken", func(before time.Time, limit int) (int64, error) {
+		return 0, errors.New("bad")
+	})
+	other := 0
+	j.add("cookies", func(before time.Time, limit int) (int64, error) {
+		other++
+		return 0, nil
+	})
+
+	j.sweep()
+	if rows != 0 || calls != 3 || other != 1 {
+		t.Errorf("rows=%d calls=%d other=%d", rows, calls, other)
+	}
+}
+
+func TestJanitor__shutdown(t *testing.T) {
+	j, err := newJanitor(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.interval = 10 * time.Millisecond
+
+	swept := make(chan struct{}, 1)
+	j.add("tokens", func(before time.Time, limit int) (int64, error) {
+		select {
+		case swept <- struct{}{}:
+		default:
+		}
+		return int64(limit), nil // always a full batch, only shutdown stops it
+	})
+	j.start()
+
+	select {
+	case <-swept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("janitor never ran")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		j.shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("janitor didn't stop")
+	}
+	j.shutdown() // calling again is fine
+
+	// disabled janitors shutdown immediately
+	j, _ = newJanitor(log.NewNopLogger())
+	j.interval = 0
+	j.start()
+	j.shutdown()
+}
@@ -20,9 +20,9 @@ type loginRequest struct {
 	Password string `json:"password"`
 }
 
-func addLoginRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository) {
+func addLoginRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, audit auditLog, alerts *loginAlerter) {
 	router.Methods("GET").Path("/users/login").HandlerFunc(checkLogin(logger, auth, userService))
-	router.Methods("POST").Path("/users/login").HandlerFunc(loginRoute(logger, auth, userService))
+	router.Methods("POST").Path("/users/login").HandlerFunc(loginRoute(logger, auth, userService, audit, alerts))
 }
 
 func getUserFromCookie(auth authable, repo userRepository, r *http.Request) (*User, error) {
@@ -35,6 +35,9 @@ func getUserFromCookie(auth authable, repo userRepository, r *http.Request) (*Us
 	if err != nil {
 		return nil, err
 	}
+	if user != nil && !user.canLogin() {
+		return nil, errUserInactive
+	}
 	return user, nil
 }
 
@@ -63,7 +66,7 @@ func checkLogin(logger log.Logger, auth authable, repo userRepository) http.Hand
 	}
 }
 
-func loginRoute(logger log.Logger, auth authable, userService userRepository) http.HandlerFunc {
+func loginRoute(logger log.Logger, auth authable, userService userRepository, audit auditLog, alerts *loginAlerter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w = wrapResponseWriter(w, r, "loginRoute")
 
@@ -105,6 +108,8 @@ func loginRoute(logger log.Logger, auth authable, userService userRepository) ht
 			w.WriteHeader(http.StatusForbidden)
 			if err != nil {
 				logger.Log("login", fmt.Sprintf("problem looking up user email %q: %v", login.Email, err))
+			} else {
+				recordAudit(audit, r, auditLoginFailed, "", "", map[string]string{"email": login.Email, "reason": "unknown email"})
 			}
 			return
 		}
@@ -113,6 +118,21 @@ func loginRoute(logger log.Logger, auth authable, userService userRepository) ht
 		if err := auth.checkPassword(u.ID, login.Password); err != nil {
 			authFailures.With("method", "web").Add(1)
 			logger.Log("login", fmt.Sprintf("userId=%s failed: %v", u.ID, err))
+			recordAudit(audit, r, auditLoginFailed, "", u.ID, map[string]string{"reason": "invalid password"})
+			if locked, err := lockAfterFailedLogin(userService, u); err != nil {
+				logger.Log("login", fmt.Sprintf("problem counting failed login of userId=%s: %v", u.ID, err))
+			} else if locked {
+				logger.Log("login", fmt.Sprintf("locked userId=%s after %d failed logins", u.ID, loginMaxFailures))
+				recordAudit(audit, r, auditUserStatusChanged, "", u.ID, map[string]string{"status": userStatusLocked, "reason": "failed logins"})
+			}
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if !u.canLogin() {
+			authFailures.With("method", "web").Add(1)
+			logger.Log("login", fmt.Sprintf("userId=%s can't login with status=%s", u.ID, u.Status))
+			recordAudit(audit, r, auditLoginFailed, "", u.ID, map[string]string{"reason": "status " + u.Status})
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
@@ -133,6 +153,14 @@ func loginRoute(logger log.Logger, auth authable, userService userRepository) ht
 			internalError(w, err)
 			return
 		}
+		recordAudit(audit, r, auditLoginSucceeded, u.ID, u.ID, nil)
+		if err := userService.clearLoginFailures(u.ID); err != nil {
+			logger.Log("login", err.Error())
+		}
+		if err := alerts.check(u, r); err != nil {
+			// the login still succeeds
+			logger.Log("login", fmt.Sprintf("problem checking login of userId=%s for a new device: %v", u.ID, err))
+		}
 
 		http.SetCookie(w, cookie)
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -0,0 +1,404 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// loginAlertTTL is how long the "this wasn't me" link of a login alert can be used for
+	loginAlertTTL = 7 * 24 * time.Hour
+)
+
+var (
+	errInvalidLoginAlert = errors.New("invalid or expired login alert code")
+
+	// userAgentVersions matches version numbers, which are dropped from fingerprints so browser
+	// and OS updates aren't new devices
+	userAgentVersions = regexp.MustCompile(`[0-9]+([._][0-9]+)*`)
+)
+
+// loginFingerprint identifies where a login came from: the network (IPv4 /24 or IPv6 /48) of
+// the client and its User-Agent without version numbers.
+type loginFingerprint struct {
+	IP        string
+	IPRange   string
+	UserAgent string
+	Device    string
+}
+
+func fingerprintLogin(r *http.Request) loginFingerprint {
+	fp := loginFingerprint{
+		IP:        clientIP(r),
+		UserAgent: strings.TrimSpace(r.UserAgent()),
+	}
+	fp.IPRange = ipRange(fp.IP)
+
+	family := strings.Join(strings.Fields(userAgentVersions.ReplaceAllString(strings.ToLower(fp.UserAgent), "")), " ")
+	sum := sha256.Sum256([]byte(family))
+	fp.Device = hex.EncodeToString(sum[:])
+	return fp
+}
+
+// ipRange returns the network of ip, addresses which don't parse are their own range.
+func ipRange(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// loginAlerter remembers where each user logs in from and notifies them of logins from a new
+// device or location, with a link to sign the login out and reset their password.
+type loginAlerter struct {
+	db       *sql.DB
+	logger   log.Logger
+	auth     authable
+	notifier Notifier
+	audit    auditLog
+
+	// oauth and tokens are revoked along with the user's sessions when a login is disowned
+	oauth  *oauth
+	tokens personalTokenRepository
+}
+
+// check records the login of u and sends an alert if it's from a device or network they haven't
+// logged in from before. Nothing is sent for a user's first login.
+func (a *loginAlerter) check(u *User, r *http.Request) error {
+	if a == nil {
+		return nil
+	}
+	fp := fingerprintLogin(r)
+
+	rows, err := a.db.Query(`select device, ip_range from user_login_fingerprints where user_id = ?`, u.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	seen, knownDevice, knownRange := false, false, false
+	for rows.Next() {
+		var device, ipRange string
+		if err := rows.Scan(&device, &ipRange); err != nil {
+			return err
+		}
+		seen = true
+		knownDevice = knownDevice || device == fp.Device
+		knownRange = knownRange || ipRange == fp.IPRange
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	now := time.Now().Format(serializedTimestampFormat)
+	query := `insert or ignore into user_login_fingerprints (user_id, device, ip_range, user_agent, first_seen_at, last_seen_at) values (?, ?, ?, ?, ?, ?)`
+	if _, err := a.db.Exec(query, u.ID, fp.Device, fp.IPRange, fp.UserAgent, now, now); err != nil {
+		return fmt.Errorf("problem recording login fingerprint of userId=%s: %v", u.ID, err)
+	}
+	query = `update user_login_fingerprints set user_agent = ?, last_seen_at = ? where user_id = ? and device = ? and ip_range = ?`
+	if _, err := a.db.Exec(query, fp.UserAgent, now, u.ID, fp.Device, fp.IPRange); err != nil {
+		return fmt.Errorf("problem recording login fingerprint of userId=%s: %v", u.ID, err)
+	}
+	if !seen || (knownDevice && knownRange) {
+		return nil
+	}
+
+	reason := "device and location"
+	if knownDevice {
+		reason = "location"
+	} else if knownRange {
+		reason = "device"
+	}
+	code, expires, err := a.createAlert(u.ID, fp, time.Now())
+	if err != nil {
+		return err
+	}
+	device := fp.UserAgent
+	if device == "" {
+		device = "an unknown device"
+	}
+	data := map[string]interface{}{
+		"Reason":    reason,
+		"Device":    device,
+		"IPAddress": fp.IP,
+		"Time":      time.Now().Format(time.RFC1123),
+		"Link":      loginAlertLink(code),
+		"ExpiresAt": expires.Format(time.RFC1123),
+	}
+	if err := a.notifier.Notify(u.Email, "new_login", data); err != nil {
+		return fmt.Errorf("problem sending login alert to userId=%s: %v", u.ID, err)
+	}
+	loginAlertsSent.With("reason", reason).Add(1)
+	a.logger.Log("login-alerts", fmt.Sprintf("userId=%s logged in from a new %s", u.ID, reason))
+	return nil
+}
+
+// loginLocation is a device and network a user has logged in from.
+type loginLocation struct {
+	IPRange     string    `json:"ipRange"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+	FirstSeenAt time.Time `json:"firstSeenAt"`
+	LastSeenAt  time.Time `json:"lastSeenAt"`
+}
+
+// getLocations returns where userId has logged in from, oldest first.
+func (a *loginAlerter) getLocations(userId string) ([]*loginLocation, error) {
+	query := `select ip_range, user_agent, first_seen_at, last_seen_at from user_login_fingerprints where user_id = ? order by first_seen_at`
+	rows, err := a.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []*loginLocation
+	for rows.Next() {
+		var loc loginLocation
+		var firstSeen, lastSeen string
+		if err := rows.Scan(&loc.IPRange, &loc.UserAgent, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		loc.FirstSeenAt, loc.LastSeenAt = parseTimestamp(firstSeen), parseTimestamp(lastSeen)
+		locations = append(locations, &loc)
+	}
+	return locations, rows.Err()
+}
+
+// loginAlertLink returns the "this wasn't me" URL of a login alert.
+func loginAlertLink(code string) string {
+	return fmt.Sprintf("https://%s/users/login/disown?code=%s", Domain, code)
+}
+
+// createAlert returns a code which disowns the login of userId from fp.
+func (a *loginAlerter) createAlert(userId string, fp loginFingerprint, now time.Time) (string, time.Time, error) {
+	code := generateID()
+	if code == "" {
+		return "", time.Time{}, errors.New("problem generating login alert code")
+	}
+	checksum, err := hash(code)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := now.Add(loginAlertTTL)
+	query := `insert into user_login_alerts (code, user_id, device, ip_range, ip, user_agent, created_at, expires_at) values (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = a.db.Exec(query, checksum, userId, fp.Device, fp.IPRange, fp.IP, fp.UserAgent, now.Format(serializedTimestampFormat), expires.Format(serializedTimestampFormat))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("problem writing login alert of userId=%s: %v", userId, err)
+	}
+	return code, expires, nil
+}
+
+// consumeAlert removes the alert of code and forgets its fingerprint, so another login from it
+// is alerted on. errInvalidLoginAlert is returned if no unexpired alert exists for code.
+func (a *loginAlerter) consumeAlert(code string) (string, *loginFingerprint, error) {
+	checksum, err := hash(code)
+	if err != nil {
+		return "", nil, errInvalidLoginAlert
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var userId, expiresAt string
+	fp := &loginFingerprint{}
+	query := `select user_id, device, ip_range, ip, user_agent, expires_at from user_login_alerts where code = ? limit 1`
+	if err := tx.QueryRow(query, checksum).Scan(&userId, &fp.Device, &fp.IPRange, &fp.IP, &fp.UserAgent, &expiresAt); err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return "", nil, errInvalidLoginAlert
+		}
+		return "", nil, err
+	}
+	if _, err := tx.Exec(`delete from user_login_alerts where code = ?`, checksum); err != nil {
+		e := tx.Rollback()
+		return "", nil, fmt.Errorf("problem removing login alert of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	if time.Now().After(parseTimestamp(expiresAt)) {
+		// the expired code is still removed
+		if err := tx.Commit(); err != nil {
+			return "", nil, err
+		}
+		return "", nil, errInvalidLoginAlert
+	}
+	query = `delete from user_login_fingerprints where user_id = ? and device = ? and ip_range = ?`
+	if _, err := tx.Exec(query, userId, fp.Device, fp.IPRange); err != nil {
+		e := tx.Rollback()
+		return "", nil, fmt.Errorf("problem removing login fingerprint of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	return userId, fp, tx.Commit()
+}
+
+// purgeExpired deletes up to limit alerts whose link expired before the given time.
+func (a *loginAlerter) purgeExpired(before time.Time, limit int) (int64, error) {
+	query := `delete from user_login_alerts where code in (select code from user_login_alerts where expires_at < ? limit ?)`
+	res, err := a.db.Exec(query, before.Format(serializedTimestampFormat), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func addLoginAlertRoutes(router *mux.Router, logger log.Logger, alerts *loginAlerter, userService userRepository) {
+	router.Methods("GET").Path("/users/login/disown").HandlerFunc(confirmDisownLogin())
+	router.Methods("POST").Path("/users/login/disown").HandlerFunc(disownLogin(logger, alerts, userService))
+}
+
+type disownLoginRequest struct {
+	Code string `json:"code"`
+}
+
+var (
+	disownLoginConfirmation = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign out this login</title></head>
+<body>
+<p>If you didn't just sign in, we'll sign out every session, revoke your tokens and email you a code to set a new password.</p>
+<form method="POST" action="/users/login/disown">
+<input type="hidden" name="code" value="{{.}}">
+<button type="submit">This wasn't me</button>
+</form>
+</body>
+</html>
+`))
+
+	disownLoginCompleted = template.Must(template.New("completed").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Signed out</title></head>
+<body>
+<p>Every session has been signed out. Check your email for a code to set a new password.</p>
+</body>
+</html>
+`))
+)
+
+// writeDisownLoginPage renders one of the disown pages, which are never cached and don't leak
+// the code in their referrer.
+func writeDisownLoginPage(w http.ResponseWriter, page *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(http.StatusOK)
+	page.Execute(w, data)
+}
+
+// confirmDisownLogin is the "this wasn't me" link of a login alert. Links in emails are followed
+// by mail scanners, so it only shows a form which POSTs the code back to disownLogin.
+func confirmDisownLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "confirmDisownLogin")
+
+		code := strings.TrimSpace(r.URL.Query().Get("code"))
+		if code == "" {
+			moovhttp.Problem(w, errInvalidLoginAlert)
+			return
+		}
+		writeDisownLoginPage(w, disownLoginConfirmation, code)
+	}
+}
+
+// disownLogin signs the login of a login alert out. Every session, OAuth2 token and personal
+// access token of the user is revoked, their password is replaced so it can't be used again,
+// and a password reset code is sent. The code is read from the confirmation form, a JSON body
+// or the query string.
+func disownLogin(logger log.Logger, alerts *loginAlerter, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "disownLogin")
+
+		code := r.URL.Query().Get("code")
+		form := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+		if form {
+			code = r.PostFormValue("code")
+		} else if code == "" {
+			var req disownLoginRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				moovhttp.Problem(w, err)
+				return
+			}
+			code = req.Code
+		}
+		if code = strings.TrimSpace(code); code == "" {
+			moovhttp.Problem(w, errInvalidLoginAlert)
+			return
+		}
+
+		userId, fp, err := alerts.consumeAlert(code)
+		if err != nil {
+			if err == errInvalidLoginAlert {
+				moovhttp.Problem(w, err)
+			} else {
+				internalError(w, err)
+			}
+			return
+		}
+		u, err := userService.lookupByUserId(userId)
+		if err != nil || u == nil {
+			internalError(w, fmt.Errorf("problem finding userId=%s of login alert: %v", userId, err))
+			return
+		}
+
+		if err := alerts.auth.invalidateCookies(userId); err != nil {
+			internalError(w, err)
+			return
+		}
+		if _, err := revokeUserAccess(alerts.oauth, alerts.tokens, userId); err != nil {
+			internalError(w, fmt.Errorf("problem revoking tokens of userId=%s: %v", userId, err))
+			return
+		}
+		// nobody knows the new password, 32 characters so it and its salt fit in bcrypt's 72 bytes
+		password := generateID()
+		if len(password) < 32 {
+			internalError(w, errors.New("problem generating password"))
+			return
+		}
+		if err := alerts.auth.writePassword(userId, password[:32]); err != nil {
+			internalError(w, fmt.Errorf("problem replacing password of userId=%s: %v", userId, err))
+			return
+		}
+		resetCode, expires, err := alerts.auth.createPasswordReset(userId, userId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		logger.Log("login-alerts", fmt.Sprintf("userId=%s disowned a login from %s", userId, fp.IP))
+		recordAudit(alerts.audit, r, auditLoginDisowned, userId, userId, map[string]string{"ip": fp.IP, "userAgent": fp.UserAgent})
+
+		data := map[string]interface{}{
+			"Code":      resetCode,
+			"ExpiresAt": expires.Format(time.RFC1123),
+		}
+		if err := alerts.notifier.Notify(u.Email, "password_reset", data); err != nil {
+			internalError(w, fmt.Errorf("problem sending password reset to userId=%s: %v", userId, err))
+			return
+		}
+
+		if form {
+			writeDisownLoginPage(w, disownLoginCompleted, nil)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
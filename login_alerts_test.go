@@ -0,0 +1,205 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestLoginAlerts__fingerprint(t *testing.T) {
+	r := httptest.NewRequest("POST", "/users/login", nil)
+	r.RemoteAddr = "203.0.113.42:4567"
+	r.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) Chrome/118.0.5993.70 Safari/537.36")
+	fp := fingerprintLogin(r)
+	if fp.IP != "203.0.113.42" || fp.IPRange != "203.0.113.0/24" {
+		t.Errorf("unexpected fingerprint: %#v", fp)
+	}
+
+	// browser updates and nearby addresses are the same fingerprint
+	r.RemoteAddr = "203.0.113.7:4567"
+	r.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_8) Chrome/119.0.6045.105 Safari/537.36")
+	if other := fingerprintLogin(r); other.Device != fp.Device || other.IPRange != fp.IPRange {
+		t.Errorf("expected %#v to match %#v", other, fp)
+	}
+	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/119.0")
+	if other := fingerprintLogin(r); other.Device == fp.Device {
+		t.Errorf("expected a new device: %#v", other)
+	}
+
+	cases := map[string]string{
+		"2001:db8:abcd:12::1": "2001:db8:abcd::/48",
+		"::ffff:10.1.2.3":     "10.1.2.0/24",
+		"unknown":             "unknown",
+	}
+	for ip, expected := range cases {
+		if v := ipRange(ip); v != expected {
+			t.Errorf("%s: got %s", ip, v)
+		}
+	}
+}
+
+func TestLoginAlerts(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	auth := &auth{db: repo.db, log: log.NewNopLogger()}
+	audit := &sqliteAuditLog{db: repo.db, log: log.NewNopLogger()}
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+	tokens := &sqlitePersonalTokenRepository{db: repo.db, log: log.NewNopLogger()}
+
+	notifier := &mockNotifier{}
+	alerts := &loginAlerter{db: repo.db, logger: log.NewNopLogger(), auth: auth, notifier: notifier, audit: audit, oauth: o.svc, tokens: tokens}
+	router := mux.NewRouter()
+	addLoginRoutes(router, log.NewNopLogger(), auth, repo, audit, alerts)
+	addLoginAlertRoutes(router, log.NewNopLogger(), alerts, repo)
+
+	user := createTestUser(t, repo, "jane@moov.io")
+	if err := auth.writePassword(user.ID, "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	login := func(ip, userAgent string) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/users/login", strings.NewReader(`{"email": "jane@moov.io", "password": "correct horse battery"}`))
+		r.RemoteAddr = ip + ":4567"
+		r.Header.Set("User-Agent", userAgent)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// the first login and logins from known places aren't alerted
+	login("203.0.113.42", "Firefox/118.0")
+	login("203.0.113.7", "Firefox/119.0")
+	if len(notifier.sent) != 0 {
+		t.Fatalf("unexpected notifications: %#v", notifier.sent)
+	}
+	login("198.51.100.1", "Firefox/119.0")
+	login("198.51.100.1", "curl/8.1.2")
+	login("198.51.100.1", "curl/8.1.2")
+	if len(notifier.sent) != 2 {
+		t.Fatalf("unexpected notifications: %#v", notifier.sent)
+	}
+	if n := notifier.sent[0]; n.to != "jane@moov.io" || n.template != "new_login" || n.data["Reason"] != "location" || n.data["IPAddress"] != "198.51.100.1" {
+		t.Errorf("unexpected notification: %#v", n)
+	}
+	if n := notifier.sent[1]; n.data["Reason"] != "device" || n.data["Device"] != "curl/8.1.2" {
+		t.Errorf("unexpected notification: %#v", n)
+	}
+
+	_, token := createOAuthClient(t, o, user.ID)
+	if err := tokens.createToken(&personalToken{ID: generateID(), UserID: user.ID, Name: "ci", CreatedAt: base.NewTime(time.Now())}, generateID()); err != nil {
+		t.Fatal(err)
+	}
+
+	// following the link only shows a confirmation form
+	link, err := url.Parse(notifier.sent[1].data["Link"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := link.Query().Get("code")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", link.RequestURI(), nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if body := w.Body.String(); !strings.Contains(body, `method="POST"`) || !strings.Contains(body, code) {
+		t.Errorf("unexpected confirmation page: %s", body)
+	}
+	if sessions, err := auth.activeSessions(user.ID); err != nil || len(sessions) == 0 {
+		t.Fatalf("expected sessions to be kept, got %v (err=%v)", sessions, err)
+	}
+
+	// this wasn't me
+	r := httptest.NewRequest("POST", "/users/login/disown", strings.NewReader(url.Values{"code": {code}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if ti, err := o.svc.tokenStore.GetByAccess(token.Access); err != nil || ti != nil {
+		t.Errorf("expected OAuth2 tokens to be revoked, got ti=%v err=%v", ti, err)
+	}
+	if pats, err := tokens.getUserTokens(user.ID); err != nil || len(pats) != 0 {
+		t.Errorf("expected personal access tokens to be revoked, got %#v err=%v", pats, err)
+	}
+	if sessions, err := auth.activeSessions(user.ID); err != nil || len(sessions) != 0 {
+		t.Errorf("expected no sessions, got %v (err=%v)", sessions, err)
+	}
+	if err := auth.checkPassword(user.ID, "correct horse battery"); err == nil {
+		t.Error("expected password to be replaced")
+	}
+	if n := notifier.sent[2]; n.template != "password_reset" || n.data["Code"] == "" {
+		t.Errorf("unexpected notification: %#v", n)
+	}
+	if userId, err := auth.consumePasswordReset(notifier.sent[2].data["Code"].(string)); err != nil || userId != user.ID {
+		t.Errorf("userId=%s err=%v", userId, err)
+	}
+	events, _, err := audit.search(auditFilter{UserID: user.ID, Type: auditLoginDisowned, Limit: 50})
+	if err != nil || len(events) != 1 || events[0].Details["userAgent"] != "curl/8.1.2" {
+		t.Errorf("unexpected audit events=%#v err=%v", events, err)
+	}
+
+	// codes work once
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", link.RequestURI(), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/users/login/disown", strings.NewReader(`{"code": ""}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+}
+
+func TestLoginAlerts__purgeExpired(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	alerts := &loginAlerter{db: repo.db, logger: log.NewNopLogger()}
+	expired, _, err := alerts.createAlert("jane", loginFingerprint{IP: "203.0.113.42"}, time.Now().Add(-2*loginAlertTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _, err := alerts.createAlert("jane", loginFingerprint{IP: "203.0.113.42"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := alerts.consumeAlert(expired); err != errInvalidLoginAlert {
+		t.Errorf("expected errInvalidLoginAlert, got %v", err)
+	}
+	if _, _, err := alerts.createAlert("jane", loginFingerprint{}, time.Now().Add(-2*loginAlertTTL)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := alerts.purgeExpired(time.Now(), 10); err != nil || n != 1 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+	if userId, fp, err := alerts.consumeAlert(current); err != nil || userId != "jane" || fp.IP != "203.0.113.42" {
+		t.Errorf("userId=%s fp=%#v err=%v", userId, fp, err)
+	}
+}
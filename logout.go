@@ -11,11 +11,11 @@ import (
 	"github.com/gorilla/mux"
 )
 
-func addLogoutRoutes(router *mux.Router, logger log.Logger, auth authable) {
-	router.Methods("DELETE").Path("/users/login").HandlerFunc(logoutRoute(auth))
+func addLogoutRoutes(router *mux.Router, logger log.Logger, auth authable, audit auditLog) {
+	router.Methods("DELETE").Path("/users/login").HandlerFunc(logoutRoute(auth, audit))
 }
 
-func logoutRoute(auth authable) func(w http.ResponseWriter, r *http.Request) {
+func logoutRoute(auth authable, audit auditLog) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w = wrapResponseWriter(w, r, "logoutRoute")
 
@@ -31,6 +31,7 @@ func logoutRoute(auth authable) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		authInactivations.With("method", "web").Add(1)
+		recordAudit(audit, r, auditLogout, userId, userId, nil)
 		w.WriteHeader(http.StatusOK)
 	}
 }
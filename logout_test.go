@@ -21,7 +21,7 @@ func TestLogout__noCookie(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("DELETE", "/users/logout", nil)
-	logoutRoute(auth)(w, r)
+	logoutRoute(auth, nil)(w, r)
 	w.Flush()
 
 	if w.Code != 200 {
@@ -40,7 +40,7 @@ func TestLogout__cookieDataWithoutUser(t *testing.T) {
 	r := httptest.NewRequest("DELETE", "/users/logout", nil)
 	r.Header.Set("Cookie", "random data")
 
-	logoutRoute(auth)(w, r)
+	logoutRoute(auth, nil)(w, r)
 	w.Flush()
 
 	if w.Code != 200 {
@@ -82,7 +82,7 @@ func TestLogout__full(t *testing.T) {
 	}
 
 	// Perofrm logout
-	logoutRoute(auth)(w, r)
+	logoutRoute(auth, nil)(w, r)
 	w.Flush()
 
 	if w.Code != 200 {
@@ -9,6 +9,7 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -34,6 +35,8 @@ var (
 	logger        log.Logger
 	flagLogFormat = flag.String("log.format", "", "Format for log lines (Options: json, plain")
 
+	flagAuditVerify = flag.Bool("audit.verify", false, "Verify the audit log's hash chain and checkpoints, then exit")
+
 	// Configuration
 	tlsCertificate, tlsPrivateKey = os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
 	serveViaTLS                   = tlsCertificate != "" && tlsPrivateKey != ""
@@ -70,6 +73,72 @@ var (
 		Name: "oauth2_token_generations",
 		Help: "Count of auth tokens created",
 	}, nil)
+	refreshTokenReuses = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "oauth2_refresh_token_reuses",
+		Help: "Count of rotated refresh tokens presented again",
+	}, nil)
+	clientSecretRotations = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "oauth2_client_secret_rotations",
+		Help: "Count of OAuth2 client secrets rotated",
+	}, nil)
+	redirectURIMismatches = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "oauth2_redirect_uri_mismatches",
+		Help: "Count of OAuth2 requests with an unregistered redirect_uri",
+	}, nil)
+
+	authCacheHits = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "auth_cache_hits",
+		Help: "Count of session, user and token lookups served from cache",
+	}, []string{"cache"})
+	authCacheMisses = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "auth_cache_misses",
+		Help: "Count of session, user and token lookups not found in cache",
+	}, []string{"cache"})
+	authCacheInvalidationErrors = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "auth_cache_invalidation_errors",
+		Help: "Count of cache invalidations which couldn't be sent to other replicas",
+	}, nil)
+
+	janitorRowsRemoved = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "janitor_rows_removed",
+		Help: "Count of expired or deleted rows purged by the janitor",
+	}, []string{"table"})
+	janitorErrors = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "janitor_errors",
+		Help: "Count of errors purging expired or deleted rows",
+	}, []string{"table"})
+
+	notificationsSent = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "notifications_sent",
+		Help: "Count of notifications delivered",
+	}, []string{"template"})
+	notificationErrors = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "notification_errors",
+		Help: "Count of failed notification deliveries, each is retried with backoff",
+	}, []string{"template"})
+
+	webhookDeliveries = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "webhook_deliveries",
+		Help: "Count of identity events delivered to webhooks",
+	}, []string{"event"})
+	webhookDeliveryErrors = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "webhook_delivery_errors",
+		Help: "Count of failed webhook deliveries, each is retried with backoff",
+	}, []string{"event"})
+
+	outboxEventsPublished = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "outbox_events_published",
+		Help: "Count of outbox events published to each sink",
+	}, []string{"sink"})
+	outboxPublishErrors = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "outbox_publish_errors",
+		Help: "Count of failed outbox publishes, the sink is retried with backoff",
+	}, []string{"sink"})
+
+	loginAlertsSent = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "login_alerts_sent",
+		Help: "Count of users alerted to a login from a new device or location",
+	}, []string{"reason"})
 )
 
 func main() {
@@ -85,12 +154,27 @@ func main() {
 	logger = log.With(logger, "caller", log.DefaultCaller)
 	logger.Log("startup", fmt.Sprintf("Starting auth server version %s", Version))
 
+	if *flagAuditVerify {
+		db, err := createConnection(getSqlitePath())
+		if err != nil {
+			logger.Log("main", fmt.Errorf("database connection error: %v", err))
+			os.Exit(1)
+		}
+		err = runAuditVerification(logger, db)
+		db.Close()
+		if err != nil {
+			logger.Log("main", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Listen for application termination.
+	errs := make(chan error)
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		logger.Log("exit", fmt.Sprintf("caught signal: %v", <-c))
-		os.Exit(0)
+		errs <- fmt.Errorf("caught signal: %v", <-c)
 	}()
 
 	adminServer := admin.NewServer(*adminAddr)
@@ -133,6 +217,34 @@ func main() {
 		logger.Log("main", fmt.Sprintf("Failed to setup OAuth2 token store: %v", err))
 		os.Exit(1)
 	}
+	if err := readClientConfig(); err != nil {
+		logger.Log("main", err)
+		os.Exit(1)
+	}
+	if err := readCacheConfig(); err != nil {
+		logger.Log("main", err)
+		os.Exit(1)
+	}
+	cacheInvalidations, err := setupCacheInvalidator(logger, os.Getenv("SESSIONS_DSN"), os.Getenv("OAUTH2_TOKENS_DSN"))
+	if err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to setup cache invalidations: %v", err))
+		os.Exit(1)
+	}
+	authCacheInvalidations = cacheInvalidations
+	cacheInvalidations.start()
+	defer cacheInvalidations.shutdown()
+	if err := readDeletionConfig(); err != nil {
+		logger.Log("main", err)
+		os.Exit(1)
+	}
+	if err := readUserStatusConfig(); err != nil {
+		logger.Log("main", err)
+		os.Exit(1)
+	}
+	if err := readAuditConfig(); err != nil {
+		logger.Log("main", err)
+		os.Exit(1)
+	}
 	oauth, err := setupOAuthServer(logger, clientStore, tokenStore)
 	if err != nil {
 		logger.Log("main", fmt.Sprintf("Failed to setup OAuth2 service: %v", err))
@@ -146,25 +258,180 @@ func main() {
 	}()
 
 	// user services
+	sessions, err := setupSessionStore(os.Getenv("SESSIONS_DSN"))
+	if err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to setup session store: %v", err))
+		os.Exit(1)
+	}
+	if c, ok := sessions.(io.Closer); ok {
+		defer c.Close()
+	}
 	authService := &auth{
+		db:       db,
+		log:      logger,
+		sessions: sessions,
+		cache:    newTTLCache("sessions"),
+	}
+	userService := &sqliteUserRepository{
+		db:    db,
+		log:   logger,
+		cache: newTTLCache("users"),
+	}
+
+	orgRepo := &sqliteOrganizationRepository{
 		db:  db,
 		log: logger,
 	}
-	userService := &sqliteUserRepository{
+	oauth.orgs = orgRepo
+	oauth.users = userService
+
+	auditEvents := &sqliteAuditLog{
 		db:  db,
 		log: logger,
 	}
+	oauth.audit = auditEvents
+
+	auditCheckpoints, err := setupAuditCheckpointer(logger, auditEvents)
+	if err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to setup audit checkpoints: %v", err))
+		os.Exit(1)
+	}
+	auditCheckpoints.start()
+	defer auditCheckpoints.shutdown()
+
+	roleRepo := &sqliteRoleRepository{
+		db:    db,
+		log:   logger,
+		cache: newTTLCache("roles"),
+	}
+	orgRepo.roleCache = roleRepo.cache
+	if err := bootstrapAdmins(logger, roleRepo); err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to assign admin roles: %v", err))
+		os.Exit(1)
+	}
+
+	personalTokens := &sqlitePersonalTokenRepository{
+		db:  db,
+		log: logger,
+	}
+
+	notifier, err := setupNotifier(logger, db)
+	if err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to setup notifier: %v", err))
+		os.Exit(1)
+	}
+	notifier.start()
+	defer notifier.shutdown()
+
+	webhooks, err := setupWebhookDispatcher(logger, db)
+	if err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to setup webhooks: %v", err))
+		os.Exit(1)
+	}
+	webhooks.start()
+	defer webhooks.shutdown()
+
+	// identity events are written to the outbox with each user change, then relayed to the sinks
+	outbox, err := setupOutboxRelay(logger, db, webhooks)
+	if err != nil {
+		logger.Log("main", fmt.Sprintf("Failed to setup outbox relay: %v", err))
+		os.Exit(1)
+	}
+	outbox.start()
+	defer outbox.shutdown()
+
+	userDeletions := &userDeleter{
+		db:     db,
+		logger: logger,
+		auth:   authService,
+		users:  userService,
+		oauth:  oauth,
+
+		userCache: userService.cache,
+		roleCache: roleRepo.cache,
+	}
+
+	// users are alerted to logins from new devices or locations
+	loginAlerts := &loginAlerter{
+		db:       db,
+		logger:   logger,
+		auth:     authService,
+		notifier: notifier,
+		audit:    auditEvents,
+		oauth:    oauth,
+		tokens:   personalTokens,
+	}
+
+	// purge expired and deleted rows in the background
+	janitor, err := newJanitor(logger)
+	if err != nil {
+		logger.Log("main", err)
+		os.Exit(1)
+	}
+	if purger, ok := tokenStore.(expiredTokenPurger); ok {
+		janitor.add("oauth2_tokens", purger.PurgeExpired)
+	}
+	janitor.add("oauth2_clients", clientStore.PurgeDeleted)
+	janitor.add("personal_access_tokens", personalTokens.purgeInactive)
+	if sessions == nil {
+		janitor.add("user_cookies", authService.purgeExpiredCookies)
+	}
+	janitor.add("notifications", notifier.purgeFinished)
+	janitor.add("webhook_deliveries", webhooks.purgeDelivered)
+	janitor.add("outbox", outbox.purgePublished)
+	janitor.add("user_login_alerts", loginAlerts.purgeExpired)
+	janitor.add("user_deletions", func(_ time.Time, limit int) (int64, error) {
+		// users are purged once their grace period ends, not after the janitor's retention
+		return userDeletions.purgeDue(time.Now(), limit)
+	})
+	janitor.start()
+	defer janitor.shutdown()
 
 	// api routes
 	router := mux.NewRouter()
 	moovhttp.AddCORSHandler(router)
 	addPingRoute(router)
-	addAuthRoutes(router, logger, authService, oauth, userService)
+	addAuthRoutes(router, logger, authService, oauth, userService, roleRepo, personalTokens)
 	addOAuthRoutes(router, oauth, logger, authService)
-	addLoginRoutes(router, logger, authService, userService)
-	addLogoutRoutes(router, logger, authService)
-	addSignupRoutes(router, logger, authService, userService)
+	addLoginRoutes(router, logger, authService, userService, auditEvents, loginAlerts)
+	addLoginAlertRoutes(router, logger, loginAlerts, userService)
+	addLogoutRoutes(router, logger, authService, auditEvents)
+	addSignupRoutes(router, logger, authService, userService, auditEvents)
 	addUserProfileRoutes(router, logger, authService, userService)
+	addOrganizationRoutes(router, logger, authService, userService, orgRepo, oauth)
+	addRoleRoutes(router, logger, authService, orgRepo, roleRepo)
+	addPersonalTokenRoutes(router, logger, authService, personalTokens, auditEvents)
+	addPasswordResetRoutes(router, logger, authService, oauth, personalTokens, auditEvents)
+	addUserDeletionRoutes(router, logger, authService, userDeletions)
+	addEmailChangeRoutes(router, logger, authService, userService, notifier)
+	addPhoneVerificationRoutes(router, logger, authService, userService, setupSMSSender(logger, os.Getenv("SMS_FILE_PATH")))
+	addAuditRoutes(router, logger, authService, auditEvents)
+	addUserExportRoutes(router, logger, authService, &userExporter{
+		auth:      authService,
+		users:     userService,
+		tokens:    personalTokens,
+		oauth:     oauth,
+		orgs:      orgRepo,
+		roles:     roleRepo,
+		deletions: userDeletions,
+		alerts:    loginAlerts,
+		audit:     auditEvents,
+	})
+
+	// user administration, on the admin server
+	usersAdmin := &userAdmin{
+		logger:    logger,
+		auth:      authService,
+		users:     userService,
+		roles:     roleRepo,
+		tokens:    personalTokens,
+		oauth:     oauth,
+		deletions: userDeletions,
+		notifier:  notifier,
+		audit:     auditEvents,
+		webhooks:  webhooks,
+	}
+	usersAdmin.register(adminServer.AddHandler)
 
 	serve := &http.Server{
 		Addr:    *httpAddr,
@@ -187,20 +454,23 @@ func main() {
 	}
 	defer shutdownServer()
 
-	// Block on HTTP server bind
-	if serveViaTLS {
-		logger.Log("transport", "HTTPS", "addr", *httpAddr)
-		if err := serve.ListenAndServeTLS(tlsCertificate, tlsPrivateKey); err != nil {
-			logger.Log("main", fmt.Errorf("ListenAndServeTLS: %v", err))
-			os.Exit(1)
-		}
-	} else {
-		logger.Log("transport", "HTTP", "addr", *httpAddr)
-		if err := serve.ListenAndServe(); err != nil {
-			logger.Log("main", fmt.Errorf("ListenAndServe: %v", err))
-			os.Exit(1)
+	// Start HTTP server
+	go func() {
+		if serveViaTLS {
+			logger.Log("transport", "HTTPS", "addr", *httpAddr)
+			if err := serve.ListenAndServeTLS(tlsCertificate, tlsPrivateKey); err != nil {
+				errs <- fmt.Errorf("ListenAndServeTLS: %v", err)
+			}
+		} else {
+			logger.Log("transport", "HTTP", "addr", *httpAddr)
+			if err := serve.ListenAndServe(); err != nil {
+				errs <- fmt.Errorf("ListenAndServe: %v", err)
+			}
 		}
-	}
+	}()
 
-	os.Exit(1)
+	// Block until shutdown, deferred calls stop the server, janitor and databases
+	if err := <-errs; err != nil {
+		logger.Log("exit", err)
+	}
 }
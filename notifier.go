@@ -0,0 +1,336 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Notifier sends a message rendered from a template to a user.
+type Notifier interface {
+	// Notify renders the named template with data and queues the message for delivery to the address.
+	Notify(to, template string, data interface{}) error
+}
+
+// notification is a rendered message waiting in (or delivered from) the notifications queue.
+type notification struct {
+	ID        string    `json:"id"`
+	To        string    `json:"to"`
+	Template  string    `json:"template"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	Attempts  int       `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// notificationTransport delivers a notification, returning an error to have it retried.
+type notificationTransport interface {
+	send(n *notification) error
+}
+
+var (
+	// notificationMaxAttempts is how many times a notification is tried before it's marked failed
+	notificationMaxAttempts = 8
+
+	errUnknownTemplate = errors.New("unknown notification template")
+)
+
+// notificationBackoff returns how long to wait before the next delivery of a notification which
+// failed attempts times. The wait doubles from 30s up to an hour.
+func notificationBackoff(attempts int) time.Duration {
+	wait := 30 * time.Second
+	for i := 1; i < attempts && wait < time.Hour; i++ {
+		wait *= 2
+	}
+	if wait > time.Hour {
+		wait = time.Hour
+	}
+	return wait
+}
+
+// notificationTemplate is the text/template source of a message's subject and body.
+type notificationTemplate struct {
+	subject, body string
+}
+
+// defaultNotificationTemplates are used unless overridden by files in NOTIFIER_TEMPLATES_DIR
+// named after the template, i.e. password_reset.subject.tmpl and password_reset.body.tmpl
+var defaultNotificationTemplates = map[string]notificationTemplate{
+	"email_change_confirm": {
+		subject: "Confirm your new email address",
+		body:    "Confirm your new email address by visiting {{.Link}} before {{.ExpiresAt}}.",
+	},
+	"email_changed": {
+		subject: "Your email address was changed",
+		body:    "The email address of your account was changed to {{.NewEmail}}. If you didn't make this change contact support immediately.",
+	},
+	"new_login": {
+		subject: "New sign-in to your account",
+		body:    "Your account was signed in to from a new {{.Reason}} at {{.Time}}: {{.Device}} from {{.IPAddress}}. If this wasn't you, visit {{.Link}} before {{.ExpiresAt}} to sign out everywhere and reset your password.",
+	},
+	"password_reset": {
+		subject: "Reset your password",
+		body:    "Use the code {{.Code}} to set a new password before {{.ExpiresAt}}.",
+	},
+}
+
+type parsedTemplate struct {
+	subject, body *template.Template
+}
+
+// parseNotificationTemplates parses the default templates, replacing the subject or body of
+// any which have a file in dir.
+func parseNotificationTemplates(dir string) (map[string]*parsedTemplate, error) {
+	out := make(map[string]*parsedTemplate)
+	for name, tmpl := range defaultNotificationTemplates {
+		subject, body := tmpl.subject, tmpl.body
+		if dir != "" {
+			if bs, err := ioutil.ReadFile(filepath.Join(dir, name+".subject.tmpl")); err == nil {
+				subject = strings.TrimSpace(string(bs))
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+			if bs, err := ioutil.ReadFile(filepath.Join(dir, name+".body.tmpl")); err == nil {
+				body = string(bs)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		p := &parsedTemplate{}
+		var err error
+		if p.subject, err = template.New(name + ".subject").Option("missingkey=error").Parse(subject); err != nil {
+			return nil, fmt.Errorf("problem parsing %s subject template: %v", name, err)
+		}
+		if p.body, err = template.New(name + ".body").Option("missingkey=error").Parse(body); err != nil {
+			return nil, fmt.Errorf("problem parsing %s body template: %v", name, err)
+		}
+		out[name] = p
+	}
+	return out, nil
+}
+
+// queuedNotifier renders notifications into the notifications table, from which they're
+// delivered in the background and retried with backoff until notificationMaxAttempts.
+type queuedNotifier struct {
+	db        *sql.DB
+	logger    log.Logger
+	transport notificationTransport
+	templates map[string]*parsedTemplate
+
+	interval  time.Duration
+	batchSize int
+
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// setupNotifier reads the notifier's config from NOTIFIER_* environment variables.
+func setupNotifier(logger log.Logger, db *sql.DB) (*queuedNotifier, error) {
+	transport, err := setupNotificationTransport(logger, os.Getenv("NOTIFIER_TRANSPORT"))
+	if err != nil {
+		return nil, err
+	}
+	templates, err := parseNotificationTemplates(os.Getenv("NOTIFIER_TEMPLATES_DIR"))
+	if err != nil {
+		return nil, err
+	}
+	n := newQueuedNotifier(logger, db, transport, templates)
+	if v := os.Getenv("NOTIFIER_INTERVAL"); v != "" {
+		dur, err := time.ParseDuration(v)
+		if err != nil || dur <= 0 {
+			return nil, fmt.Errorf("invalid NOTIFIER_INTERVAL=%q", v)
+		}
+		n.interval = dur
+	}
+	if v := os.Getenv("NOTIFIER_MAX_ATTEMPTS"); v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts < 1 {
+			return nil, fmt.Errorf("invalid NOTIFIER_MAX_ATTEMPTS=%q", v)
+		}
+		notificationMaxAttempts = attempts
+	}
+	return n, nil
+}
+
+func newQueuedNotifier(logger log.Logger, db *sql.DB, transport notificationTransport, templates map[string]*parsedTemplate) *queuedNotifier {
+	return &queuedNotifier{
+		db:        db,
+		logger:    logger,
+		transport: transport,
+		templates: templates,
+		interval:  10 * time.Second,
+		batchSize: 100,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (n *queuedNotifier) Notify(to, name string, data interface{}) error {
+	tmpl, ok := n.templates[name]
+	if !ok {
+		return fmt.Errorf("%v: %s", errUnknownTemplate, name)
+	}
+	var subject, body bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return fmt.Errorf("problem rendering %s subject: %v", name, err)
+	}
+	if err := tmpl.body.Execute(&body, data); err != nil {
+		return fmt.Errorf("problem rendering %s body: %v", name, err)
+	}
+
+	id := generateID()
+	if id == "" {
+		return errors.New("problem generating notification id")
+	}
+	now := time.Now().Format(serializedTimestampFormat)
+	query := `insert into notifications (notification_id, recipient, template, subject, body, attempts, next_attempt_at, created_at) values (?, ?, ?, ?, ?, 0, ?, ?)`
+	if _, err := n.db.Exec(query, id, to, name, subject.String(), body.String(), now, now); err != nil {
+		return fmt.Errorf("problem queueing %s notification: %v", name, err)
+	}
+	return nil
+}
+
+// deliver sends up to limit notifications which are due at now, returning how many were sent.
+func (n *queuedNotifier) deliver(now time.Time, limit int) (int64, error) {
+	query := `select notification_id, recipient, template, subject, body, attempts, created_at from notifications
+where sent_at is null and failed_at is null and next_attempt_at <= ?
+order by next_attempt_at asc limit ?`
+	rows, err := n.db.Query(query, now.Format(serializedTimestampFormat), limit)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var pending []*notification
+	for rows.Next() {
+		var createdAt string
+		msg := &notification{}
+		if err := rows.Scan(&msg.ID, &msg.To, &msg.Template, &msg.Subject, &msg.Body, &msg.Attempts, &createdAt); err != nil {
+			return 0, err
+		}
+		msg.CreatedAt = parseTimestamp(createdAt)
+		pending = append(pending, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	var sent int64
+	for _, msg := range pending {
+		msg.Attempts++
+		if err := n.transport.send(msg); err != nil {
+			if err := n.failed(msg, now, err); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		// the body isn't needed once it's sent and can hold codes which act on the account
+		query := `update notifications set attempts = ?, sent_at = ?, last_error = null, body = '' where notification_id = ?`
+		if _, err := n.db.Exec(query, msg.Attempts, time.Now().Format(serializedTimestampFormat), msg.ID); err != nil {
+			return sent, fmt.Errorf("problem marking notification %s sent: %v", msg.ID, err)
+		}
+		notificationsSent.With("template", msg.Template).Add(1)
+		sent++
+	}
+	return sent, nil
+}
+
+// failed records a delivery error, scheduling a retry or giving up after notificationMaxAttempts.
+func (n *queuedNotifier) failed(msg *notification, now time.Time, sendErr error) error {
+	notificationErrors.With("template", msg.Template).Add(1)
+
+	var err error
+	if msg.Attempts >= notificationMaxAttempts {
+		n.logger.Log("notifier", fmt.Sprintf("giving up on notification %s after %d attempts: %v", msg.ID, msg.Attempts, sendErr))
+		query := `update notifications set attempts = ?, last_error = ?, failed_at = ?, body = '' where notification_id = ?`
+		_, err = n.db.Exec(query, msg.Attempts, sendErr.Error(), now.Format(serializedTimestampFormat), msg.ID)
+	} else {
+		next := now.Add(notificationBackoff(msg.Attempts))
+		n.logger.Log("notifier", fmt.Sprintf("problem sending notification %s (attempt %d), retrying at %v: %v", msg.ID, msg.Attempts, next, sendErr))
+		query := `update notifications set attempts = ?, last_error = ?, next_attempt_at = ? where notification_id = ?`
+		_, err = n.db.Exec(query, msg.Attempts, sendErr.Error(), next.Format(serializedTimestampFormat), msg.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("problem recording failed notification %s: %v", msg.ID, err)
+	}
+	return nil
+}
+
+// purgeFinished removes up to limit notifications which were sent or gave up before the given time.
+func (n *queuedNotifier) purgeFinished(before time.Time, limit int) (int64, error) {
+	query := `delete from notifications where notification_id in (select notification_id from notifications
+where (sent_at is not null and sent_at < ?) or (failed_at is not null and failed_at < ?) limit ?)`
+	ts := before.Format(serializedTimestampFormat)
+	res, err := n.db.Exec(query, ts, ts, limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// start delivers due notifications every interval until shutdown is called.
+func (n *queuedNotifier) start() {
+	n.started = true
+	n.logger.Log("notifier", fmt.Sprintf("delivering notifications every %v", n.interval))
+	go func() {
+		defer close(n.done)
+
+		ticker := time.NewTicker(n.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for {
+					sent, err := n.deliver(time.Now(), n.batchSize)
+					if err != nil {
+						n.logger.Log("notifier", fmt.Sprintf("problem delivering notifications: %v", err))
+						break
+					}
+					if sent < int64(n.batchSize) || n.stopping() {
+						break
+					}
+				}
+			case <-n.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (n *queuedNotifier) stopping() bool {
+	select {
+	case <-n.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops delivering notifications and waits for an in-progress batch to finish.
+func (n *queuedNotifier) shutdown() {
+	if n == nil || !n.started {
+		return
+	}
+	select {
+	case <-n.stop:
+	default:
+		close(n.stop)
+	}
+	<-n.done
+}
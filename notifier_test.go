@@ -0,0 +1,273 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+type sentNotification struct {
+	to, template string
+	data         map[string]interface{}
+}
+
+// mockNotifier records each notification after checking it renders with the default templates
+type mockNotifier struct {
+	sent []sentNotification
+}
+
+func (n *mockNotifier) Notify(to, template string, data interface{}) error {
+	templates, err := parseNotificationTemplates("")
+	if err != nil {
+		return err
+	}
+	tmpl, ok := templates[template]
+	if !ok {
+		return errUnknownTemplate
+	}
+	if err := tmpl.body.Execute(ioutil.Discard, data); err != nil {
+		return err
+	}
+	m, _ := data.(map[string]interface{})
+	n.sent = append(n.sent, sentNotification{to: to, template: template, data: m})
+	return nil
+}
+
+// recordingTransport keeps each notification sent, failing while err is set
+type recordingTransport struct {
+	sent []*notification
+	err  error
+}
+
+func (t *recordingTransport) send(n *notification) error {
+	if t.err != nil {
+		return t.err
+	}
+	t.sent = append(t.sent, n)
+	return nil
+}
+
+func TestNotifier__notificationBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		7:  32 * time.Minute,
+		8:  time.Hour,
+		50: time.Hour,
+	}
+	for attempts, expected := range cases {
+		if got := notificationBackoff(attempts); got != expected {
+			t.Errorf("attempts=%d: got %v, expected %v", attempts, got, expected)
+		}
+	}
+}
+
+func TestNotifier__templates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifier-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "password_reset.subject.tmpl"), []byte("Your code\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "password_reset.body.tmpl"), []byte("Code: {{.Code}}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := parseNotificationTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	transport := &recordingTransport{}
+	notifier := newQueuedNotifier(log.NewNopLogger(), repo.db, transport, templates)
+	if err := notifier.Notify("jane@moov.io", "password_reset", map[string]interface{}{"Code": "1234", "ExpiresAt": "tomorrow"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify("jane@moov.io", "email_changed", map[string]interface{}{"NewEmail": "new@moov.io"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := notifier.deliver(time.Now(), 10); err != nil || n != 2 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	for _, n := range transport.sent {
+		switch n.Template {
+		case "password_reset":
+			if n.Subject != "Your code" || n.Body != "Code: 1234" {
+				t.Errorf("expected overridden template: %#v", n)
+			}
+		case "email_changed":
+			if !strings.Contains(n.Body, "new@moov.io") {
+				t.Errorf("expected default template: %#v", n)
+			}
+		}
+	}
+
+	// templates fail to render instead of sending messages with missing values
+	if err := notifier.Notify("jane@moov.io", "password_reset", map[string]interface{}{}); err == nil {
+		t.Error("expected error")
+	}
+	if err := notifier.Notify("jane@moov.io", "missing", nil); err == nil {
+		t.Error("expected error")
+	}
+
+	// broken overrides are rejected on startup
+	if err := ioutil.WriteFile(filepath.Join(dir, "email_changed.body.tmpl"), []byte("{{.NewEmail"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseNotificationTemplates(dir); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestNotifier__retries(t *testing.T) {
+	defer func(n int) { notificationMaxAttempts = n }(notificationMaxAttempts)
+	notificationMaxAttempts = 3
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	templates, err := parseNotificationTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &recordingTransport{err: errors.New("connection refused")}
+	notifier := newQueuedNotifier(log.NewNopLogger(), repo.db, transport, templates)
+	for _, to := range []string{"first@moov.io", "second@moov.io"} {
+		if err := notifier.Notify(to, "email_changed", map[string]interface{}{"NewEmail": "new@moov.io"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// failures are retried after a backoff
+	now := time.Now()
+	if n, err := notifier.deliver(now, 10); err != nil || n != 0 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	var attempts int
+	var lastError, nextAttempt string
+	if err := repo.db.QueryRow(`select attempts, last_error, next_attempt_at from notifications limit 1`).Scan(&attempts, &lastError, &nextAttempt); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 || lastError != "connection refused" || !parseTimestamp(nextAttempt).After(now.Add(notificationBackoff(1)-time.Second)) {
+		t.Errorf("attempts=%d lastError=%q nextAttempt=%s", attempts, lastError, nextAttempt)
+	}
+	if n, err := notifier.deliver(now, 10); err != nil || n != 0 {
+		t.Fatalf("expected nothing due, n=%d err=%v", n, err)
+	}
+
+	// the transport recovers, but only one notification is delivered per batch
+	transport.err = nil
+	now = now.Add(notificationBackoff(1))
+	if n, err := notifier.deliver(now, 1); err != nil || n != 1 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+
+	// the other gives up after notificationMaxAttempts
+	transport.err = errors.New("mailbox unavailable")
+	for i := 0; i < notificationMaxAttempts; i++ {
+		now = now.Add(time.Hour)
+		if _, err := notifier.deliver(now, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sent, failed int
+	if err := repo.db.QueryRow(`select count(sent_at), count(failed_at) from notifications`).Scan(&sent, &failed); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || failed != 1 {
+		t.Errorf("sent=%d failed=%d", sent, failed)
+	}
+	transport.err = nil
+	if n, err := notifier.deliver(now.Add(time.Hour), 10); err != nil || n != 0 {
+		t.Errorf("expected failed notification to be left, n=%d err=%v", n, err)
+	}
+
+	// finished notifications are purged
+	if n, err := notifier.purgeFinished(time.Now().Add(-time.Hour), 10); err != nil || n != 0 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+	if n, err := notifier.purgeFinished(now.Add(time.Hour), 10); err != nil || n != 2 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+}
+
+func TestNotifier__setupNotifier(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	n, err := setupNotifier(log.NewNopLogger(), repo.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.transport.(*logTransport); !ok {
+		t.Errorf("unexpected transport %T", n.transport)
+	}
+	n.start()
+	n.shutdown()
+
+	for k, v := range map[string]string{"NOTIFIER_INTERVAL": "0s", "NOTIFIER_MAX_ATTEMPTS": "zero", "NOTIFIER_TRANSPORT": "pigeon"} {
+		os.Setenv(k, v)
+		if _, err := setupNotifier(log.NewNopLogger(), repo.db); err == nil {
+			t.Errorf("%s=%s: expected error", k, v)
+		}
+		os.Unsetenv(k)
+	}
+}
+
+func TestNotifier__deliverLoop(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	templates, err := parseNotificationTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &recordingTransport{}
+	notifier := newQueuedNotifier(log.NewNopLogger(), repo.db, transport, templates)
+	notifier.interval = 10 * time.Millisecond
+	if err := notifier.Notify("jane@moov.io", "password_reset", map[string]interface{}{"Code": "1234", "ExpiresAt": "tomorrow"}); err != nil {
+		t.Fatal(err)
+	}
+	notifier.start()
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		var sent int
+		if err := repo.db.QueryRow(`select count(sent_at) from notifications`).Scan(&sent); err != nil {
+			t.Fatal(err)
+		}
+		if sent == 1 {
+			break
+		}
+	}
+	notifier.shutdown()
+	if len(transport.sent) != 1 {
+		t.Errorf("got %d notifications", len(transport.sent))
+	}
+}
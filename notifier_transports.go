@@ -0,0 +1,175 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// setupNotificationTransport returns the transport named by NOTIFIER_TRANSPORT (log, file, smtp
+// or webhook) configured from the transport's own environment variables. Empty means log.
+func setupNotificationTransport(logger log.Logger, name string) (notificationTransport, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "log":
+		return &logTransport{logger: logger}, nil
+
+	case "file":
+		path := os.Getenv("NOTIFIER_FILE_PATH")
+		if path == "" {
+			return nil, errors.New("NOTIFIER_FILE_PATH is required for the file notifier")
+		}
+		return &fileTransport{path: path}, nil
+
+	case "smtp":
+		t := &smtpTransport{
+			addr:     os.Getenv("NOTIFIER_SMTP_ADDR"),
+			username: os.Getenv("NOTIFIER_SMTP_USERNAME"),
+			password: os.Getenv("NOTIFIER_SMTP_PASSWORD"),
+			from:     os.Getenv("NOTIFIER_SMTP_FROM"),
+		}
+		if t.addr == "" || t.from == "" {
+			return nil, errors.New("NOTIFIER_SMTP_ADDR and NOTIFIER_SMTP_FROM are required for the smtp notifier")
+		}
+		if _, _, err := net.SplitHostPort(t.addr); err != nil {
+			return nil, fmt.Errorf("invalid NOTIFIER_SMTP_ADDR=%q: %v", t.addr, err)
+		}
+		return t, nil
+
+	case "webhook":
+		url := os.Getenv("NOTIFIER_WEBHOOK_URL")
+		if url == "" {
+			return nil, errors.New("NOTIFIER_WEBHOOK_URL is required for the webhook notifier")
+		}
+		return newWebhookTransport(url), nil
+	}
+	return nil, fmt.Errorf("unknown NOTIFIER_TRANSPORT=%q", name)
+}
+
+// logTransport writes notifications to the logger instead of delivering them. Bodies hold
+// codes and links which act on the recipient's account, so they're never logged. Use the
+// file transport to read messages in local development.
+type logTransport struct {
+	logger log.Logger
+}
+
+func (t *logTransport) send(n *notification) error {
+	if t.logger != nil {
+		t.logger.Log("notifier", fmt.Sprintf("to=%s template=%s subject=%q body=<redacted %d bytes>", n.To, n.Template, n.Subject, len(n.Body)))
+	}
+	return nil
+}
+
+// fileTransport appends each notification to a file as a line of JSON, which lets
+// local development and tests read the messages back.
+type fileTransport struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (t *fileTransport) send(n *notification) error {
+	bs, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fd, err := os.OpenFile(t.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("problem opening notifications file: %v", err)
+	}
+	if _, err := fd.Write(append(bs, '\n')); err != nil {
+		fd.Close()
+		return fmt.Errorf("problem writing notifications file: %v", err)
+	}
+	return fd.Close()
+}
+
+// smtpTransport emails notifications as plain text through an SMTP server, using STARTTLS when
+// the server offers it. PLAIN auth is used when a username is set.
+type smtpTransport struct {
+	addr               string
+	username, password string
+	from               string
+}
+
+// stripHeader removes line breaks so values can't inject email headers
+var stripHeader = strings.NewReplacer("\r", "", "\n", "")
+
+func (t *smtpTransport) message(n *notification) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", stripHeader.Replace(t.from))
+	fmt.Fprintf(&buf, "To: %s\r\n", stripHeader.Replace(n.To))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", stripHeader.Replace(n.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", n.CreatedAt.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-Id: <%s@%s>\r\n", n.ID, Domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(n.Body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+func (t *smtpTransport) send(n *notification) error {
+	var auth smtp.Auth
+	if t.username != "" {
+		host, _, _ := net.SplitHostPort(t.addr)
+		auth = smtp.PlainAuth("", t.username, t.password, host)
+	}
+	return smtp.SendMail(t.addr, auth, t.from, []string{n.To}, t.message(n))
+}
+
+// webhookTransport POSTs each notification as JSON, any non-2xx response is retried.
+type webhookTransport struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookTransport(url string) *webhookTransport {
+	return &webhookTransport{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (t *webhookTransport) send(n *notification) error {
+	bs, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Notification-Id", n.ID)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxReadBytes))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notification webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func testNotification() *notification {
+	return &notification{
+		ID:        generateID(),
+		To:        "jane@moov.io",
+		Template:  "email_changed",
+		Subject:   "Your email address was changed",
+		Body:      "first line\nsecond line",
+		CreatedAt: time.Now(),
+	}
+}
+
+func TestNotificationTransports__setup(t *testing.T) {
+	if tr, err := setupNotificationTransport(log.NewNopLogger(), ""); err != nil {
+		t.Error(err)
+	} else if _, ok := tr.(*logTransport); !ok {
+		t.Errorf("unexpected transport %T", tr)
+	}
+
+	// each transport requires its config
+	for _, name := range []string{"file", "smtp", "webhook", "carrier-pigeon"} {
+		if _, err := setupNotificationTransport(log.NewNopLogger(), name); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	os.Setenv("NOTIFIER_SMTP_ADDR", "localhost")
+	os.Setenv("NOTIFIER_SMTP_FROM", "noreply@moov.io")
+	defer os.Unsetenv("NOTIFIER_SMTP_ADDR")
+	defer os.Unsetenv("NOTIFIER_SMTP_FROM")
+	if _, err := setupNotificationTransport(log.NewNopLogger(), "smtp"); err == nil {
+		t.Error("expected error for address without a port")
+	}
+	os.Setenv("NOTIFIER_SMTP_ADDR", "localhost:25")
+	if tr, err := setupNotificationTransport(log.NewNopLogger(), "SMTP"); err != nil {
+		t.Error(err)
+	} else if _, ok := tr.(*smtpTransport); !ok {
+		t.Errorf("unexpected transport %T", tr)
+	}
+}
+
+func TestNotificationTransports__file(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notifications.jsonl")
+	os.Setenv("NOTIFIER_FILE_PATH", path)
+	defer os.Unsetenv("NOTIFIER_FILE_PATH")
+	tr, err := setupNotificationTransport(log.NewNopLogger(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := tr.send(testNotification()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	var lines int
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		var n notification
+		if err := json.Unmarshal(scanner.Bytes(), &n); err != nil || n.To != "jane@moov.io" || n.Body == "" {
+			t.Errorf("unexpected notification=%#v err=%v", n, err)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("got %d lines", lines)
+	}
+}
+
+func TestNotificationTransports__smtpMessage(t *testing.T) {
+	tr := &smtpTransport{addr: "localhost:25", from: "noreply@moov.io"}
+	n := testNotification()
+	n.Subject = "Hello\r\nBcc: attacker@example.com"
+
+	msg := string(tr.message(n))
+	if !strings.Contains(msg, "To: jane@moov.io\r\n") || !strings.Contains(msg, "From: noreply@moov.io\r\n") {
+		t.Errorf("missing headers: %q", msg)
+	}
+	if strings.Contains(msg, "\r\nBcc:") {
+		t.Errorf("header injected: %q", msg)
+	}
+	if !strings.HasSuffix(msg, "\r\n\r\nfirst line\r\nsecond line") {
+		t.Errorf("unexpected body: %q", msg)
+	}
+}
+
+func TestNotificationTransports__webhook(t *testing.T) {
+	var received []notification
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil || r.Header.Get("X-Notification-Id") != n.ID {
+			t.Errorf("unexpected notification=%#v err=%v", n, err)
+		}
+		received = append(received, n)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	tr := newWebhookTransport(server.URL)
+	if err := tr.send(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := tr.send(testNotification()); err == nil {
+		t.Error("expected error")
+	}
+	if len(received) != 2 || received[0].Subject != "Your email address was changed" {
+		t.Errorf("unexpected notifications: %#v", received)
+	}
+}
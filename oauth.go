@@ -5,9 +5,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	stderr "errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -20,7 +22,6 @@ import (
 	"gopkg.in/oauth2.v3"
 	"gopkg.in/oauth2.v3/errors"
 	"gopkg.in/oauth2.v3/manage"
-	"gopkg.in/oauth2.v3/models"
 	"gopkg.in/oauth2.v3/server"
 )
 
@@ -34,13 +35,41 @@ type oauth struct {
 	tokenStore  oauth2.TokenStore
 	server      *server.Server
 
+	// orgs is used to check organization membership, organizations are
+	// unavailable when it's nil.
+	orgs organizationRepository
+
+	// users is used to check the status of users, tokens aren't checked when it's nil.
+	users userRepository
+
+	// audit records client and token events, nothing is recorded when it's nil.
+	audit auditLog
+
 	logger log.Logger
 }
 
+// checkUserStatus returns errUserInactive if userId exists but isn't active.
+func (o *oauth) checkUserStatus(userId string) error {
+	if o.users == nil {
+		return nil
+	}
+	u, err := o.users.lookupByUserId(userId)
+	if err != nil {
+		return err
+	}
+	if u != nil && !u.canAccess() {
+		return errUserInactive
+	}
+	return nil
+}
+
 func setupOAuthTokenStore(connStr string) (oauth2.TokenStore, error) {
 	if connStr == "" {
 		connStr = "file:oauth2_tokens.db"
 	}
+	if strings.HasPrefix(connStr, "redis://") || strings.HasPrefix(connStr, "rediss://") {
+		return oauthdb.NewRedisTokenStore(connStr)
+	}
 	return oauthdb.NewTokenStoreDB(connStr)
 }
 
@@ -56,6 +85,9 @@ func setupOAuthServer(logger log.Logger, clientStore *oauthdb.ClientStore, token
 		logger: logger,
 	}
 
+	// Bearer tokens are checked on every request, so cache them
+	tokenStore = newCachedTokenStore(tokenStore)
+
 	// Create our session manager
 	out.manager = manage.NewDefaultManager()
 	out.manager.MapTokenStorage(tokenStore)
@@ -71,13 +103,39 @@ func setupOAuthServer(logger log.Logger, clientStore *oauthdb.ClientStore, token
 	out.manager.SetAuthorizeCodeTokenCfg(cfg)
 	out.manager.SetClientTokenCfg(cfg)
 
+	// Rotate refresh tokens, each refresh_token grant issues a new refresh token and
+	// removes the previous access and refresh tokens.
+	out.manager.SetRefreshTokenCfg(&manage.RefreshingConfig{
+		AccessTokenExp:     cfg.AccessTokenExp,
+		RefreshTokenExp:    cfg.RefreshTokenExp,
+		IsGenerateRefresh:  true,
+		IsResetRefreshTime: true,
+		IsRemoveAccess:     true,
+		IsRemoveRefresh:    true,
+	})
+
 	// Setup oauth2 clients database
 	out.clientStore = clientStore
 	out.manager.MapClientStorage(out.clientStore)
 
+	// The manager only hands the client's Domain to this handler, so redirect_uri values are
+	// matched against the client's registered URIs in authorizeRequestHandler and tokenHandler.
+	out.manager.SetValidateURIHandler(func(_, redirectURI string) error {
+		if err := validateRedirectURI(redirectURI); err != nil {
+			return errors.ErrInvalidRequest
+		}
+		return nil
+	})
+
 	out.server = server.NewDefaultServer(out.manager)
 	out.server.SetAllowGetAccessRequest(true)
-	out.server.SetClientInfoHandler(server.ClientFormHandler)
+	out.server.SetAllowedResponseType(oauth2.Code) // the implicit flow leaks tokens in redirects
+	out.server.SetClientInfoHandler(out.clientInfoHandler)
+	out.server.SetClientScopeHandler(out.clientScopeHandler)
+	out.server.SetUserAuthorizationHandler(userAuthorizationHandler)
+	out.server.SetRefreshingScopeHandler(func(newScope, oldScope string) (bool, error) {
+		return scopesAllowed(parseScopes(oldScope), parseScopes(newScope)), nil
+	})
 	out.server.SetInternalErrorHandler(func(err error) (re *errors.Response) {
 		logger.Log("internal-error", err.Error())
 		return
@@ -95,9 +153,18 @@ func setupOAuthServer(logger log.Logger, clientStore *oauthdb.ClientStore, token
 
 // addOAuthRoutes includes our oauth2 routes on the provided mux.Router
 func addOAuthRoutes(r *mux.Router, o *oauth, logger log.Logger, auth authable) {
+	r.Methods("GET").Path("/oauth2/authorize").Queries("response_type", "{response_type}").HandlerFunc(o.authorizeRequestHandler(auth))
+	r.Methods("POST").Path("/oauth2/authorize").HandlerFunc(o.authorizeRequestHandler(auth))
 	r.Methods("GET").Path("/oauth2/authorize").HandlerFunc(o.authorizeHandler)
+
+	// OAuth2 client routes
 	r.Methods("GET").Path("/oauth2/clients").HandlerFunc(o.getClientsForUserId(auth))
-	r.Methods("POST").Path("/oauth2/client").HandlerFunc(o.createClientHandler(auth))
+	r.Methods("POST").Path("/oauth2/clients").HandlerFunc(o.createClientHandler(auth))
+	r.Methods("GET").Path("/oauth2/clients/{client_id}").HandlerFunc(o.getClientHandler(auth))
+	r.Methods("DELETE").Path("/oauth2/clients/{client_id}").HandlerFunc(o.deleteClientHandler(auth))
+	r.Methods("POST").Path("/oauth2/clients/{client_id}/secret").HandlerFunc(o.rotateClientSecretHandler(auth))
+	r.Methods("PUT").Path("/oauth2/clients/{client_id}/redirect_uris").HandlerFunc(o.updateRedirectURIsHandler(auth))
+	r.Methods("POST").Path("/oauth2/client").HandlerFunc(o.createLegacyClientHandler(auth))
 
 	// Check token routes
 	if o.server.Config.AllowGetAccessRequest {
@@ -121,9 +188,91 @@ func (o *oauth) requestHasValidOAuthToken(r *http.Request) (oauth2.TokenInfo, er
 		authFailures.With("method", "oauth2").Add(1)
 		return nil, errNoClientId
 	}
+	if err := o.checkUserStatus(ti.GetUserID()); err != nil {
+		authFailures.With("method", "oauth2").Add(1)
+		return nil, err
+	}
 	return ti, nil
 }
 
+// clientPasswordVerifier is implemented by OAuth2 clients which only store a hash of their secret.
+type clientPasswordVerifier interface {
+	VerifyPassword(secret string) bool
+}
+
+// clientInfoHandler reads the client credentials from r and verifies the secret with the client.
+//
+// The oauth2 manager compares client secrets with the value from ClientInfo.GetSecret, which is
+// a hash for our clients. Once the plaintext secret is verified the stored hash is handed to the
+// manager in its place.
+func (o *oauth) clientInfoHandler(r *http.Request) (string, string, error) {
+	clientID, clientSecret, err := server.ClientFormHandler(r)
+	if err != nil {
+		return "", "", err
+	}
+	cli, err := o.clientStore.GetByID(clientID)
+	if err != nil {
+		return "", "", err
+	}
+	if cli == nil {
+		return "", "", errors.ErrInvalidClient
+	}
+	if verifier, ok := cli.(clientPasswordVerifier); ok {
+		if !verifier.VerifyPassword(clientSecret) {
+			return "", "", errors.ErrInvalidClient
+		}
+		return clientID, cli.GetSecret(), nil
+	}
+	return clientID, clientSecret, nil
+}
+
+// clientScopeHandler allows a token request only when every requested scope was registered
+// on the OAuth2 client.
+func (o *oauth) clientScopeHandler(clientID, scope string) (bool, error) {
+	cli, err := o.clientStore.GetByID(clientID)
+	if err != nil {
+		return false, err
+	}
+	if cli == nil {
+		return false, errors.ErrInvalidClient
+	}
+	return scopesAllowed(clientScopes(cli), parseScopes(scope)), nil
+}
+
+// refreshTokenFamilies is implemented by token stores which link rotated refresh tokens
+// together. Presenting a refresh token which was already rotated revokes the whole family.
+type refreshTokenFamilies interface {
+	GetFamilyByRefresh(refresh string) (family string, used bool, err error)
+	ClaimRefresh(refresh string) (family string, claimed bool, err error)
+	ReleaseRefresh(refresh string) error
+	SetFamily(refresh, family string) error
+	RemoveByFamily(family string) error
+}
+
+// checkRefreshTokenReuse claims refresh for this request and returns its family. If refresh
+// was already used, including by a concurrent request, then every token in its family is
+// revoked and errors.ErrInvalidGrant is returned.
+func (o *oauth) checkRefreshTokenReuse(r *http.Request, userId, refresh string) (string, error) {
+	families, ok := o.tokenStore.(refreshTokenFamilies)
+	if !ok {
+		return "", nil
+	}
+	family, claimed, err := families.ClaimRefresh(refresh)
+	if err != nil {
+		return "", err
+	}
+	if !claimed && family != "" {
+		refreshTokenReuses.Add(1)
+		if err := families.RemoveByFamily(family); err != nil {
+			return "", fmt.Errorf("problem revoking refresh token family=%s: %v", family, err)
+		}
+		o.logger.Log("security", fmt.Sprintf("refresh token reused, revoked token family=%s for userId=%s", family, userId))
+		recordAudit(o.audit, r, auditRefreshTokenReused, userId, userId, map[string]string{"family": family})
+		return "", errors.ErrInvalidGrant
+	}
+	return family, nil
+}
+
 // authorizeHandler checks the request for appropriate oauth information
 // and returns "200 OK" if the token is valid.
 func (o *oauth) authorizeHandler(w http.ResponseWriter, r *http.Request) {
@@ -142,6 +291,117 @@ func (o *oauth) authorizeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("{}"))
 }
 
+type contextKey string
+
+// authorizedUserIdKey holds the userId of the logged in user making an OAuth2 authorization request.
+const authorizedUserIdKey contextKey = "authorized-user-id"
+
+// userAuthorizationHandler returns the logged in user set by authorizeRequestHandler. The
+// client is redirected with access_denied otherwise.
+func userAuthorizationHandler(w http.ResponseWriter, r *http.Request) (string, error) {
+	if userId, ok := r.Context().Value(authorizedUserIdKey).(string); ok && userId != "" {
+		return userId, nil
+	}
+	return "", errors.ErrAccessDenied
+}
+
+// authorizeRequestHandler handles OAuth2 authorization requests (RFC 6749 Section 4.1.1) from
+// a logged in user. GET shows the user a consent page, which POSTs back with a CSRF token tied
+// to their session. Only an approved POST redirects back to the client with a code.
+//
+// redirect_uri must exactly match one of the client's registered URIs and can only be left
+// out when a single URI is registered, in which case it can also be left out of the code
+// exchange. Otherwise the error is written in the response as the user-agent must not be
+// sent to an unverified URI.
+func (o *oauth) authorizeRequestHandler(auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.authorizeRequestHandler")
+
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, errors.ErrInvalidRequest, err.Error())
+			return
+		}
+		clientId := r.Form.Get("client_id")
+		if clientId == "" {
+			writeOAuthError(w, errors.ErrInvalidRequest, "missing client_id")
+			return
+		}
+		cli, err := o.clientStore.GetByID(clientId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if cli == nil {
+			writeOAuthError(w, errors.ErrInvalidClient, "unknown client_id")
+			return
+		}
+
+		redirectURI := r.Form.Get("redirect_uri")
+		if uris := clientRedirectURIs(cli); redirectURI == "" {
+			if len(uris) != 1 {
+				writeOAuthError(w, errors.ErrInvalidRequest, "redirect_uri is required")
+				return
+			}
+			r.Form.Set("redirect_uri", uris[0])
+		} else if !redirectURIRegistered(cli, redirectURI) {
+			redirectURIMismatches.Add(1)
+			writeOAuthError(w, errors.ErrInvalidRequest, "redirect_uri is not registered for the client")
+			return
+		}
+
+		if !o.server.CheckResponseType(oauth2.ResponseType(r.Form.Get("response_type"))) {
+			writeOAuthError(w, errors.ErrUnsupportedResponseType, "only the code response_type is supported")
+			return
+		}
+		if !scopesAllowed(clientScopes(cli), parseScopes(r.Form.Get("scope"))) {
+			writeOAuthError(w, errors.ErrInvalidScope, "scope is not allowed for the client")
+			return
+		}
+
+		if userId, err := extractUserId(auth, r); err == nil && o.checkUserStatus(userId) == nil {
+			if r.Method != "POST" {
+				writeAuthorizeConsent(w, r, cli)
+				return
+			}
+			if !validAuthorizeCSRFToken(r, clientId) {
+				writeOAuthError(w, errors.ErrAccessDenied, "invalid csrf_token")
+				return
+			}
+			if r.PostForm.Get("decision") == "approve" {
+				r = r.WithContext(context.WithValue(r.Context(), authorizedUserIdKey, userId))
+			}
+		}
+		if err := o.server.HandleAuthorizeRequest(w, r); err != nil {
+			writeOAuthError(w, err, "invalid authorization request")
+			return
+		}
+	}
+}
+
+// defaultCodeRedirectURI fills in the redirect_uri of an authorization code exchange which leaves
+// it out. Authorization requests without a redirect_uri are sent to the client's only registered
+// URI, so that URI is used when the code was issued for it.
+func (o *oauth) defaultCodeRedirectURI(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	if r.Form.Get("grant_type") != oauth2.AuthorizationCode.String() || r.Form.Get("redirect_uri") != "" || r.Form.Get("code") == "" {
+		return nil
+	}
+	ti, err := o.tokenStore.GetByCode(r.Form.Get("code"))
+	if err != nil || ti == nil {
+		return err
+	}
+	cli, err := o.clientStore.GetByID(ti.GetClientID())
+	if err != nil || cli == nil {
+		return err
+	}
+	if uris := clientRedirectURIs(cli); len(uris) == 1 && uris[0] == ti.GetRedirectURI() {
+		r.Form.Set("redirect_uri", uris[0])
+	}
+	return nil
+}
+
 // tokenHandler passes off the request down to our oauth2 library to
 // generate a token (or return an error).
 func (o *oauth) tokenHandler(auth authable) http.HandlerFunc {
@@ -153,6 +413,19 @@ func (o *oauth) tokenHandler(auth authable) http.HandlerFunc {
 			moovhttp.Problem(w, err)
 			return
 		}
+		if err := o.checkUserStatus(userId); err != nil {
+			if err == errUserInactive {
+				w.WriteHeader(http.StatusForbidden)
+			} else {
+				internalError(w, err)
+			}
+			return
+		}
+
+		if err := o.defaultCodeRedirectURI(r); err != nil {
+			internalError(w, err)
+			return
+		}
 
 		// This block is copied from o.server.HandleTokenRequest
 		// We needed to inspect what's going on a bit.
@@ -161,11 +434,55 @@ func (o *oauth) tokenHandler(auth authable) http.HandlerFunc {
 			moovhttp.Problem(w, verr)
 			return
 		}
+		if tgr.Scope == "" && (gt == oauth2.ClientCredentials || gt == oauth2.PasswordCredentials) {
+			// Issue tokens with every scope the client is allowed when none are requested
+			cli, err := o.clientStore.GetByID(tgr.ClientID)
+			if err != nil {
+				moovhttp.Problem(w, err)
+				return
+			}
+			if cli != nil {
+				tgr.Scope = strings.Join(clientScopes(cli), " ")
+			}
+		}
+		if gt == oauth2.AuthorizationCode {
+			// the code is bound to its redirect_uri, which also has to still be registered
+			cli, err := o.clientStore.GetByID(tgr.ClientID)
+			if err != nil {
+				moovhttp.Problem(w, err)
+				return
+			}
+			if cli == nil || !redirectURIRegistered(cli, tgr.RedirectURI) {
+				redirectURIMismatches.Add(1)
+				writeOAuthError(w, errors.ErrInvalidGrant, "redirect_uri is not registered for the client")
+				return
+			}
+		}
+		var family string
+		if gt == oauth2.Refreshing {
+			family, verr = o.checkRefreshTokenReuse(r, userId, tgr.Refresh)
+			if verr != nil {
+				moovhttp.Problem(w, verr)
+				return
+			}
+		}
 		ti, verr := o.server.GetAccessToken(gt, tgr)
 		if verr != nil {
+			if families, ok := o.tokenStore.(refreshTokenFamilies); ok && gt == oauth2.Refreshing {
+				// the refresh token wasn't rotated, so it can be tried again
+				if err := families.ReleaseRefresh(tgr.Refresh); err != nil {
+					o.logger.Log("oauth", fmt.Sprintf("problem releasing refresh token: %v", err))
+				}
+			}
 			moovhttp.Problem(w, verr)
 			return
 		}
+		if families, ok := o.tokenStore.(refreshTokenFamilies); ok && family != "" && ti.GetRefresh() != "" {
+			if err := families.SetFamily(ti.GetRefresh(), family); err != nil {
+				internalError(w, fmt.Errorf("unable to link rotated refresh token to family=%s: %v", family, err))
+				return
+			}
+		}
 		data := o.server.GetTokenData(ti)
 		bs, err := json.Marshal(data)
 		if err != nil {
@@ -180,14 +497,22 @@ func (o *oauth) tokenHandler(auth authable) http.HandlerFunc {
 		if ww, ok := w.(*responseWriter); ok && ww.rec.Code == http.StatusOK {
 			tokenGenerations.Add(1)
 
-			// Set userId on the token and update in our DB.
-			ti.SetUserID(userId)
-			if err := o.tokenStore.Create(ti); err != nil {
-				moovhttp.InternalError(w, fmt.Errorf("unable to update OAuth token userId (%s): %v", userId, err))
-				return
+			// Codes and refresh tokens keep the user who authorized them. Other grants have no
+			// resource owner, so the token belongs to the caller.
+			if gt != oauth2.AuthorizationCode && gt != oauth2.Refreshing {
+				// Set userId on the token and update in our DB.
+				ti.SetUserID(userId)
+				if err := o.tokenStore.Create(ti); err != nil {
+					moovhttp.InternalError(w, fmt.Errorf("unable to update OAuth token userId (%s): %v", userId, err))
+					return
+				}
 			}
+			recordAudit(o.audit, r, auditTokenIssued, userId, ti.GetUserID(), map[string]string{
+				"clientId":  tgr.ClientID,
+				"grantType": string(gt),
+			})
 
-			w.Header().Set("X-User-Id", userId) // only on non-errors
+			w.Header().Set("X-User-Id", ti.GetUserID()) // only on non-errors
 		}
 
 		// Write our response
@@ -197,116 +522,14 @@ func (o *oauth) tokenHandler(auth authable) http.HandlerFunc {
 	}
 }
 
-// createClientHandler will create an oauth client for the authenticated user.
-//
-// This method extracts the user from the cookies in r.
-func (o *oauth) createClientHandler(auth authable) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w = wrapResponseWriter(w, r, "oauth.createTokenHandler")
-
-		userId, err := auth.findUserId(extractCookie(r).Value)
-		if err != nil {
-			// user not found, return
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		// TODO(adam): don't create tokens if user hasn't gone through email verification
-
-		records, err := o.clientStore.GetByUserID(userId)
-		if err != nil && !strings.Contains(err.Error(), "not found") {
-			internalError(w, err)
-			return
-		}
-		if len(records) == 0 { // nothing found, so fake one
-			records = append(records, &models.Client{})
-		}
-
-		clients := make([]*models.Client, len(records))
-		for i := range records {
-			err = o.clientStore.DeleteByID(records[i].GetID())
-			if err != nil && !strings.Contains(err.Error(), "not found") {
-				internalError(w, err)
-				return
-			}
-
-			clients[i] = &models.Client{
-				ID:     generateID()[:12],
-				Secret: generateID(),
-				Domain: Domain,
-				UserID: userId,
-			}
-
-			// Write client into oauth clients db.
-			if err := o.clientStore.Set(clients[i].GetID(), clients[i]); err != nil {
-				internalError(w, err)
-				return
-			}
-		}
-
-		// metrics
-		clientGenerations.Add(1)
-
-		// render back new clients
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		var responseClients []*client
-		for i := range clients {
-			responseClients = append(responseClients, &client{
-				ClientID:     clients[i].ID,
-				ClientSecret: clients[i].Secret,
-				Domain:       clients[i].Domain,
-			})
-		}
-		if err := json.NewEncoder(w).Encode(responseClients); err != nil {
-			internalError(w, err)
-			return
-		}
-	}
-}
-
-type client struct {
-	ClientID     string `json:"client_id"`
-	ClientSecret string `json:"client_secret"`
-	Domain       string `json:"domain"`
-}
-
 func (o *oauth) shutdown() error {
 	if o == nil || o.clientStore == nil {
 		return nil
 	}
-	return o.clientStore.Close()
-}
-
-func (o *oauth) getClientsForUserId(auth authable) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w = wrapResponseWriter(w, r, "oauth.getClientsForUserId")
-
-		userId, err := extractUserId(auth, r)
-		if err != nil {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		clients, err := o.clientStore.GetByUserID(userId)
-		if err != nil {
-			internalError(w, err)
-			return
-		}
-
-		// render OAuth2 clients for user
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		var responseClients []*client
-		for i := range clients {
-			responseClients = append(responseClients, &client{
-				ClientID:     clients[i].GetID(),
-				ClientSecret: clients[i].GetSecret(),
-				Domain:       clients[i].GetDomain(),
-			})
-		}
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(responseClients); err != nil {
-			internalError(w, err)
-			return
+	if c, ok := o.tokenStore.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return err
 		}
 	}
+	return o.clientStore.Close()
 }
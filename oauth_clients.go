@@ -0,0 +1,659 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
+	"github.com/moov-io/base"
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+const (
+	maxClientNameLength        = 100
+	maxClientDescriptionLength = 1000
+)
+
+var (
+	// maxClientsPerUser is how many OAuth2 clients a user can have at once.
+	// Set OAUTH2_MAX_CLIENTS_PER_USER to override the default.
+	maxClientsPerUser = 25
+
+	// clientSecretGracePeriod is how long a client's previous secret is accepted after rotation.
+	// Set OAUTH2_CLIENT_SECRET_GRACE_PERIOD to override the default.
+	clientSecretGracePeriod = 24 * time.Hour
+
+	// maxClientSecretGracePeriod is the longest grace period a rotation can request.
+	maxClientSecretGracePeriod = 30 * 24 * time.Hour
+
+	errNoClientName = errors.New("missing OAuth2 client name")
+)
+
+// readClientConfig updates the OAuth2 client settings from their environment variables if set.
+func readClientConfig() error {
+	if v := os.Getenv("OAUTH2_MAX_CLIENTS_PER_USER"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid OAUTH2_MAX_CLIENTS_PER_USER=%q", v)
+		}
+		maxClientsPerUser = n
+	}
+	if v := os.Getenv("OAUTH2_CLIENT_SECRET_GRACE_PERIOD"); v != "" {
+		dur, err := time.ParseDuration(v)
+		if err != nil || dur < 0 || dur > maxClientSecretGracePeriod {
+			return fmt.Errorf("invalid OAUTH2_CLIENT_SECRET_GRACE_PERIOD=%q", v)
+		}
+		clientSecretGracePeriod = dur
+	}
+	return nil
+}
+
+type createClientRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// Scopes are the scopes tokens for the new client are allowed to have.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// RedirectURIs are the exact redirection endpoints the client can use.
+	RedirectURIs []string `json:"redirect_uris,omitempty"`
+
+	// OrganizationID creates the client for an organization the user is a member of.
+	OrganizationID string `json:"organization_id,omitempty"`
+}
+
+func (req createClientRequest) validate() error {
+	if n := utf8.RuneCountInString(req.Name); n > maxClientNameLength {
+		return fmt.Errorf("OAuth2 client name is limited to %d characters", maxClientNameLength)
+	}
+	if n := utf8.RuneCountInString(req.Description); n > maxClientDescriptionLength {
+		return fmt.Errorf("OAuth2 client description is limited to %d characters", maxClientDescriptionLength)
+	}
+	if err := validateRedirectURIs(req.RedirectURIs); err != nil {
+		return err
+	}
+	return validateScopes(req.Scopes)
+}
+
+type client struct {
+	ClientID string `json:"client_id"`
+
+	// ClientSecret is only returned when a client is created, afterwards
+	// only the masked SecretHint is available.
+	ClientSecret string `json:"client_secret,omitempty"`
+	SecretHint   string `json:"client_secret_hint,omitempty"`
+
+	Domain       string    `json:"domain"`
+	Name         string    `json:"name,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	Scopes       []string  `json:"scopes,omitempty"`
+	RedirectURIs []string  `json:"redirect_uris,omitempty"`
+	CreatedAt    base.Time `json:"created_at"`
+
+	// OrganizationID is set for clients which belong to an organization.
+	OrganizationID string `json:"organization_id,omitempty"`
+
+	// Secrets are the client secrets currently accepted, newest first.
+	Secrets []clientSecret `json:"secrets,omitempty"`
+}
+
+type clientSecret struct {
+	Hint      string     `json:"hint"`
+	CreatedAt base.Time  `json:"created_at"`
+	ExpiresAt *base.Time `json:"expires_at,omitempty"`
+}
+
+func newClientResponse(cli oauth2.ClientInfo) *client {
+	out := &client{
+		ClientID: cli.GetID(),
+		Domain:   cli.GetDomain(),
+		Scopes:   clientScopes(cli),
+
+		RedirectURIs: clientRedirectURIs(cli),
+	}
+	if c, ok := cli.(*oauthdb.Client); ok {
+		out.SecretHint = c.SecretHint
+		out.OrganizationID = c.OrganizationID
+		out.Name = c.Name
+		out.Description = c.Description
+		out.CreatedAt = base.NewTime(c.CreatedAt)
+
+		out.Secrets = append(out.Secrets, clientSecret{
+			Hint:      c.SecretHint,
+			CreatedAt: base.NewTime(c.SecretCreatedAt),
+		})
+		for i := range c.PreviousSecrets {
+			expires := base.NewTime(c.PreviousSecrets[i].ExpiresAt)
+			out.Secrets = append(out.Secrets, clientSecret{
+				Hint:      c.PreviousSecrets[i].Hint,
+				CreatedAt: base.NewTime(c.PreviousSecrets[i].CreatedAt),
+				ExpiresAt: &expires,
+			})
+		}
+	}
+	return out
+}
+
+// clientTokenRemover is implemented by token stores which can revoke every token issued to a client.
+type clientTokenRemover interface {
+	RemoveByClientID(clientID string) error
+}
+
+// userTokenRemover is implemented by token stores which can revoke every token issued to a user.
+type userTokenRemover interface {
+	RemoveByUserID(userID string) error
+}
+
+// clientUserTokenRemover is implemented by token stores which can revoke the tokens a client
+// issued to one user.
+type clientUserTokenRemover interface {
+	RemoveByClientAndUserID(clientID, userID string) error
+}
+
+// userTokenMetadata is implemented by token stores which can list the tokens of a user.
+type userTokenMetadata interface {
+	MetadataByUserID(userID string) ([]oauthdb.TokenMetadata, error)
+}
+
+// userTokenPurger is implemented by token stores which can permanently delete every token of a user.
+type userTokenPurger interface {
+	PurgeByUserID(userID string) (int64, error)
+	CountByUserID(userID string) (int64, error)
+}
+
+// revokeOrganizationTokens revokes every token the OAuth2 clients of orgId issued to userId,
+// which is done when they leave the organization.
+func (o *oauth) revokeOrganizationTokens(orgId, userId string) error {
+	remover, ok := o.tokenStore.(clientUserTokenRemover)
+	if !ok {
+		return nil
+	}
+	clients, err := o.clientStore.GetByOrganizationID(orgId)
+	if err != nil {
+		return err
+	}
+	for i := range clients {
+		if err := remover.RemoveByClientAndUserID(clients[i].GetID(), userId); err != nil {
+			return fmt.Errorf("problem revoking tokens of OAuth2 client %s: %v", clients[i].GetID(), err)
+		}
+	}
+	return nil
+}
+
+// existingClients returns the clients of an organization, or of userId when orgId is empty.
+func (o *oauth) existingClients(userId, orgId string) ([]oauth2.ClientInfo, error) {
+	if orgId != "" {
+		return o.clientStore.GetByOrganizationID(orgId)
+	}
+	return o.clientStore.GetByUserID(userId)
+}
+
+// writeNewClient saves a new OAuth2 client for userId from req and returns it with the
+// plaintext secret, which is never available again. Any problems are written to w and
+// a nil client is returned.
+func (o *oauth) writeNewClient(w http.ResponseWriter, userId string, req createClientRequest) *client {
+	req.Scopes = parseScopes(strings.Join(req.Scopes, " "))
+	req.RedirectURIs = dedupeRedirectURIs(req.RedirectURIs)
+	if err := req.validate(); err != nil {
+		moovhttp.Problem(w, err)
+		return nil
+	}
+
+	// TODO(adam): don't create tokens if user hasn't gone through email verification
+
+	if req.OrganizationID != "" {
+		member, err := isOrgMember(o.orgs, req.OrganizationID, userId)
+		if err != nil {
+			internalError(w, err)
+			return nil
+		}
+		if !member {
+			moovhttp.Problem(w, errNotOrgMember)
+			return nil
+		}
+	}
+	cli := &oauthdb.Client{
+		Client: models.Client{
+			ID:     generateID()[:12],
+			Secret: generateID(),
+			Domain: Domain,
+			UserID: userId,
+		},
+		Name:           req.Name,
+		Description:    req.Description,
+		Scopes:         req.Scopes,
+		RedirectURIs:   req.RedirectURIs,
+		OrganizationID: req.OrganizationID,
+	}
+	if err := o.clientStore.Create(cli, maxClientsPerUser); err != nil {
+		switch err {
+		case oauthdb.ErrClientLimit:
+			moovhttp.Problem(w, fmt.Errorf("OAuth2 client limit of %d reached", maxClientsPerUser))
+		case oauthdb.ErrClientNameTaken:
+			moovhttp.Problem(w, fmt.Errorf("OAuth2 client named %q already exists", req.Name))
+		default:
+			internalError(w, err)
+		}
+		return nil
+	}
+	clientGenerations.Add(1)
+
+	// read back the client for its stored metadata
+	stored, err := o.clientStore.GetByID(cli.GetID())
+	if err != nil || stored == nil {
+		internalError(w, fmt.Errorf("problem reading OAuth2 client %s after creation: %v", cli.GetID(), err))
+		return nil
+	}
+	resp := newClientResponse(stored)
+	resp.ClientSecret = cli.Secret
+	return resp
+}
+
+// createClientHandler will create a named oauth client for the authenticated user.
+//
+// This method extracts the user from the cookies in r.
+func (o *oauth) createClientHandler(auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.createClientHandler")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.Body == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bs, err := read(r.Body)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		var req createClientRequest
+		if err := json.Unmarshal(bs, &req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if req.Name = strings.TrimSpace(req.Name); req.Name == "" {
+			moovhttp.Problem(w, errNoClientName)
+			return
+		}
+
+		cli := o.writeNewClient(w, userId, req)
+		if cli == nil {
+			return
+		}
+		recordAudit(o.audit, r, auditClientCreated, userId, userId, map[string]string{"clientId": cli.ClientID})
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(cli); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+// createLegacyClientHandler creates an oauth client for the authenticated user and
+// responds with it in an array.
+//
+// Deprecated: Use POST /oauth2/clients, this route no longer removes a user's other clients.
+func (o *oauth) createLegacyClientHandler(auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.createLegacyClientHandler")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req createClientRequest
+		if r.Body != nil {
+			bs, err := read(r.Body)
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			if len(bs) > 0 {
+				if err := json.Unmarshal(bs, &req); err != nil {
+					moovhttp.Problem(w, err)
+					return
+				}
+			}
+		}
+		req.Name = strings.TrimSpace(req.Name)
+
+		cli := o.writeNewClient(w, userId, req)
+		if cli == nil {
+			return
+		}
+		recordAudit(o.audit, r, auditClientCreated, userId, userId, map[string]string{"clientId": cli.ClientID})
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode([]*client{cli}); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+func (o *oauth) getClientsForUserId(auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.getClientsForUserId")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		orgId := r.URL.Query().Get("organization_id")
+		if orgId != "" {
+			member, err := isOrgMember(o.orgs, orgId, userId)
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			if !member {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		clients, err := o.existingClients(userId, orgId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+
+		// render OAuth2 clients for user
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		responseClients := make([]*client, 0, len(clients))
+		for i := range clients {
+			responseClients = append(responseClients, newClientResponse(clients[i]))
+		}
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(responseClients); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+// getUserClient returns the OAuth2 client from the route's {client_id} if userId can read it
+// (manage is false) or change it (manage is true). nil is returned if no client is found.
+//
+// Organization clients can be read by every member of the organization and only changed by
+// its owners, whoever created them. Other clients belong to the user who created them.
+// errNotOrgOwner is returned when a member tries to change an organization client.
+func (o *oauth) getUserClient(userId string, r *http.Request, manage bool) (oauth2.ClientInfo, error) {
+	clientId := mux.Vars(r)["client_id"]
+	if clientId == "" {
+		return nil, nil
+	}
+	cli, err := o.clientStore.GetByID(clientId)
+	if err != nil || cli == nil {
+		return nil, err
+	}
+	if c, ok := cli.(*oauthdb.Client); ok && c.OrganizationID != "" {
+		if o.orgs == nil {
+			return nil, nil
+		}
+		member, err := o.orgs.getMember(c.OrganizationID, userId)
+		if err != nil || member == nil {
+			return nil, err // don't leak other organization's clients
+		}
+		if manage && member.Role != orgRoleOwner {
+			return nil, errNotOrgOwner
+		}
+		return cli, nil
+	}
+	if cli.GetUserID() == userId {
+		return cli, nil
+	}
+	return nil, nil // don't leak other user's clients
+}
+
+// writeClientError writes the response for an error from getUserClient.
+func writeClientError(w http.ResponseWriter, err error) {
+	if err == errNotOrgOwner {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	internalError(w, err)
+}
+
+func (o *oauth) getClientHandler(auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.getClientHandler")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		cli, err := o.getUserClient(userId, r, false)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if cli == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(newClientResponse(cli)); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+// deleteClientHandler removes an OAuth2 client and revokes every token issued to it.
+func (o *oauth) deleteClientHandler(auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.deleteClientHandler")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		cli, err := o.getUserClient(userId, r, true)
+		if err != nil {
+			writeClientError(w, err)
+			return
+		}
+		if cli == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := o.clientStore.DeleteByID(cli.GetID()); err != nil {
+			internalError(w, err)
+			return
+		}
+		if remover, ok := o.tokenStore.(clientTokenRemover); ok {
+			if err := remover.RemoveByClientID(cli.GetID()); err != nil {
+				internalError(w, fmt.Errorf("problem revoking tokens for OAuth2 client %s: %v", cli.GetID(), err))
+				return
+			}
+		}
+		recordAudit(o.audit, r, auditClientDeleted, userId, userId, map[string]string{"clientId": cli.GetID()})
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type rotateClientSecretRequest struct {
+	// GracePeriod is how long the current secret is still accepted, as a Go duration (e.g. "1h").
+	// The default is used when empty and "0s" revokes the current secret immediately.
+	GracePeriod string `json:"grace_period,omitempty"`
+}
+
+func (req rotateClientSecretRequest) gracePeriod() (time.Duration, error) {
+	if req.GracePeriod == "" {
+		return clientSecretGracePeriod, nil
+	}
+	dur, err := time.ParseDuration(req.GracePeriod)
+	if err != nil {
+		return 0, fmt.Errorf("invalid grace_period: %v", err)
+	}
+	if dur < 0 || dur > maxClientSecretGracePeriod {
+		return 0, fmt.Errorf("grace_period must be between 0s and %v", maxClientSecretGracePeriod)
+	}
+	return dur, nil
+}
+
+// rotateClientSecretHandler issues a new secret for an OAuth2 client. The previous secret is
+// accepted until its grace period ends so consumers can roll over without an outage.
+func (o *oauth) rotateClientSecretHandler(auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.rotateClientSecretHandler")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req rotateClientSecretRequest
+		if r.Body != nil {
+			bs, err := read(r.Body)
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			if len(bs) > 0 {
+				if err := json.Unmarshal(bs, &req); err != nil {
+					moovhttp.Problem(w, err)
+					return
+				}
+			}
+		}
+		grace, err := req.gracePeriod()
+		if err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		cli, err := o.getUserClient(userId, r, true)
+		if err != nil {
+			writeClientError(w, err)
+			return
+		}
+		if cli == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		secret := generateID()
+		if err := o.clientStore.RotateSecret(cli.GetID(), secret, grace); err != nil {
+			internalError(w, err)
+			return
+		}
+		clientSecretRotations.Add(1)
+		recordAudit(o.audit, r, auditClientSecretRotated, userId, userId, map[string]string{"clientId": cli.GetID()})
+
+		stored, err := o.clientStore.GetByID(cli.GetID())
+		if err != nil || stored == nil {
+			internalError(w, fmt.Errorf("problem reading OAuth2 client %s after secret rotation: %v", cli.GetID(), err))
+			return
+		}
+		resp := newClientResponse(stored)
+		resp.ClientSecret = secret
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+type redirectURIsRequest struct {
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// updateRedirectURIsHandler replaces the registered redirect URIs of an OAuth2 client.
+func (o *oauth) updateRedirectURIsHandler(auth authable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "oauth.updateRedirectURIsHandler")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.Body == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bs, err := read(r.Body)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		var req redirectURIsRequest
+		if err := json.Unmarshal(bs, &req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		req.RedirectURIs = dedupeRedirectURIs(req.RedirectURIs)
+		if err := validateRedirectURIs(req.RedirectURIs); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		cli, err := o.getUserClient(userId, r, true)
+		if err != nil {
+			writeClientError(w, err)
+			return
+		}
+		if cli == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := o.clientStore.SetRedirectURIs(cli.GetID(), req.RedirectURIs); err != nil {
+			internalError(w, err)
+			return
+		}
+		stored, err := o.clientStore.GetByID(cli.GetID())
+		if err != nil || stored == nil {
+			internalError(w, fmt.Errorf("problem reading OAuth2 client %s after updating redirect URIs: %v", cli.GetID(), err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(newClientResponse(stored)); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func createTestClientRouter(t *testing.T) (*mux.Router, *testOAuth, *testAuth) {
+	t.Helper()
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	addOAuthRoutes(router, o.svc, log.NewNopLogger(), auth)
+	return router, o, auth
+}
+
+func createTestClient(t *testing.T, router *mux.Router, cookie *http.Cookie, req createClientRequest) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(req); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/oauth2/clients", &body)
+	r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	w.Flush()
+	return w
+}
+
+func TestOAuthClients__create(t *testing.T) {
+	router, o, auth := createTestClientRouter(t)
+	defer o.cleanup()
+	defer auth.cleanup()
+
+	cookie, err := createCookie(generateID(), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// missing name
+	w := createTestClient(t, router, cookie, createClientRequest{})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// create two clients
+	for _, name := range []string{"billing", "reports"} {
+		w = createTestClient(t, router, cookie, createClientRequest{Name: name, Description: "integration", Scopes: []string{"read"}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body.String())
+		}
+		var c client
+		if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+			t.Fatal(err)
+		}
+		if c.ClientID == "" || c.ClientSecret == "" || c.Name != name || c.Description != "integration" {
+			t.Errorf("unexpected client: %#v", c)
+		}
+	}
+
+	// duplicate name
+	w = createTestClient(t, router, cookie, createClientRequest{Name: "Billing"})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "already exists") {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// both clients are listed
+	r := httptest.NewRequest("GET", "/oauth2/clients", nil)
+	r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	var clients []*client
+	if err := json.NewDecoder(w.Body).Decode(&clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 2 {
+		t.Errorf("got %d clients: %#v", len(clients), clients)
+	}
+}
+
+func TestOAuthClients__quota(t *testing.T) {
+	router, o, auth := createTestClientRouter(t)
+	defer o.cleanup()
+	defer auth.cleanup()
+
+	max := maxClientsPerUser
+	maxClientsPerUser = 1
+	defer func() { maxClientsPerUser = max }()
+
+	cookie, err := createCookie(generateID(), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := createTestClient(t, router, cookie, createClientRequest{Name: "first"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	w = createTestClient(t, router, cookie, createClientRequest{Name: "second"})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "limit of 1") {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOAuthClients__getAndDelete(t *testing.T) {
+	router, o, auth := createTestClientRouter(t)
+	defer o.cleanup()
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCookie, err := createCookie(generateID(), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, token := createOAuthClient(t, o, userId)
+
+	request := func(method string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, fmt.Sprintf("/oauth2/clients/%s", c.ID), nil)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	// read the client
+	w := request("GET", cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var resp client
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ClientID != c.ID {
+		t.Errorf("got client %#v", resp)
+	}
+
+	// other users can't see or delete it
+	if w := request("GET", otherCookie); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := request("DELETE", otherCookie); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// delete the client
+	if w := request("DELETE", cookie); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request("GET", cookie); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	if ti, _ := o.tokenStore.GetByAccess(token.Access); ti != nil {
+		t.Errorf("expected token to be revoked: %v", ti)
+	}
+}
+
+func TestOAuthClients__createLegacy(t *testing.T) {
+	router, o, auth := createTestClientRouter(t)
+	defer o.cleanup()
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, _ := createOAuthClient(t, o, userId)
+
+	r := httptest.NewRequest("POST", "/oauth2/client", nil)
+	r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var clients []*client
+	if err := json.NewDecoder(w.Body).Decode(&clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients[0].ClientID == existing.ID {
+		t.Errorf("unexpected clients: %#v", clients)
+	}
+
+	// the existing client is kept
+	if cli, err := o.svc.clientStore.GetByID(existing.ID); err != nil || cli == nil {
+		t.Errorf("expected existing client, got %v (err=%v)", cli, err)
+	}
+}
+
+func TestOAuthClients__secrets(t *testing.T) {
+	router, o, auth := createTestClientRouter(t)
+	defer o.cleanup()
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := createTestClient(t, router, cookie, createClientRequest{Name: "billing"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var created client
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ClientSecret == "" {
+		t.Fatal("expected client secret on creation")
+	}
+
+	// secret is masked afterwards
+	r := httptest.NewRequest("GET", fmt.Sprintf("/oauth2/clients/%s", created.ClientID), nil)
+	r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if strings.Contains(w.Body.String(), created.ClientSecret) {
+		t.Errorf("client secret returned: %s", w.Body.String())
+	}
+	var resp client
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ClientSecret != "" || !strings.HasSuffix(created.ClientSecret, strings.TrimPrefix(resp.SecretHint, "****")) {
+		t.Errorf("unexpected client: %#v", resp)
+	}
+
+	// the plaintext secret still issues tokens, but the stored hash doesn't
+	stored, _ := o.svc.clientStore.GetByID(created.ClientID)
+	for secret, status := range map[string]int{created.ClientSecret: http.StatusOK, stored.GetSecret(): http.StatusBadRequest} {
+		url := fmt.Sprintf("/oauth2/token?grant_type=client_credentials&client_id=%s&client_secret=%s", created.ClientID, secret)
+		r = httptest.NewRequest("POST", url, nil)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+
+		if w.Code != status {
+			t.Errorf("got %d (expected %d): %s", w.Code, status, w.Body.String())
+		}
+	}
+}
+
+func TestOAuthClients__rotateSecret(t *testing.T) {
+	router, o, auth := createTestClientRouter(t)
+	defer o.cleanup()
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := createTestClient(t, router, cookie, createClientRequest{Name: "billing"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var created client
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	rotate := func(clientId, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", fmt.Sprintf("/oauth2/clients/%s/secret", clientId), strings.NewReader(body))
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	issueToken := func(secret string) int {
+		url := fmt.Sprintf("/oauth2/token?grant_type=client_credentials&client_id=%s&client_secret=%s", created.ClientID, secret)
+		r := httptest.NewRequest("POST", url, nil)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w.Code
+	}
+
+	// unknown client and bad grace periods
+	if w := rotate(generateID(), ""); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	for _, body := range []string{`{"grace_period": "soon"}`, `{"grace_period": "-1h"}`, `{"grace_period": "10000h"}`} {
+		if w := rotate(created.ClientID, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", body, w.Code)
+		}
+	}
+
+	// rotate with the default grace period, both secrets work
+	w = rotate(created.ClientID, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var rotated client
+	if err := json.NewDecoder(w.Body).Decode(&rotated); err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ClientSecret == "" || rotated.ClientSecret == created.ClientSecret {
+		t.Fatalf("unexpected secret: %#v", rotated)
+	}
+	if n := len(rotated.Secrets); n != 2 {
+		t.Fatalf("got %d secrets: %#v", n, rotated.Secrets)
+	}
+	if rotated.Secrets[0].ExpiresAt != nil || rotated.Secrets[1].ExpiresAt == nil || rotated.Secrets[1].Hint != created.SecretHint {
+		t.Errorf("unexpected secrets: %#v", rotated.Secrets)
+	}
+	if exp := rotated.Secrets[1].ExpiresAt.Time; exp.Before(time.Now().Add(clientSecretGracePeriod - time.Minute)) {
+		t.Errorf("previous secret expires at %v", exp)
+	}
+	for _, secret := range []string{created.ClientSecret, rotated.ClientSecret} {
+		if code := issueToken(secret); code != http.StatusOK {
+			t.Errorf("got %d", code)
+		}
+	}
+
+	// rotate again without a grace period, only the newest secret works
+	w = rotate(created.ClientID, `{"grace_period": "0s"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var latest client
+	if err := json.NewDecoder(w.Body).Decode(&latest); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(latest.Secrets); n != 2 {
+		t.Errorf("got %d secrets: %#v", n, latest.Secrets) // newest and the original secret
+	}
+	for secret, status := range map[string]int{created.ClientSecret: http.StatusOK, rotated.ClientSecret: http.StatusBadRequest, latest.ClientSecret: http.StatusOK} {
+		if code := issueToken(secret); code != status {
+			t.Errorf("got %d (expected %d)", code, status)
+		}
+	}
+
+	// other users can't rotate the secret
+	other, err := createCookie(generateID(), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", fmt.Sprintf("/oauth2/clients/%s/secret", created.ClientID), nil)
+	r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", other.Value))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+}
+
+func TestOAuthClients__redirectURIs(t *testing.T) {
+	router, o, auth := createTestClientRouter(t)
+	defer o.cleanup()
+	defer auth.cleanup()
+
+	cookie, err := createCookie(generateID(), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// invalid redirect URIs
+	w := createTestClient(t, router, cookie, createClientRequest{Name: "app", RedirectURIs: []string{"http://app.example.com/callback"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = createTestClient(t, router, cookie, createClientRequest{Name: "app", RedirectURIs: []string{"https://app.example.com/callback"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var c client
+	if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.RedirectURIs) != 1 || c.RedirectURIs[0] != "https://app.example.com/callback" {
+		t.Errorf("got redirect URIs: %v", c.RedirectURIs)
+	}
+
+	update := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", fmt.Sprintf("/oauth2/clients/%s/redirect_uris", c.ClientID), strings.NewReader(body))
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	if w := update(`{"redirect_uris": ["https://app.example.com/#frag"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	w = update(`{"redirect_uris": ["https://app.example.com/a", "http://localhost:3000/b"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.RedirectURIs) != 2 || c.RedirectURIs[1] != "http://localhost:3000/b" {
+		t.Errorf("got redirect URIs: %v", c.RedirectURIs)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
+
+	"gopkg.in/oauth2.v3"
+)
+
+var (
+	authorizeConsentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorize {{.Name}}</title></head>
+<body>
+<p><strong>{{.Name}}</strong> is asking to access your account{{if .Scopes}} with these scopes:{{else}}.{{end}}</p>
+{{if .Scopes}}<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<p>You'll be sent to {{.RedirectURI}}</p>
+<form method="POST" action="/oauth2/authorize">
+<input type="hidden" name="response_type" value="{{.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit" name="decision" value="approve">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+)
+
+type authorizeConsent struct {
+	Name         string
+	ClientID     string
+	ResponseType string
+	RedirectURI  string
+	Scope        string
+	Scopes       []string
+	State        string
+	CSRFToken    string
+}
+
+// authorizeCSRFToken ties a consent form to the user's session and the client, so another site
+// can't submit the form on the user's behalf.
+func authorizeCSRFToken(session, clientId string) string {
+	mac := hmac.New(sha256.New, []byte(session))
+	mac.Write([]byte("oauth2-authorize:" + clientId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validAuthorizeCSRFToken checks the consent form was rendered for the session of r.
+func validAuthorizeCSRFToken(r *http.Request, clientId string) bool {
+	cookie := extractCookie(r)
+	if cookie == nil || cookie.Value == "" {
+		return false
+	}
+	expected := authorizeCSRFToken(cookie.Value, clientId)
+	return hmac.Equal([]byte(expected), []byte(r.PostForm.Get("csrf_token")))
+}
+
+// writeAuthorizeConsent asks the logged in user to approve the authorization request of r.
+// The page can't be framed, so it can't be clicked through from another site.
+func writeAuthorizeConsent(w http.ResponseWriter, r *http.Request, cli oauth2.ClientInfo) {
+	consent := authorizeConsent{
+		Name:         cli.GetID(),
+		ClientID:     cli.GetID(),
+		ResponseType: r.Form.Get("response_type"),
+		RedirectURI:  r.Form.Get("redirect_uri"),
+		Scope:        r.Form.Get("scope"),
+		Scopes:       parseScopes(r.Form.Get("scope")),
+		State:        r.Form.Get("state"),
+	}
+	if c, ok := cli.(*oauthdb.Client); ok && c.Name != "" {
+		consent.Name = c.Name
+	}
+	if cookie := extractCookie(r); cookie != nil {
+		consent.CSRFToken = authorizeCSRFToken(cookie.Value, cli.GetID())
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(http.StatusOK)
+	authorizeConsentPage.Execute(w, consent)
+}
@@ -7,15 +7,20 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/moov-io/auth/pkg/oauthdb"
+
 	"github.com/go-kit/kit/log"
 	"gopkg.in/oauth2.v3"
 	"gopkg.in/oauth2.v3/models"
@@ -293,3 +298,342 @@ func TestOAuth__getClientsForUserId(t *testing.T) {
 		t.Errorf("c.ID=%s clients[0].ClientID=%s", c.ID, clients[0].ClientID)
 	}
 }
+
+func TestOAuth__refreshTokenReuse(t *testing.T) {
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	audit := &sqliteAuditLog{db: repo.db, log: log.NewNopLogger()}
+	o.svc.audit = audit
+
+	client, token := createOAuthClient(t, o, userId)
+	token.Refresh = generateID()
+	token.RefreshCreateAt = time.Now().Add(-1 * time.Second)
+	token.RefreshExpiresIn = 30 * time.Minute
+	if err := o.tokenStore.Create(token); err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("/oauth2/token?grant_type=refresh_token&client_id=%s&client_secret=%s&refresh_token=%s", client.ID, client.Secret, refreshToken)
+		req := httptest.NewRequest("POST", url, nil)
+		req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+
+		w := httptest.NewRecorder()
+		o.svc.tokenHandler(auth)(w, req)
+		w.Flush()
+		return w
+	}
+
+	// first use rotates the refresh token
+	w := refresh(token.Refresh)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d HTTP status code: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Access  string `json:"access_token"`
+		Refresh string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Refresh == "" || resp.Refresh == token.Refresh {
+		t.Fatalf("expected rotated refresh token, got %q", resp.Refresh)
+	}
+
+	// a concurrent request which already claimed the refresh token wins, the other is reuse
+	if _, claimed, err := o.tokenStore.(refreshTokenFamilies).ClaimRefresh(resp.Refresh); err != nil || !claimed {
+		t.Fatalf("claimed=%v err=%v", claimed, err)
+	}
+	w = refresh(resp.Refresh)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Errorf("got %d HTTP status code: %s", w.Code, w.Body.String())
+	}
+
+	// reusing the old refresh token is rejected
+	w = refresh(token.Refresh)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d HTTP status code: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Errorf("got %q for response", w.Body.String())
+	}
+	events, _, err := audit.search(auditFilter{UserID: userId, Type: auditRefreshTokenReused})
+	if err != nil || len(events) != 2 || events[0].Details["family"] == "" {
+		t.Errorf("unexpected audit events=%#v err=%v", events, err)
+	}
+
+	// and the rotated tokens were revoked with it
+	if ti, _ := o.tokenStore.GetByRefresh(resp.Refresh); ti != nil {
+		t.Errorf("expected rotated refresh token to be revoked: %v", ti)
+	}
+	if ti, _ := o.tokenStore.GetByAccess(resp.Access); ti != nil {
+		t.Errorf("expected rotated access token to be revoked: %v", ti)
+	}
+}
+
+func TestOAuth__tokenHandlerScopes(t *testing.T) {
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &oauthdb.Client{
+		Client: models.Client{
+			ID:     generateID(),
+			Secret: generateID(),
+			Domain: "api.moov.io",
+			UserID: userId,
+		},
+		Scopes: []string{"read"},
+	}
+	if err := o.svc.clientStore.Set(client.ID, client); err != nil {
+		t.Fatal(err)
+	}
+
+	requestToken := func(scope string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("/oauth2/token?grant_type=client_credentials&client_id=%s&client_secret=%s&scope=%s", client.ID, client.Secret, scope)
+		req := httptest.NewRequest("POST", url, nil)
+		req.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+
+		w := httptest.NewRecorder()
+		o.svc.tokenHandler(auth)(w, req)
+		w.Flush()
+		return w
+	}
+
+	// scope not registered on the client
+	w := requestToken("write")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_scope") {
+		t.Errorf("got %d HTTP status code: %s", w.Code, w.Body.String())
+	}
+
+	// no scope requested, so all client scopes are given
+	w = requestToken("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d HTTP status code: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Scope != "read" {
+		t.Errorf("got scope %q", resp.Scope)
+	}
+}
+
+func TestOAuth__authorizationCodeRedirectURIs(t *testing.T) {
+	router, o, auth := createTestClientRouter(t)
+	defer o.cleanup()
+	defer auth.cleanup()
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirectURI := "https://app.example.com/callback"
+	w := createTestClient(t, router, cookie, createClientRequest{Name: "app", Scopes: []string{"read"}, RedirectURIs: []string{redirectURI}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var cli client
+	if err := json.NewDecoder(w.Body).Decode(&cli); err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := func(query string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/oauth2/authorize?"+query, nil)
+		if cookie != nil {
+			r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	// approve shows the consent page of query and submits its form with decision
+	approve := func(query string, cookie *http.Cookie, decision string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := authorize(query, cookie)
+		if w.Code != http.StatusOK || w.Header().Get("X-Frame-Options") != "DENY" {
+			t.Fatalf("expected consent page, got %d %v: %s", w.Code, w.Header(), w.Body.String())
+		}
+		form := url.Values{}
+		for _, m := range regexp.MustCompile(`name="([a-z_]+)" value="([^"]*)"`).FindAllStringSubmatch(w.Body.String(), -1) {
+			if m[1] != "decision" {
+				form.Set(m[1], html.UnescapeString(m[2]))
+			}
+		}
+		form.Set("decision", decision)
+		r := httptest.NewRequest("POST", "/oauth2/authorize", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	oauthError := func(w *httptest.ResponseRecorder) string {
+		var resp struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Error
+	}
+
+	// unregistered redirect_uri, unknown client
+	for query, expected := range map[string]string{
+		fmt.Sprintf("response_type=code&client_id=%s&redirect_uri=%s", cli.ClientID, "https://evil.example.com/callback"): "invalid_request",
+		fmt.Sprintf("response_type=code&client_id=%s&redirect_uri=%s", cli.ClientID, redirectURI+"/extra"):                "invalid_request",
+		fmt.Sprintf("response_type=code&client_id=%s&redirect_uri=%s", generateID(), redirectURI):                         "invalid_client",
+		fmt.Sprintf("response_type=code&client_id=%s&scope=read+admin", cli.ClientID):                                     "invalid_scope",
+		fmt.Sprintf("response_type=token&client_id=%s", cli.ClientID):                                                     "unsupported_response_type",
+		"response_type=code": "invalid_request",
+	} {
+		w := authorize(query, cookie)
+		if w.Code < 400 || w.Header().Get("Location") != "" {
+			t.Errorf("%s: got %d %v", query, w.Code, w.Header())
+		}
+		if v := oauthError(w); v != expected {
+			t.Errorf("%s: got error %q", query, v)
+		}
+	}
+
+	// users must be logged in
+	w = authorize(fmt.Sprintf("response_type=code&client_id=%s&state=abc", cli.ClientID), nil)
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), redirectURI+"?") || !strings.Contains(w.Header().Get("Location"), "error=access_denied") {
+		t.Errorf("got %d %v", w.Code, w.Header())
+	}
+
+	// the consent form only works with the user's own session
+	other, err := createCookie(generateID(), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"response_type": {"code"}, "client_id": {cli.ClientID}, "decision": {"approve"}, "csrf_token": {authorizeCSRFToken(other.Value, cli.ClientID)}}
+	r := httptest.NewRequest("POST", "/oauth2/authorize", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || w.Header().Get("Location") != "" || oauthError(w) != "access_denied" {
+		t.Errorf("got %d %v: %s", w.Code, w.Header(), w.Body.String())
+	}
+
+	// users can deny the client
+	w = approve(fmt.Sprintf("response_type=code&client_id=%s&state=abc", cli.ClientID), cookie, "deny")
+	if w.Code != http.StatusFound || !strings.Contains(w.Header().Get("Location"), "error=access_denied") {
+		t.Errorf("got %d %v", w.Code, w.Header())
+	}
+
+	// the single registered URI is used when redirect_uri is missing
+	w = approve(fmt.Sprintf("response_type=code&client_id=%s&state=abc&scope=read", cli.ClientID), cookie, "approve")
+	if w.Code != http.StatusFound {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := loc.Query().Get("code")
+	if !strings.HasPrefix(loc.String(), redirectURI+"?") || code == "" || loc.Query().Get("state") != "abc" {
+		t.Fatalf("unexpected redirect: %s", loc)
+	}
+
+	exchange := func(redirect string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Set("grant_type", "authorization_code")
+		form.Set("client_id", cli.ClientID)
+		form.Set("client_secret", cli.ClientSecret)
+		form.Set("code", code)
+		form.Set("redirect_uri", redirect)
+		r := httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	// mismatched redirect_uri on the code exchange
+	w = exchange("https://evil.example.com/callback", cookie)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if v := oauthError(w); v != "invalid_grant" {
+		t.Errorf("got error %q", v)
+	}
+
+	// redirect_uri can be left out of the exchange when it was left out of the authorization,
+	// and the token belongs to the user who approved it rather than whoever exchanged the code
+	w = exchange("", other)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Access string `json:"access_token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Access == "" {
+		t.Fatalf("access=%q err=%v", resp.Access, err)
+	}
+	if ti, err := o.svc.tokenStore.GetByAccess(resp.Access); err != nil || ti == nil || ti.GetUserID() != userId || ti.GetScope() != "read" {
+		t.Errorf("unexpected token=%#v err=%v", ti, err)
+	}
+	if v := w.Header().Get("X-User-Id"); v != userId {
+		t.Errorf("got X-User-Id %q", v)
+	}
+
+	w = approve(fmt.Sprintf("response_type=code&client_id=%s&redirect_uri=%s", cli.ClientID, url.QueryEscape(redirectURI)), cookie, "approve")
+	if w.Code != http.StatusFound {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	loc, err = url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code = loc.Query().Get("code")
+	w = exchange(redirectURI, cookie)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "access_token") {
+		t.Errorf("unexpected token response: %s", w.Body.String())
+	}
+}
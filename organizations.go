@@ -0,0 +1,665 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/moov-io/base"
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	orgRoleOwner  = "owner"
+	orgRoleMember = "member"
+
+	maxOrganizationNameLength = 100
+
+	// orgInviteTTL is how long an invitation can be accepted for
+	orgInviteTTL = 7 * 24 * time.Hour
+)
+
+var (
+	errNoOrganizationName = errors.New("missing organization name")
+	errNotOrgMember       = errors.New("not a member of the organization")
+	errNotOrgOwner        = errors.New("not an owner of the organization")
+	errLastOrgOwner       = errors.New("organizations need at least one owner")
+	errInvalidOrgInvite   = errors.New("invalid or expired organization invite")
+)
+
+type organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt base.Time `json:"createdAt"`
+
+	// Members is only included when reading a single organization
+	Members []*organizationMember `json:"members,omitempty"`
+}
+
+type organizationMember struct {
+	UserID    string    `json:"userId"`
+	Role      string    `json:"role"`
+	CreatedAt base.Time `json:"createdAt"`
+}
+
+type organizationInvite struct {
+	ID             string    `json:"id"`
+	OrganizationID string    `json:"organizationId"`
+	Email          string    `json:"email"`
+	Role           string    `json:"role"`
+	InvitedBy      string    `json:"invitedBy"`
+	CreatedAt      base.Time `json:"createdAt"`
+	ExpiresAt      base.Time `json:"expiresAt"`
+
+	// Code is only returned when the invite is created, it's given to the invited
+	// user to accept the invite.
+	Code string `json:"code,omitempty"`
+}
+
+func validOrgRole(role string) bool {
+	return role == orgRoleOwner || role == orgRoleMember
+}
+
+type organizationRepository interface {
+	// createOrganization saves org and adds userId as its owner.
+	createOrganization(org *organization, userId string) error
+
+	// getOrganization returns an organization with its members.
+	// This function can return nil, nil meaning no organization was found.
+	getOrganization(orgId string) (*organization, error)
+
+	// getUserOrganizations returns the organizations userId is a member of.
+	getUserOrganizations(userId string) ([]*organization, error)
+
+	// getMember returns the membership of userId in orgId.
+	// This function can return nil, nil meaning userId isn't a member.
+	getMember(orgId, userId string) (*organizationMember, error)
+
+	// removeMember deletes the membership of userId in orgId, along with the roles they were
+	// assigned within it. errLastOrgOwner is returned
+	// when userId is the organization's only owner.
+	removeMember(orgId, userId string) error
+
+	// createInvite saves an invite which is accepted with code.
+	createInvite(invite *organizationInvite, code string) error
+
+	// getUserInvites returns the invites sent to email or by userId, oldest first.
+	getUserInvites(email, userId string) ([]*organizationInvite, error)
+
+	// acceptInvite adds user to the organization of the unexpired invite for code.
+	// errInvalidOrgInvite is returned if there's no invite for code and user's email.
+	acceptInvite(code string, user *User) (*organizationInvite, error)
+}
+
+type sqliteOrganizationRepository struct {
+	db  *sql.DB
+	log log.Logger
+
+	// roleCache is cleared of members' roles as they're removed
+	roleCache *ttlCache
+}
+
+func parseTimestamp(v string) time.Time {
+	t, _ := time.Parse(serializedTimestampFormat, v)
+	return t
+}
+
+func (r *sqliteOrganizationRepository) createOrganization(org *organization, userId string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	createdAt := org.CreatedAt.Format(serializedTimestampFormat)
+
+	query := `insert into organizations (organization_id, name, created_by, created_at) values (?, ?, ?, ?)`
+	if _, err := tx.Exec(query, org.ID, org.Name, userId, createdAt); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem creating organization=%s, err=%v, rollback err=%v", org.ID, err, e)
+	}
+	query = `insert into organization_members (organization_id, user_id, role, created_at) values (?, ?, ?, ?)`
+	if _, err := tx.Exec(query, org.ID, userId, orgRoleOwner, createdAt); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem adding owner to organization=%s, err=%v, rollback err=%v", org.ID, err, e)
+	}
+	return tx.Commit()
+}
+
+func (r *sqliteOrganizationRepository) getOrganization(orgId string) (*organization, error) {
+	query := `select name, created_by, created_at from organizations where organization_id = ? and deleted_at is null limit 1`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	org := &organization{ID: orgId}
+	var createdAt string
+	if err := stmt.QueryRow(orgId).Scan(&org.Name, &org.CreatedBy, &createdAt); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	org.CreatedAt = base.NewTime(parseTimestamp(createdAt))
+
+	members, err := r.getMembers(orgId)
+	if err != nil {
+		return nil, err
+	}
+	org.Members = members
+	return org, nil
+}
+
+func (r *sqliteOrganizationRepository) getMembers(orgId string) ([]*organizationMember, error) {
+	query := `select user_id, role, created_at from organization_members where organization_id = ? order by created_at`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(orgId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []*organizationMember
+	for rows.Next() {
+		var m organizationMember
+		var createdAt string
+		if err := rows.Scan(&m.UserID, &m.Role, &createdAt); err != nil {
+			return nil, err
+		}
+		m.CreatedAt = base.NewTime(parseTimestamp(createdAt))
+		members = append(members, &m)
+	}
+	return members, rows.Err()
+}
+
+func (r *sqliteOrganizationRepository) getUserOrganizations(userId string) ([]*organization, error) {
+	query := `select o.organization_id, o.name, o.created_by, o.created_at
+from organizations as o
+inner join organization_members as m
+on o.organization_id = m.organization_id
+where m.user_id = ? and o.deleted_at is null
+order by o.created_at`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []*organization
+	for rows.Next() {
+		var org organization
+		var createdAt string
+		if err := rows.Scan(&org.ID, &org.Name, &org.CreatedBy, &createdAt); err != nil {
+			return nil, err
+		}
+		org.CreatedAt = base.NewTime(parseTimestamp(createdAt))
+		orgs = append(orgs, &org)
+	}
+	return orgs, rows.Err()
+}
+
+func (r *sqliteOrganizationRepository) getMember(orgId, userId string) (*organizationMember, error) {
+	query := `select m.role, m.created_at from organization_members as m
+inner join organizations as o on o.organization_id = m.organization_id
+where m.organization_id = ? and m.user_id = ? and o.deleted_at is null limit 1`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	m := &organizationMember{UserID: userId}
+	var createdAt string
+	if err := stmt.QueryRow(orgId, userId).Scan(&m.Role, &createdAt); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m.CreatedAt = base.NewTime(parseTimestamp(createdAt))
+	return m, nil
+}
+
+func (r *sqliteOrganizationRepository) removeMember(orgId, userId string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var role string
+	var owners int
+	query := `select role, (select count(*) from organization_members where organization_id = ? and role = ?)
+from organization_members where organization_id = ? and user_id = ?`
+	if err := tx.QueryRow(query, orgId, orgRoleOwner, orgId, userId).Scan(&role, &owners); err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil // not a member
+		}
+		return err
+	}
+	if role == orgRoleOwner && owners <= 1 {
+		tx.Rollback()
+		return errLastOrgOwner
+	}
+	for _, query := range []string{
+		`delete from organization_members where organization_id = ? and user_id = ?`,
+		`delete from user_roles where organization_id = ? and user_id = ?`,
+	} {
+		if _, err := tx.Exec(query, orgId, userId); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem removing userId=%s from organization=%s, err=%v, rollback err=%v", userId, orgId, err, e)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	r.roleCache.removeTagged(userId)
+	return nil
+}
+
+func (r *sqliteOrganizationRepository) createInvite(invite *organizationInvite, code string) error {
+	checksum, err := hash(code)
+	if err != nil {
+		return err
+	}
+	query := `insert into organization_invites (invite_id, organization_id, code, clean_email, email, role, invited_by, created_at, expires_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(invite.ID, invite.OrganizationID, checksum, cleanEmail(invite.Email), invite.Email, invite.Role, invite.InvitedBy,
+		invite.CreatedAt.Format(serializedTimestampFormat), invite.ExpiresAt.Format(serializedTimestampFormat))
+	return err
+}
+
+func (r *sqliteOrganizationRepository) getUserInvites(email, userId string) ([]*organizationInvite, error) {
+	query := `select invite_id, organization_id, email, role, invited_by, created_at, expires_at from organization_invites
+where (clean_email = ? and clean_email != '') or (invited_by = ? and invited_by != '') order by created_at`
+	rows, err := r.db.Query(query, cleanEmail(email), userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []*organizationInvite
+	for rows.Next() {
+		var invite organizationInvite
+		var createdAt, expiresAt string
+		if err := rows.Scan(&invite.ID, &invite.OrganizationID, &invite.Email, &invite.Role, &invite.InvitedBy, &createdAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		invite.CreatedAt = base.NewTime(parseTimestamp(createdAt))
+		invite.ExpiresAt = base.NewTime(parseTimestamp(expiresAt))
+		invites = append(invites, &invite)
+	}
+	return invites, rows.Err()
+}
+
+func (r *sqliteOrganizationRepository) acceptInvite(code string, user *User) (*organizationInvite, error) {
+	checksum, err := hash(code)
+	if err != nil {
+		return nil, errInvalidOrgInvite
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	invite := &organizationInvite{}
+	var createdAt, expiresAt string
+	query := `select i.invite_id, i.organization_id, i.email, i.role, i.invited_by, i.created_at, i.expires_at
+from organization_invites as i
+inner join organizations as o on o.organization_id = i.organization_id
+where i.code = ? and i.clean_email = ? and i.accepted_at is null and i.expires_at > ? and o.deleted_at is null
+limit 1`
+	row := tx.QueryRow(query, checksum, user.cleanEmail(), time.Now().Format(serializedTimestampFormat))
+	if err := row.Scan(&invite.ID, &invite.OrganizationID, &invite.Email, &invite.Role, &invite.InvitedBy, &createdAt, &expiresAt); err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, errInvalidOrgInvite
+		}
+		return nil, err
+	}
+	invite.CreatedAt = base.NewTime(parseTimestamp(createdAt))
+	invite.ExpiresAt = base.NewTime(parseTimestamp(expiresAt))
+
+	// existing members keep their role
+	query = `insert or ignore into organization_members (organization_id, user_id, role, created_at) values (?, ?, ?, ?)`
+	if _, err := tx.Exec(query, invite.OrganizationID, user.ID, invite.Role, time.Now().Format(serializedTimestampFormat)); err != nil {
+		e := tx.Rollback()
+		return nil, fmt.Errorf("problem adding userId=%s to organization=%s, err=%v, rollback err=%v", user.ID, invite.OrganizationID, err, e)
+	}
+	if _, err := tx.Exec(`update organization_invites set accepted_at = ?, accepted_by = ? where invite_id = ?`, time.Now().Format(serializedTimestampFormat), user.ID, invite.ID); err != nil {
+		e := tx.Rollback()
+		return nil, fmt.Errorf("problem accepting invite=%s, err=%v, rollback err=%v", invite.ID, err, e)
+	}
+	return invite, tx.Commit()
+}
+
+func addOrganizationRoutes(router *mux.Router, logger log.Logger, auth authable, userRepo userRepository, orgRepo organizationRepository, o *oauth) {
+	router.Methods("GET").Path("/organizations").HandlerFunc(getUserOrganizations(logger, auth, orgRepo))
+	router.Methods("POST").Path("/organizations").HandlerFunc(createOrganization(logger, auth, orgRepo))
+	router.Methods("POST").Path("/organizations/invites/accept").HandlerFunc(acceptOrganizationInvite(logger, auth, userRepo, orgRepo))
+	router.Methods("GET").Path("/organizations/{organizationId}").HandlerFunc(getOrganization(logger, auth, orgRepo))
+	router.Methods("POST").Path("/organizations/{organizationId}/invites").HandlerFunc(inviteOrganizationMember(logger, auth, orgRepo))
+	router.Methods("DELETE").Path("/organizations/{organizationId}/members/{userId}").HandlerFunc(removeOrganizationMember(logger, auth, orgRepo, o))
+}
+
+type createOrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+func createOrganization(logger log.Logger, auth authable, orgRepo organizationRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "createOrganization")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req createOrganizationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if req.Name = strings.TrimSpace(req.Name); req.Name == "" {
+			moovhttp.Problem(w, errNoOrganizationName)
+			return
+		}
+		if utf8.RuneCountInString(req.Name) > maxOrganizationNameLength {
+			moovhttp.Problem(w, fmt.Errorf("organization name is limited to %d characters", maxOrganizationNameLength))
+			return
+		}
+
+		org := &organization{
+			ID:        generateID(),
+			Name:      req.Name,
+			CreatedBy: userId,
+			CreatedAt: base.NewTime(time.Now()),
+		}
+		if err := orgRepo.createOrganization(org, userId); err != nil {
+			internalError(w, err)
+			return
+		}
+		org, err = orgRepo.getOrganization(org.ID)
+		if err != nil || org == nil {
+			internalError(w, fmt.Errorf("problem reading organization after creation: %v", err))
+			return
+		}
+		logger.Log("organizations", fmt.Sprintf("userId=%s created organization=%s", userId, org.ID))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(org); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+func getUserOrganizations(logger log.Logger, auth authable, orgRepo organizationRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "getUserOrganizations")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		orgs, err := orgRepo.getUserOrganizations(userId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if orgs == nil {
+			orgs = []*organization{}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(orgs); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+// getMembership returns the caller's membership in the route's {organizationId}. A 403 or 404
+// is written to w and nil is returned if the caller isn't a member.
+func getMembership(w http.ResponseWriter, r *http.Request, auth authable, orgRepo organizationRepository) (string, *organizationMember) {
+	userId, err := extractUserId(auth, r)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return "", nil
+	}
+	member, err := orgRepo.getMember(mux.Vars(r)["organizationId"], userId)
+	if err != nil {
+		internalError(w, err)
+		return "", nil
+	}
+	if member == nil {
+		w.WriteHeader(http.StatusNotFound) // don't leak other organizations
+		return "", nil
+	}
+	return userId, member
+}
+
+func getOrganization(logger log.Logger, auth authable, orgRepo organizationRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "getOrganization")
+
+		if _, member := getMembership(w, r, auth, orgRepo); member == nil {
+			return
+		}
+		org, err := orgRepo.getOrganization(mux.Vars(r)["organizationId"])
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if org == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(org); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+type inviteOrganizationMemberRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role,omitempty"`
+}
+
+func inviteOrganizationMember(logger log.Logger, auth authable, orgRepo organizationRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "inviteOrganizationMember")
+
+		userId, member := getMembership(w, r, auth, orgRepo)
+		if member == nil {
+			return
+		}
+		if member.Role != orgRoleOwner {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req inviteOrganizationMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if req.Email = strings.TrimSpace(req.Email); req.Email == "" || !strings.Contains(req.Email, "@") {
+			moovhttp.Problem(w, fmt.Errorf("invalid email %q", req.Email))
+			return
+		}
+		if req.Role == "" {
+			req.Role = orgRoleMember
+		}
+		if !validOrgRole(req.Role) {
+			moovhttp.Problem(w, fmt.Errorf("unknown organization role %q", req.Role))
+			return
+		}
+
+		now := time.Now()
+		invite := &organizationInvite{
+			ID:             generateID(),
+			OrganizationID: mux.Vars(r)["organizationId"],
+			Email:          req.Email,
+			Role:           req.Role,
+			InvitedBy:      userId,
+			CreatedAt:      base.NewTime(now),
+			ExpiresAt:      base.NewTime(now.Add(orgInviteTTL)),
+			Code:           generateID(),
+		}
+		if err := orgRepo.createInvite(invite, invite.Code); err != nil {
+			internalError(w, err)
+			return
+		}
+		logger.Log("organizations", fmt.Sprintf("userId=%s invited %s to organization=%s", userId, invite.Email, invite.OrganizationID))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(invite); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+type acceptOrganizationInviteRequest struct {
+	Code string `json:"code"`
+}
+
+func acceptOrganizationInvite(logger log.Logger, auth authable, userRepo userRepository, orgRepo organizationRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "acceptOrganizationInvite")
+
+		user, err := getUserFromCookie(auth, userRepo, r)
+		if err != nil || user == nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req acceptOrganizationInviteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if req.Code = strings.TrimSpace(req.Code); req.Code == "" {
+			moovhttp.Problem(w, errInvalidOrgInvite)
+			return
+		}
+
+		invite, err := orgRepo.acceptInvite(req.Code, user)
+		if err != nil {
+			if err == errInvalidOrgInvite {
+				moovhttp.Problem(w, err)
+			} else {
+				internalError(w, err)
+			}
+			return
+		}
+		org, err := orgRepo.getOrganization(invite.OrganizationID)
+		if err != nil || org == nil {
+			internalError(w, fmt.Errorf("problem reading organization=%s: %v", invite.OrganizationID, err))
+			return
+		}
+		logger.Log("organizations", fmt.Sprintf("userId=%s joined organization=%s", user.ID, org.ID))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(org); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+// removeOrganizationMember deletes a membership. Owners can remove anyone and members can
+// remove themselves (i.e. leave the organization). Tokens the organization's OAuth2 clients
+// issued to the removed member are revoked.
+func removeOrganizationMember(logger log.Logger, auth authable, orgRepo organizationRepository, o *oauth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "removeOrganizationMember")
+
+		userId, member := getMembership(w, r, auth, orgRepo)
+		if member == nil {
+			return
+		}
+		orgId, targetId := mux.Vars(r)["organizationId"], mux.Vars(r)["userId"]
+		if targetId != userId && member.Role != orgRoleOwner {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if err := orgRepo.removeMember(orgId, targetId); err != nil {
+			if err == errLastOrgOwner {
+				moovhttp.Problem(w, err)
+			} else {
+				internalError(w, err)
+			}
+			return
+		}
+		if o != nil {
+			if err := o.revokeOrganizationTokens(orgId, targetId); err != nil {
+				internalError(w, err)
+				return
+			}
+		}
+		logger.Log("organizations", fmt.Sprintf("userId=%s removed userId=%s from organization=%s", userId, targetId, orgId))
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// requestedOrganization returns the organization a request is acting in from the
+// X-Organization-Id header, or the organization_id query parameter.
+func requestedOrganization(r *http.Request) string {
+	if v := strings.TrimSpace(r.Header.Get("X-Organization-Id")); v != "" {
+		return v
+	}
+	return strings.TrimSpace(r.URL.Query().Get("organization_id"))
+}
+
+// isOrgMember returns true if userId belongs to orgId.
+func isOrgMember(orgRepo organizationRepository, orgId, userId string) (bool, error) {
+	if orgRepo == nil || orgId == "" || userId == "" {
+		return false, nil
+	}
+	member, err := orgRepo.getMember(orgId, userId)
+	return member != nil, err
+}
@@ -0,0 +1,466 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func createTestUser(t *testing.T, repo userRepository, email string) *User {
+	t.Helper()
+
+	u := &User{
+		ID:        generateID(),
+		Email:     email,
+		FirstName: "Jane",
+		LastName:  "Doe",
+		CreatedAt: base.NewTime(time.Now()),
+	}
+	if err := repo.upsert(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestOrganizations__repository(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	orgRepo := &sqliteOrganizationRepository{db: repo.db, log: log.NewNopLogger()}
+
+	owner := createTestUser(t, repo, "owner@moov.io")
+	other := createTestUser(t, repo, "other@moov.io")
+
+	org := &organization{ID: generateID(), Name: "Moov", CreatedAt: base.NewTime(time.Now())}
+	if err := orgRepo.createOrganization(org, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := orgRepo.getMember(org.ID, owner.ID); err != nil || m == nil || m.Role != orgRoleOwner {
+		t.Fatalf("expected owner, got member=%#v err=%v", m, err)
+	}
+	if m, err := orgRepo.getMember(org.ID, other.ID); err != nil || m != nil {
+		t.Fatalf("expected no member, got member=%#v err=%v", m, err)
+	}
+
+	// invite and accept
+	invite := &organizationInvite{
+		ID:             generateID(),
+		OrganizationID: org.ID,
+		Email:          "Other@moov.io",
+		Role:           orgRoleMember,
+		InvitedBy:      owner.ID,
+		CreatedAt:      base.NewTime(time.Now()),
+		ExpiresAt:      base.NewTime(time.Now().Add(time.Hour)),
+	}
+	code := generateID()
+	if err := orgRepo.createInvite(invite, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orgRepo.acceptInvite(code, owner); err != errInvalidOrgInvite {
+		t.Errorf("expected invite for other email to be rejected, got %v", err)
+	}
+	if _, err := orgRepo.acceptInvite(code, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orgRepo.acceptInvite(code, other); err != errInvalidOrgInvite {
+		t.Errorf("expected accepted invite to be rejected, got %v", err)
+	}
+	orgs, err := orgRepo.getUserOrganizations(other.ID)
+	if err != nil || len(orgs) != 1 || orgs[0].ID != org.ID {
+		t.Fatalf("unexpected orgs=%#v err=%v", orgs, err)
+	}
+	found, err := orgRepo.getOrganization(org.ID)
+	if err != nil || found == nil || len(found.Members) != 2 {
+		t.Fatalf("unexpected org=%#v err=%v", found, err)
+	}
+
+	// the last owner can't be removed
+	if err := orgRepo.removeMember(org.ID, owner.ID); err != errLastOrgOwner {
+		t.Errorf("expected errLastOrgOwner, got %v", err)
+	}
+	if err := orgRepo.removeMember(org.ID, other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := orgRepo.getMember(org.ID, other.ID); err != nil || m != nil {
+		t.Errorf("expected removed member, got member=%#v err=%v", m, err)
+	}
+
+	// expired invites can't be accepted
+	invite.ID, invite.ExpiresAt = generateID(), base.NewTime(time.Now().Add(-1*time.Minute))
+	code = generateID()
+	if err := orgRepo.createInvite(invite, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orgRepo.acceptInvite(code, other); err != errInvalidOrgInvite {
+		t.Errorf("expected expired invite to be rejected, got %v", err)
+	}
+}
+
+func TestOrganizations__routes(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	orgRepo := &sqliteOrganizationRepository{db: repo.db, log: log.NewNopLogger()}
+
+	router := mux.NewRouter()
+	addOrganizationRoutes(router, log.NewNopLogger(), auth, repo, orgRepo, nil)
+
+	owner, other := createTestUser(t, repo, "owner@moov.io"), createTestUser(t, repo, "other@moov.io")
+	ownerCookie, err := createCookie(owner.ID, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCookie, err := createCookie(other.ID, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path string, cookie *http.Cookie, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		r := httptest.NewRequest(method, path, &buf)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	// create
+	w := do("POST", "/organizations", ownerCookie, createOrganizationRequest{Name: " "})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	w = do("POST", "/organizations", ownerCookie, createOrganizationRequest{Name: "Moov"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var org organization
+	if err := json.NewDecoder(w.Body).Decode(&org); err != nil {
+		t.Fatal(err)
+	}
+	if org.ID == "" || org.Name != "Moov" || len(org.Members) != 1 {
+		t.Fatalf("unexpected organization: %#v", org)
+	}
+
+	// non-members can't see it or invite
+	if w := do("GET", "/organizations/"+org.ID, otherCookie, nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("POST", "/organizations/"+org.ID+"/invites", otherCookie, inviteOrganizationMemberRequest{Email: "other@moov.io"}); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// invite and accept
+	w = do("POST", "/organizations/"+org.ID+"/invites", ownerCookie, inviteOrganizationMemberRequest{Email: "other@moov.io"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var invite organizationInvite
+	if err := json.NewDecoder(w.Body).Decode(&invite); err != nil {
+		t.Fatal(err)
+	}
+	if invite.Code == "" || invite.Role != orgRoleMember {
+		t.Fatalf("unexpected invite: %#v", invite)
+	}
+	if w := do("POST", "/organizations/invites/accept", otherCookie, acceptOrganizationInviteRequest{Code: "wrong"}); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("POST", "/organizations/invites/accept", otherCookie, acceptOrganizationInviteRequest{Code: invite.Code}); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = do("GET", "/organizations", otherCookie, nil)
+	var orgs []*organization
+	if err := json.NewDecoder(w.Body).Decode(&orgs); err != nil || len(orgs) != 1 {
+		t.Fatalf("unexpected orgs=%#v err=%v", orgs, err)
+	}
+
+	// members can't remove others, or invite
+	if w := do("DELETE", fmt.Sprintf("/organizations/%s/members/%s", org.ID, owner.ID), otherCookie, nil); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("POST", "/organizations/"+org.ID+"/invites", otherCookie, inviteOrganizationMemberRequest{Email: "third@moov.io"}); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// the last owner can't leave
+	if w := do("DELETE", fmt.Sprintf("/organizations/%s/members/%s", org.ID, owner.ID), ownerCookie, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// members can leave
+	if w := do("DELETE", fmt.Sprintf("/organizations/%s/members/%s", org.ID, other.ID), otherCookie, nil); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("GET", "/organizations/"+org.ID, otherCookie, nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+}
+
+func TestOrganizations__checkAuth(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	orgRepo := &sqliteOrganizationRepository{db: repo.db, log: log.NewNopLogger()}
+	o.svc.orgs = orgRepo
+
+	user := createTestUser(t, repo, "owner@moov.io")
+	org := &organization{ID: generateID(), Name: "Moov", CreatedAt: base.NewTime(time.Now())}
+	if err := orgRepo.createOrganization(org, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(user.ID, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(orgId string, configure func(r *http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/auth/check", nil)
+		if orgId != "" {
+			r.Header.Set("X-Organization-Id", orgId)
+		}
+		configure(r)
+		w := httptest.NewRecorder()
+		checkAuth(log.NewNopLogger(), auth, o.svc, repo, nil, nil)(w, r)
+		w.Flush()
+		return w
+	}
+	withCookie := func(r *http.Request) {
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+	}
+
+	// cookies report the requested organization
+	w := check(org.ID, withCookie)
+	if w.Code != http.StatusOK || w.Header().Get("X-Organization-Id") != org.ID {
+		t.Errorf("got %d X-Organization-Id=%q", w.Code, w.Header().Get("X-Organization-Id"))
+	}
+	if w := check("", withCookie); w.Code != http.StatusOK || w.Header().Get("X-Organization-Id") != "" {
+		t.Errorf("got %d X-Organization-Id=%q", w.Code, w.Header().Get("X-Organization-Id"))
+	}
+	if w := check(generateID(), withCookie); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// tokens from an organization's client are in the organization
+	client := &oauthdb.Client{
+		Client: models.Client{
+			ID:     generateID(),
+			Secret: generateID(),
+			UserID: user.ID,
+		},
+		OrganizationID: org.ID,
+	}
+	if err := o.svc.clientStore.Set(client.ID, client); err != nil {
+		t.Fatal(err)
+	}
+	token := &models.Token{
+		ClientID:        client.ID,
+		UserID:          user.ID,
+		Access:          generateID(),
+		AccessCreateAt:  time.Now(),
+		AccessExpiresIn: 30 * time.Minute,
+	}
+	if err := o.tokenStore.Create(token); err != nil {
+		t.Fatal(err)
+	}
+	withToken := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token.Access)
+	}
+	if w := check("", withToken); w.Code != http.StatusOK || w.Header().Get("X-Organization-Id") != org.ID {
+		t.Errorf("got %d X-Organization-Id=%q", w.Code, w.Header().Get("X-Organization-Id"))
+	}
+	if w := check(generateID(), withToken); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// tokens of removed members are rejected
+	member := createTestUser(t, repo, "member@moov.io")
+	if _, err := orgRepo.db.Exec(`insert into organization_members (organization_id, user_id, role, created_at) values (?, ?, ?, ?)`,
+		org.ID, member.ID, orgRoleMember, time.Now().Format(serializedTimestampFormat)); err != nil {
+		t.Fatal(err)
+	}
+	memberToken := &models.Token{
+		ClientID:        client.ID,
+		UserID:          member.ID,
+		Access:          generateID(),
+		AccessCreateAt:  time.Now(),
+		AccessExpiresIn: 30 * time.Minute,
+	}
+	if err := o.tokenStore.Create(memberToken); err != nil {
+		t.Fatal(err)
+	}
+	withMemberToken := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+memberToken.Access)
+	}
+	if w := check("", withMemberToken); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if err := orgRepo.removeMember(org.ID, member.ID); err != nil {
+		t.Fatal(err)
+	}
+	if w := check("", withMemberToken); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// removing a member through the API revokes their tokens
+	if _, err := orgRepo.db.Exec(`insert into organization_members (organization_id, user_id, role, created_at) values (?, ?, ?, ?)`,
+		org.ID, member.ID, orgRoleMember, time.Now().Format(serializedTimestampFormat)); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.svc.revokeOrganizationTokens(org.ID, member.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ti, _ := o.tokenStore.GetByAccess(memberToken.Access); ti != nil {
+		t.Errorf("expected token to be revoked: %v", ti)
+	}
+	if ti, _ := o.tokenStore.GetByAccess(token.Access); ti == nil {
+		t.Error("expected the owner's token to remain")
+	}
+}
+
+func TestOrganizations__clients(t *testing.T) {
+	router, o, auth := createTestClientRouter(t)
+	defer o.cleanup()
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	orgRepo := &sqliteOrganizationRepository{db: repo.db, log: log.NewNopLogger()}
+	o.svc.orgs = orgRepo
+
+	owner, other := generateID(), generateID()
+	org := &organization{ID: generateID(), Name: "Moov", CreatedAt: base.NewTime(time.Now())}
+	if err := orgRepo.createOrganization(org, owner); err != nil {
+		t.Fatal(err)
+	}
+	ownerCookie, _ := createCookie(owner, auth)
+	otherCookie, _ := createCookie(other, auth)
+
+	// only members can create clients for an organization
+	w := createTestClient(t, router, otherCookie, createClientRequest{Name: "shared", OrganizationID: org.ID})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	w = createTestClient(t, router, ownerCookie, createClientRequest{Name: "shared", OrganizationID: org.ID})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var cli client
+	if err := json.NewDecoder(w.Body).Decode(&cli); err != nil {
+		t.Fatal(err)
+	}
+	if cli.OrganizationID != org.ID {
+		t.Errorf("got organization_id=%q", cli.OrganizationID)
+	}
+
+	get := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	if w := get("/oauth2/clients/"+cli.ClientID, otherCookie); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := get("/oauth2/clients?organization_id="+org.ID, otherCookie); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// other members can read the organization's clients
+	if _, err := orgRepo.db.Exec(`insert into organization_members (organization_id, user_id, role, created_at) values (?, ?, ?, ?)`,
+		org.ID, other, orgRoleMember, time.Now().Format(serializedTimestampFormat)); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("/oauth2/clients/"+cli.ClientID, otherCookie); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	w = get("/oauth2/clients?organization_id="+org.ID, otherCookie)
+	var clients []*client
+	if err := json.NewDecoder(w.Body).Decode(&clients); err != nil || len(clients) != 1 {
+		t.Errorf("unexpected clients=%#v err=%v", clients, err)
+	}
+
+	// but only owners can change them
+	send := func(method, path string, cookie *http.Cookie, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	if w := send("POST", "/oauth2/clients/"+cli.ClientID+"/secret", otherCookie, ""); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send("PUT", "/oauth2/clients/"+cli.ClientID+"/redirect_uris", otherCookie, `{"redirect_uris":["https://evil.example.com/cb"]}`); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send("DELETE", "/oauth2/clients/"+cli.ClientID, otherCookie, ""); w.Code != http.StatusForbidden {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// removed members lose access, even to clients they created
+	if err := orgRepo.removeMember(org.ID, owner); err == nil {
+		t.Error("expected the last owner to stay")
+	}
+	if _, err := orgRepo.db.Exec(`update organization_members set role = ? where organization_id = ? and user_id = ?`, orgRoleOwner, org.ID, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := orgRepo.removeMember(org.ID, owner); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("/oauth2/clients/"+cli.ClientID, ownerCookie); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := send("DELETE", "/oauth2/clients/"+cli.ClientID, otherCookie, ""); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// execer is satisfied by *sql.DB and *sql.Tx, so an outbox event is written in the transaction
+// of the change it describes.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// writeOutbox saves an identity event about userId to the outbox. Events are only relayed to sinks
+// once the transaction they're written in commits, so a change and its event are atomic.
+func writeOutbox(tx execer, eventType, userId string, data map[string]interface{}) error {
+	event := &identityEvent{
+		ID:        generateID(),
+		Type:      eventType,
+		UserID:    userId,
+		Data:      data,
+		CreatedAt: time.Now(),
+	}
+	if event.ID == "" {
+		return errors.New("problem generating event ID")
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	query := `insert into outbox (event_id, event_type, user_id, payload, created_at) values (?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, event.ID, event.Type, event.UserID, string(payload), event.CreatedAt.Format(serializedTimestampFormat)); err != nil {
+		return fmt.Errorf("problem writing %s event for userId=%s to outbox: %v", eventType, userId, err)
+	}
+	return nil
+}
+
+// clearOutboxData removes the data of every outbox event about userId, returning how many events
+// were changed. The events are kept so each sink still receives them in order.
+func clearOutboxData(tx *sql.Tx, userId string) (int64, error) {
+	rows, err := tx.Query(`select seq, payload from outbox where user_id = ?`, userId)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	payloads := make(map[int64]string)
+	for rows.Next() {
+		var seq int64
+		var payload string
+		if err := rows.Scan(&seq, &payload); err != nil {
+			return 0, err
+		}
+		var event identityEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			return 0, fmt.Errorf("problem reading outbox event seq=%d: %v", seq, err)
+		}
+		if len(event.Data) == 0 {
+			continue
+		}
+		event.Data = nil
+		bs, err := json.Marshal(event)
+		if err != nil {
+			return 0, err
+		}
+		payloads[seq] = string(bs)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	for seq, payload := range payloads {
+		if _, err := tx.Exec(`update outbox set payload = ? where seq = ?`, payload, seq); err != nil {
+			return 0, fmt.Errorf("problem clearing outbox event seq=%d: %v", seq, err)
+		}
+	}
+	return int64(len(payloads)), nil
+}
+
+// outboxSink is a destination the relay publishes every outbox event to.
+type outboxSink struct {
+	name      string
+	publisher eventPublisher
+}
+
+// outboxRelay publishes outbox events to each sink in the order they were written.
+//
+// Every sink has a cursor of the last event it accepted, which is only moved after the sink
+// returns. Events are delivered at least once: a failed sink is retried from its cursor with
+// backoff (without holding up the other sinks) and an event can be sent again if the relay stops
+// between publishing and saving the cursor. Consumers should de-duplicate on the event ID.
+type outboxRelay struct {
+	db     *sql.DB
+	logger log.Logger
+	sinks  []outboxSink
+
+	interval  time.Duration
+	batchSize int
+
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// setupOutboxRelay reads OUTBOX_SINKS (comma separated, default webhook) and the settings of each sink.
+func setupOutboxRelay(logger log.Logger, db *sql.DB, webhooks *webhookDispatcher) (*outboxRelay, error) {
+	names := os.Getenv("OUTBOX_SINKS")
+	if names == "" {
+		names = "webhook"
+	}
+	var sinks []outboxSink
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		var publisher eventPublisher
+		switch name {
+		case "":
+			continue
+		case "webhook":
+			publisher = webhooks
+		case "file":
+			path := os.Getenv("OUTBOX_FILE_PATH")
+			if path == "" {
+				return nil, errors.New("OUTBOX_FILE_PATH is required for the file sink")
+			}
+			publisher = &fileSink{path: path}
+		case "nats":
+			sink, err := newNATSSink(os.Getenv("OUTBOX_NATS_URL"), os.Getenv("OUTBOX_NATS_SUBJECT"))
+			if err != nil {
+				return nil, err
+			}
+			publisher = sink
+		case "kafka":
+			sink, err := newKafkaRESTSink(os.Getenv("OUTBOX_KAFKA_REST_URL"), os.Getenv("OUTBOX_KAFKA_TOPIC"))
+			if err != nil {
+				return nil, err
+			}
+			publisher = sink
+		default:
+			return nil, fmt.Errorf("unknown OUTBOX_SINKS sink %q", name)
+		}
+		for i := range sinks {
+			if sinks[i].name == name {
+				return nil, fmt.Errorf("OUTBOX_SINKS has %s twice", name)
+			}
+		}
+		sinks = append(sinks, outboxSink{name: name, publisher: publisher})
+	}
+
+	relay := newOutboxRelay(logger, db, sinks)
+	if v := os.Getenv("OUTBOX_INTERVAL"); v != "" {
+		dur, err := time.ParseDuration(v)
+		if err != nil || dur <= 0 {
+			return nil, fmt.Errorf("invalid OUTBOX_INTERVAL=%q", v)
+		}
+		relay.interval = dur
+	}
+	return relay, nil
+}
+
+func newOutboxRelay(logger log.Logger, db *sql.DB, sinks []outboxSink) *outboxRelay {
+	return &outboxRelay{
+		db:        db,
+		logger:    logger,
+		sinks:     sinks,
+		interval:  5 * time.Second,
+		batchSize: 100,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// outboxCursor is where a sink is in the outbox, and its retry state after a failure.
+type outboxCursor struct {
+	seq           int64
+	attempts      int
+	nextAttemptAt string
+}
+
+func (o *outboxRelay) cursor(sink string) (*outboxCursor, error) {
+	c := &outboxCursor{}
+	var nextAttemptAt sql.NullString
+	query := `select seq, attempts, next_attempt_at from outbox_cursors where sink = ? limit 1`
+	if err := o.db.QueryRow(query, sink).Scan(&c.seq, &c.attempts, &nextAttemptAt); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return c, nil // new sinks start with the oldest event still in the outbox
+		}
+		return nil, err
+	}
+	c.nextAttemptAt = nextAttemptAt.String
+	return c, nil
+}
+
+// relay publishes up to limit events to each sink which isn't backing off at now, returning how
+// many events were published to the sink which was furthest behind.
+func (o *outboxRelay) relay(now time.Time, limit int) (int64, error) {
+	var most int64
+	for _, sink := range o.sinks {
+		n, err := o.relayTo(sink, now, limit)
+		if err != nil {
+			return most, err
+		}
+		if n > most {
+			most = n
+		}
+	}
+	return most, nil
+}
+
+func (o *outboxRelay) relayTo(sink outboxSink, now time.Time, limit int) (int64, error) {
+	cursor, err := o.cursor(sink.name)
+	if err != nil {
+		return 0, err
+	}
+	if cursor.nextAttemptAt != "" && cursor.nextAttemptAt > now.Format(serializedTimestampFormat) {
+		return 0, nil
+	}
+
+	rows, err := o.db.Query(`select seq, event_type, payload from outbox where seq > ? order by seq asc limit ?`, cursor.seq, limit)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	type pending struct {
+		seq       int64
+		eventType string
+		payload   string
+	}
+	var events []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.seq, &p.eventType, &p.payload); err != nil {
+			return 0, err
+		}
+		events = append(events, p)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	var published int64
+	for _, p := range events {
+		var event identityEvent
+		if err := json.Unmarshal([]byte(p.payload), &event); err != nil {
+			return published, fmt.Errorf("problem reading outbox event seq=%d: %v", p.seq, err)
+		}
+		if err := sink.publisher.publish(&event); err != nil {
+			// later events wait for this one so each sink receives them in order
+			return published, o.failed(sink.name, cursor, p.seq, now, err)
+		}
+		query := `replace into outbox_cursors (sink, seq, attempts, next_attempt_at, last_error, updated_at) values (?, ?, 0, null, null, ?)`
+		if _, err := o.db.Exec(query, sink.name, p.seq, time.Now().Format(serializedTimestampFormat)); err != nil {
+			return published, fmt.Errorf("problem moving %s outbox cursor to seq=%d: %v", sink.name, p.seq, err)
+		}
+		cursor.seq, cursor.attempts = p.seq, 0
+		outboxEventsPublished.With("sink", sink.name).Add(1)
+		published++
+	}
+	return published, nil
+}
+
+// failed records a sink's error publishing the event at seq, it's retried with the same backoff
+// as notifications. Outbox events are never given up on.
+func (o *outboxRelay) failed(sink string, cursor *outboxCursor, seq int64, now time.Time, publishErr error) error {
+	outboxPublishErrors.With("sink", sink).Add(1)
+
+	attempts := cursor.attempts + 1
+	next := now.Add(notificationBackoff(attempts))
+	o.logger.Log("outbox", fmt.Sprintf("problem publishing outbox event seq=%d to %s (attempt %d), retrying at %v: %v", seq, sink, attempts, next, publishErr))
+
+	query := `replace into outbox_cursors (sink, seq, attempts, next_attempt_at, last_error, updated_at) values (?, ?, ?, ?, ?, ?)`
+	_, err := o.db.Exec(query, sink, cursor.seq, attempts, next.Format(serializedTimestampFormat), publishErr.Error(), now.Format(serializedTimestampFormat))
+	if err != nil {
+		return fmt.Errorf("problem recording failed %s outbox publish: %v", sink, err)
+	}
+	return nil
+}
+
+// purgePublished removes up to limit events written before the given time which every sink has
+// published. Events are kept while any sink is behind them. The newest event is always kept,
+// sqlite reuses the seq of an empty table which would put new events behind every cursor.
+func (o *outboxRelay) purgePublished(before time.Time, limit int) (int64, error) {
+	if len(o.sinks) == 0 {
+		return 0, nil
+	}
+	var seq int64 = -1
+	for _, sink := range o.sinks {
+		cursor, err := o.cursor(sink.name)
+		if err != nil {
+			return 0, err
+		}
+		if seq < 0 || cursor.seq < seq {
+			seq = cursor.seq
+		}
+	}
+	query := `delete from outbox where seq in (select seq from outbox where seq <= ? and seq < (select max(seq) from outbox) and created_at < ? order by seq limit ?)`
+	res, err := o.db.Exec(query, seq, before.Format(serializedTimestampFormat), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// start relays outbox events every interval until shutdown is called.
+func (o *outboxRelay) start() {
+	o.started = true
+	o.logger.Log("outbox", fmt.Sprintf("relaying outbox events every %v to %d sinks", o.interval, len(o.sinks)))
+	go func() {
+		defer close(o.done)
+
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for {
+					published, err := o.relay(time.Now(), o.batchSize)
+					if err != nil {
+						o.logger.Log("outbox", fmt.Sprintf("problem relaying outbox events: %v", err))
+						break
+					}
+					if published < int64(o.batchSize) || o.stopping() {
+						break
+					}
+				}
+			case <-o.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (o *outboxRelay) stopping() bool {
+	select {
+	case <-o.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops relaying events and waits for an in-progress batch to finish.
+func (o *outboxRelay) shutdown() {
+	if o == nil || !o.started {
+		return
+	}
+	select {
+	case <-o.stop:
+	default:
+		close(o.stop)
+	}
+	<-o.done
+}
@@ -0,0 +1,275 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileSink appends each event to a file as a line of JSON. The file is opened for every event
+// so it can be rotated.
+type fileSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *fileSink) publish(event *identityEvent) error {
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fd, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(append(bs, '\n')); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// natsSink publishes each event to a NATS server on the subject "<prefix>.<event type>", e.g.
+// identity.user.created. A PING follows every PUB and the event is only published once the
+// server's PONG is read, which means the server processed the PUB.
+type natsSink struct {
+	addr     string
+	user     string
+	password string
+	prefix   string
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// newNATSSink reads a nats://[user:password@]host:port URL, the subject prefix defaults to identity.
+func newNATSSink(rawurl, prefix string) (*natsSink, error) {
+	if rawurl == "" {
+		return nil, errors.New("OUTBOX_NATS_URL is required for the nats sink")
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("invalid OUTBOX_NATS_URL=%q", rawurl)
+	}
+	if prefix == "" {
+		prefix = "identity"
+	}
+	if strings.ContainsAny(prefix, " \t\r\n*>") {
+		return nil, fmt.Errorf("invalid OUTBOX_NATS_SUBJECT=%q", prefix)
+	}
+	sink := &natsSink{
+		addr:    u.Host,
+		prefix:  prefix,
+		timeout: 10 * time.Second,
+	}
+	if u.Port() == "" {
+		sink.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		sink.user = u.User.Username()
+		sink.password, _ = u.User.Password()
+	}
+	return sink, nil
+}
+
+// connect dials the server, reading its INFO and sending CONNECT. Verbose mode is off so the
+// server only replies to PING (or with -ERR).
+func (s *natsSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting: %q", strings.TrimSpace(line))
+	}
+	opts := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "auth-outbox",
+		"lang":     "go",
+		"version":  Version,
+	}
+	if s.user != "" {
+		opts["user"] = s.user
+		opts["pass"] = s.password
+	}
+	bs, err := json.Marshal(opts)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", bs); err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn, s.reader = conn, reader
+	return nil
+}
+
+func (s *natsSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.reader = nil, nil
+	}
+}
+
+func (s *natsSink) publish(event *identityEvent) error {
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return fmt.Errorf("problem connecting to NATS: %v", err)
+		}
+	}
+	if err := s.send(s.prefix+"."+event.Type, bs); err != nil {
+		s.close() // reconnect for the next event
+		return err
+	}
+	return nil
+}
+
+func (s *natsSink) send(subject string, payload []byte) error {
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "PUB %s %d\r\n", subject, len(payload))
+	buf.Write(payload)
+	buf.WriteString("\r\nPING\r\n")
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// +OK and INFO updates are ignored
+	}
+}
+
+// kafkaRESTSink produces each event to a Kafka topic through a REST Proxy (v2 API), which
+// Kafka-compatible brokers such as Redpanda also serve. Records are keyed by user ID so each
+// user's events are kept in order on one partition.
+type kafkaRESTSink struct {
+	endpoint string
+	client   *http.Client
+}
+
+// newKafkaRESTSink reads the REST Proxy's base URL, the topic defaults to identity-events.
+func newKafkaRESTSink(rawurl, topic string) (*kafkaRESTSink, error) {
+	if rawurl == "" {
+		return nil, errors.New("OUTBOX_KAFKA_REST_URL is required for the kafka sink")
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OUTBOX_KAFKA_REST_URL=%q", rawurl)
+	}
+	if topic == "" {
+		topic = "identity-events"
+	}
+	return &kafkaRESTSink{
+		endpoint: strings.TrimSuffix(u.String(), "/") + "/topics/" + url.PathEscape(topic),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+type kafkaRESTRecord struct {
+	Key   string         `json:"key"`
+	Value *identityEvent `json:"value"`
+}
+
+type kafkaRESTResponse struct {
+	Offsets []struct {
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+func (s *kafkaRESTSink) publish(event *identityEvent) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []kafkaRESTRecord{{Key: event.UserID, Value: event}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("kafka REST proxy responded with %s: %s", resp.Status, strings.TrimSpace(string(bs)))
+	}
+	var produced kafkaRESTResponse
+	if err := json.Unmarshal(bs, &produced); err != nil {
+		return fmt.Errorf("problem reading kafka REST proxy response: %v", err)
+	}
+	if len(produced.Offsets) != 1 {
+		return fmt.Errorf("kafka REST proxy returned %d offsets for 1 record", len(produced.Offsets))
+	}
+	if o := produced.Offsets[0]; o.ErrorCode != nil || o.Error != "" {
+		return fmt.Errorf("kafka REST proxy didn't produce the record: %s", o.Error)
+	}
+	return nil
+}
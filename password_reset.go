@@ -0,0 +1,144 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// passwordResetTTL is how long a password reset code can be used for
+	passwordResetTTL = 24 * time.Hour
+)
+
+var (
+	errInvalidPasswordReset = errors.New("invalid or expired password reset code")
+)
+
+// createPasswordReset returns a new code which lets the holder set the password of userId.
+// Only one code is valid for each user, creating a code replaces any previous code.
+func (a *auth) createPasswordReset(userId, createdBy string) (string, time.Time, error) {
+	code := generateID()
+	if code == "" {
+		return "", time.Time{}, errors.New("problem generating password reset code")
+	}
+	checksum, err := hash(code)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(passwordResetTTL)
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if _, err := tx.Exec(`delete from user_password_resets where user_id = ?`, userId); err != nil {
+		e := tx.Rollback()
+		return "", time.Time{}, fmt.Errorf("problem clearing password resets of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	query := `insert into user_password_resets (code, user_id, created_by, expires_at) values (?, ?, ?, ?)`
+	if _, err := tx.Exec(query, checksum, userId, createdBy, expires.Format(serializedTimestampFormat)); err != nil {
+		e := tx.Rollback()
+		return "", time.Time{}, fmt.Errorf("problem writing password reset of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	return code, expires, tx.Commit()
+}
+
+// consumePasswordReset returns the userId of an unexpired code and removes the code.
+// errInvalidPasswordReset is returned if no such code exists.
+func (a *auth) consumePasswordReset(code string) (string, error) {
+	checksum, err := hash(code)
+	if err != nil {
+		return "", errInvalidPasswordReset
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	var userId, expiresAt string
+	query := `select user_id, expires_at from user_password_resets where code = ? limit 1`
+	if err := tx.QueryRow(query, checksum).Scan(&userId, &expiresAt); err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return "", errInvalidPasswordReset
+		}
+		return "", err
+	}
+	if _, err := tx.Exec(`delete from user_password_resets where code = ?`, checksum); err != nil {
+		e := tx.Rollback()
+		return "", fmt.Errorf("problem removing password reset of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	if time.Now().After(parseTimestamp(expiresAt)) {
+		return "", errInvalidPasswordReset
+	}
+	return userId, nil
+}
+
+func addPasswordResetRoutes(router *mux.Router, logger log.Logger, auth authable, o *oauth, tokens personalTokenRepository, audit auditLog) {
+	router.Methods("POST").Path("/users/password/reset").HandlerFunc(resetPassword(logger, auth, o, tokens, audit))
+}
+
+type resetPasswordRequest struct {
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+// resetPassword sets a user's password from a password reset code, signing out every session
+// and revoking their OAuth2 and personal access tokens.
+func resetPassword(logger log.Logger, auth authable, o *oauth, tokens personalTokenRepository, audit auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "resetPassword")
+
+		var req resetPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if err := validatePassword(req.Password); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		userId, err := auth.consumePasswordReset(req.Code)
+		if err != nil {
+			if err == errInvalidPasswordReset {
+				moovhttp.Problem(w, err)
+			} else {
+				internalError(w, err)
+			}
+			return
+		}
+		if err := auth.writePassword(userId, req.Password); err != nil {
+			internalError(w, err)
+			return
+		}
+		if err := auth.invalidateCookies(userId); err != nil {
+			internalError(w, err)
+			return
+		}
+		if _, err := revokeUserAccess(o, tokens, userId); err != nil {
+			internalError(w, err)
+			return
+		}
+		logger.Log("password-reset", fmt.Sprintf("userId=%s reset their password", userId))
+		recordAudit(audit, r, auditPasswordChanged, userId, userId, map[string]string{"method": "reset code"})
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
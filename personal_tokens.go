@@ -0,0 +1,372 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/moov-io/base"
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// personalTokenPrefix starts every personal access token so they can be found by
+	// secret scanners (and told apart from OAuth2 access tokens).
+	personalTokenPrefix = "moov_pat_"
+
+	maxPersonalTokensPerUser = 25
+	maxPersonalTokenName     = 100
+
+	// personalTokenUsedInterval is how often last_used_at is written for a token in use
+	personalTokenUsedInterval = time.Minute
+)
+
+var (
+	errInvalidPersonalToken = errors.New("invalid personal access token")
+	errNoPersonalTokenName  = errors.New("no token name provided")
+)
+
+// personalToken is a long-lived token a user creates to call our APIs from scripts.
+// Only a hash of the token is stored, the token itself is returned once on creation.
+type personalToken struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Prefix     string     `json:"prefix"`
+	CreatedAt  base.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+
+	// Token is only set when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+func (t *personalToken) expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+type personalTokenRepository interface {
+	// createToken saves the token which is presented as secret.
+	createToken(t *personalToken, secret string) error
+
+	// getUserTokens returns the active (unrevoked and unexpired) tokens of userId.
+	getUserTokens(userId string) ([]*personalToken, error)
+
+	// revokeToken revokes the token of userId, returning false if it wasn't found.
+	revokeToken(userId, tokenId string) (bool, error)
+
+	// revokeUserTokens revokes every token of userId, returning how many were revoked.
+	revokeUserTokens(userId string) (int64, error)
+
+	// lookup returns the active token presented as secret.
+	// This function can return nil, nil meaning no active token was found.
+	lookup(secret string) (*personalToken, error)
+}
+
+type sqlitePersonalTokenRepository struct {
+	db  *sql.DB
+	log log.Logger
+}
+
+func (r *sqlitePersonalTokenRepository) createToken(t *personalToken, secret string) error {
+	checksum, err := hash(secret)
+	if err != nil {
+		return err
+	}
+	var expiresAt *string
+	if t.ExpiresAt != nil {
+		v := t.ExpiresAt.Format(serializedTimestampFormat)
+		expiresAt = &v
+	}
+	query := `insert into personal_access_tokens (token_id, user_id, name, token, prefix, scopes, created_at, expires_at) values (?, ?, ?, ?, ?, ?, ?, ?)`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(t.ID, t.UserID, t.Name, checksum, t.Prefix, strings.Join(t.Scopes, " "), t.CreatedAt.Format(serializedTimestampFormat), expiresAt)
+	return err
+}
+
+const personalTokenColumns = `token_id, user_id, name, prefix, scopes, created_at, expires_at, last_used_at`
+
+func scanPersonalToken(row interface{ Scan(...interface{}) error }) (*personalToken, error) {
+	t := &personalToken{}
+	var scopes, createdAt string
+	var expiresAt, lastUsedAt sql.NullString
+	if err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &scopes, &createdAt, &expiresAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	t.Scopes = parseScopes(scopes)
+	if t.Scopes == nil {
+		t.Scopes = []string{}
+	}
+	t.CreatedAt = base.NewTime(parseTimestamp(createdAt))
+	if expiresAt.String != "" {
+		when := parseTimestamp(expiresAt.String)
+		t.ExpiresAt = &when
+	}
+	if lastUsedAt.String != "" {
+		when := parseTimestamp(lastUsedAt.String)
+		t.LastUsedAt = &when
+	}
+	return t, nil
+}
+
+func (r *sqlitePersonalTokenRepository) getUserTokens(userId string) ([]*personalToken, error) {
+	query := `select ` + personalTokenColumns + ` from personal_access_tokens where user_id = ? and revoked_at is null order by created_at`
+	rows, err := r.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*personalToken
+	for rows.Next() {
+		t, err := scanPersonalToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		if !t.expired() {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, rows.Err()
+}
+
+func (r *sqlitePersonalTokenRepository) revokeToken(userId, tokenId string) (bool, error) {
+	query := `update personal_access_tokens set revoked_at = ? where token_id = ? and user_id = ? and revoked_at is null`
+	res, err := r.db.Exec(query, time.Now().Format(serializedTimestampFormat), tokenId, userId)
+	if err != nil {
+		return false, fmt.Errorf("problem revoking personal token=%s: %v", tokenId, err)
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (r *sqlitePersonalTokenRepository) revokeUserTokens(userId string) (int64, error) {
+	query := `update personal_access_tokens set revoked_at = ? where user_id = ? and revoked_at is null`
+	res, err := r.db.Exec(query, time.Now().Format(serializedTimestampFormat), userId)
+	if err != nil {
+		return 0, fmt.Errorf("problem revoking personal tokens of userId=%s: %v", userId, err)
+	}
+	return res.RowsAffected()
+}
+
+func (r *sqlitePersonalTokenRepository) lookup(secret string) (*personalToken, error) {
+	if !strings.HasPrefix(secret, personalTokenPrefix) {
+		return nil, nil
+	}
+	checksum, err := hash(secret)
+	if err != nil {
+		return nil, err
+	}
+	query := `select ` + personalTokenColumns + ` from personal_access_tokens where token = ? and revoked_at is null limit 1`
+	t, err := scanPersonalToken(r.db.QueryRow(query, checksum))
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if t.expired() {
+		return nil, nil
+	}
+
+	// Only record usage every so often, /auth/check is called for every request.
+	if now := time.Now(); t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > personalTokenUsedInterval {
+		query = `update personal_access_tokens set last_used_at = ? where token_id = ?`
+		if _, err := r.db.Exec(query, now.Format(serializedTimestampFormat), t.ID); err != nil {
+			r.log.Log("personal-tokens", fmt.Sprintf("problem updating last_used_at of token=%s: %v", t.ID, err))
+		}
+		t.LastUsedAt = &now
+	}
+	return t, nil
+}
+
+// purgeInactive deletes up to limit tokens which were revoked or expired before the given time.
+func (r *sqlitePersonalTokenRepository) purgeInactive(before time.Time, limit int) (int64, error) {
+	query := `delete from personal_access_tokens where rowid in (select rowid from personal_access_tokens where revoked_at < ? or expires_at < ? limit ?)`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	cutoff := before.Format(serializedTimestampFormat)
+	res, err := stmt.Exec(cutoff, cutoff, limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// personalTokenFromRequest returns the personal access token sent as an Authorization Bearer token.
+func personalTokenFromRequest(r *http.Request) string {
+	v := r.Header.Get("Authorization")
+	if len(v) < 7 || !strings.EqualFold(v[:7], "bearer ") {
+		return ""
+	}
+	if token := strings.TrimSpace(v[7:]); strings.HasPrefix(token, personalTokenPrefix) {
+		return token
+	}
+	return ""
+}
+
+func addPersonalTokenRoutes(router *mux.Router, logger log.Logger, auth authable, tokens personalTokenRepository, audit auditLog) {
+	router.Methods("GET").Path("/users/tokens").HandlerFunc(getPersonalTokens(logger, auth, tokens))
+	router.Methods("POST").Path("/users/tokens").HandlerFunc(createPersonalToken(logger, auth, tokens, audit))
+	router.Methods("DELETE").Path("/users/tokens/{tokenId}").HandlerFunc(revokePersonalToken(logger, auth, tokens, audit))
+}
+
+func getPersonalTokens(logger log.Logger, auth authable, tokens personalTokenRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "getPersonalTokens")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		out, err := tokens.getUserTokens(userId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if out == nil {
+			out = []*personalToken{}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+type createPersonalTokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    string     `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+func createPersonalToken(logger log.Logger, auth authable, tokens personalTokenRepository, audit auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "createPersonalToken")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req createPersonalTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if req.Name = strings.TrimSpace(req.Name); req.Name == "" {
+			moovhttp.Problem(w, errNoPersonalTokenName)
+			return
+		}
+		if utf8.RuneCountInString(req.Name) > maxPersonalTokenName {
+			moovhttp.Problem(w, fmt.Errorf("token name is limited to %d characters", maxPersonalTokenName))
+			return
+		}
+		scopes := parseScopes(req.Scopes)
+		if err := validateScopes(scopes); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+			moovhttp.Problem(w, errors.New("expiresAt must be in the future"))
+			return
+		}
+
+		existing, err := tokens.getUserTokens(userId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if len(existing) >= maxPersonalTokensPerUser {
+			moovhttp.Problem(w, fmt.Errorf("users are limited to %d personal access tokens", maxPersonalTokensPerUser))
+			return
+		}
+
+		id, secret := generateID(), generateID()
+		if id == "" || secret == "" {
+			internalError(w, errors.New("problem generating personal access token"))
+			return
+		}
+		if scopes == nil {
+			scopes = []string{}
+		}
+		token := &personalToken{
+			ID:        id,
+			UserID:    userId,
+			Name:      req.Name,
+			Scopes:    scopes,
+			Prefix:    personalTokenPrefix + secret[:4],
+			CreatedAt: base.NewTime(time.Now()),
+			ExpiresAt: req.ExpiresAt,
+			Token:     personalTokenPrefix + secret,
+		}
+		if err := tokens.createToken(token, token.Token); err != nil {
+			internalError(w, err)
+			return
+		}
+		logger.Log("personal-tokens", fmt.Sprintf("userId=%s created personal token=%s", userId, token.ID))
+		recordAudit(audit, r, auditPersonalTokenCreated, userId, userId, map[string]string{"tokenId": token.ID, "scopes": strings.Join(scopes, " ")})
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(token); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+func revokePersonalToken(logger log.Logger, auth authable, tokens personalTokenRepository, audit auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "revokePersonalToken")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		tokenId := mux.Vars(r)["tokenId"]
+		found, err := tokens.revokeToken(userId, tokenId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		logger.Log("personal-tokens", fmt.Sprintf("userId=%s revoked personal token=%s", userId, tokenId))
+		recordAudit(audit, r, auditPersonalTokenRevoked, userId, userId, map[string]string{"tokenId": tokenId})
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestPersonalTokens__repository(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	tokens := &sqlitePersonalTokenRepository{db: repo.db, log: log.NewNopLogger()}
+
+	userId, secret := generateID(), personalTokenPrefix+generateID()
+	token := &personalToken{
+		ID:        generateID(),
+		UserID:    userId,
+		Name:      "deploys",
+		Scopes:    []string{"read"},
+		Prefix:    secret[:13],
+		CreatedAt: base.NewTime(time.Now()),
+	}
+	if err := tokens.createToken(token, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := tokens.lookup(secret)
+	if err != nil || found == nil || found.ID != token.ID || found.UserID != userId {
+		t.Fatalf("unexpected token=%#v err=%v", found, err)
+	}
+	if found.LastUsedAt == nil {
+		t.Error("expected lastUsedAt")
+	}
+	if found, err := tokens.lookup(personalTokenPrefix + generateID()); err != nil || found != nil {
+		t.Errorf("expected no token, got token=%#v err=%v", found, err)
+	}
+
+	// expired tokens aren't accepted or listed
+	expired, expiredSecret := *token, personalTokenPrefix+generateID()
+	expired.ID = generateID()
+	when := time.Now().Add(-1 * time.Minute)
+	expired.ExpiresAt = &when
+	if err := tokens.createToken(&expired, expiredSecret); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := tokens.lookup(expiredSecret); err != nil || found != nil {
+		t.Errorf("expected no token, got token=%#v err=%v", found, err)
+	}
+	if list, err := tokens.getUserTokens(userId); err != nil || len(list) != 1 {
+		t.Errorf("unexpected tokens=%#v err=%v", list, err)
+	}
+
+	// revoke
+	if ok, err := tokens.revokeToken(generateID(), token.ID); err != nil || ok {
+		t.Errorf("expected other users to not revoke token, ok=%v err=%v", ok, err)
+	}
+	if ok, err := tokens.revokeToken(userId, token.ID); err != nil || !ok {
+		t.Fatalf("ok=%v err=%v", ok, err)
+	}
+	if found, err := tokens.lookup(secret); err != nil || found != nil {
+		t.Errorf("expected revoked token to be rejected, got token=%#v err=%v", found, err)
+	}
+
+	n, err := tokens.purgeInactive(time.Now().Add(time.Minute), 10)
+	if err != nil || n != 2 {
+		t.Errorf("expected 2 purged tokens, got %d err=%v", n, err)
+	}
+}
+
+func TestPersonalTokens__routes(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	tokens := &sqlitePersonalTokenRepository{db: repo.db, log: log.NewNopLogger()}
+
+	router := mux.NewRouter()
+	addPersonalTokenRoutes(router, log.NewNopLogger(), auth, tokens, nil)
+
+	userId := generateID()
+	cookie, err := createCookie(userId, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		r := httptest.NewRequest(method, path, &buf)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	if w := do("POST", "/users/tokens", createPersonalTokenRequest{Name: " "}); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	past := time.Now().Add(-1 * time.Hour)
+	if w := do("POST", "/users/tokens", createPersonalTokenRequest{Name: "deploys", ExpiresAt: &past}); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+
+	w := do("POST", "/users/tokens", createPersonalTokenRequest{Name: "deploys", Scopes: "read write"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var created personalToken
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Token, personalTokenPrefix) || !strings.HasPrefix(created.Token, created.Prefix) || len(created.Scopes) != 2 {
+		t.Fatalf("unexpected token: %#v", created)
+	}
+
+	// the token is only returned once
+	w = do("GET", "/users/tokens", nil)
+	var list []*personalToken
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil || len(list) != 1 || list[0].Token != "" {
+		t.Fatalf("unexpected tokens=%#v err=%v", list, err)
+	}
+
+	if w := do("DELETE", "/users/tokens/"+generateID(), nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("DELETE", "/users/tokens/"+created.ID, nil); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if found, _ := tokens.lookup(created.Token); found != nil {
+		t.Errorf("expected revoked token, got %#v", found)
+	}
+}
+
+func TestPersonalTokens__checkAuth(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	tokens := &sqlitePersonalTokenRepository{db: repo.db, log: log.NewNopLogger()}
+
+	user := createTestUser(t, repo, "test@moov.io")
+	secret := personalTokenPrefix + generateID()
+	token := &personalToken{
+		ID:        generateID(),
+		UserID:    user.ID,
+		Name:      "deploys",
+		Scopes:    []string{"read"},
+		CreatedAt: base.NewTime(time.Now()),
+	}
+	if err := tokens.createToken(token, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(path, secret string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		checkAuth(log.NewNopLogger(), auth, o.svc, repo, nil, tokens)(w, r)
+		w.Flush()
+		return w
+	}
+
+	w := check("/auth/check", secret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if v := w.Header().Get("X-User-Id"); v != user.ID {
+		t.Errorf("got X-User-Id=%q", v)
+	}
+	if v := w.Header().Get("X-Scopes"); v != "read" {
+		t.Errorf("got X-Scopes=%q", v)
+	}
+	if v := w.Header().Get("X-Personal-Token-Id"); v != token.ID {
+		t.Errorf("got X-Personal-Token-Id=%q", v)
+	}
+
+	// scopes are enforced
+	if w := check("/auth/check?scopes=write", secret); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := check("/auth/check", personalTokenPrefix+generateID()); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+}
@@ -49,10 +49,63 @@ func NewClientStoreDB(connString string) (*ClientStore, error) {
 	if err := clientStore.migrate(); err != nil {
 		return nil, err
 	}
+	if err := clientStore.hashPlaintextSecrets(); err != nil {
+		return nil, err
+	}
 
 	return clientStore, nil
 }
 
+// Client is an oauth2.ClientInfo along with the extra metadata ClientStore keeps for each client.
+//
+// Secret holds a hash of the client secret when read from ClientStore, use VerifyPassword to compare secrets.
+type Client struct {
+	models.Client
+
+	// SecretHint is a masked form of the secret, safe to show users.
+	SecretHint string
+
+	// Name is a short label for the client, unique among a user's clients.
+	Name string
+
+	// Description is optional free form text about the client.
+	Description string
+
+	// Scopes are the only scopes tokens for this client can be issued with.
+	Scopes []string
+
+	// RedirectURIs are the registered redirection endpoints of the client, matched exactly.
+	RedirectURIs []string
+
+	// SecretCreatedAt is when the current secret was issued.
+	SecretCreatedAt time.Time
+
+	// PreviousSecrets are rotated secrets which are still accepted until they expire.
+	PreviousSecrets []ClientSecret
+
+	// OrganizationID is set for clients which belong to an organization instead of only their creator.
+	OrganizationID string
+
+	CreatedAt time.Time
+}
+
+// ClientSecret is a rotated client secret that remains valid until ExpiresAt.
+type ClientSecret struct {
+	// Secret is a hash of the client secret
+	Secret string
+
+	// Hint is a masked form of the secret, safe to show users.
+	Hint string
+
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// GetScopes returns the scopes this client is allowed to request
+func (c *Client) GetScopes() []string {
+	return c.Scopes
+}
+
 // ClientStore wraps oauth2.ClientStore with an underlying *sql.DB provided from NewClientStoreDB
 type ClientStore struct {
 	oauth2.ClientStore
@@ -66,6 +119,26 @@ func (cs *ClientStore) migrate() error {
 	}
 	queries := []string{
 		`create table if not exists oauth2_clients(id, secret, domain, user_id, created_at datetime, deleted_at datetime)`,
+
+		// Allowed scopes, space delimited
+		`alter table oauth2_clients add column scopes`,
+
+		// Named clients
+		`alter table oauth2_clients add column name`,
+		`alter table oauth2_clients add column description`,
+
+		// Client secrets are hashed, only a hint is kept for showing users
+		`alter table oauth2_clients add column secret_hint`,
+
+		// Secret rotation, previous secrets are accepted until they expire
+		`alter table oauth2_clients add column secret_created_at datetime`,
+		`create table if not exists oauth2_client_secrets(client_id, secret, secret_hint, created_at datetime, expires_at datetime)`,
+
+		// Registered redirect URIs, space delimited
+		`alter table oauth2_clients add column redirect_uris`,
+
+		// Clients owned by an organization
+		`alter table oauth2_clients add column organization_id`,
 	}
 	return migrate(cs.db, queries)
 }
@@ -75,74 +148,322 @@ func (cs *ClientStore) Close() error {
 	return cs.db.Close()
 }
 
+const clientColumns = `id, secret, secret_hint, domain, user_id, organization_id, scopes, redirect_uris, name, description, secret_created_at, created_at`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanClient(row scanner) (*Client, error) {
+	var client Client
+	var hint, organizationID, scopes, redirectURIs, name, description sql.NullString
+	var secretCreatedAt *time.Time
+	if err := row.Scan(&client.ID, &client.Secret, &hint, &client.Domain, &client.UserID, &organizationID, &scopes, &redirectURIs, &name, &description, &secretCreatedAt, &client.CreatedAt); err != nil {
+		return nil, err
+	}
+	client.SecretHint = hint.String
+	client.OrganizationID = organizationID.String
+	client.RedirectURIs = strings.Fields(redirectURIs.String)
+	client.SecretCreatedAt = client.CreatedAt
+	if secretCreatedAt != nil {
+		client.SecretCreatedAt = *secretCreatedAt
+	}
+	client.Scopes = strings.Fields(scopes.String)
+	client.Name = name.String
+	client.Description = description.String
+	return &client, nil
+}
+
 // GetByID returns an oauth2.ClientInfo if the ID matches id.
 func (cs *ClientStore) GetByID(id string) (oauth2.ClientInfo, error) {
-	query := `select id, secret, domain, user_id from oauth2_clients where id = ? and deleted_at is null order by created_at desc limit 1;`
+	query := `select ` + clientColumns + ` from oauth2_clients where id = ? and deleted_at is null order by created_at desc limit 1;`
 	stmt, err := cs.db.Prepare(query)
 	if err != nil {
 		return nil, fmt.Errorf("client store: failed to prepare GetByID: %v", err)
 	}
 	defer stmt.Close()
 
-	row := stmt.QueryRow(id)
-
-	var client models.Client
-	if err := row.Scan(&client.ID, &client.Secret, &client.Domain, &client.UserID); err != nil {
+	client, err := scanClient(stmt.QueryRow(id))
+	if err != nil {
 		if strings.Contains(err.Error(), "no rows in result set") {
 			return nil, nil // not found
 		}
 		return nil, fmt.Errorf("readClient: row.Scan: %v", err)
 	}
+	if err := cs.readPreviousSecrets(client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
 
-	return &client, nil
+// readPreviousSecrets adds the unexpired rotated secrets of each client.
+func (cs *ClientStore) readPreviousSecrets(clients ...*Client) error {
+	query := `select secret, secret_hint, created_at, expires_at from oauth2_client_secrets where client_id = ? and expires_at > ? order by created_at desc;`
+	stmt, err := cs.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("client store: failed to prepare readPreviousSecrets: %v", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	for _, client := range clients {
+		rows, err := stmt.Query(client.ID, now)
+		if err != nil {
+			return fmt.Errorf("client store: failed to query previous secrets of client %s: %v", client.ID, err)
+		}
+		client.PreviousSecrets = nil
+		for rows.Next() {
+			var secret ClientSecret
+			if err := rows.Scan(&secret.Secret, &secret.Hint, &secret.CreatedAt, &secret.ExpiresAt); err != nil {
+				rows.Close()
+				return fmt.Errorf("readPreviousSecrets: rows.Scan: %v", err)
+			}
+			client.PreviousSecrets = append(client.PreviousSecrets, secret)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Set writes the oauth2.ClientInfo to the underlying database.
+//
+// The client secret is hashed before being written. Name, Description, Scopes, RedirectURIs
+// and OrganizationID are saved when cli is a *Client.
 func (cs *ClientStore) Set(id string, cli oauth2.ClientInfo) error {
 	if cli == nil {
 		return fmt.Errorf("nil oauth2.ClientInfo: %T", cli)
 	}
 
-	query := `insert into oauth2_clients (id, secret, domain, user_id, created_at) values (?, ?, ?, ?, ?);`
+	var organizationID, scopes, redirectURIs, name, description string
+	if c, ok := cli.(*Client); ok {
+		organizationID = c.OrganizationID
+		scopes = strings.Join(c.Scopes, " ")
+		redirectURIs = strings.Join(c.RedirectURIs, " ")
+		name, description = c.Name, c.Description
+	}
+
+	secret, hint := cli.GetSecret(), secretHint(cli.GetSecret())
+	if c, ok := cli.(*Client); ok && isHashedSecret(secret) {
+		hint = c.SecretHint // already stored once
+	}
+
+	query := `insert into oauth2_clients (id, secret, secret_hint, domain, user_id, organization_id, scopes, redirect_uris, name, description, secret_created_at, created_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
 	stmt, err := cs.db.Prepare(query)
 	if err != nil {
 		return fmt.Errorf("client store: failed to prepare Set: %v", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(cli.GetID(), cli.GetSecret(), cli.GetDomain(), cli.GetUserID(), time.Now())
+	now := time.Now()
+	_, err = stmt.Exec(cli.GetID(), hashSecret(secret), hint, cli.GetDomain(), cli.GetUserID(), organizationID, scopes, redirectURIs, name, description, now, now)
 	return err
 }
 
+var (
+	// ErrClientLimit is returned by Create when the owner already has the maximum number of clients.
+	ErrClientLimit = errors.New("client store: client limit reached")
+
+	// ErrClientNameTaken is returned by Create when the owner has a client with the same name.
+	ErrClientNameTaken = errors.New("client store: client name already exists")
+)
+
+// Create writes a new client if its owner (the organization, or else the user) has fewer than
+// limit clients and, when the client is named, none with the same name
+// (ignoring case). Both checks and the insert are one statement, so concurrent calls can't
+// go over the limit or duplicate a name.
+func (cs *ClientStore) Create(cli *Client, limit int) error {
+	if cli == nil {
+		return errors.New("nil *Client")
+	}
+	owner, ownerID := "user_id = ?", cli.UserID
+	if cli.OrganizationID != "" {
+		owner, ownerID = "organization_id = ?", cli.OrganizationID
+	}
+	query := `insert into oauth2_clients (id, secret, secret_hint, domain, user_id, organization_id, scopes, redirect_uris, name, description, secret_created_at, created_at)
+select ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+where (select count(*) from oauth2_clients where ` + owner + ` and deleted_at is null) < ?
+and (? = '' or not exists (select 1 from oauth2_clients where ` + owner + ` and deleted_at is null and lower(name) = lower(?)));`
+	stmt, err := cs.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("client store: failed to prepare Create: %v", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	res, err := stmt.Exec(cli.ID, hashSecret(cli.Secret), secretHint(cli.Secret), cli.Domain, cli.UserID, cli.OrganizationID,
+		strings.Join(cli.Scopes, " "), strings.Join(cli.RedirectURIs, " "), cli.Name, cli.Description, now, now,
+		ownerID, limit, cli.Name, ownerID, cli.Name)
+	if err != nil {
+		return fmt.Errorf("client store: failed to create client: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	if cli.Name != "" {
+		var taken int
+		query = `select count(*) from oauth2_clients where ` + owner + ` and deleted_at is null and lower(name) = lower(?)`
+		if err := cs.db.QueryRow(query, ownerID, cli.Name).Scan(&taken); err != nil {
+			return fmt.Errorf("client store: failed to check client name: %v", err)
+		}
+		if taken > 0 {
+			return ErrClientNameTaken
+		}
+	}
+	return ErrClientLimit
+}
+
 // GetByUserID returns an array of oauth2.ClientInfo which have a UserID mathcing
-// userId.
+// userId. Clients are ordered newest first.
 // If return values are nil that means no matching records were found.
 func (cs *ClientStore) GetByUserID(userId string) ([]oauth2.ClientInfo, error) {
-	query := `select id, secret, domain, user_id from oauth2_clients where user_id = ? and deleted_at is null order by created_at desc limit 1;`
+	query := `select ` + clientColumns + ` from oauth2_clients where user_id = ? and deleted_at is null order by created_at desc;`
+	clients, err := cs.queryClients(query, userId)
+	if err != nil {
+		return nil, fmt.Errorf("client store: GetByUserID: %v", err)
+	}
+	return clients, nil
+}
+
+// GetByOrganizationID returns the clients which belong to an organization, newest first.
+// If return values are nil that means no matching records were found.
+func (cs *ClientStore) GetByOrganizationID(organizationID string) ([]oauth2.ClientInfo, error) {
+	query := `select ` + clientColumns + ` from oauth2_clients where organization_id = ? and deleted_at is null order by created_at desc;`
+	clients, err := cs.queryClients(query, organizationID)
+	if err != nil {
+		return nil, fmt.Errorf("client store: GetByOrganizationID: %v", err)
+	}
+	return clients, nil
+}
+
+func (cs *ClientStore) queryClients(query string, args ...interface{}) ([]oauth2.ClientInfo, error) {
 	stmt, err := cs.db.Prepare(query)
 	if err != nil {
-		return nil, fmt.Errorf("client store: failed to prepare GetByID: %v", err)
+		return nil, fmt.Errorf("failed to prepare: %v", err)
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(userId)
+	rows, err := stmt.Query(args...)
 	if err != nil {
-		return nil, fmt.Errorf("client store: failed to query GetByID: %v", err)
+		return nil, fmt.Errorf("failed to query: %v", err)
 	}
 	defer rows.Close()
 
-	var clients []oauth2.ClientInfo
+	var found []*Client
 	for rows.Next() {
-		var client models.Client
-		if err := rows.Scan(&client.ID, &client.Secret, &client.Domain, &client.UserID); err != nil {
-			if strings.Contains(err.Error(), "no rows in result set") {
-				continue // not found
-			}
+		client, err := scanClient(rows)
+		if err != nil {
 			return nil, fmt.Errorf("readClient: rows.Scan: %v", err)
 		}
-		clients = append(clients, &client)
+		found = append(found, client)
 	}
-	return clients, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := cs.readPreviousSecrets(found...); err != nil {
+		return nil, err
+	}
+	var clients []oauth2.ClientInfo
+	for i := range found {
+		clients = append(clients, found[i])
+	}
+	return clients, nil
+}
+
+// RotateSecret replaces the secret of client id with secret. The current secret is kept as a
+// previous secret and accepted for the grace period, a zero grace period revokes it immediately.
+func (cs *ClientStore) RotateSecret(id string, secret string, grace time.Duration) error {
+	if secret == "" {
+		return errors.New("client store: empty client secret")
+	}
+
+	tx, err := cs.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var current, hint sql.NullString
+	var secretCreatedAt *time.Time
+	var createdAt time.Time
+	query := `select secret, secret_hint, secret_created_at, created_at from oauth2_clients where id = ? and deleted_at is null order by created_at desc limit 1;`
+	if err := tx.QueryRow(query, id).Scan(&current, &hint, &secretCreatedAt, &createdAt); err != nil {
+		e := tx.Rollback()
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return fmt.Errorf("client store: client %s not found", id)
+		}
+		return fmt.Errorf("problem reading secret of client %s, err=%v, rollback err=%v", id, err, e)
+	}
+
+	if secretCreatedAt != nil {
+		createdAt = *secretCreatedAt
+	}
+
+	now := time.Now()
+	if grace > 0 {
+		query = `insert into oauth2_client_secrets (client_id, secret, secret_hint, created_at, expires_at) values (?, ?, ?, ?, ?);`
+		if _, err := tx.Exec(query, id, hashSecret(current.String), hint.String, createdAt, now.Add(grace)); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem saving previous secret of client %s, err=%v, rollback err=%v", id, err, e)
+		}
+	}
+
+	query = `update oauth2_clients set secret = ?, secret_hint = ?, secret_created_at = ? where id = ? and deleted_at is null;`
+	if _, err := tx.Exec(query, hashSecret(secret), secretHint(secret), now, id); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem updating secret of client %s, err=%v, rollback err=%v", id, err, e)
+	}
+	return tx.Commit()
+}
+
+// hashPlaintextSecrets replaces client secrets written before secrets were hashed.
+func (cs *ClientStore) hashPlaintextSecrets() error {
+	rows, err := cs.db.Query(`select id, secret from oauth2_clients where secret not like ?`, hashedSecretPrefix+"%")
+	if err != nil {
+		return fmt.Errorf("client store: failed to find plaintext secrets: %v", err)
+	}
+	secrets := make(map[string]string)
+	for rows.Next() {
+		var id, secret string
+		if err := rows.Scan(&id, &secret); err != nil {
+			rows.Close()
+			return fmt.Errorf("client store: failed to read plaintext secret: %v", err)
+		}
+		secrets[id] = secret
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stmt, err := cs.db.Prepare(`update oauth2_clients set secret = ?, secret_hint = ? where id = ? and secret = ?`)
+	if err != nil {
+		return fmt.Errorf("client store: failed to prepare hashPlaintextSecrets: %v", err)
+	}
+	defer stmt.Close()
+
+	for id, secret := range secrets {
+		if _, err := stmt.Exec(hashSecret(secret), secretHint(secret), id, secret); err != nil {
+			return fmt.Errorf("client store: failed to hash secret of client %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// SetRedirectURIs replaces the registered redirect URIs of client id.
+func (cs *ClientStore) SetRedirectURIs(id string, uris []string) error {
+	query := `update oauth2_clients set redirect_uris = ? where id = ? and deleted_at is null;`
+	stmt, err := cs.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("client store: failed to prepare SetRedirectURIs: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(strings.Join(uris, " "), id)
+	return err
 }
 
 // DeleteByID removes the oauth2.ClientInfo for the provided id.
@@ -157,3 +478,63 @@ func (cs *ClientStore) DeleteByID(id string) error {
 	_, err = stmt.Exec(time.Now(), id)
 	return err
 }
+
+// PurgeByUserID permanently deletes every client of the user (including deleted clients) and their
+// rotated secrets. Clients of an organization are kept for the organization, but no longer reference
+// the user. The number of clients deleted and the number of organization clients kept are returned.
+func (cs *ClientStore) PurgeByUserID(userID string) (int64, int64, error) {
+	tx, err := cs.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	personal := `user_id = ? and (organization_id is null or organization_id = '')`
+	if _, err := tx.Exec(`delete from oauth2_client_secrets where client_id in (select id from oauth2_clients where `+personal+`)`, userID); err != nil {
+		e := tx.Rollback()
+		return 0, 0, fmt.Errorf("client store: failed to purge secrets of user: %v, rollback err=%v", err, e)
+	}
+	res, err := tx.Exec(`delete from oauth2_clients where `+personal, userID)
+	if err != nil {
+		e := tx.Rollback()
+		return 0, 0, fmt.Errorf("client store: failed to purge clients of user: %v, rollback err=%v", err, e)
+	}
+	removed, _ := res.RowsAffected()
+	res, err = tx.Exec(`update oauth2_clients set user_id = '' where user_id = ?`, userID)
+	if err != nil {
+		e := tx.Rollback()
+		return 0, 0, fmt.Errorf("client store: failed to anonymize organization clients of user: %v, rollback err=%v", err, e)
+	}
+	anonymized, _ := res.RowsAffected()
+	return removed, anonymized, tx.Commit()
+}
+
+// CountByUserID returns how many clients, including deleted clients, reference the user.
+func (cs *ClientStore) CountByUserID(userID string) (int64, error) {
+	var n int64
+	if err := cs.db.QueryRow(`select count(*) from oauth2_clients where user_id = ?`, userID).Scan(&n); err != nil {
+		return 0, fmt.Errorf("client store: failed to count clients of user: %v", err)
+	}
+	return n, nil
+}
+
+// PurgeDeleted permanently deletes up to limit clients which were deleted before the given time,
+// along with rotated secrets which expired before then or belong to purged clients. The number of
+// rows deleted is returned.
+func (cs *ClientStore) PurgeDeleted(before time.Time, limit int) (int64, error) {
+	query := `delete from oauth2_clients where rowid in (select rowid from oauth2_clients where deleted_at is not null and deleted_at < ? limit ?)`
+	res, err := cs.db.Exec(query, before, limit)
+	if err != nil {
+		return 0, fmt.Errorf("client store: failed to purge deleted clients: %v", err)
+	}
+	removed, _ := res.RowsAffected()
+	if removed >= int64(limit) {
+		return removed, nil
+	}
+
+	query = `delete from oauth2_client_secrets where rowid in (select rowid from oauth2_client_secrets where expires_at < ? or client_id not in (select id from oauth2_clients) limit ?)`
+	res, err = cs.db.Exec(query, before, limit-int(removed))
+	if err != nil {
+		return removed, fmt.Errorf("client store: failed to purge expired secrets: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	return removed + n, nil
+}
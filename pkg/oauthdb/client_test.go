@@ -8,8 +8,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"gopkg.in/oauth2.v3"
 	"gopkg.in/oauth2.v3/models"
 )
 
@@ -95,3 +99,313 @@ func TestClientStore(t *testing.T) {
 		t.Fatalf("expected nothing, but got client=%v err=%v", client, err)
 	}
 }
+
+func TestClientStore__Scopes(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	c := &Client{
+		Client: models.Client{
+			ID:     generateID(),
+			Secret: generateID(),
+			Domain: "api.moov.io",
+			UserID: generateID(),
+		},
+		Scopes: []string{"read", "write"},
+	}
+	if err := cs.Set(c.ID, c); err != nil {
+		t.Fatalf("problem writing %v: %v", c, err)
+	}
+
+	client, err := cs.GetByID(c.ID)
+	if err != nil || client == nil {
+		t.Fatalf("expected client, but got client=%v err=%v", client, err)
+	}
+	scopes := client.(*Client).GetScopes()
+	if len(scopes) != 2 || scopes[0] != "read" || scopes[1] != "write" {
+		t.Errorf("got scopes: %v", scopes)
+	}
+
+	// clients without scopes
+	other := &models.Client{
+		ID:     generateID(),
+		Secret: generateID(),
+		UserID: generateID(),
+	}
+	if err := cs.Set(other.ID, other); err != nil {
+		t.Fatal(err)
+	}
+	client, err = cs.GetByID(other.ID)
+	if err != nil || client == nil {
+		t.Fatalf("expected client, but got client=%v err=%v", client, err)
+	}
+	if scopes := client.(*Client).GetScopes(); len(scopes) != 0 {
+		t.Errorf("got scopes: %v", scopes)
+	}
+}
+
+func TestClientStore__GetByUserID(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	userId := generateID()
+	for _, name := range []string{"first", "second"} {
+		c := &Client{
+			Client: models.Client{
+				ID:     generateID(),
+				Secret: generateID(),
+				UserID: userId,
+			},
+			Name:        name,
+			Description: "for " + name,
+		}
+		if err := cs.Set(c.ID, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clients, err := cs.GetByUserID(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 2 {
+		t.Fatalf("got %d clients", len(clients))
+	}
+	for i := range clients {
+		c := clients[i].(*Client)
+		if c.Name == "" || c.Description != "for "+c.Name || c.CreatedAt.IsZero() {
+			t.Errorf("unexpected client: %#v", c)
+		}
+	}
+}
+
+func TestClientStore__RedirectURIs(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	c := &Client{
+		Client: models.Client{
+			ID:     generateID(),
+			Secret: generateID(),
+			UserID: generateID(),
+		},
+		RedirectURIs: []string{"https://app.example.com/callback"},
+	}
+	if err := cs.Set(c.ID, c); err != nil {
+		t.Fatal(err)
+	}
+	client, err := cs.GetByID(c.ID)
+	if err != nil || client == nil {
+		t.Fatalf("expected client, but got client=%v err=%v", client, err)
+	}
+	if uris := client.(*Client).RedirectURIs; len(uris) != 1 || uris[0] != c.RedirectURIs[0] {
+		t.Errorf("got redirect URIs: %v", uris)
+	}
+
+	// replace them
+	uris := []string{"https://app.example.com/a", "http://localhost:8080/b"}
+	if err := cs.SetRedirectURIs(c.ID, uris); err != nil {
+		t.Fatal(err)
+	}
+	client, err = cs.GetByID(c.ID)
+	if err != nil || client == nil {
+		t.Fatalf("expected client, but got client=%v err=%v", client, err)
+	}
+	if got := client.(*Client).RedirectURIs; len(got) != 2 || got[0] != uris[0] || got[1] != uris[1] {
+		t.Errorf("got redirect URIs: %v", got)
+	}
+}
+
+func TestClientStore__PurgeDeleted(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	var clients []*models.Client
+	for i := 0; i < 3; i++ {
+		c := &models.Client{
+			ID:     generateID(),
+			Secret: generateID(),
+			UserID: generateID(),
+		}
+		if err := cs.Set(c.ID, c); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+	// rotated secrets of a deleted client are purged with it
+	if err := cs.RotateSecret(clients[0].ID, generateID(), 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients[:2] {
+		if err := cs.DeleteByID(c.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// too recent
+	n, err := cs.PurgeDeleted(time.Now().Add(-1*time.Minute), 10)
+	if err != nil || n != 0 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+
+	n, err = cs.PurgeDeleted(time.Now().Add(time.Minute), 10)
+	if err != nil || n != 3 {
+		t.Fatalf("n=%d err=%v", n, err) // two clients and one secret
+	}
+	var count int
+	if err := cs.db.QueryRow(`select count(*) from oauth2_clients`).Scan(&count); err != nil || count != 1 {
+		t.Errorf("count=%d err=%v", count, err)
+	}
+	if cli, err := cs.GetByID(clients[2].ID); err != nil || cli == nil {
+		t.Errorf("expected client, err=%v", err)
+	}
+}
+
+func TestClientStore__GetByOrganizationID(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	orgId := generateID()
+	c := &Client{
+		Client: models.Client{
+			ID:     generateID(),
+			Secret: generateID(),
+			UserID: generateID(),
+		},
+		OrganizationID: orgId,
+	}
+	if err := cs.Set(c.ID, c); err != nil {
+		t.Fatal(err)
+	}
+	clients, err := cs.GetByOrganizationID(orgId)
+	if err != nil || len(clients) != 1 {
+		t.Fatalf("got clients=%v err=%v", clients, err)
+	}
+	if id := clients[0].(*Client).OrganizationID; id != orgId {
+		t.Errorf("got organization %q", id)
+	}
+	if clients, err := cs.GetByOrganizationID(generateID()); err != nil || len(clients) != 0 {
+		t.Errorf("got clients=%v err=%v", clients, err)
+	}
+}
+
+func TestClientStore__PurgeByUserID(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	userID := generateID()
+	personal := &models.Client{ID: generateID(), Secret: generateID(), UserID: userID}
+	deleted := &models.Client{ID: generateID(), Secret: generateID(), UserID: userID}
+	org := &Client{
+		Client:         models.Client{ID: generateID(), Secret: generateID(), UserID: userID},
+		OrganizationID: generateID(),
+	}
+	other := &models.Client{ID: generateID(), Secret: generateID(), UserID: generateID()}
+	for _, c := range []oauth2.ClientInfo{personal, deleted, org, other} {
+		if err := cs.Set(c.GetID(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cs.RotateSecret(personal.ID, generateID(), 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.DeleteByID(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, anonymized, err := cs.PurgeByUserID(userID)
+	if err != nil || removed != 2 || anonymized != 1 {
+		t.Fatalf("removed=%d anonymized=%d err=%v", removed, anonymized, err)
+	}
+	if n, err := cs.CountByUserID(userID); err != nil || n != 0 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+	var secrets int
+	if err := cs.db.QueryRow(`select count(*) from oauth2_client_secrets where client_id = ?`, personal.ID).Scan(&secrets); err != nil || secrets != 0 {
+		t.Errorf("secrets=%d err=%v", secrets, err)
+	}
+	if cli, err := cs.GetByID(org.ID); err != nil || cli == nil || cli.GetUserID() != "" {
+		t.Errorf("expected organization client without user, got %#v err=%v", cli, err)
+	}
+	if n, err := cs.CountByUserID(other.UserID); err != nil || n != 1 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+}
+
+func TestClientStore__Create(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	userId := generateID()
+	newClient := func(name string) *Client {
+		return &Client{
+			Client: models.Client{ID: generateID(), Secret: generateID(), UserID: userId},
+			Name:   name,
+		}
+	}
+
+	// concurrent creates don't go over the limit
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- cs.Create(newClient(fmt.Sprintf("client %d", i)), 3)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil && err != ErrClientLimit && !strings.Contains(err.Error(), "locked") {
+			t.Error(err)
+		}
+	}
+	clients, err := cs.GetByUserID(userId)
+	if err != nil || len(clients) != 3 {
+		t.Fatalf("got %d clients, err=%v", len(clients), err)
+	}
+
+	if err := cs.Create(newClient(strings.ToUpper(clients[0].(*Client).Name)), 10); err != ErrClientNameTaken {
+		t.Errorf("expected ErrClientNameTaken, got %v", err)
+	}
+	if err := cs.Create(newClient(""), 10); err != nil {
+		t.Error(err)
+	}
+
+	// organization clients are limited separately
+	c := newClient("client 0")
+	c.OrganizationID = generateID()
+	if err := cs.Create(c, 1); err != nil {
+		t.Fatal(err)
+	}
+	c = newClient("other")
+	c.OrganizationID = generateID()
+	if err := cs.Create(c, 1); err != nil {
+		t.Fatal(err)
+	}
+	if cli, err := cs.GetByID(c.ID); err != nil || cli.(*Client).OrganizationID != c.OrganizationID || !cli.(*Client).VerifyPassword(c.Secret) {
+		t.Errorf("unexpected client %#v err=%v", cli, err)
+	}
+}
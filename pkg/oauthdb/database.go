@@ -39,11 +39,18 @@ func migrate(db *sql.DB, queries []string) error {
 	for i, query := range queries {
 		stmt, err := db.Prepare(query)
 		if err != nil {
+			if isDuplicateColumnError(err) {
+				continue // column was added by an earlier run
+			}
 			return fmt.Errorf("migration #%d [%s...] didn't prepare: %v", i, query[:40], err)
 		}
 
 		res, err := stmt.Exec()
 		if err != nil {
+			stmt.Close()
+			if isDuplicateColumnError(err) {
+				continue // column was added by an earlier run
+			}
 			return fmt.Errorf("migration #%d [%s...] had problem: %v", i, query[:40], err)
 		}
 
@@ -57,6 +64,15 @@ func migrate(db *sql.DB, queries []string) error {
 	return nil
 }
 
+// isDuplicateColumnError returns true when err is from an 'alter table ... add column' migration
+// that has already been applied.
+func isDuplicateColumnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), "duplicate column name")
+}
+
 // generateID creates a new random ID
 func generateID() string {
 	bs := make([]byte, 20)
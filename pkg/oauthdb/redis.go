@@ -0,0 +1,563 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package oauthdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// RedisTokenStore is an oauth2.TokenStore which keeps tokens in Redis (or a server speaking
+// the Redis protocol). Tokens and each of their code, access and refresh values are written
+// with a TTL so Redis removes them once expired.
+type RedisTokenStore struct {
+	client *redis.Client
+}
+
+// NewRedisTokenStore returns a RedisTokenStore connected to the server at redisURL.
+//
+//   store, err := oauthdb.NewRedisTokenStore("redis://localhost:6379/0")
+//
+// redisURL follows the redis URI scheme, See https://www.iana.org/assignments/uri-schemes/prov/redis
+func NewRedisTokenStore(redisURL string) (*RedisTokenStore, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("problem parsing redis URL: %v", err)
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("problem with Ping against redis %s: %v", opts.Addr, err)
+	}
+	return &RedisTokenStore{client: client}, nil
+}
+
+// Close shuts down connections to the underlying redis server
+func (rs *RedisTokenStore) Close() error {
+	return rs.client.Close()
+}
+
+const redisKeyPrefix = "oauth2:"
+
+func redisTokenKey(id string) string            { return redisKeyPrefix + "token:" + id }
+func redisCodeKey(code string) string           { return redisKeyPrefix + "code:" + code }
+func redisAccessKey(access string) string       { return redisKeyPrefix + "access:" + access }
+func redisRefreshKey(refresh string) string     { return redisKeyPrefix + "refresh:" + refresh }
+func redisUsedRefreshKey(refresh string) string { return redisKeyPrefix + "used-refresh:" + refresh }
+func redisClaimKey(refresh string) string       { return redisKeyPrefix + "claimed-refresh:" + refresh }
+func redisFamilyKey(family string) string       { return redisKeyPrefix + "family:" + family }
+func redisClientKey(clientID string) string     { return redisKeyPrefix + "client:" + clientID }
+func redisUserKey(userID string) string         { return redisKeyPrefix + "user:" + userID }
+
+// redisToken is the value stored for each token
+type redisToken struct {
+	models.Token
+
+	ID     string `json:"id"`
+	Family string `json:"family"`
+}
+
+// remaining returns how long a part of the token is valid for. ok is false when the part has
+// no value or has already expired, and a zero duration means the part never expires.
+func remaining(value string, createdAt time.Time, expiresIn time.Duration, now time.Time) (ttl time.Duration, ok bool) {
+	if value == "" {
+		return 0, false
+	}
+	if expiresIn <= 0 {
+		return 0, true
+	}
+	if createdAt.IsZero() {
+		createdAt = now
+	}
+	ttl = createdAt.Add(expiresIn).Sub(now)
+	return ttl, ttl > 0
+}
+
+// lifetime returns how long the token needs to be kept for, which is the longest of its parts.
+// A zero duration means the token never expires.
+func (t *redisToken) lifetime(now time.Time) (time.Duration, bool) {
+	var longest time.Duration
+	var found bool
+	parts := []struct {
+		value     string
+		createdAt time.Time
+		expiresIn time.Duration
+	}{
+		{t.Code, t.CodeCreateAt, t.CodeExpiresIn},
+		{t.Access, t.AccessCreateAt, t.AccessExpiresIn},
+		{t.Refresh, t.RefreshCreateAt, t.RefreshExpiresIn},
+	}
+	for _, p := range parts {
+		ttl, ok := remaining(p.value, p.createdAt, p.expiresIn, now)
+		if !ok {
+			continue
+		}
+		if ttl == 0 {
+			return 0, true
+		}
+		found = true
+		if ttl > longest {
+			longest = ttl
+		}
+	}
+	return longest, found
+}
+
+func newRedisToken(info oauth2.TokenInfo) *redisToken {
+	now := time.Now()
+	t := &redisToken{
+		Token: models.Token{
+			ClientID:         info.GetClientID(),
+			UserID:           info.GetUserID(),
+			RedirectURI:      info.GetRedirectURI(),
+			Scope:            info.GetScope(),
+			Code:             info.GetCode(),
+			CodeCreateAt:     info.GetCodeCreateAt(),
+			CodeExpiresIn:    info.GetCodeExpiresIn(),
+			Access:           info.GetAccess(),
+			AccessCreateAt:   info.GetAccessCreateAt(),
+			AccessExpiresIn:  info.GetAccessExpiresIn(),
+			Refresh:          info.GetRefresh(),
+			RefreshCreateAt:  info.GetRefreshCreateAt(),
+			RefreshExpiresIn: info.GetRefreshExpiresIn(),
+		},
+	}
+	for _, ts := range []*time.Time{&t.CodeCreateAt, &t.AccessCreateAt, &t.RefreshCreateAt} {
+		if ts.IsZero() {
+			*ts = now
+		}
+	}
+	return t
+}
+
+// Create writes an oauth2.TokenInfo into redis.
+//
+// A token with the same code, access or refresh value is replaced by the incoming token. This is
+// done to update the userId on a given token. New tokens start their own refresh token family,
+// replaced tokens keep their existing family.
+func (rs *RedisTokenStore) Create(info oauth2.TokenInfo) error {
+	token := newRedisToken(info)
+	var keys []string
+	if token.Access != "" {
+		keys = append(keys, redisAccessKey(token.Access))
+	}
+	if token.Code != "" {
+		keys = append(keys, redisCodeKey(token.Code))
+	}
+	if token.Refresh != "" {
+		keys = append(keys, redisRefreshKey(token.Refresh))
+	}
+	for _, key := range keys {
+		existing, err := rs.getBy(key)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			token.ID, token.Family = existing.ID, existing.Family
+
+			// the token moves out of the sets of its previous user and client
+			if existing.UserID != token.UserID {
+				if err := rs.client.SRem(redisUserKey(existing.UserID), existing.ID).Err(); err != nil {
+					return fmt.Errorf("redis token store: failed to remove token from user: %v", err)
+				}
+			}
+			if existing.ClientID != token.ClientID {
+				if err := rs.client.SRem(redisClientKey(existing.ClientID), existing.ID).Err(); err != nil {
+					return fmt.Errorf("redis token store: failed to remove token from client: %v", err)
+				}
+			}
+			break
+		}
+	}
+	if token.ID == "" {
+		token.ID, token.Family = generateID(), generateID()
+	}
+	return rs.write(token)
+}
+
+// redisAddToSet adds ARGV[1] to the set at KEYS[1], which is kept for at least ARGV[2]
+// milliseconds (0 keeps it forever). A set's TTL is only ever extended so it outlives every
+// token listed in it.
+var redisAddToSet = redis.NewScript(`
+local existed = redis.call('EXISTS', KEYS[1])
+redis.call('SADD', KEYS[1], ARGV[1])
+local ttl = tonumber(ARGV[2])
+if ttl == 0 then
+	redis.call('PERSIST', KEYS[1])
+	return 0
+end
+local current = redis.call('PTTL', KEYS[1])
+if existed == 0 or (current >= 0 and current < ttl) then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 0
+`)
+
+// write saves the token and its lookup keys, each part expires on its own.
+func (rs *RedisTokenStore) write(token *redisToken) error {
+	now := time.Now()
+	ttl, ok := token.lifetime(now)
+	if !ok {
+		return nil // already expired
+	}
+	bs, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("redis token store: failed to encode token: %v", err)
+	}
+
+	_, err = rs.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(redisTokenKey(token.ID), bs, ttl)
+		if v, ok := remaining(token.Code, token.CodeCreateAt, token.CodeExpiresIn, now); ok {
+			pipe.Set(redisCodeKey(token.Code), token.ID, v)
+		}
+		if v, ok := remaining(token.Access, token.AccessCreateAt, token.AccessExpiresIn, now); ok {
+			pipe.Set(redisAccessKey(token.Access), token.ID, v)
+		}
+		if v, ok := remaining(token.Refresh, token.RefreshCreateAt, token.RefreshExpiresIn, now); ok {
+			pipe.Set(redisRefreshKey(token.Refresh), token.ID, v)
+		}
+		for _, key := range []string{redisFamilyKey(token.Family), redisClientKey(token.ClientID), redisUserKey(token.UserID)} {
+			redisAddToSet.Eval(pipe, []string{key}, token.ID, int64(ttl/time.Millisecond))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis token store: failed to write token: %v", err)
+	}
+	return nil
+}
+
+// getBy reads the token whose ID is stored at key. nil is returned if either is missing.
+func (rs *RedisTokenStore) getBy(key string) (*redisToken, error) {
+	id, err := rs.client.Get(key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis token store: failed to read %s: %v", key, err)
+	}
+	return rs.get(id)
+}
+
+func (rs *RedisTokenStore) get(id string) (*redisToken, error) {
+	bs, err := rs.client.Get(redisTokenKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis token store: failed to read token: %v", err)
+	}
+	var token redisToken
+	if err := json.Unmarshal(bs, &token); err != nil {
+		return nil, fmt.Errorf("redis token store: failed to decode token: %v", err)
+	}
+	return &token, nil
+}
+
+// remove deletes a token and its lookup keys. Refresh tokens which haven't expired are remembered
+// so a reused refresh token can still be traced back to its family.
+func (rs *RedisTokenStore) remove(token *redisToken) error {
+	if token == nil {
+		return nil
+	}
+	now := time.Now()
+	_, err := rs.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(redisTokenKey(token.ID))
+		if token.Code != "" {
+			pipe.Del(redisCodeKey(token.Code))
+		}
+		if token.Access != "" {
+			pipe.Del(redisAccessKey(token.Access))
+		}
+		if token.Refresh != "" {
+			pipe.Del(redisRefreshKey(token.Refresh))
+			if v, ok := remaining(token.Refresh, token.RefreshCreateAt, token.RefreshExpiresIn, now); ok {
+				pipe.Set(redisUsedRefreshKey(token.Refresh), token.Family, v)
+			}
+		}
+		pipe.SRem(redisFamilyKey(token.Family), token.ID)
+		pipe.SRem(redisClientKey(token.ClientID), token.ID)
+		pipe.SRem(redisUserKey(token.UserID), token.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis token store: failed to remove token: %v", err)
+	}
+	return nil
+}
+
+func (rs *RedisTokenStore) removeBy(key string) error {
+	token, err := rs.getBy(key)
+	if err != nil {
+		return err
+	}
+	return rs.remove(token)
+}
+
+// removeSet deletes every token listed in the set at key, and the set itself.
+func (rs *RedisTokenStore) removeSet(key string) error {
+	ids, err := rs.client.SMembers(key).Result()
+	if err != nil {
+		return fmt.Errorf("redis token store: failed to read %s: %v", key, err)
+	}
+	for i := range ids {
+		token, err := rs.get(ids[i])
+		if err != nil {
+			return err
+		}
+		if err := rs.remove(token); err != nil {
+			return err
+		}
+	}
+	return rs.client.Del(key).Err()
+}
+
+// RemoveByCode use the authorization code to delete the token information
+func (rs *RedisTokenStore) RemoveByCode(code string) error {
+	return rs.removeBy(redisCodeKey(code))
+}
+
+// RemoveByAccess use the access token to delete the token information
+func (rs *RedisTokenStore) RemoveByAccess(access string) error {
+	return rs.removeBy(redisAccessKey(access))
+}
+
+// RemoveByRefresh use the refresh token to delete the token information
+func (rs *RedisTokenStore) RemoveByRefresh(refresh string) error {
+	return rs.removeBy(redisRefreshKey(refresh))
+}
+
+// RemoveByClientID deletes every token issued to the OAuth2 client
+func (rs *RedisTokenStore) RemoveByClientID(clientID string) error {
+	return rs.removeSet(redisClientKey(clientID))
+}
+
+// RemoveByUserID deletes every token issued to the user
+func (rs *RedisTokenStore) RemoveByUserID(userID string) error {
+	return rs.removeSet(redisUserKey(userID))
+}
+
+// RemoveByClientAndUserID deletes every token the OAuth2 client issued to the user
+func (rs *RedisTokenStore) RemoveByClientAndUserID(clientID, userID string) error {
+	ids, err := rs.client.SInter(redisClientKey(clientID), redisUserKey(userID)).Result()
+	if err != nil {
+		return fmt.Errorf("redis token store: failed to read tokens of client and user: %v", err)
+	}
+	for i := range ids {
+		token, err := rs.get(ids[i])
+		if err != nil {
+			return err
+		}
+		if err := rs.remove(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeByUserID deletes every token issued to the user, returning how many were deleted.
+// Tokens are never kept once removed from Redis.
+//
+// Besides the tokens in the user's set, every stored token is scanned for the user, so tokens
+// missing from the set (i.e. if it expired first) are deleted as well.
+func (rs *RedisTokenStore) PurgeByUserID(userID string) (int64, error) {
+	tokens, err := rs.scanUserTokens(userID)
+	if err != nil {
+		return 0, err
+	}
+	if err := rs.removeSet(redisUserKey(userID)); err != nil {
+		return 0, err
+	}
+	for i := range tokens {
+		if err := rs.remove(tokens[i]); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(tokens)), nil
+}
+
+// CountByUserID returns how many tokens are stored for the user. Every stored token is scanned,
+// rather than trusting the user's set, so this verifies PurgeByUserID.
+func (rs *RedisTokenStore) CountByUserID(userID string) (int64, error) {
+	tokens, err := rs.scanUserTokens(userID)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(tokens)), nil
+}
+
+// scanUserTokens returns every stored token issued to the user. The code, access and refresh
+// keys all point at these tokens.
+func (rs *RedisTokenStore) scanUserTokens(userID string) ([]*redisToken, error) {
+	var tokens []*redisToken
+	var cursor uint64
+	for {
+		keys, next, err := rs.client.Scan(cursor, redisTokenKey("*"), 500).Result()
+		if err != nil {
+			return nil, fmt.Errorf("redis token store: failed to scan tokens: %v", err)
+		}
+		for i := range keys {
+			token, err := rs.get(strings.TrimPrefix(keys[i], redisTokenKey("")))
+			if err != nil {
+				return nil, err
+			}
+			if token != nil && token.UserID == userID {
+				tokens = append(tokens, token)
+			}
+		}
+		if next == 0 {
+			return tokens, nil
+		}
+		cursor = next
+	}
+}
+
+// MetadataByUserID returns every token stored for the user, oldest first.
+func (rs *RedisTokenStore) MetadataByUserID(userID string) ([]TokenMetadata, error) {
+	ids, err := rs.client.SMembers(redisUserKey(userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis token store: failed to read tokens of user: %v", err)
+	}
+	var tokens []TokenMetadata
+	for i := range ids {
+		token, err := rs.get(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		if token == nil {
+			continue // expired
+		}
+		md := TokenMetadata{
+			ClientID:    token.ClientID,
+			RedirectURI: token.RedirectURI,
+			Scope:       token.Scope,
+			CreatedAt:   token.CodeCreateAt,
+		}
+		if token.Access != "" {
+			md.CreatedAt = token.AccessCreateAt
+			if token.AccessExpiresIn > 0 {
+				t := token.AccessCreateAt.Add(token.AccessExpiresIn)
+				md.AccessExpiresAt = &t
+			}
+		}
+		if token.Refresh != "" && token.RefreshExpiresIn > 0 {
+			t := token.RefreshCreateAt.Add(token.RefreshExpiresIn)
+			md.RefreshExpiresAt = &t
+		}
+		tokens = append(tokens, md)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+// RemoveByFamily deletes every token issued under the refresh token family
+func (rs *RedisTokenStore) RemoveByFamily(family string) error {
+	return rs.removeSet(redisFamilyKey(family))
+}
+
+// GetFamilyByRefresh returns the family a refresh token was issued under and if the refresh token
+// has already been used (or otherwise removed). An empty family is returned for unknown tokens.
+func (rs *RedisTokenStore) GetFamilyByRefresh(refresh string) (string, bool, error) {
+	token, err := rs.getBy(redisRefreshKey(refresh))
+	if err != nil {
+		return "", false, err
+	}
+	if token != nil {
+		return token.Family, false, nil
+	}
+	family, err := rs.client.Get(redisUsedRefreshKey(refresh)).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("redis token store: failed on GetFamilyByRefresh: %v", err)
+	}
+	return family, true, nil
+}
+
+// ClaimRefresh marks the refresh token used before it's exchanged and returns its family. Only
+// one caller can claim a refresh token (with SETNX), claimed is false when it was already claimed
+// or removed (or is unknown, in which case family is empty).
+func (rs *RedisTokenStore) ClaimRefresh(refresh string) (string, bool, error) {
+	if refresh == "" {
+		return "", false, nil
+	}
+	token, err := rs.getBy(redisRefreshKey(refresh))
+	if err != nil {
+		return "", false, err
+	}
+	if token == nil {
+		family, _, err := rs.GetFamilyByRefresh(refresh)
+		return family, false, err
+	}
+	ttl, ok := remaining(token.Refresh, token.RefreshCreateAt, token.RefreshExpiresIn, time.Now())
+	if !ok {
+		return token.Family, true, nil // expired, which the manager rejects
+	}
+	claimed, err := rs.client.SetNX(redisClaimKey(refresh), token.Family, ttl).Result()
+	if err != nil {
+		return "", false, fmt.Errorf("redis token store: failed on ClaimRefresh: %v", err)
+	}
+	return token.Family, claimed, nil
+}
+
+// ReleaseRefresh undoes ClaimRefresh when the refresh token couldn't be exchanged.
+func (rs *RedisTokenStore) ReleaseRefresh(refresh string) error {
+	if err := rs.client.Del(redisClaimKey(refresh)).Err(); err != nil {
+		return fmt.Errorf("redis token store: failed on ReleaseRefresh: %v", err)
+	}
+	return nil
+}
+
+// SetFamily moves the token holding the refresh token into family. This is called after a refresh
+// token is rotated so the new token stays linked to the token it replaced.
+func (rs *RedisTokenStore) SetFamily(refresh, family string) error {
+	token, err := rs.getBy(redisRefreshKey(refresh))
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return errors.New("redis token store: refresh token not found")
+	}
+	if token.Family == family {
+		return nil
+	}
+	if err := rs.client.SRem(redisFamilyKey(token.Family), token.ID).Err(); err != nil {
+		return fmt.Errorf("redis token store: failed to leave family: %v", err)
+	}
+	token.Family = family
+	return rs.write(token)
+}
+
+// GetByCode use the authorization code for token information data
+func (rs *RedisTokenStore) GetByCode(code string) (oauth2.TokenInfo, error) {
+	return rs.tokenInfo(redisCodeKey(code))
+}
+
+// GetByAccess use the access token for token information data
+func (rs *RedisTokenStore) GetByAccess(access string) (oauth2.TokenInfo, error) {
+	return rs.tokenInfo(redisAccessKey(access))
+}
+
+// GetByRefresh use the refresh token for token information data
+func (rs *RedisTokenStore) GetByRefresh(refresh string) (oauth2.TokenInfo, error) {
+	return rs.tokenInfo(redisRefreshKey(refresh))
+}
+
+func (rs *RedisTokenStore) tokenInfo(key string) (oauth2.TokenInfo, error) {
+	token, err := rs.getBy(key)
+	if err != nil || token == nil {
+		return nil, err
+	}
+	return &token.Token, nil
+}
@@ -0,0 +1,409 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package oauthdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+type testRedisTokenStore struct {
+	*RedisTokenStore
+
+	server *miniredis.Miniredis
+}
+
+func (rs *testRedisTokenStore) Close() error {
+	defer rs.server.Close()
+	return rs.RedisTokenStore.Close()
+}
+
+func createTestRedisTokenStore(t *testing.T) *testRedisTokenStore {
+	t.Helper()
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := NewRedisTokenStore("redis://" + server.Addr())
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return &testRedisTokenStore{
+		RedisTokenStore: rs,
+		server:          server,
+	}
+}
+
+func TestRedisTokenStore(t *testing.T) {
+	rs := createTestRedisTokenStore(t)
+	defer rs.Close()
+
+	// expect nothing
+	token, err := rs.GetByAccess(generateID())
+	if err != nil || token != nil {
+		t.Fatalf("expected nothing, but got token=%v err=%v", token, err)
+	}
+
+	tk := &models.Token{
+		ClientID:         generateID(),
+		UserID:           generateID(),
+		Code:             generateID(),
+		CodeCreateAt:     time.Now(),
+		CodeExpiresIn:    10 * time.Minute,
+		Access:           generateID(),
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  30 * time.Minute,
+		Refresh:          generateID(),
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: 24 * time.Hour,
+	}
+	if err := rs.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	lookups := map[string]func(string) (oauth2.TokenInfo, error){
+		tk.Code:    rs.GetByCode,
+		tk.Access:  rs.GetByAccess,
+		tk.Refresh: rs.GetByRefresh,
+	}
+	for value, get := range lookups {
+		token, err := get(value)
+		if err != nil || token == nil {
+			t.Fatalf("expected token, but got token=%v err=%v", token, err)
+		}
+		if token.GetUserID() != tk.UserID {
+			t.Errorf("got userId %s", token.GetUserID())
+		}
+	}
+
+	// re-writing the token updates it in place
+	tk.SetUserID(generateID())
+	if err := rs.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := rs.GetByAccess(tk.Access); err != nil || token.GetUserID() != tk.UserID {
+		t.Fatalf("expected updated token, but got token=%v err=%v", token, err)
+	}
+
+	// remove it
+	if err := rs.RemoveByAccess(tk.Access); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{redisCodeKey(tk.Code), redisAccessKey(tk.Access), redisRefreshKey(tk.Refresh)} {
+		if rs.server.Exists(key) {
+			t.Errorf("%s still exists", key)
+		}
+	}
+}
+
+func TestRedisTokenStore__Expiry(t *testing.T) {
+	rs := createTestRedisTokenStore(t)
+	defer rs.Close()
+
+	tk := &models.Token{
+		ClientID:         generateID(),
+		UserID:           generateID(),
+		Access:           generateID(),
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  30 * time.Minute,
+		Refresh:          generateID(),
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: 2 * time.Hour,
+	}
+	if err := rs.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+
+	// the access token expires before the refresh token
+	rs.server.FastForward(time.Hour)
+	if token, err := rs.GetByAccess(tk.Access); err != nil || token != nil {
+		t.Fatalf("expected expired access token, but got token=%v err=%v", token, err)
+	}
+	if token, err := rs.GetByRefresh(tk.Refresh); err != nil || token == nil {
+		t.Fatalf("expected token, but got token=%v err=%v", token, err)
+	}
+
+	// then everything is gone
+	rs.server.FastForward(time.Hour)
+	if keys := rs.server.Keys(); len(keys) != 0 {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+
+	// tokens which are already expired aren't written
+	tk.Access, tk.AccessCreateAt = generateID(), time.Now().Add(-1*time.Hour)
+	tk.Refresh, tk.RefreshCreateAt = "", time.Time{}
+	if err := rs.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	if keys := rs.server.Keys(); len(keys) != 0 {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+}
+
+func TestRedisTokenStore__Family(t *testing.T) {
+	rs := createTestRedisTokenStore(t)
+	defer rs.Close()
+
+	tk := &models.Token{
+		ClientID:         generateID(),
+		UserID:           generateID(),
+		Access:           generateID(),
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  30 * time.Minute,
+		Refresh:          generateID(),
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: 30 * time.Minute,
+	}
+	if err := rs.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	family, used, err := rs.GetFamilyByRefresh(tk.Refresh)
+	if err != nil || family == "" || used {
+		t.Fatalf("expected family, but got family=%q used=%v err=%v", family, used, err)
+	}
+
+	// a refresh token can only be claimed once, until it's released
+	if f, claimed, err := rs.ClaimRefresh(tk.Refresh); err != nil || f != family || !claimed {
+		t.Fatalf("expected claim, but got family=%q claimed=%v err=%v", f, claimed, err)
+	}
+	if f, claimed, err := rs.ClaimRefresh(tk.Refresh); err != nil || f != family || claimed {
+		t.Fatalf("expected claimed token, but got family=%q claimed=%v err=%v", f, claimed, err)
+	}
+	if err := rs.ReleaseRefresh(tk.Refresh); err != nil {
+		t.Fatal(err)
+	}
+	if _, claimed, err := rs.ClaimRefresh(tk.Refresh); err != nil || !claimed {
+		t.Fatalf("expected claim after release, but got claimed=%v err=%v", claimed, err)
+	}
+	if f, claimed, err := rs.ClaimRefresh(generateID()); err != nil || f != "" || claimed {
+		t.Fatalf("expected nothing, but got family=%q claimed=%v err=%v", f, claimed, err)
+	}
+
+	// rotate the refresh token
+	next := &models.Token{
+		ClientID:         tk.ClientID,
+		UserID:           tk.UserID,
+		Access:           generateID(),
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  30 * time.Minute,
+		Refresh:          generateID(),
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: 30 * time.Minute,
+	}
+	if err := rs.Create(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.RemoveByRefresh(tk.Refresh); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.SetFamily(next.Refresh, family); err != nil {
+		t.Fatal(err)
+	}
+	if f, used, err := rs.GetFamilyByRefresh(tk.Refresh); err != nil || f != family || !used {
+		t.Fatalf("expected used token, but got family=%q used=%v err=%v", f, used, err)
+	}
+	if f, used, err := rs.GetFamilyByRefresh(next.Refresh); err != nil || f != family || used {
+		t.Fatalf("expected unused token, but got family=%q used=%v err=%v", f, used, err)
+	}
+
+	// revoke the family
+	if err := rs.RemoveByFamily(family); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := rs.GetByRefresh(next.Refresh); err != nil || token != nil {
+		t.Fatalf("expected nothing, but got token=%v err=%v", token, err)
+	}
+}
+
+func TestRedisTokenStore__RemoveByClientID(t *testing.T) {
+	rs := createTestRedisTokenStore(t)
+	defer rs.Close()
+
+	clientID := generateID()
+	var accesses []string
+	for i := 0; i < 3; i++ {
+		tk := &models.Token{
+			ClientID:        clientID,
+			UserID:          generateID(),
+			Access:          generateID(),
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: 30 * time.Minute,
+		}
+		if err := rs.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+		accesses = append(accesses, tk.Access)
+	}
+	if err := rs.RemoveByClientID(clientID); err != nil {
+		t.Fatal(err)
+	}
+	for i := range accesses {
+		if token, err := rs.GetByAccess(accesses[i]); err != nil || token != nil {
+			t.Errorf("expected nothing, but got token=%v err=%v", token, err)
+		}
+	}
+}
+
+func TestRedisTokenStore__RemoveByUserID(t *testing.T) {
+	rs := createTestRedisTokenStore(t)
+	defer rs.Close()
+
+	userID := generateID()
+	var accesses []string
+	for i := 0; i < 3; i++ {
+		tk := &models.Token{
+			ClientID:        generateID(),
+			UserID:          userID,
+			Access:          generateID(),
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: 30 * time.Minute,
+		}
+		if err := rs.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+		accesses = append(accesses, tk.Access)
+	}
+	if err := rs.RemoveByUserID(userID); err != nil {
+		t.Fatal(err)
+	}
+	for i := range accesses {
+		if token, err := rs.GetByAccess(accesses[i]); err != nil || token != nil {
+			t.Errorf("expected nothing, but got token=%v err=%v", token, err)
+		}
+	}
+}
+
+func TestRedisTokenStore__PurgeByUserID(t *testing.T) {
+	rs := createTestRedisTokenStore(t)
+	defer rs.Close()
+
+	userID := generateID()
+	for i := 0; i < 3; i++ {
+		tk := &models.Token{
+			ClientID:        generateID(),
+			UserID:          userID,
+			Access:          generateID(),
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: 30 * time.Minute,
+		}
+		if err := rs.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := rs.CountByUserID(userID); err != nil || n != 3 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+
+	// tokens missing from the user's set are still found
+	if err := rs.client.Del(redisUserKey(userID)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rs.CountByUserID(userID); err != nil || n != 3 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if n, err := rs.PurgeByUserID(userID); err != nil || n != 3 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if n, err := rs.CountByUserID(userID); err != nil || n != 0 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+}
+
+func TestRedisTokenStore__MetadataByUserID(t *testing.T) {
+	rs := createTestRedisTokenStore(t)
+	defer rs.Close()
+
+	userID := generateID()
+	tk := &models.Token{
+		ClientID:        generateID(),
+		UserID:          userID,
+		Scope:           "read",
+		Access:          generateID(),
+		AccessCreateAt:  time.Now(),
+		AccessExpiresIn: 30 * time.Minute,
+		Refresh:         generateID(),
+		RefreshCreateAt: time.Now(),
+	}
+	if err := rs.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := rs.MetadataByUserID(userID)
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("tokens=%#v err=%v", tokens, err)
+	}
+	md := tokens[0]
+	if md.ClientID != tk.ClientID || md.Scope != "read" || md.AccessExpiresAt == nil {
+		t.Errorf("unexpected metadata: %#v", md)
+	}
+	if md.RefreshExpiresAt != nil {
+		t.Errorf("expected refresh token to never expire: %#v", md)
+	}
+}
+
+func TestRedisTokenStore__Sets(t *testing.T) {
+	rs := createTestRedisTokenStore(t)
+	defer rs.Close()
+
+	// tokens with a shorter lifetime don't shorten the sets listing longer lived tokens
+	userID := generateID()
+	long := &models.Token{
+		ClientID:         generateID(),
+		UserID:           userID,
+		Access:           generateID(),
+		AccessExpiresIn:  time.Hour,
+		Refresh:          generateID(),
+		RefreshExpiresIn: 24 * time.Hour,
+	}
+	if err := rs.Create(long); err != nil {
+		t.Fatal(err)
+	}
+	short := &models.Token{
+		ClientID:        long.ClientID,
+		UserID:          userID,
+		Access:          generateID(),
+		AccessExpiresIn: time.Minute,
+	}
+	if err := rs.Create(short); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{redisUserKey(userID), redisClientKey(long.ClientID)} {
+		if ttl := rs.server.TTL(key); ttl < 23*time.Hour {
+			t.Errorf("%s: ttl=%v", key, ttl)
+		}
+	}
+	rs.server.FastForward(2 * time.Hour)
+	if err := rs.RemoveByUserID(userID); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := rs.GetByRefresh(long.Refresh); err != nil || token != nil {
+		t.Errorf("expected nothing, but got token=%v err=%v", token, err)
+	}
+
+	// tokens given to another user leave the previous user's set
+	tk := &models.Token{
+		ClientID:        generateID(),
+		Access:          generateID(),
+		AccessExpiresIn: time.Hour,
+	}
+	if err := rs.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	tk.UserID = generateID()
+	if err := rs.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rs.CountByUserID(""); err != nil || n != 0 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+	if n, err := rs.CountByUserID(tk.UserID); err != nil || n != 1 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package oauthdb
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// hashedSecretPrefix marks client secrets which are stored as a SHA256 checksum.
+//
+// Client secrets are generated with enough entropy that a fast hash is sufficient.
+const hashedSecretPrefix = "sha256:"
+
+// hashSecret returns the at-rest form of a client secret. Secrets already hashed are returned as-is.
+func hashSecret(secret string) string {
+	if isHashedSecret(secret) {
+		return secret
+	}
+	return checksum(secret)
+}
+
+func checksum(secret string) string {
+	ss := sha256.Sum256([]byte(secret))
+	return hashedSecretPrefix + hex.EncodeToString(ss[:])
+}
+
+func isHashedSecret(secret string) bool {
+	return strings.HasPrefix(secret, hashedSecretPrefix)
+}
+
+// secretHint returns a masked form of secret which is safe to show users.
+func secretHint(secret string) string {
+	if len(secret) < 12 {
+		return "****"
+	}
+	return fmt.Sprintf("****%s", secret[len(secret)-4:])
+}
+
+// VerifyPassword compares the provided plaintext secret against the stored hash of the client's secret
+// and any previous secrets which haven't expired. The stored hash itself is never accepted as a secret.
+//
+// This matches oauth2.ClientPasswordVerifier from newer versions of gopkg.in/oauth2.v3
+func (c *Client) VerifyPassword(secret string) bool {
+	if secret == "" || c.Secret == "" {
+		return false
+	}
+	hashed := []byte(checksum(secret))
+	if subtle.ConstantTimeCompare(hashed, []byte(hashSecret(c.Secret))) == 1 {
+		return true
+	}
+	now := time.Now()
+	for i := range c.PreviousSecrets {
+		if c.PreviousSecrets[i].ExpiresAt.After(now) && subtle.ConstantTimeCompare(hashed, []byte(c.PreviousSecrets[i].Secret)) == 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package oauthdb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestSecret__hashSecret(t *testing.T) {
+	secret := generateID()
+	hashed := hashSecret(secret)
+	if !strings.HasPrefix(hashed, hashedSecretPrefix) || strings.Contains(hashed, secret) {
+		t.Errorf("unexpected hash: %s", hashed)
+	}
+	if v := hashSecret(hashed); v != hashed {
+		t.Errorf("hashed secret was hashed again: %s", v)
+	}
+	if v := secretHint(secret); v != "****"+secret[len(secret)-4:] {
+		t.Errorf("got hint %q", v)
+	}
+	if v := secretHint("short"); v != "****" {
+		t.Errorf("got hint %q", v)
+	}
+}
+
+func TestClientStore__hashedSecrets(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	c := &models.Client{
+		ID:     generateID(),
+		Secret: generateID(),
+		UserID: generateID(),
+	}
+	if err := cs.Set(c.ID, c); err != nil {
+		t.Fatal(err)
+	}
+
+	// the plaintext secret isn't stored
+	var stored string
+	if err := cs.db.QueryRow(`select secret from oauth2_clients where id = ?`, c.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored == c.Secret || !isHashedSecret(stored) {
+		t.Errorf("secret stored as %q", stored)
+	}
+
+	cli, err := cs.GetByID(c.ID)
+	if err != nil || cli == nil {
+		t.Fatalf("expected client, but got client=%v err=%v", cli, err)
+	}
+	client := cli.(*Client)
+	if !client.VerifyPassword(c.Secret) {
+		t.Error("expected secret to verify")
+	}
+	if client.VerifyPassword(generateID()) || client.VerifyPassword("") || client.VerifyPassword(stored) {
+		t.Error("expected other secrets to fail")
+	}
+	if client.SecretHint != secretHint(c.Secret) {
+		t.Errorf("got hint %q", client.SecretHint)
+	}
+}
+
+func TestClientStore__hashPlaintextSecrets(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	// write a client like older versions did
+	id, secret := generateID(), generateID()
+	_, err = cs.db.Exec(`insert into oauth2_clients (id, secret, domain, user_id, created_at) values (?, ?, ?, ?, ?)`, id, secret, "moov.io", generateID(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.hashPlaintextSecrets(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := cs.GetByID(id)
+	if err != nil || cli == nil {
+		t.Fatalf("expected client, but got client=%v err=%v", cli, err)
+	}
+	if cli.GetSecret() == secret || !cli.(*Client).VerifyPassword(secret) {
+		t.Errorf("secret wasn't hashed: %q", cli.GetSecret())
+	}
+	if v := cli.(*Client).SecretHint; v != secretHint(secret) {
+		t.Errorf("got hint %q", v)
+	}
+}
+
+func TestClientStore__RotateSecret(t *testing.T) {
+	cs, err := createTestClientStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	c := &models.Client{
+		ID:     generateID(),
+		Secret: generateID(),
+		UserID: generateID(),
+	}
+	if err := cs.Set(c.ID, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.RotateSecret(generateID(), generateID(), time.Hour); err == nil {
+		t.Error("expected error for unknown client")
+	}
+
+	second := generateID()
+	if err := cs.RotateSecret(c.ID, second, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	cli, err := cs.GetByID(c.ID)
+	if err != nil || cli == nil {
+		t.Fatalf("expected client, but got client=%v err=%v", cli, err)
+	}
+	client := cli.(*Client)
+	if !client.VerifyPassword(second) || !client.VerifyPassword(c.Secret) {
+		t.Error("expected both secrets to verify")
+	}
+	if len(client.PreviousSecrets) != 1 || client.PreviousSecrets[0].Hint != secretHint(c.Secret) || client.SecretHint != secretHint(second) {
+		t.Errorf("unexpected client: %#v", client)
+	}
+
+	// expired secrets aren't accepted
+	client.PreviousSecrets[0].ExpiresAt = time.Now().Add(-1 * time.Second)
+	if client.VerifyPassword(c.Secret) {
+		t.Error("expected expired secret to fail")
+	}
+
+	// rotate without a grace period
+	third := generateID()
+	if err := cs.RotateSecret(c.ID, third, 0); err != nil {
+		t.Fatal(err)
+	}
+	clients, err := cs.GetByUserID(c.UserID)
+	if err != nil || len(clients) != 1 {
+		t.Fatalf("got %d clients, err=%v", len(clients), err)
+	}
+	client = clients[0].(*Client)
+	if !client.VerifyPassword(third) || client.VerifyPassword(second) || !client.VerifyPassword(c.Secret) {
+		t.Error("unexpected secret verification")
+	}
+}
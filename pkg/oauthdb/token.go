@@ -54,6 +54,9 @@ func NewTokenStoreDB(connString string) (*TokenStore, error) {
 	if err := tokenStore.migrate(); err != nil {
 		return nil, err
 	}
+	if err := tokenStore.backfillTimestamps(); err != nil {
+		return nil, err
+	}
 	return tokenStore, nil
 }
 
@@ -68,6 +71,20 @@ func (ts *TokenStore) migrate() error {
 	}
 	queries := []string{
 		`create table if not exists oauth2_tokens(client_id, user_id, redirect_uri, scope, code, code_expires_in, access, access_expires_in, refresh, refresh_expires_in, created_at datetime, deleted_at datetime, unique (code, access, refresh) on conflict abort)`,
+
+		// Refresh token families, every token rotated from a refresh token shares its family_id
+		`alter table oauth2_tokens add column family_id`,
+
+		// Creation and expiration of each part of a token, expires_at is null when it doesn't expire
+		`alter table oauth2_tokens add column code_created_at datetime`,
+		`alter table oauth2_tokens add column code_expires_at datetime`,
+		`alter table oauth2_tokens add column access_created_at datetime`,
+		`alter table oauth2_tokens add column access_expires_at datetime`,
+		`alter table oauth2_tokens add column refresh_created_at datetime`,
+		`alter table oauth2_tokens add column refresh_expires_at datetime`,
+
+		// Set when a refresh token is claimed for rotation, so it can only be exchanged once
+		`alter table oauth2_tokens add column refresh_used_at datetime`,
 	}
 	return migrate(ts.db, queries)
 }
@@ -76,16 +93,279 @@ func (ts *TokenStore) migrate() error {
 //
 // If an existing token exists (matching code, access, and refresh) then that row will be
 // replaced by the incoming token. This is done to update the userId on a given token.
+//
+// New tokens start their own refresh token family, replaced tokens keep their existing family.
 func (ts *TokenStore) Create(info oauth2.TokenInfo) error {
-	query := `replace into oauth2_tokens (client_id, user_id, redirect_uri, scope, code, code_expires_in, access, access_expires_in, refresh, refresh_expires_in, created_at)
-values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	query := `replace into oauth2_tokens (client_id, user_id, redirect_uri, scope, code, code_expires_in, access, access_expires_in, refresh, refresh_expires_in, family_id, created_at,
+code_created_at, code_expires_at, access_created_at, access_expires_at, refresh_created_at, refresh_expires_at)
+values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, coalesce((select family_id from oauth2_tokens where code = ? and access = ? and refresh = ?), ?), ?, ?, ?, ?, ?, ?, ?)`
 	stmt, err := ts.db.Prepare(query)
 	if err != nil {
 		return fmt.Errorf("token store: failed to prepare Create: %v", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(info.GetClientID(), info.GetUserID(), info.GetRedirectURI(), info.GetScope(), info.GetCode(), info.GetCodeExpiresIn().String(), info.GetAccess(), info.GetAccessExpiresIn().String(), info.GetRefresh(), info.GetRefreshExpiresIn().String(), time.Now())
+	now := time.Now()
+	codeCreatedAt, codeExpiresAt := timestamps(info.GetCode(), info.GetCodeCreateAt(), info.GetCodeExpiresIn(), now)
+	accessCreatedAt, accessExpiresAt := timestamps(info.GetAccess(), info.GetAccessCreateAt(), info.GetAccessExpiresIn(), now)
+	refreshCreatedAt, refreshExpiresAt := timestamps(info.GetRefresh(), info.GetRefreshCreateAt(), info.GetRefreshExpiresIn(), now)
+
+	_, err = stmt.Exec(info.GetClientID(), info.GetUserID(), info.GetRedirectURI(), info.GetScope(), info.GetCode(), info.GetCodeExpiresIn().String(), info.GetAccess(), info.GetAccessExpiresIn().String(), info.GetRefresh(), info.GetRefreshExpiresIn().String(),
+		info.GetCode(), info.GetAccess(), info.GetRefresh(), generateID(), now,
+		codeCreatedAt, codeExpiresAt, accessCreatedAt, accessExpiresAt, refreshCreatedAt, refreshExpiresAt)
+	return err
+}
+
+// timestamps returns the creation and expiration times stored for one part of a token. Both are nil
+// when the token has no value for the part and the expiration is nil when the part doesn't expire.
+//
+// Timestamps are stored in UTC so they compare correctly in SQL.
+func timestamps(value string, createdAt time.Time, expiresIn time.Duration, now time.Time) (*time.Time, *time.Time) {
+	if value == "" {
+		return nil, nil
+	}
+	if createdAt.IsZero() {
+		createdAt = now
+	}
+	created := createdAt.UTC()
+	if expiresIn <= 0 {
+		return &created, nil
+	}
+	expires := created.Add(expiresIn)
+	return &created, &expires
+}
+
+// backfillTimestamps sets the creation and expiration columns of tokens written before they existed.
+// Those tokens only kept a single created_at and each expiration as a duration.
+func (ts *TokenStore) backfillTimestamps() error {
+	query := `select rowid, code, code_expires_in, access, access_expires_in, refresh, refresh_expires_in, created_at from oauth2_tokens
+where code_created_at is null and access_created_at is null and refresh_created_at is null`
+	rows, err := ts.db.Query(query)
+	if err != nil {
+		return fmt.Errorf("token store: failed to find tokens without timestamps: %v", err)
+	}
+	type row struct {
+		id                                               int64
+		code, access, refresh                            string
+		codeExpiresIn, accessExpiresIn, refreshExpiresIn sql.NullString
+		createdAt                                        time.Time
+	}
+	var found []row
+	for rows.Next() {
+		var r row
+		var code, access, refresh sql.NullString
+		if err := rows.Scan(&r.id, &code, &r.codeExpiresIn, &access, &r.accessExpiresIn, &refresh, &r.refreshExpiresIn, &r.createdAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("token store: backfillTimestamps: %v", err)
+		}
+		r.code, r.access, r.refresh = code.String, access.String, refresh.String
+		found = append(found, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return nil
+	}
+
+	stmt, err := ts.db.Prepare(`update oauth2_tokens set code_created_at = ?, code_expires_at = ?, access_created_at = ?, access_expires_at = ?, refresh_created_at = ?, refresh_expires_at = ? where rowid = ?`)
+	if err != nil {
+		return fmt.Errorf("token store: failed to prepare backfillTimestamps: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, r := range found {
+		codeCreatedAt, codeExpiresAt := timestamps(r.code, r.createdAt, parseDuration(r.codeExpiresIn.String), r.createdAt)
+		accessCreatedAt, accessExpiresAt := timestamps(r.access, r.createdAt, parseDuration(r.accessExpiresIn.String), r.createdAt)
+		refreshCreatedAt, refreshExpiresAt := timestamps(r.refresh, r.createdAt, parseDuration(r.refreshExpiresIn.String), r.createdAt)
+		if _, err := stmt.Exec(codeCreatedAt, codeExpiresAt, accessCreatedAt, accessExpiresAt, refreshCreatedAt, refreshExpiresAt, r.id); err != nil {
+			return fmt.Errorf("token store: failed to backfill timestamps: %v", err)
+		}
+	}
+	return nil
+}
+
+func parseDuration(v string) time.Duration {
+	dur, err := time.ParseDuration(v)
+	if err != nil {
+		return 0
+	}
+	return dur
+}
+
+// RemoveByClientID deletes every token issued to the OAuth2 client
+func (ts *TokenStore) RemoveByClientID(clientID string) error {
+	query := `update oauth2_tokens set deleted_at = ? where client_id = ? and deleted_at is null`
+	stmt, err := ts.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("token store: failed to prepare RemoveByClientID: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(time.Now(), clientID)
+	return err
+}
+
+// RemoveByUserID deletes every token issued to the user
+func (ts *TokenStore) RemoveByUserID(userID string) error {
+	query := `update oauth2_tokens set deleted_at = ? where user_id = ? and deleted_at is null`
+	stmt, err := ts.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("token store: failed to prepare RemoveByUserID: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(time.Now(), userID)
+	return err
+}
+
+// RemoveByClientAndUserID deletes every token the OAuth2 client issued to the user
+func (ts *TokenStore) RemoveByClientAndUserID(clientID, userID string) error {
+	query := `update oauth2_tokens set deleted_at = ? where client_id = ? and user_id = ? and deleted_at is null`
+	stmt, err := ts.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("token store: failed to prepare RemoveByClientAndUserID: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(time.Now(), clientID, userID)
+	return err
+}
+
+// PurgeByUserID permanently deletes every token issued to the user, including removed tokens.
+// The number of rows deleted is returned.
+func (ts *TokenStore) PurgeByUserID(userID string) (int64, error) {
+	res, err := ts.db.Exec(`delete from oauth2_tokens where user_id = ?`, userID)
+	if err != nil {
+		return 0, fmt.Errorf("token store: failed to purge tokens of user: %v", err)
+	}
+	return res.RowsAffected()
+}
+
+// CountByUserID returns how many tokens, including removed tokens, are stored for the user.
+func (ts *TokenStore) CountByUserID(userID string) (int64, error) {
+	var n int64
+	if err := ts.db.QueryRow(`select count(*) from oauth2_tokens where user_id = ?`, userID).Scan(&n); err != nil {
+		return 0, fmt.Errorf("token store: failed to count tokens of user: %v", err)
+	}
+	return n, nil
+}
+
+// TokenMetadata describes a token issued to a user without its code, access or refresh values.
+type TokenMetadata struct {
+	ClientID    string
+	RedirectURI string
+	Scope       string
+	CreatedAt   time.Time
+
+	// AccessExpiresAt and RefreshExpiresAt are nil when the token doesn't have that part,
+	// or when it never expires.
+	AccessExpiresAt  *time.Time
+	RefreshExpiresAt *time.Time
+
+	// RemovedAt is set on removed tokens which haven't been purged yet.
+	RemovedAt *time.Time
+}
+
+// MetadataByUserID returns every token stored for the user, including removed tokens, oldest first.
+func (ts *TokenStore) MetadataByUserID(userID string) ([]TokenMetadata, error) {
+	query := `select client_id, redirect_uri, scope, created_at, access_expires_at, refresh_expires_at, deleted_at from oauth2_tokens where user_id = ? order by created_at`
+	rows, err := ts.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("token store: failed to query tokens of user: %v", err)
+	}
+	defer rows.Close()
+
+	var tokens []TokenMetadata
+	for rows.Next() {
+		var md TokenMetadata
+		var createdAt *time.Time
+		if err := rows.Scan(&md.ClientID, &md.RedirectURI, &md.Scope, &createdAt, &md.AccessExpiresAt, &md.RefreshExpiresAt, &md.RemovedAt); err != nil {
+			return nil, fmt.Errorf("token store: failed to read token of user: %v", err)
+		}
+		if createdAt != nil {
+			md.CreatedAt = *createdAt
+		}
+		tokens = append(tokens, md)
+	}
+	return tokens, rows.Err()
+}
+
+// GetFamilyByRefresh returns the family a refresh token was issued under and if the refresh token
+// has already been used (or otherwise removed). An empty family is returned for unknown tokens.
+func (ts *TokenStore) GetFamilyByRefresh(refresh string) (string, bool, error) {
+	query := `select family_id, deleted_at from oauth2_tokens where refresh = ? order by created_at desc limit 1`
+	stmt, err := ts.db.Prepare(query)
+	if err != nil {
+		return "", false, fmt.Errorf("token store: failed to prepare GetFamilyByRefresh: %v", err)
+	}
+	defer stmt.Close()
+
+	var family sql.NullString
+	var deletedAt *time.Time
+	if err := stmt.QueryRow(refresh).Scan(&family, &deletedAt); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return "", false, nil // not found
+		}
+		return "", false, fmt.Errorf("token store: failed on GetFamilyByRefresh: %v", err)
+	}
+	return family.String, deletedAt != nil, nil
+}
+
+// ClaimRefresh marks the refresh token used before it's exchanged and returns its family. Only
+// one caller can claim a refresh token, claimed is false when it was already claimed or removed
+// (or is unknown, in which case family is empty).
+func (ts *TokenStore) ClaimRefresh(refresh string) (string, bool, error) {
+	if refresh == "" {
+		return "", false, nil
+	}
+	query := `update oauth2_tokens set refresh_used_at = ? where refresh = ? and refresh_used_at is null and deleted_at is null`
+	res, err := ts.db.Exec(query, time.Now(), refresh)
+	if err != nil {
+		return "", false, fmt.Errorf("token store: failed on ClaimRefresh: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", false, fmt.Errorf("token store: failed on ClaimRefresh: %v", err)
+	}
+	family, _, err := ts.GetFamilyByRefresh(refresh)
+	return family, n > 0, err
+}
+
+// ReleaseRefresh undoes ClaimRefresh when the refresh token couldn't be exchanged.
+func (ts *TokenStore) ReleaseRefresh(refresh string) error {
+	query := `update oauth2_tokens set refresh_used_at = null where refresh = ? and deleted_at is null`
+	if _, err := ts.db.Exec(query, refresh); err != nil {
+		return fmt.Errorf("token store: failed on ReleaseRefresh: %v", err)
+	}
+	return nil
+}
+
+// SetFamily moves the token holding the refresh token into family. This is called after a refresh
+// token is rotated so the new token stays linked to the token it replaced.
+func (ts *TokenStore) SetFamily(refresh, family string) error {
+	query := `update oauth2_tokens set family_id = ? where refresh = ? and deleted_at is null`
+	stmt, err := ts.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("token store: failed to prepare SetFamily: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(family, refresh)
+	return err
+}
+
+// RemoveByFamily deletes every token issued under the refresh token family
+func (ts *TokenStore) RemoveByFamily(family string) error {
+	query := `update oauth2_tokens set deleted_at = ? where family_id = ? and deleted_at is null`
+	stmt, err := ts.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("token store: failed to prepare RemoveByFamily: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(time.Now(), family)
 	return err
 }
 
@@ -129,61 +409,92 @@ func (ts *TokenStore) RemoveByRefresh(refresh string) error {
 	return err
 }
 
-func queryForRow(db *sql.DB, col, needle string) (oauth2.TokenInfo, error) {
-	query := fmt.Sprintf(`select client_id, user_id, redirect_uri, scope, code, code_expires_in, access, access_expires_in, refresh, refresh_expires_in, created_at from oauth2_tokens where %s = ? and deleted_at is null limit 1`, col)
+// queryForRow reads the token with a matching col value. expiresCol is the expiration column of
+// the part of the token being looked up, tokens which have expired aren't returned.
+func queryForRow(db *sql.DB, col, expiresCol, needle string) (oauth2.TokenInfo, error) {
+	query := fmt.Sprintf(`select client_id, user_id, redirect_uri, scope, code, code_created_at, code_expires_at, access, access_created_at, access_expires_at, refresh, refresh_created_at, refresh_expires_at
+from oauth2_tokens where %s = ? and deleted_at is null and (%s is null or %s > ?) limit 1`, col, expiresCol, expiresCol)
 	stmt, err := db.Prepare(query)
 	if err != nil {
-		return nil, fmt.Errorf("token store: failed to prepare RemoveByRefresh: %v", err)
+		return nil, fmt.Errorf("token store: failed to prepare queryForRow: %v", err)
 	}
 	defer stmt.Close()
 
-	row := stmt.QueryRow(needle)
+	row := stmt.QueryRow(needle, time.Now().UTC())
 
 	var token models.Token
+	var codeCreatedAt, codeExpiresAt, accessCreatedAt, accessExpiresAt, refreshCreatedAt, refreshExpiresAt *time.Time
 
-	var createdAt time.Time
-	codeExpiresIn, accessExpiresIn, refreshExpiresIn := "", "", ""
-
-	err = row.Scan(&token.ClientID, &token.UserID, &token.RedirectURI, &token.Scope, &token.Code, &codeExpiresIn, &token.Access, &accessExpiresIn, &token.Refresh, &refreshExpiresIn, &createdAt)
+	err = row.Scan(&token.ClientID, &token.UserID, &token.RedirectURI, &token.Scope,
+		&token.Code, &codeCreatedAt, &codeExpiresAt,
+		&token.Access, &accessCreatedAt, &accessExpiresAt,
+		&token.Refresh, &refreshCreatedAt, &refreshExpiresAt)
 	if err != nil {
 		if strings.Contains(err.Error(), "no rows in result set") {
 			return nil, nil // not found
 		}
-		return nil, fmt.Errorf("token store: failed on GetByCode: %v", err)
+		return nil, fmt.Errorf("token store: failed on queryForRow: %v", err)
 	}
 
-	token.AccessCreateAt = createdAt
-	token.CodeCreateAt = createdAt
-	token.RefreshCreateAt = createdAt
+	token.CodeCreateAt, token.CodeExpiresIn = readTimestamps(codeCreatedAt, codeExpiresAt)
+	token.AccessCreateAt, token.AccessExpiresIn = readTimestamps(accessCreatedAt, accessExpiresAt)
+	token.RefreshCreateAt, token.RefreshExpiresIn = readTimestamps(refreshCreatedAt, refreshExpiresAt)
 
-	dur, err := time.ParseDuration(accessExpiresIn)
-	if err == nil {
-		token.AccessExpiresIn = dur
-	}
-	dur, err = time.ParseDuration(codeExpiresIn)
-	if err == nil {
-		token.CodeExpiresIn = dur
+	return &token, nil
+}
+
+// readTimestamps converts stored timestamps back into a creation time and duration.
+func readTimestamps(createdAt, expiresAt *time.Time) (time.Time, time.Duration) {
+	if createdAt == nil {
+		return time.Time{}, 0
 	}
-	dur, err = time.ParseDuration(refreshExpiresIn)
-	if err == nil {
-		token.RefreshExpiresIn = dur
+	if expiresAt == nil {
+		return *createdAt, 0
 	}
-
-	return &token, nil
+	return *createdAt, expiresAt.Sub(*createdAt)
 }
 
 // GetByCode use the authorization code for token information data
 // TODO(adam): make sure this is protected by a userId check
 func (ts *TokenStore) GetByCode(code string) (oauth2.TokenInfo, error) {
-	return queryForRow(ts.db, "code", code)
+	return queryForRow(ts.db, "code", "code_expires_at", code)
 }
 
 // GetByAccess use the access token for token information data
 func (ts *TokenStore) GetByAccess(access string) (oauth2.TokenInfo, error) {
-	return queryForRow(ts.db, "access", access)
+	return queryForRow(ts.db, "access", "access_expires_at", access)
 }
 
 // GetByRefresh use the refresh token for token information data
 func (ts *TokenStore) GetByRefresh(refresh string) (oauth2.TokenInfo, error) {
-	return queryForRow(ts.db, "refresh", refresh)
+	return queryForRow(ts.db, "refresh", "refresh_expires_at", refresh)
+}
+
+// PurgeExpired permanently deletes up to limit tokens which were removed, or whose code, access
+// and refresh tokens all expired, before the given time. The number of rows deleted is returned.
+//
+// Removed tokens are kept until their refresh token expires, so a used refresh token which is
+// replayed is still detected as reuse (see GetFamilyByRefresh).
+func (ts *TokenStore) PurgeExpired(before time.Time, limit int) (int64, error) {
+	query := `delete from oauth2_tokens where rowid in (select rowid from oauth2_tokens where deleted_at is not null and deleted_at < ?
+and (refresh is null or refresh = '' or refresh_expires_at < ?) limit ?)`
+	res, err := ts.db.Exec(query, before, before.UTC(), limit)
+	if err != nil {
+		return 0, fmt.Errorf("token store: failed to purge removed tokens: %v", err)
+	}
+	removed, _ := res.RowsAffected()
+	if removed >= int64(limit) {
+		return removed, nil
+	}
+
+	// parts of a token without a value are skipped, parts which never expire keep the token
+	query = `delete from oauth2_tokens where rowid in (select rowid from oauth2_tokens where deleted_at is null
+and (code = '' or code_expires_at < ?) and (access = '' or access_expires_at < ?) and (refresh = '' or refresh_expires_at < ?) limit ?)`
+	before = before.UTC()
+	res, err = ts.db.Exec(query, before, before, before, limit-int(removed))
+	if err != nil {
+		return removed, fmt.Errorf("token store: failed to purge expired tokens: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	return removed + n, nil
 }
@@ -125,6 +125,115 @@ func TestTokenStore__ByAccess(t *testing.T) {
 	}
 }
 
+func TestTokenStore__RemoveByUserID(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	userId := generateID()
+	var accesses []string
+	for i := 0; i < 3; i++ {
+		tk := &models.Token{
+			ClientID:        generateID(),
+			UserID:          userId,
+			Access:          generateID(),
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: 30 * time.Minute,
+		}
+		if err := ts.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+		accesses = append(accesses, tk.Access)
+	}
+	if err := ts.RemoveByUserID(userId); err != nil {
+		t.Fatal(err)
+	}
+	for i := range accesses {
+		if token, err := ts.GetByAccess(accesses[i]); err != nil || token != nil {
+			t.Errorf("expected nothing, but got token=%v err=%v", token, err)
+		}
+	}
+}
+
+func TestTokenStore__PurgeByUserID(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	userID := generateID()
+	for i := 0; i < 2; i++ {
+		tk := &models.Token{
+			ClientID:        generateID(),
+			UserID:          userID,
+			Access:          generateID(),
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: 30 * time.Minute,
+		}
+		if err := ts.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// removed tokens are purged too
+	if err := ts.RemoveByUserID(userID); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ts.CountByUserID(userID); err != nil || n != 2 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if n, err := ts.PurgeByUserID(userID); err != nil || n != 2 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if n, err := ts.CountByUserID(userID); err != nil || n != 0 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+}
+
+func TestTokenStore__MetadataByUserID(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	userID := generateID()
+	tk := &models.Token{
+		ClientID:         generateID(),
+		UserID:           userID,
+		Scope:            "read",
+		Access:           generateID(),
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  30 * time.Minute,
+		Refresh:          generateID(),
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: 24 * time.Hour,
+	}
+	if err := ts.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.RemoveByAccess(tk.Access); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := ts.MetadataByUserID(userID)
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("tokens=%#v err=%v", tokens, err)
+	}
+	md := tokens[0]
+	if md.ClientID != tk.ClientID || md.Scope != "read" || md.CreatedAt.IsZero() {
+		t.Errorf("unexpected metadata: %#v", md)
+	}
+	if md.AccessExpiresAt == nil || md.RefreshExpiresAt == nil || md.RemovedAt == nil {
+		t.Errorf("missing timestamps: %#v", md)
+	}
+	if tokens, err := ts.MetadataByUserID(generateID()); err != nil || len(tokens) != 0 {
+		t.Errorf("tokens=%#v err=%v", tokens, err)
+	}
+}
+
 func TestTokenStore__ByCode(t *testing.T) {
 	ts, err := createTestTokenStore()
 	if err != nil {
@@ -212,3 +321,279 @@ func TestTokenStore__ByRefresh(t *testing.T) {
 		t.Fatalf("expected nothing, but got token=%v err=%v", token, err)
 	}
 }
+
+func TestTokenStore__Family(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	// expect nothing
+	family, used, err := ts.GetFamilyByRefresh(generateID())
+	if err != nil || family != "" || used {
+		t.Fatalf("expected nothing, but got family=%q used=%v err=%v", family, used, err)
+	}
+
+	// write a token, it starts its own family
+	tk := &models.Token{
+		ClientID:         generateID(),
+		UserID:           generateID(),
+		Access:           generateID(),
+		AccessCreateAt:   time.Now().Add(-1 * time.Second), // in the past
+		AccessExpiresIn:  30 * time.Minute,                 // the future
+		Refresh:          generateID(),
+		RefreshCreateAt:  time.Now().Add(-1 * time.Second), // in the past
+		RefreshExpiresIn: 30 * time.Minute,                 // the future
+	}
+	if err := ts.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	family, used, err = ts.GetFamilyByRefresh(tk.Refresh)
+	if err != nil || family == "" || used {
+		t.Fatalf("expected family, but got family=%q used=%v err=%v", family, used, err)
+	}
+
+	// re-writing the token keeps its family
+	tk.SetUserID(generateID())
+	if err := ts.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	if f, _, _ := ts.GetFamilyByRefresh(tk.Refresh); f != family {
+		t.Errorf("family changed from %q to %q", family, f)
+	}
+
+	// a refresh token can only be claimed once, until it's released
+	if f, claimed, err := ts.ClaimRefresh(tk.Refresh); err != nil || f != family || !claimed {
+		t.Fatalf("expected claim, but got family=%q claimed=%v err=%v", f, claimed, err)
+	}
+	if f, claimed, err := ts.ClaimRefresh(tk.Refresh); err != nil || f != family || claimed {
+		t.Fatalf("expected claimed token, but got family=%q claimed=%v err=%v", f, claimed, err)
+	}
+	if err := ts.ReleaseRefresh(tk.Refresh); err != nil {
+		t.Fatal(err)
+	}
+	if _, claimed, err := ts.ClaimRefresh(tk.Refresh); err != nil || !claimed {
+		t.Fatalf("expected claim after release, but got claimed=%v err=%v", claimed, err)
+	}
+	if f, claimed, err := ts.ClaimRefresh(generateID()); err != nil || f != "" || claimed {
+		t.Fatalf("expected nothing, but got family=%q claimed=%v err=%v", f, claimed, err)
+	}
+
+	// rotate the refresh token
+	next := &models.Token{
+		ClientID:         tk.ClientID,
+		UserID:           tk.UserID,
+		Access:           generateID(),
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  30 * time.Minute,
+		Refresh:          generateID(),
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: 30 * time.Minute,
+	}
+	if err := ts.Create(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.RemoveByRefresh(tk.Refresh); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.SetFamily(next.Refresh, family); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old refresh token has been used
+	if f, used, err := ts.GetFamilyByRefresh(tk.Refresh); err != nil || f != family || !used {
+		t.Fatalf("expected used token, but got family=%q used=%v err=%v", f, used, err)
+	}
+	if f, used, err := ts.GetFamilyByRefresh(next.Refresh); err != nil || f != family || used {
+		t.Fatalf("expected unused token, but got family=%q used=%v err=%v", f, used, err)
+	}
+
+	// revoke the family
+	if err := ts.RemoveByFamily(family); err != nil {
+		t.Fatal(err)
+	}
+	token, err := ts.GetByRefresh(next.Refresh)
+	if err != nil || token != nil {
+		t.Fatalf("expected nothing, but got token=%v err=%v", token, err)
+	}
+}
+
+func TestTokenStore__PurgeExpired(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	newToken := func(refreshExpiresIn time.Duration) *models.Token {
+		tk := &models.Token{
+			ClientID:         generateID(),
+			UserID:           generateID(),
+			Access:           generateID(),
+			AccessExpiresIn:  30 * time.Minute,
+			Refresh:          generateID(),
+			RefreshExpiresIn: refreshExpiresIn,
+		}
+		if err := ts.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+		return tk
+	}
+	expired1, expired2 := newToken(time.Hour), newToken(time.Hour)
+	active := newToken(24 * time.Hour)
+	removed := newToken(24 * time.Hour)
+	if err := ts.RemoveByAccess(removed.Access); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is old enough yet
+	n, err := ts.PurgeExpired(time.Now().Add(-1*time.Minute), 10)
+	if err != nil || n != 0 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+
+	// purge in batches of two, removed tokens are kept while their refresh token could be replayed
+	before := time.Now().Add(2 * time.Hour)
+	n, err = ts.PurgeExpired(before, 2)
+	if err != nil || n != 2 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	n, err = ts.PurgeExpired(before, 2)
+	if err != nil || n != 0 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	for _, tk := range []*models.Token{expired1, expired2} {
+		if ti, err := ts.GetByRefresh(tk.Refresh); err != nil || ti != nil {
+			t.Errorf("expected token to be purged: %v (err=%v)", ti, err)
+		}
+	}
+	if family, used, _ := ts.GetFamilyByRefresh(removed.Refresh); family == "" || !used {
+		t.Errorf("expected removed token to be kept, family=%q used=%v", family, used)
+	}
+	if ti, err := ts.GetByRefresh(active.Refresh); err != nil || ti == nil {
+		t.Errorf("expected active token, err=%v", err)
+	}
+
+	// once the refresh token expires the removed token is purged
+	n, err = ts.PurgeExpired(time.Now().Add(25*time.Hour), 10)
+	if err != nil || n != 2 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if family, _, _ := ts.GetFamilyByRefresh(removed.Refresh); family != "" {
+		t.Error("expected removed token to be purged")
+	}
+}
+
+func TestTokenStore__Expiry(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	// access token expired, refresh token still valid
+	accessCreatedAt := time.Now().Add(-2 * time.Hour)
+	refreshCreatedAt := time.Now().Add(-1 * time.Hour)
+	tk := &models.Token{
+		ClientID:         generateID(),
+		UserID:           generateID(),
+		Access:           generateID(),
+		AccessCreateAt:   accessCreatedAt,
+		AccessExpiresIn:  time.Hour,
+		Refresh:          generateID(),
+		RefreshCreateAt:  refreshCreatedAt,
+		RefreshExpiresIn: 24 * time.Hour,
+	}
+	if err := ts.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	if ti, err := ts.GetByAccess(tk.Access); err != nil || ti != nil {
+		t.Errorf("expected expired access token to be filtered, got %v (err=%v)", ti, err)
+	}
+	ti, err := ts.GetByRefresh(tk.Refresh)
+	if err != nil || ti == nil {
+		t.Fatalf("expected token, err=%v", err)
+	}
+	if !ti.GetAccessCreateAt().Equal(accessCreatedAt) || ti.GetAccessExpiresIn() != time.Hour {
+		t.Errorf("access created=%v expires=%v", ti.GetAccessCreateAt(), ti.GetAccessExpiresIn())
+	}
+	if !ti.GetRefreshCreateAt().Equal(refreshCreatedAt) || ti.GetRefreshExpiresIn() != 24*time.Hour {
+		t.Errorf("refresh created=%v expires=%v", ti.GetRefreshCreateAt(), ti.GetRefreshExpiresIn())
+	}
+
+	// refresh tokens without an expiration don't expire
+	tk = &models.Token{
+		ClientID:        generateID(),
+		Access:          generateID(),
+		AccessCreateAt:  time.Now().Add(-48 * time.Hour),
+		AccessExpiresIn: time.Hour,
+		Refresh:         generateID(),
+		RefreshCreateAt: time.Now().Add(-48 * time.Hour),
+	}
+	if err := ts.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	if ti, err := ts.GetByRefresh(tk.Refresh); err != nil || ti == nil || ti.GetRefreshExpiresIn() != 0 {
+		t.Errorf("expected token without expiration, got %v (err=%v)", ti, err)
+	}
+	if n, err := ts.PurgeExpired(time.Now(), 10); err != nil || n != 0 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+
+	// expired codes
+	tk = &models.Token{
+		ClientID:      generateID(),
+		Code:          generateID(),
+		CodeCreateAt:  time.Now().Add(-20 * time.Minute),
+		CodeExpiresIn: 10 * time.Minute,
+	}
+	if err := ts.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	if ti, err := ts.GetByCode(tk.Code); err != nil || ti != nil {
+		t.Errorf("expected expired code to be filtered, got %v (err=%v)", ti, err)
+	}
+}
+
+func TestTokenStore__backfillTimestamps(t *testing.T) {
+	ts, err := createTestTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	// write tokens like older versions did
+	createdAt := time.Now().Add(-1 * time.Hour)
+	active, expired := generateID(), generateID()
+	query := `insert into oauth2_tokens (client_id, user_id, redirect_uri, scope, code, code_expires_in, access, access_expires_in, refresh, refresh_expires_in, created_at) values (?, ?, '', '', '', '0s', ?, ?, ?, ?, ?)`
+	if _, err := ts.db.Exec(query, generateID(), generateID(), active, (2 * time.Hour).String(), generateID(), (72 * time.Hour).String(), createdAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.db.Exec(query, generateID(), generateID(), expired, (30 * time.Minute).String(), "", "0s", createdAt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.backfillTimestamps(); err != nil {
+		t.Fatal(err)
+	}
+
+	ti, err := ts.GetByAccess(active)
+	if err != nil || ti == nil {
+		t.Fatalf("expected token, err=%v", err)
+	}
+	if !ti.GetAccessCreateAt().Equal(createdAt) || ti.GetAccessExpiresIn() != 2*time.Hour || ti.GetRefreshExpiresIn() != 72*time.Hour {
+		t.Errorf("unexpected token: %#v", ti)
+	}
+	if ti.GetCode() != "" || !ti.GetCodeCreateAt().IsZero() {
+		t.Errorf("unexpected code: %#v", ti)
+	}
+	if ti, err := ts.GetByAccess(expired); err != nil || ti != nil {
+		t.Errorf("expected expired token to be filtered, got %v (err=%v)", ti, err)
+	}
+
+	// running again changes nothing
+	if err := ts.backfillTimestamps(); err != nil {
+		t.Fatal(err)
+	}
+}
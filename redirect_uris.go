@@ -0,0 +1,127 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+const (
+	maxClientRedirectURIs      = 10
+	maxClientRedirectURILength = 2000
+)
+
+// validateRedirectURI checks uri can be registered as an OAuth2 redirection endpoint.
+//
+// RFC 6749 Section 3.1.2 requires an absolute URI without a fragment. Plain http is only
+// allowed for loopback hosts used by native apps and local development.
+func validateRedirectURI(uri string) error {
+	if uri == "" || len(uri) > maxClientRedirectURILength || strings.ContainsAny(uri, " \t\r\n") {
+		return fmt.Errorf("invalid redirect URI %q", uri)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid redirect URI %q: %v", uri, err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("redirect URI %q must be absolute", uri)
+	}
+	if u.Fragment != "" || strings.Contains(uri, "#") {
+		return fmt.Errorf("redirect URI %q must not include a fragment", uri)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+	case "http":
+		if !isLoopbackHost(u.Hostname()) {
+			return fmt.Errorf("redirect URI %q must use https", uri)
+		}
+	default:
+		return fmt.Errorf("redirect URI %q has unsupported scheme %s", uri, u.Scheme)
+	}
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validateRedirectURIs checks each URI and that only a limited number are registered.
+func validateRedirectURIs(uris []string) error {
+	if len(uris) > maxClientRedirectURIs {
+		return fmt.Errorf("OAuth2 clients are limited to %d redirect URIs", maxClientRedirectURIs)
+	}
+	for i := range uris {
+		if err := validateRedirectURI(uris[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dedupeRedirectURIs drops repeated URIs while keeping their order.
+func dedupeRedirectURIs(uris []string) []string {
+	var out []string
+	for i := range uris {
+		if !containsURI(out, uris[i]) {
+			out = append(out, uris[i])
+		}
+	}
+	return out
+}
+
+func containsURI(uris []string, needle string) bool {
+	for i := range uris {
+		if uris[i] == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// clientRedirectURIs returns the registered redirect URIs of cli.
+func clientRedirectURIs(cli oauth2.ClientInfo) []string {
+	if c, ok := cli.(*oauthdb.Client); ok {
+		return c.RedirectURIs
+	}
+	return nil
+}
+
+// redirectURIRegistered returns true if uri exactly matches one of the client's registered redirect URIs.
+func redirectURIRegistered(cli oauth2.ClientInfo, uri string) bool {
+	return uri != "" && containsURI(clientRedirectURIs(cli), uri)
+}
+
+// writeOAuthError responds with an RFC 6749 Section 5.2 error response. It's used when
+// an error can't be sent back to the client's redirect URI.
+func writeOAuthError(w http.ResponseWriter, err error, description string) {
+	status := http.StatusBadRequest
+	switch err {
+	case errors.ErrInvalidClient:
+		status = http.StatusUnauthorized
+	case errors.ErrAccessDenied:
+		status = http.StatusForbidden
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             err.Error(),
+		"error_description": description,
+	})
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedirectURIs__validate(t *testing.T) {
+	valid := []string{
+		"https://app.example.com/callback",
+		"https://app.example.com:8443/oauth?tenant=1",
+		"http://localhost:8080/callback",
+		"http://127.0.0.1/callback",
+		"http://[::1]:9000/cb",
+	}
+	for i := range valid {
+		if err := validateRedirectURI(valid[i]); err != nil {
+			t.Errorf("%s: %v", valid[i], err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"/callback",
+		"app.example.com/callback",
+		"http://app.example.com/callback",
+		"https://app.example.com/callback#frag",
+		"https://app.example.com/call back",
+		"javascript:alert(1)",
+		"ftp://app.example.com/callback",
+		"https://app.example.com/" + strings.Repeat("a", maxClientRedirectURILength),
+	}
+	for i := range invalid {
+		if err := validateRedirectURI(invalid[i]); err == nil {
+			t.Errorf("expected error for %q", invalid[i])
+		}
+	}
+
+	var uris []string
+	for i := 0; i <= maxClientRedirectURIs; i++ {
+		uris = append(uris, "https://app.example.com/"+generateID())
+	}
+	if err := validateRedirectURIs(uris); err == nil {
+		t.Error("expected error")
+	}
+	if err := validateRedirectURIs(uris[:maxClientRedirectURIs]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedirectURIs__dedupe(t *testing.T) {
+	uris := dedupeRedirectURIs([]string{"https://a.example.com", "https://b.example.com", "https://a.example.com"})
+	if len(uris) != 2 || uris[0] != "https://a.example.com" || uris[1] != "https://b.example.com" {
+		t.Errorf("got %v", uris)
+	}
+}
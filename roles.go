@@ -0,0 +1,688 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moov-io/base"
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// adminRole is created by our migrations and grants every permission
+	adminRole = "admin"
+
+	// permRolesWrite allows defining roles and assigning them to users
+	permRolesWrite = "roles:write"
+
+	// permAll matches every permission
+	permAll = "*"
+
+	maxRolePermissions = 100
+)
+
+var (
+	roleNameRegex   = regexp.MustCompile(`^[a-z0-9][a-z0-9_.:-]{0,63}$`)
+	permissionRegex = regexp.MustCompile(`^([a-z0-9][a-z0-9_.:-]{0,99}|\*)$`)
+
+	errRoleNotFound = errors.New("role not found")
+)
+
+type role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Permissions []string `json:"permissions"`
+
+	// OrgAssignable roles can be assigned within an organization by its owners, other roles
+	// need the global roles:write permission.
+	OrgAssignable bool `json:"orgAssignable"`
+
+	CreatedAt base.Time `json:"createdAt"`
+}
+
+// userRole is a role assigned to a user, either globally or within an organization.
+type userRole struct {
+	Role           string    `json:"role"`
+	OrganizationID string    `json:"organizationId,omitempty"`
+	CreatedAt      base.Time `json:"createdAt"`
+}
+
+type roleRepository interface {
+	listRoles() ([]*role, error)
+
+	// getRole returns the role called name.
+	// This function can return nil, nil meaning no role was found.
+	getRole(name string) (*role, error)
+
+	// upsertRole creates the role or replaces its description and permissions.
+	upsertRole(r *role) error
+
+	// deleteRole removes the role and every assignment of it.
+	deleteRole(name string) error
+
+	// getUserRoles returns the roles assigned to userId globally and, when orgId isn't
+	// empty, within orgId.
+	getUserRoles(userId, orgId string) ([]*userRole, error)
+
+	// assignRole gives userId the role globally (empty orgId) or within orgId.
+	assignRole(userId, name, orgId string) error
+	unassignRole(userId, name, orgId string) error
+
+	// hasPermission returns true if any of the roles of userId (globally or within orgId)
+	// grant permission.
+	hasPermission(userId, orgId, permission string) (bool, error)
+}
+
+type sqliteRoleRepository struct {
+	db  *sql.DB
+	log log.Logger
+
+	// cache holds the role names of userId and orgId pairs for /auth/check
+	cache *ttlCache
+}
+
+func (r *sqliteRoleRepository) listRoles() ([]*role, error) {
+	rows, err := r.db.Query(`select r.name, r.description, r.created_at, o.name is not null from roles as r
+left join org_assignable_roles as o on r.name = o.name order by r.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*role
+	for rows.Next() {
+		var out role
+		var description, createdAt sql.NullString
+		if err := rows.Scan(&out.Name, &description, &createdAt, &out.OrgAssignable); err != nil {
+			return nil, err
+		}
+		out.Description = description.String
+		out.CreatedAt = base.NewTime(parseTimestamp(createdAt.String))
+		roles = append(roles, &out)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range roles {
+		if roles[i].Permissions, err = r.getPermissions(roles[i].Name); err != nil {
+			return nil, err
+		}
+	}
+	return roles, nil
+}
+
+func (r *sqliteRoleRepository) getRole(name string) (*role, error) {
+	stmt, err := r.db.Prepare(`select r.description, r.created_at, o.name is not null from roles as r
+left join org_assignable_roles as o on r.name = o.name where r.name = ? limit 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	out := &role{Name: name}
+	var description, createdAt sql.NullString
+	if err := stmt.QueryRow(name).Scan(&description, &createdAt, &out.OrgAssignable); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	out.Description = description.String
+	out.CreatedAt = base.NewTime(parseTimestamp(createdAt.String))
+	if out.Permissions, err = r.getPermissions(name); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *sqliteRoleRepository) getPermissions(name string) ([]string, error) {
+	rows, err := r.db.Query(`select permission from role_permissions where name = ? order by permission`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, p)
+	}
+	return permissions, rows.Err()
+}
+
+func (r *sqliteRoleRepository) upsertRole(in *role) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	query := `insert or ignore into roles (name, description, created_at) values (?, ?, ?)`
+	if _, err := tx.Exec(query, in.Name, in.Description, in.CreatedAt.Format(serializedTimestampFormat)); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem writing role=%s, err=%v, rollback err=%v", in.Name, err, e)
+	}
+	if _, err := tx.Exec(`update roles set description = ? where name = ?`, in.Description, in.Name); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem updating role=%s, err=%v, rollback err=%v", in.Name, err, e)
+	}
+	if _, err := tx.Exec(`delete from role_permissions where name = ?`, in.Name); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem clearing permissions of role=%s, err=%v, rollback err=%v", in.Name, err, e)
+	}
+	if _, err := tx.Exec(`delete from org_assignable_roles where name = ?`, in.Name); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem updating role=%s, err=%v, rollback err=%v", in.Name, err, e)
+	}
+	if in.OrgAssignable {
+		if _, err := tx.Exec(`insert into org_assignable_roles (name) values (?)`, in.Name); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem updating role=%s, err=%v, rollback err=%v", in.Name, err, e)
+		}
+	}
+	for i := range in.Permissions {
+		if _, err := tx.Exec(`insert or ignore into role_permissions (name, permission) values (?, ?)`, in.Name, in.Permissions[i]); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem writing permissions of role=%s, err=%v, rollback err=%v", in.Name, err, e)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *sqliteRoleRepository) deleteRole(name string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		`delete from user_roles where name = ?`,
+		`delete from role_permissions where name = ?`,
+		`delete from org_assignable_roles where name = ?`,
+		`delete from roles where name = ?`,
+	} {
+		if _, err := tx.Exec(query, name); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem deleting role=%s, err=%v, rollback err=%v", name, err, e)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	r.cache.clear()
+	return nil
+}
+
+func (r *sqliteRoleRepository) getUserRoles(userId, orgId string) ([]*userRole, error) {
+	query := `select name, organization_id, created_at from user_roles where user_id = ? and (organization_id = '' or organization_id = ?) order by organization_id, name`
+	rows, err := r.db.Query(query, userId, orgId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*userRole
+	for rows.Next() {
+		var ur userRole
+		var createdAt string
+		if err := rows.Scan(&ur.Role, &ur.OrganizationID, &createdAt); err != nil {
+			return nil, err
+		}
+		ur.CreatedAt = base.NewTime(parseTimestamp(createdAt))
+		roles = append(roles, &ur)
+	}
+	return roles, rows.Err()
+}
+
+func (r *sqliteRoleRepository) assignRole(userId, name, orgId string) error {
+	query := `insert or ignore into user_roles (user_id, name, organization_id, created_at) values (?, ?, ?, ?)`
+	if _, err := r.db.Exec(query, userId, name, orgId, time.Now().Format(serializedTimestampFormat)); err != nil {
+		return fmt.Errorf("problem assigning role=%s to userId=%s: %v", name, userId, err)
+	}
+	r.cache.removeTagged(userId)
+	return nil
+}
+
+func (r *sqliteRoleRepository) unassignRole(userId, name, orgId string) error {
+	query := `delete from user_roles where user_id = ? and name = ? and organization_id = ?`
+	if _, err := r.db.Exec(query, userId, name, orgId); err != nil {
+		return fmt.Errorf("problem removing role=%s from userId=%s: %v", name, userId, err)
+	}
+	r.cache.removeTagged(userId)
+	return nil
+}
+
+func (r *sqliteRoleRepository) hasPermission(userId, orgId, permission string) (bool, error) {
+	query := `select count(*) from user_roles as ur
+inner join role_permissions as rp on ur.name = rp.name
+where ur.user_id = ? and (ur.organization_id = '' or ur.organization_id = ?) and (rp.permission = ? or rp.permission = ?)`
+	var n int
+	if err := r.db.QueryRow(query, userId, orgId, permission, permAll).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// assignedRoleNames are the sorted names of a user's global roles and their roles within
+// one organization.
+type assignedRoleNames struct {
+	global []string
+	org    []string
+}
+
+// roleNames returns the names of the roles userId has globally and within orgId.
+// A nil roleRepository has no roles.
+func roleNames(roles roleRepository, userId, orgId string) (*assignedRoleNames, error) {
+	if roles == nil || userId == "" {
+		return &assignedRoleNames{}, nil
+	}
+	var cache *ttlCache
+	if r, ok := roles.(*sqliteRoleRepository); ok {
+		cache = r.cache
+	}
+	key := userId + "|" + orgId
+	if v, ok := cache.get(key); ok {
+		return v.(*assignedRoleNames), nil
+	}
+	assigned, err := roles.getUserRoles(userId, orgId)
+	if err != nil {
+		return nil, err
+	}
+	names := &assignedRoleNames{}
+	for i := range assigned {
+		if assigned[i].OrganizationID == "" {
+			names.global = append(names.global, assigned[i].Role)
+		} else {
+			names.org = append(names.org, assigned[i].Role)
+		}
+	}
+	sort.Strings(names.global)
+	sort.Strings(names.org)
+	cache.set(key, names, 0, userId)
+	return names, nil
+}
+
+// requiredRoles returns the global roles a request to /auth/check demands the caller has, from
+// the 'roles' query parameter or X-Required-Roles header.
+func requiredRoles(r *http.Request) []string {
+	raw := strings.Join([]string{r.URL.Query().Get("roles"), r.Header.Get("X-Required-Roles")}, " ")
+	return parseScopes(raw)
+}
+
+// requiredOrganizationRoles returns the roles a request to /auth/check demands the caller has
+// within their organization, from the 'organization_roles' query parameter or
+// X-Required-Organization-Roles header.
+func requiredOrganizationRoles(r *http.Request) []string {
+	raw := strings.Join([]string{r.URL.Query().Get("organization_roles"), r.Header.Get("X-Required-Organization-Roles")}, " ")
+	return parseScopes(raw)
+}
+
+// bootstrapAdmins assigns the admin role to each user ID in RBAC_ADMIN_USER_IDS.
+func bootstrapAdmins(logger log.Logger, roles roleRepository) error {
+	for _, userId := range strings.FieldsFunc(os.Getenv("RBAC_ADMIN_USER_IDS"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if err := roles.assignRole(userId, adminRole, ""); err != nil {
+			return err
+		}
+		logger.Log("roles", fmt.Sprintf("userId=%s has the %s role", userId, adminRole))
+	}
+	return nil
+}
+
+func (in *role) validate() error {
+	if !roleNameRegex.MatchString(in.Name) {
+		return fmt.Errorf("invalid role name %q", in.Name)
+	}
+	if len(in.Permissions) > maxRolePermissions {
+		return fmt.Errorf("roles are limited to %d permissions", maxRolePermissions)
+	}
+	for i := range in.Permissions {
+		if !permissionRegex.MatchString(in.Permissions[i]) {
+			return fmt.Errorf("invalid permission %q", in.Permissions[i])
+		}
+	}
+	return nil
+}
+
+func addRoleRoutes(router *mux.Router, logger log.Logger, auth authable, orgRepo organizationRepository, roleRepo roleRepository) {
+	router.Methods("GET").Path("/roles").HandlerFunc(listRoles(logger, auth, roleRepo))
+	router.Methods("PUT").Path("/roles/{role}").HandlerFunc(upsertRole(logger, auth, roleRepo))
+	router.Methods("DELETE").Path("/roles/{role}").HandlerFunc(deleteRole(logger, auth, roleRepo))
+
+	router.Methods("GET").Path("/users/{userId}/roles").HandlerFunc(getUserRoles(logger, auth, orgRepo, roleRepo))
+	router.Methods("PUT").Path("/users/{userId}/roles/{role}").HandlerFunc(assignUserRole(logger, auth, orgRepo, roleRepo))
+	router.Methods("DELETE").Path("/users/{userId}/roles/{role}").HandlerFunc(unassignUserRole(logger, auth, orgRepo, roleRepo))
+}
+
+// canManageRoles returns true if userId can assign roles within orgId, or globally when orgId
+// is empty. Organization owners can assign roles within their organization, but only those
+// which are OrgAssignable (see roleAssignment).
+func canManageRoles(orgRepo organizationRepository, roleRepo roleRepository, userId, orgId string) (bool, error) {
+	ok, err := roleRepo.hasPermission(userId, orgId, permRolesWrite)
+	if ok || err != nil || orgId == "" || orgRepo == nil {
+		return ok, err
+	}
+	member, err := orgRepo.getMember(orgId, userId)
+	if err != nil {
+		return false, err
+	}
+	return member != nil && member.Role == orgRoleOwner, nil
+}
+
+// requirePermission returns true if userId has the global permission, otherwise a 403 is written to w.
+func requirePermission(w http.ResponseWriter, roleRepo roleRepository, userId, permission string) bool {
+	ok, err := roleRepo.hasPermission(userId, "", permission)
+	if err != nil {
+		internalError(w, err)
+		return false
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return ok
+}
+
+// holdsPermissions returns true if userId has every permission, either globally or within orgId.
+// Only users with permAll hold permAll.
+func holdsPermissions(roleRepo roleRepository, userId, orgId string, permissions []string) (bool, error) {
+	for i := range permissions {
+		ok, err := roleRepo.hasPermission(userId, orgId, permissions[i])
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func listRoles(logger log.Logger, auth authable, roleRepo roleRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "listRoles")
+
+		if _, err := extractUserId(auth, r); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		roles, err := roleRepo.listRoles()
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if roles == nil {
+			roles = []*role{}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(roles); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+type upsertRoleRequest struct {
+	Description   string   `json:"description"`
+	Permissions   []string `json:"permissions"`
+	OrgAssignable bool     `json:"orgAssignable"`
+}
+
+func upsertRole(logger log.Logger, auth authable, roleRepo roleRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "upsertRole")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !requirePermission(w, roleRepo, userId, permRolesWrite) {
+			return
+		}
+
+		var req upsertRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		in := &role{
+			Name:          mux.Vars(r)["role"],
+			Description:   strings.TrimSpace(req.Description),
+			Permissions:   parseScopes(strings.Join(req.Permissions, " ")),
+			OrgAssignable: req.OrgAssignable,
+			CreatedAt:     base.NewTime(time.Now()),
+		}
+		if in.Name == adminRole {
+			moovhttp.Problem(w, fmt.Errorf("the %s role can't be changed", adminRole))
+			return
+		}
+		if err := in.validate(); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		// roles:write can't be used to hand out permissions the caller doesn't have
+		held, err := holdsPermissions(roleRepo, userId, "", in.Permissions)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if !held {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := roleRepo.upsertRole(in); err != nil {
+			internalError(w, err)
+			return
+		}
+		out, err := roleRepo.getRole(in.Name)
+		if err != nil || out == nil {
+			internalError(w, fmt.Errorf("problem reading role=%s: %v", in.Name, err))
+			return
+		}
+		logger.Log("roles", fmt.Sprintf("userId=%s updated role=%s permissions=%s", userId, out.Name, strings.Join(out.Permissions, ",")))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+func deleteRole(logger log.Logger, auth authable, roleRepo roleRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "deleteRole")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !requirePermission(w, roleRepo, userId, permRolesWrite) {
+			return
+		}
+
+		name := mux.Vars(r)["role"]
+		if name == adminRole {
+			moovhttp.Problem(w, fmt.Errorf("the %s role can't be deleted", adminRole))
+			return
+		}
+		if err := roleRepo.deleteRole(name); err != nil {
+			internalError(w, err)
+			return
+		}
+		logger.Log("roles", fmt.Sprintf("userId=%s deleted role=%s", userId, name))
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func getUserRoles(logger log.Logger, auth authable, orgRepo organizationRepository, roleRepo roleRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "getUserRoles")
+
+		userId, err := extractUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		targetId, orgId := mux.Vars(r)["userId"], r.URL.Query().Get("organization_id")
+		if targetId != userId {
+			allowed, err := canManageRoles(orgRepo, roleRepo, userId, orgId)
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			if !allowed {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		roles, err := roleRepo.getUserRoles(targetId, orgId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if roles == nil {
+			roles = []*userRole{}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(roles); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
+
+// roleAssignment checks the caller can change the roles of the route's {userId} and returns
+// the target user, role and organization. Any problems are written to w and ok is false.
+func roleAssignment(w http.ResponseWriter, r *http.Request, auth authable, orgRepo organizationRepository, roleRepo roleRepository) (userId, targetId, name, orgId string, ok bool) {
+	userId, err := extractUserId(auth, r)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	targetId, name, orgId = mux.Vars(r)["userId"], mux.Vars(r)["role"], r.URL.Query().Get("organization_id")
+
+	allowed, err := canManageRoles(orgRepo, roleRepo, userId, orgId)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if !allowed {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if orgId != "" && name == adminRole {
+		moovhttp.Problem(w, fmt.Errorf("the %s role can only be assigned globally", adminRole))
+		return
+	}
+	existing, err := roleRepo.getRole(name)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if existing == nil {
+		moovhttp.Problem(w, errRoleNotFound)
+		return
+	}
+	if orgId == "" || containsScope(existing.Permissions, permAll) {
+		// Global roles apply everywhere, so only admins can hand them out
+		admin, err := roleRepo.hasPermission(userId, "", permAll)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if !admin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	if orgId != "" && !existing.OrgAssignable {
+		// Owners and organization scoped roles:write can't hand out arbitrary roles,
+		// and global roles:write only grants what the caller already holds.
+		global, err := roleRepo.hasPermission(userId, "", permRolesWrite)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		held, err := holdsPermissions(roleRepo, userId, orgId, existing.Permissions)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if !global || !held {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	return userId, targetId, name, orgId, true
+}
+
+func assignUserRole(logger log.Logger, auth authable, orgRepo organizationRepository, roleRepo roleRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "assignUserRole")
+
+		userId, targetId, name, orgId, ok := roleAssignment(w, r, auth, orgRepo, roleRepo)
+		if !ok {
+			return
+		}
+		if orgId != "" {
+			member, err := isOrgMember(orgRepo, orgId, targetId)
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			if !member {
+				moovhttp.Problem(w, errNotOrgMember)
+				return
+			}
+		}
+		if err := roleRepo.assignRole(targetId, name, orgId); err != nil {
+			internalError(w, err)
+			return
+		}
+		logger.Log("roles", fmt.Sprintf("userId=%s assigned role=%s to userId=%s organization=%q", userId, name, targetId, orgId))
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func unassignUserRole(logger log.Logger, auth authable, orgRepo organizationRepository, roleRepo roleRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "unassignUserRole")
+
+		userId, targetId, name, orgId, ok := roleAssignment(w, r, auth, orgRepo, roleRepo)
+		if !ok {
+			return
+		}
+		if err := roleRepo.unassignRole(targetId, name, orgId); err != nil {
+			internalError(w, err)
+			return
+		}
+		logger.Log("roles", fmt.Sprintf("userId=%s removed role=%s from userId=%s organization=%q", userId, name, targetId, orgId))
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
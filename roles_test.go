@@ -0,0 +1,431 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestRoles__repository(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	roleRepo := &sqliteRoleRepository{db: repo.db, log: log.NewNopLogger(), cache: newTTLCache("roles")}
+
+	// admin is created by our migrations
+	admin, err := roleRepo.getRole(adminRole)
+	if err != nil || admin == nil || len(admin.Permissions) != 1 || admin.Permissions[0] != permAll {
+		t.Fatalf("unexpected admin role=%#v err=%v", admin, err)
+	}
+
+	in := &role{Name: "billing", Description: "Billing", Permissions: []string{"invoices:read"}, CreatedAt: base.NewTime(time.Now())}
+	if err := roleRepo.upsertRole(in); err != nil {
+		t.Fatal(err)
+	}
+	in.Permissions = []string{"invoices:read", "invoices:write"}
+	if err := roleRepo.upsertRole(in); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := roleRepo.getRole("billing"); err != nil || r == nil || len(r.Permissions) != 2 {
+		t.Fatalf("unexpected role=%#v err=%v", r, err)
+	}
+	if roles, err := roleRepo.listRoles(); err != nil || len(roles) != 2 {
+		t.Fatalf("unexpected roles=%#v err=%v", roles, err)
+	}
+
+	// assign within an organization
+	userId, orgId := generateID(), generateID()
+	if err := roleRepo.assignRole(userId, "billing", orgId); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := roleRepo.hasPermission(userId, orgId, "invoices:write"); !ok {
+		t.Error("expected permission within organization")
+	}
+	if ok, _ := roleRepo.hasPermission(userId, "", "invoices:write"); ok {
+		t.Error("expected no global permission")
+	}
+	if names, err := roleNames(roleRepo, userId, orgId); err != nil || len(names.global) != 0 || len(names.org) != 1 || names.org[0] != "billing" {
+		t.Errorf("unexpected names=%#v err=%v", names, err)
+	}
+	if names, _ := roleNames(roleRepo, userId, ""); len(names.global) != 0 || len(names.org) != 0 {
+		t.Errorf("unexpected names=%#v", names)
+	}
+
+	// admin has every permission
+	if err := roleRepo.assignRole(userId, adminRole, ""); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := roleRepo.hasPermission(userId, "", "anything"); !ok {
+		t.Error("expected admin to have every permission")
+	}
+	if names, _ := roleNames(roleRepo, userId, orgId); len(names.global) != 1 || len(names.org) != 1 {
+		t.Errorf("expected cached names to be cleared, got %#v", names)
+	}
+
+	// deleting a role removes its assignments
+	if err := roleRepo.deleteRole("billing"); err != nil {
+		t.Fatal(err)
+	}
+	if roles, err := roleRepo.getUserRoles(userId, orgId); err != nil || len(roles) != 1 || roles[0].Role != adminRole {
+		t.Errorf("unexpected roles=%#v err=%v", roles, err)
+	}
+	if err := roleRepo.unassignRole(userId, adminRole, ""); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := roleNames(roleRepo, userId, orgId); len(names.global) != 0 || len(names.org) != 0 {
+		t.Errorf("unexpected names=%#v", names)
+	}
+}
+
+func TestRoles__validate(t *testing.T) {
+	if err := (&role{Name: "billing", Permissions: []string{"invoices:read", "*"}}).validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (&role{Name: "Billing Team"}).validate(); err == nil {
+		t.Error("expected error")
+	}
+	if err := (&role{Name: "billing", Permissions: []string{"invoices read"}}).validate(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestRoles__bootstrapAdmins(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	roleRepo := &sqliteRoleRepository{db: repo.db, log: log.NewNopLogger()}
+
+	first, second := generateID(), generateID()
+	os.Setenv("RBAC_ADMIN_USER_IDS", fmt.Sprintf("%s, %s", first, second))
+	defer os.Unsetenv("RBAC_ADMIN_USER_IDS")
+
+	if err := bootstrapAdmins(log.NewNopLogger(), roleRepo); err != nil {
+		t.Fatal(err)
+	}
+	for _, userId := range []string{first, second} {
+		if ok, err := roleRepo.hasPermission(userId, "", permRolesWrite); err != nil || !ok {
+			t.Errorf("expected userId=%s to be an admin, err=%v", userId, err)
+		}
+	}
+}
+
+func TestRoles__routes(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	orgRepo := &sqliteOrganizationRepository{db: repo.db, log: log.NewNopLogger()}
+	roleRepo := &sqliteRoleRepository{db: repo.db, log: log.NewNopLogger()}
+
+	router := mux.NewRouter()
+	addRoleRoutes(router, log.NewNopLogger(), auth, orgRepo, roleRepo)
+
+	admin, owner, member := createTestUser(t, repo, "admin@moov.io"), createTestUser(t, repo, "owner@moov.io"), createTestUser(t, repo, "member@moov.io")
+	if err := roleRepo.assignRole(admin.ID, adminRole, ""); err != nil {
+		t.Fatal(err)
+	}
+	org := &organization{ID: generateID(), Name: "Moov", CreatedAt: base.NewTime(time.Now())}
+	if err := orgRepo.createOrganization(org, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	cookies := make(map[string]*http.Cookie)
+	for _, u := range []*User{admin, owner, member} {
+		cookie, err := createCookie(u.ID, auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookies[u.ID] = cookie
+	}
+
+	do := func(method, path string, userId string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		r := httptest.NewRequest(method, path, &buf)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookies[userId].Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	// only admins can define roles
+	req := upsertRoleRequest{Description: "Billing", Permissions: []string{"invoices:read"}}
+	if w := do("PUT", "/roles/billing", owner.ID, req); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("PUT", "/roles/"+adminRole, admin.ID, req); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	w := do("PUT", "/roles/billing", admin.ID, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var r role
+	if err := json.NewDecoder(w.Body).Decode(&r); err != nil || r.Name != "billing" || len(r.Permissions) != 1 {
+		t.Fatalf("unexpected role=%#v err=%v", r, err)
+	}
+	w = do("GET", "/roles", member.ID, nil)
+	var roles []*role
+	if err := json.NewDecoder(w.Body).Decode(&roles); err != nil || len(roles) != 2 {
+		t.Fatalf("unexpected roles=%#v err=%v", roles, err)
+	}
+
+	// organization owners can assign roles to members within their organization
+	path := fmt.Sprintf("/users/%s/roles/billing?organization_id=%s", member.ID, org.ID)
+	if w := do("PUT", path, owner.ID, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected role which isn't org assignable to be rejected, got %d", w.Code)
+	}
+	req.OrgAssignable = true
+	if w := do("PUT", "/roles/billing", admin.ID, req); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", path, owner.ID, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected non-member to be rejected, got %d", w.Code)
+	}
+	invite := &organizationInvite{
+		ID:             generateID(),
+		OrganizationID: org.ID,
+		Email:          member.Email,
+		Role:           orgRoleMember,
+		InvitedBy:      owner.ID,
+		CreatedAt:      base.NewTime(time.Now()),
+		ExpiresAt:      base.NewTime(time.Now().Add(time.Hour)),
+	}
+	code := generateID()
+	if err := orgRepo.createInvite(invite, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orgRepo.acceptInvite(code, member); err != nil {
+		t.Fatal(err)
+	}
+	if w := do("PUT", path, owner.ID, nil); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", fmt.Sprintf("/users/%s/roles/billing", member.ID), owner.ID, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected global assignment to be rejected, got %d", w.Code)
+	}
+	if w := do("PUT", fmt.Sprintf("/users/%s/roles/%s?organization_id=%s", member.ID, adminRole, org.ID), owner.ID, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("PUT", fmt.Sprintf("/users/%s/roles/missing", member.ID), admin.ID, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// users can read their own roles
+	w = do("GET", fmt.Sprintf("/users/%s/roles?organization_id=%s", member.ID, org.ID), member.ID, nil)
+	var assigned []*userRole
+	if err := json.NewDecoder(w.Body).Decode(&assigned); err != nil || len(assigned) != 1 || assigned[0].OrganizationID != org.ID {
+		t.Fatalf("unexpected roles=%#v err=%v", assigned, err)
+	}
+	if w := do("GET", fmt.Sprintf("/users/%s/roles", owner.ID), member.ID, nil); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	if w := do("DELETE", path, owner.ID, nil); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// removed members lose their roles within the organization
+	if w := do("PUT", path, owner.ID, nil); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if err := orgRepo.removeMember(org.ID, member.ID); err != nil {
+		t.Fatal(err)
+	}
+	if roles, err := roleRepo.getUserRoles(member.ID, org.ID); err != nil || len(roles) != 0 {
+		t.Errorf("unexpected roles=%#v err=%v", roles, err)
+	}
+
+	if w := do("DELETE", "/roles/billing", admin.ID, nil); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+}
+
+func TestRoles__escalation(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	orgRepo := &sqliteOrganizationRepository{db: repo.db, log: log.NewNopLogger()}
+	roleRepo := &sqliteRoleRepository{db: repo.db, log: log.NewNopLogger()}
+
+	router := mux.NewRouter()
+	addRoleRoutes(router, log.NewNopLogger(), auth, orgRepo, roleRepo)
+
+	admin, manager, member := createTestUser(t, repo, "admin@moov.io"), createTestUser(t, repo, "manager@moov.io"), createTestUser(t, repo, "member@moov.io")
+	if err := roleRepo.assignRole(admin.ID, adminRole, ""); err != nil {
+		t.Fatal(err)
+	}
+	roleManager := &role{Name: "role-manager", Permissions: []string{permRolesWrite}, CreatedAt: base.NewTime(time.Now())}
+	if err := roleRepo.upsertRole(roleManager); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleRepo.assignRole(manager.ID, roleManager.Name, ""); err != nil {
+		t.Fatal(err)
+	}
+	org := &organization{ID: generateID(), Name: "Moov", CreatedAt: base.NewTime(time.Now())}
+	if err := orgRepo.createOrganization(org, admin.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path string, userId string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		cookie, err := createCookie(userId, auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(method, path, &buf)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	// roles:write only grants the permissions the caller holds
+	if w := do("PUT", "/roles/superuser", manager.ID, upsertRoleRequest{Permissions: []string{permAll}}); w.Code != http.StatusForbidden {
+		t.Errorf("expected * role to be rejected, got %d", w.Code)
+	}
+	if w := do("PUT", "/roles/billing", manager.ID, upsertRoleRequest{Permissions: []string{"invoices:read"}}); w.Code != http.StatusForbidden {
+		t.Errorf("expected unheld permission to be rejected, got %d", w.Code)
+	}
+	if w := do("PUT", "/roles/delegate", manager.ID, upsertRoleRequest{Permissions: []string{permRolesWrite}}); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/roles/billing", admin.ID, upsertRoleRequest{Permissions: []string{"invoices:read"}}); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	// global roles and * roles need *
+	for _, name := range []string{adminRole, "delegate"} {
+		if w := do("PUT", fmt.Sprintf("/users/%s/roles/%s", member.ID, name), manager.ID, nil); w.Code != http.StatusForbidden {
+			t.Errorf("expected global %s assignment to be rejected, got %d", name, w.Code)
+		}
+	}
+	if w := do("PUT", fmt.Sprintf("/users/%s/roles/billing?organization_id=%s", member.ID, org.ID), manager.ID, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected unheld role to be rejected, got %d", w.Code)
+	}
+	if w := do("DELETE", fmt.Sprintf("/users/%s/roles/%s", admin.ID, adminRole), manager.ID, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected admin removal to be rejected, got %d", w.Code)
+	}
+	if w := do("PUT", fmt.Sprintf("/users/%s/roles/delegate", member.ID), admin.ID, nil); w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if ok, err := roleRepo.hasPermission(member.ID, "", permAll); err != nil || ok {
+		t.Errorf("member shouldn't hold *: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestRoles__checkAuth(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	roleRepo := &sqliteRoleRepository{db: repo.db, log: log.NewNopLogger()}
+	orgRepo := &sqliteOrganizationRepository{db: repo.db, log: log.NewNopLogger()}
+	o.svc.orgs = orgRepo
+
+	user := createTestUser(t, repo, "test@moov.io")
+	if err := roleRepo.upsertRole(&role{Name: "billing", CreatedAt: base.NewTime(time.Now())}); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleRepo.assignRole(user.ID, "billing", ""); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(user.ID, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		checkAuth(log.NewNopLogger(), auth, o.svc, repo, roleRepo, nil)(w, r)
+		w.Flush()
+		return w
+	}
+
+	w := check("/auth/check")
+	if w.Code != http.StatusOK || w.Header().Get("X-Roles") != "billing" {
+		t.Errorf("got %d X-Roles=%q", w.Code, w.Header().Get("X-Roles"))
+	}
+	if w := check("/auth/check?roles=billing"); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := check("/auth/check?roles=billing,admin"); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// roles within an organization are kept apart from global roles
+	org := &organization{ID: generateID(), Name: "Moov", CreatedAt: base.NewTime(time.Now())}
+	if err := orgRepo.createOrganization(org, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleRepo.upsertRole(&role{Name: "support", OrgAssignable: true, CreatedAt: base.NewTime(time.Now())}); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleRepo.assignRole(user.ID, "support", org.ID); err != nil {
+		t.Fatal(err)
+	}
+	w = check("/auth/check?organization_id=" + org.ID)
+	if w.Code != http.StatusOK || w.Header().Get("X-Roles") != "billing" || w.Header().Get("X-Organization-Roles") != "support" {
+		t.Errorf("got %d X-Roles=%q X-Organization-Roles=%q", w.Code, w.Header().Get("X-Roles"), w.Header().Get("X-Organization-Roles"))
+	}
+	if w := check("/auth/check?roles=support&organization_id=" + org.ID); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := check("/auth/check?organization_roles=support&organization_id=" + org.ID); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gopkg.in/oauth2.v3"
+)
+
+var (
+	// scopeTokenRegex matches a single scope-token from RFC 6749 Section 3.3
+	//   scope-token = 1*( %x21 / %x23-5B / %x5D-7E )
+	scopeTokenRegex = regexp.MustCompile(`^[\x21\x23-\x5B\x5D-\x7E]+$`)
+)
+
+// parseScopes splits a space (or comma) delimited list of scopes. Duplicate scopes are dropped.
+func parseScopes(raw string) []string {
+	var out []string
+	for _, s := range strings.FieldsFunc(raw, func(r rune) bool { return r == ' ' || r == ',' }) {
+		if !containsScope(out, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// validateScopes checks each scope is a valid OAuth2 scope-token.
+func validateScopes(scopes []string) error {
+	for i := range scopes {
+		if strings.Contains(scopes[i], ",") || !scopeTokenRegex.MatchString(scopes[i]) {
+			return fmt.Errorf("invalid scope %q", scopes[i])
+		}
+	}
+	return nil
+}
+
+func containsScope(scopes []string, needle string) bool {
+	for i := range scopes {
+		if scopes[i] == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// scopesAllowed returns true if every requested scope is found in allowed.
+func scopesAllowed(allowed, requested []string) bool {
+	for i := range requested {
+		if !containsScope(allowed, requested[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientScopes returns the scopes an OAuth2 client has been registered with.
+func clientScopes(cli oauth2.ClientInfo) []string {
+	if c, ok := cli.(interface{ GetScopes() []string }); ok {
+		return c.GetScopes()
+	}
+	return nil
+}
+
+// requiredScopes returns the scopes a request to /auth/check demands the caller has.
+//
+// Scopes can be set with the 'scopes' query parameter (i.e. the forward auth address)
+// or the X-Required-Scopes header set by the proxy.
+func requiredScopes(r *http.Request) []string {
+	raw := strings.Join([]string{r.URL.Query().Get("scopes"), r.Header.Get("X-Required-Scopes")}, " ")
+	return parseScopes(raw)
+}
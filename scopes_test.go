@@ -0,0 +1,68 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestScopes__parse(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		{"", nil},
+		{"read", []string{"read"}},
+		{"read write", []string{"read", "write"}},
+		{"read,write", []string{"read", "write"}},
+		{" read  read,write ", []string{"read", "write"}},
+	}
+	for i := range cases {
+		res := parseScopes(cases[i].input)
+		if !reflect.DeepEqual(res, cases[i].expected) {
+			t.Errorf("%q: got %#v", cases[i].input, res)
+		}
+	}
+}
+
+func TestScopes__validate(t *testing.T) {
+	if err := validateScopes([]string{"read", "ach:write", "users/*"}); err != nil {
+		t.Error(err)
+	}
+	if err := validateScopes([]string{`bad"scope`}); err == nil {
+		t.Error("expected error")
+	}
+	if err := validateScopes([]string{"bad\\scope"}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestScopes__allowed(t *testing.T) {
+	allowed := []string{"read", "write"}
+	if !scopesAllowed(allowed, nil) {
+		t.Error("expected no scopes to be allowed")
+	}
+	if !scopesAllowed(allowed, []string{"write"}) {
+		t.Error("expected write to be allowed")
+	}
+	if scopesAllowed(allowed, []string{"read", "admin"}) {
+		t.Error("expected admin to be rejected")
+	}
+	if scopesAllowed(nil, []string{"read"}) {
+		t.Error("expected read to be rejected")
+	}
+}
+
+func TestScopes__required(t *testing.T) {
+	r := httptest.NewRequest("GET", "/auth/check?scopes=read,write", nil)
+	r.Header.Set("X-Required-Scopes", "write admin")
+
+	res := requiredScopes(r)
+	if !reflect.DeepEqual(res, []string{"read", "write", "admin"}) {
+		t.Errorf("got %#v", res)
+	}
+}
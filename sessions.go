@@ -0,0 +1,128 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// sessionStore keeps the checksum of each user's cookie outside of the user_cookies table.
+// Like user_cookies only the latest cookie of a user is valid.
+type sessionStore interface {
+	// lookup returns the userId of an unexpired session, or an empty string if there's none.
+	lookup(checksum string) (string, error)
+	write(userId, checksum string, expires time.Time) error
+	invalidate(userId string) (int64, error)
+
+	// expiry returns when the user's session expires, or the zero time if they don't have one.
+	expiry(userId string) (time.Time, error)
+}
+
+// setupSessionStore returns a sessionStore for connStr. A nil store is returned when connStr
+// is empty, which keeps sessions in the SQL database.
+func setupSessionStore(connStr string) (sessionStore, error) {
+	if connStr == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(connStr, "redis://") || strings.HasPrefix(connStr, "rediss://") {
+		return newRedisSessionStore(connStr)
+	}
+	return nil, fmt.Errorf("unsupported SESSIONS_DSN %q", connStr)
+}
+
+// redisSessionStore keeps sessions in Redis (or a server speaking the Redis protocol) so
+// every replica sees the same sessions. Keys are written with a TTL of the cookie's expiry.
+type redisSessionStore struct {
+	client *redis.Client
+}
+
+func newRedisSessionStore(redisURL string) (*redisSessionStore, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("problem parsing redis URL: %v", err)
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("problem with Ping against redis %s: %v", opts.Addr, err)
+	}
+	return &redisSessionStore{client: client}, nil
+}
+
+func redisSessionKey(checksum string) string   { return "session:" + checksum }
+func redisUserSessionKey(userId string) string { return "user-session:" + userId }
+
+func (rs *redisSessionStore) lookup(checksum string) (string, error) {
+	userId, err := rs.client.Get(redisSessionKey(checksum)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("problem reading session: %v", err)
+	}
+	return userId, nil
+}
+
+// write replaces the user's session with checksum, the previous session is removed.
+func (rs *redisSessionStore) write(userId, checksum string, expires time.Time) error {
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return nil // already expired
+	}
+	previous, err := rs.client.Get(redisUserSessionKey(userId)).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("problem reading session: %v", err)
+	}
+	_, err = rs.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		if previous != "" && previous != checksum {
+			pipe.Del(redisSessionKey(previous))
+		}
+		pipe.Set(redisSessionKey(checksum), userId, ttl)
+		pipe.Set(redisUserSessionKey(userId), checksum, ttl)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("problem writing session: %v", err)
+	}
+	return nil
+}
+
+// invalidate removes the user's session and returns how many were removed.
+func (rs *redisSessionStore) invalidate(userId string) (int64, error) {
+	checksum, err := rs.client.Get(redisUserSessionKey(userId)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("problem reading session: %v", err)
+	}
+	n, err := rs.client.Del(redisSessionKey(checksum), redisUserSessionKey(userId)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("problem removing session: %v", err)
+	}
+	if n > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (rs *redisSessionStore) expiry(userId string) (time.Time, error) {
+	ttl, err := rs.client.PTTL(redisUserSessionKey(userId)).Result()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("problem reading session: %v", err)
+	}
+	if ttl <= 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(ttl), nil
+}
+
+func (rs *redisSessionStore) Close() error {
+	return rs.client.Close()
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestSessions__setupSessionStore(t *testing.T) {
+	store, err := setupSessionStore("")
+	if err != nil || store != nil {
+		t.Errorf("expected no store, got store=%v err=%v", store, err)
+	}
+	if _, err := setupSessionStore("memcache://localhost"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestSessions__redis(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	store, err := setupSessionStore("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.(*redisSessionStore).Close()
+
+	a, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.cleanup()
+	a.sessions = store
+
+	userId := generateID()
+	cookie, err := createCookie(userId, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := a.findUserId(cookie.Value); err != nil || id != userId {
+		t.Fatalf("expected userId=%s, got %s err=%v", userId, id, err)
+	}
+
+	// nothing is written to user_cookies
+	var count int
+	if err := a.db.QueryRow(`select count(*) from user_cookies`).Scan(&count); err != nil || count != 0 {
+		t.Errorf("count=%d err=%v", count, err)
+	}
+
+	// a new cookie replaces the previous one
+	next, err := createCookie(userId, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := a.findUserId(cookie.Value); id != "" {
+		t.Errorf("previous cookie still valid for %s", id)
+	}
+	if id, err := a.findUserId(next.Value); err != nil || id != userId {
+		t.Fatalf("expected userId=%s, got %s err=%v", userId, id, err)
+	}
+	if sessions, err := a.activeSessions(userId); err != nil || len(sessions) != 1 || sessions[0].ExpiresAt.Sub(next.Expires) > time.Second {
+		t.Errorf("unexpected sessions=%#v err=%v", sessions, err)
+	}
+
+	// sessions expire with the cookie
+	server.FastForward(time.Until(next.Expires) + time.Second)
+	if id, err := a.findUserId(next.Value); err != nil || id != "" {
+		t.Errorf("expected expired session, got %s err=%v", id, err)
+	}
+
+	// logout
+	cookie, err = createCookie(userId, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.invalidateCookies(userId); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := a.findUserId(cookie.Value); err != nil || id != "" {
+		t.Errorf("expected no session, got %s err=%v", id, err)
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+
+	// expired cookies aren't written
+	expired := &http.Cookie{Value: generateID(), Expires: time.Now().Add(-1 * time.Minute)}
+	if err := a.writeCookie(userId, expired); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+}
@@ -36,11 +36,11 @@ type signupRequest struct {
 	CompanyURL string `json:"companyUrl,omitempty"`
 }
 
-func addSignupRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository) {
-	router.Methods("POST").Path("/users/create").HandlerFunc(signupRoute(auth, userService))
+func addSignupRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, audit auditLog) {
+	router.Methods("POST").Path("/users/create").HandlerFunc(signupRoute(auth, userService, audit))
 }
 
-func signupRoute(auth authable, userService userRepository) func(w http.ResponseWriter, r *http.Request) {
+func signupRoute(auth authable, userService userRepository, audit auditLog) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w = wrapResponseWriter(w, r, "signupRoute")
 
@@ -116,15 +116,15 @@ func signupRoute(auth authable, userService userRepository) func(w http.Response
 				CompanyURL: signup.CompanyURL,
 				CreatedAt:  base.NewTime(time.Now()),
 			}
-			if err := userService.upsert(u); err != nil {
-				internalError(w, fmt.Errorf("problem writing user: %v", err))
-				return
+			if signupRequireVerification {
+				u.Status = userStatusPending
 			}
-
-			if err := auth.writePassword(u.ID, signup.Password); err != nil {
-				internalError(w, fmt.Errorf("problem writing user credentials: %v", err))
+			// the user, their password and the user.created event are written together
+			if err := userService.create(u, signup.Password); err != nil {
+				internalError(w, fmt.Errorf("problem writing user: %v", err))
 				return
 			}
+			recordAudit(audit, r, auditSignup, u.ID, u.ID, nil)
 
 			// signup worked, yay!
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -0,0 +1,74 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// smsSender delivers a text message to a phone number.
+type smsSender interface {
+	sendSMS(to, body string) error
+}
+
+// setupSMSSender returns the sender for text messages. Messages are appended to the file at
+// path when it's set, otherwise they're logged. Both are stand-ins for an SMS provider.
+func setupSMSSender(logger log.Logger, path string) smsSender {
+	if path != "" {
+		return &fileSMSSender{path: path}
+	}
+	return &logSMSSender{logger: logger}
+}
+
+// logSMSSender writes text messages to the logger instead of delivering them.
+type logSMSSender struct {
+	logger log.Logger
+}
+
+func (s *logSMSSender) sendSMS(to, body string) error {
+	if s.logger != nil {
+		s.logger.Log("sms", fmt.Sprintf("to=%s", to), "body", body)
+	}
+	return nil
+}
+
+// fileSMSSender appends each text message to a file as a line of JSON, which lets
+// local development and tests read the messages back.
+type fileSMSSender struct {
+	path string
+	mu   sync.Mutex
+}
+
+type fileSMS struct {
+	To     string    `json:"to"`
+	Body   string    `json:"body"`
+	SentAt time.Time `json:"sentAt"`
+}
+
+func (s *fileSMSSender) sendSMS(to, body string) error {
+	bs, err := json.Marshal(fileSMS{To: to, Body: body, SentAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fd, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("problem opening SMS file: %v", err)
+	}
+	if _, err := fd.Write(append(bs, '\n')); err != nil {
+		fd.Close()
+		return fmt.Errorf("problem writing SMS file: %v", err)
+	}
+	return fd.Close()
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// readSMSFile returns every message written by a fileSMSSender
+func readSMSFile(t *testing.T, path string) []fileSMS {
+	t.Helper()
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	var out []fileSMS
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		var msg fileSMS
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+func TestSMS__setupSMSSender(t *testing.T) {
+	if s, ok := setupSMSSender(log.NewNopLogger(), "").(*logSMSSender); !ok {
+		t.Errorf("unexpected sender %T", s)
+	}
+	if err := setupSMSSender(log.NewNopLogger(), "").sendSMS("+15555555555", "hello"); err != nil {
+		t.Error(err)
+	}
+
+	dir, err := ioutil.TempDir("", "sms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sms.jsonl")
+	sender := setupSMSSender(log.NewNopLogger(), path)
+	for _, body := range []string{"first", "second"} {
+		if err := sender.sendSMS("+15555555555", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs := readSMSFile(t, path)
+	if len(msgs) != 2 || msgs[0].Body != "first" || msgs[1].To != "+15555555555" || msgs[1].SentAt.IsZero() {
+		t.Errorf("unexpected messages: %#v", msgs)
+	}
+}
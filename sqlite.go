@@ -29,6 +29,59 @@ var (
 		`create table if not exists user_details(user_id primary key, first_name, last_name, phone, company_url);`,
 		`create table if not exists user_cookies(user_id primary key, data, valid_until);`,
 		`create table if not exists user_passwords(user_id primary key, password, salt);`,
+		`create table if not exists user_status(user_id primary key, status, updated_at);`,
+		`create table if not exists user_status_transitions(user_id, from_status, to_status, reason, changed_by, created_at);`,
+		`update user_status set status = 'suspended' where status = 'disabled';`,
+		`create table if not exists user_login_failures(user_id primary key, failures, last_failed_at);`,
+		`create table if not exists user_password_resets(code primary key, user_id, created_by, expires_at);`,
+		`create table if not exists user_deletions(user_id primary key, requested_at, purge_after, purged_at, report);`,
+		`create table if not exists user_email_changes(code primary key, user_id, email, clean_email, expires_at);`,
+		`create table if not exists user_phone_verifications(user_id primary key, phone, code, expires_at, attempts, sent_at, sends, window_started_at);`,
+		`create table if not exists user_verified_phones(user_id primary key, phone, verified_at);`,
+		`create table if not exists user_login_fingerprints(user_id, device, ip_range, user_agent, first_seen_at, last_seen_at, primary key (user_id, device, ip_range));`,
+		`create table if not exists user_login_alerts(code primary key, user_id, device, ip_range, ip, user_agent, created_at, expires_at);`,
+
+		// Organizations
+		`create table if not exists organizations(organization_id primary key, name, created_by, created_at, deleted_at);`,
+		`create table if not exists organization_members(organization_id, user_id, role, created_at, primary key (organization_id, user_id));`,
+		`create table if not exists organization_invites(invite_id primary key, organization_id, code, clean_email, email, role, invited_by, created_at, expires_at, accepted_at, accepted_by);`,
+
+		// Roles, user_roles.organization_id is empty for global assignments
+		`create table if not exists roles(name primary key, description, created_at);`,
+		`create table if not exists role_permissions(name, permission, primary key (name, permission));`,
+		`create table if not exists user_roles(user_id, name, organization_id, created_at, primary key (user_id, name, organization_id));`,
+		`create table if not exists org_assignable_roles(name primary key);`,
+		`insert or ignore into roles (name, description) values ('admin', 'Every permission, including managing roles');`,
+		`insert or ignore into role_permissions (name, permission) values ('admin', '*');`,
+
+		// Personal access tokens, only a hash of each token is stored
+		`create table if not exists personal_access_tokens(token_id primary key, user_id, name, token, prefix, scopes, created_at, expires_at, last_used_at, revoked_at);`,
+		`create unique index if not exists personal_access_tokens_token on personal_access_tokens(token);`,
+
+		// Notifications waiting to be delivered, or kept until the janitor's retention once sent or failed
+		`create table if not exists notifications(notification_id primary key, recipient, template, subject, body, attempts, next_attempt_at, last_error, created_at, sent_at, failed_at);`,
+
+		// Security audit log, seq orders events and is the cursor of each page. Each event's hash
+		// covers the previous event's hash and checkpoints sign the hash at a seq.
+		`create table if not exists audit_events(seq integer primary key, event_id unique, type, actor_id, user_id, ip, user_agent, request_id, details, created_at, prev_hash, hash);`,
+		`create table if not exists audit_checkpoints(seq primary key, hash, signature, created_at);`,
+
+		// Salt of each audit event's personal data (IP, User-Agent and details). Once a deleted user's
+		// data is erased only the digest their event's hash covers is left.
+		`create table if not exists audit_event_salts(event_id primary key, salt, digest, erased_at);`,
+
+		// Webhook subscriptions to identity events and each delivery to them, failed deliveries are the dead-letter list
+		`create table if not exists webhooks(webhook_id primary key, url, secret, event_types, created_by, created_at, deleted_at);`,
+		`create table if not exists webhook_deliveries(delivery_id primary key, webhook_id, event_id, event_type, user_id, payload, attempts, next_attempt_at, response_status, last_error, created_at, delivered_at, failed_at);`,
+		`create index if not exists webhook_deliveries_webhook_id on webhook_deliveries(webhook_id, created_at);`,
+		`create index if not exists webhook_deliveries_event_id on webhook_deliveries(event_id, webhook_id);`,
+
+		// Transactional outbox of identity events, written with the user change they describe. Each
+		// sink's cursor is the seq of the last event it published.
+		`create table if not exists outbox(seq integer primary key, event_id unique, event_type, user_id, payload, created_at);`,
+		`create table if not exists outbox_cursors(sink primary key, seq, attempts, next_attempt_at, last_error, updated_at);`,
+		`create index if not exists audit_events_user_id on audit_events(user_id, seq);`,
+		`create index if not exists audit_events_actor_id on audit_events(actor_id, seq);`,
 	}
 
 	// Metrics
@@ -0,0 +1,170 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
+
+	"gopkg.in/oauth2.v3"
+)
+
+// cachedTokenStore caches access token lookups of an oauth2.TokenStore, which is how every
+// Bearer token is validated. Tokens are dropped from the cache when they're revoked through
+// the store.
+type cachedTokenStore struct {
+	oauth2.TokenStore
+
+	cache *ttlCache
+}
+
+// newCachedTokenStore wraps store with a cache, store is returned as-is if caching is disabled.
+func newCachedTokenStore(store oauth2.TokenStore) oauth2.TokenStore {
+	cache := newTTLCache("tokens")
+	if cache == nil {
+		return store
+	}
+	return &cachedTokenStore{
+		TokenStore: store,
+		cache:      cache,
+	}
+}
+
+func (ts *cachedTokenStore) Create(info oauth2.TokenInfo) error {
+	// Tokens are re-written to update their userId
+	ts.cache.remove(info.GetAccess())
+	return ts.TokenStore.Create(info)
+}
+
+func (ts *cachedTokenStore) GetByAccess(access string) (oauth2.TokenInfo, error) {
+	if v, ok := ts.cache.get(access); ok {
+		return v.(oauth2.TokenInfo), nil
+	}
+	ti, err := ts.TokenStore.GetByAccess(access)
+	if err != nil || ti == nil {
+		return ti, err
+	}
+	var ttl time.Duration
+	if exp := ti.GetAccessExpiresIn(); exp > 0 {
+		ttl = time.Until(ti.GetAccessCreateAt().Add(exp))
+		if ttl <= 0 {
+			return ti, nil // expired, let the manager reject it
+		}
+	}
+	ts.cache.set(access, ti, ttl, ti.GetClientID(), ti.GetUserID())
+	return ti, nil
+}
+
+func (ts *cachedTokenStore) RemoveByAccess(access string) error {
+	ts.cache.remove(access)
+	return ts.TokenStore.RemoveByAccess(access)
+}
+
+func (ts *cachedTokenStore) RemoveByCode(code string) error {
+	if ti, _ := ts.TokenStore.GetByCode(code); ti != nil {
+		ts.cache.remove(ti.GetAccess())
+	}
+	return ts.TokenStore.RemoveByCode(code)
+}
+
+func (ts *cachedTokenStore) RemoveByRefresh(refresh string) error {
+	if ti, _ := ts.TokenStore.GetByRefresh(refresh); ti != nil {
+		ts.cache.remove(ti.GetAccess())
+	}
+	return ts.TokenStore.RemoveByRefresh(refresh)
+}
+
+func (ts *cachedTokenStore) RemoveByClientID(clientID string) error {
+	ts.cache.removeTagged(clientID)
+	if remover, ok := ts.TokenStore.(clientTokenRemover); ok {
+		return remover.RemoveByClientID(clientID)
+	}
+	return nil
+}
+
+func (ts *cachedTokenStore) RemoveByUserID(userID string) error {
+	ts.cache.removeTagged(userID)
+	if remover, ok := ts.TokenStore.(userTokenRemover); ok {
+		return remover.RemoveByUserID(userID)
+	}
+	return nil
+}
+
+func (ts *cachedTokenStore) RemoveByClientAndUserID(clientID, userID string) error {
+	ts.cache.removeTagged(userID)
+	if remover, ok := ts.TokenStore.(clientUserTokenRemover); ok {
+		return remover.RemoveByClientAndUserID(clientID, userID)
+	}
+	return nil
+}
+
+func (ts *cachedTokenStore) PurgeByUserID(userID string) (int64, error) {
+	ts.cache.removeTagged(userID)
+	if purger, ok := ts.TokenStore.(userTokenPurger); ok {
+		return purger.PurgeByUserID(userID)
+	}
+	return 0, nil
+}
+
+func (ts *cachedTokenStore) CountByUserID(userID string) (int64, error) {
+	if purger, ok := ts.TokenStore.(userTokenPurger); ok {
+		return purger.CountByUserID(userID)
+	}
+	return 0, nil
+}
+
+func (ts *cachedTokenStore) MetadataByUserID(userID string) ([]oauthdb.TokenMetadata, error) {
+	if md, ok := ts.TokenStore.(userTokenMetadata); ok {
+		return md.MetadataByUserID(userID)
+	}
+	return nil, nil
+}
+
+func (ts *cachedTokenStore) GetFamilyByRefresh(refresh string) (string, bool, error) {
+	if families, ok := ts.TokenStore.(refreshTokenFamilies); ok {
+		return families.GetFamilyByRefresh(refresh)
+	}
+	return "", false, nil
+}
+
+func (ts *cachedTokenStore) ClaimRefresh(refresh string) (string, bool, error) {
+	if families, ok := ts.TokenStore.(refreshTokenFamilies); ok {
+		return families.ClaimRefresh(refresh)
+	}
+	return "", true, nil
+}
+
+func (ts *cachedTokenStore) ReleaseRefresh(refresh string) error {
+	if families, ok := ts.TokenStore.(refreshTokenFamilies); ok {
+		return families.ReleaseRefresh(refresh)
+	}
+	return nil
+}
+
+func (ts *cachedTokenStore) SetFamily(refresh, family string) error {
+	if families, ok := ts.TokenStore.(refreshTokenFamilies); ok {
+		return families.SetFamily(refresh, family)
+	}
+	return nil
+}
+
+// RemoveByFamily clears every cached token as the cache doesn't know which tokens are in a
+// family. Families are only revoked when a refresh token is reused, which is rare.
+func (ts *cachedTokenStore) RemoveByFamily(family string) error {
+	ts.cache.clear()
+	if families, ok := ts.TokenStore.(refreshTokenFamilies); ok {
+		return families.RemoveByFamily(family)
+	}
+	return nil
+}
+
+func (ts *cachedTokenStore) Close() error {
+	if c, ok := ts.TokenStore.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
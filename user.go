@@ -37,6 +37,12 @@ type User struct {
 	Phone      string    `json:"phone"`
 	CompanyURL string    `json:"companyUrl"`
 	CreatedAt  base.Time `json:"createdAt"`
+
+	// Status is where the user is in their lifecycle, see user_status.go
+	Status string `json:"status"`
+
+	// PhoneVerified is true when Phone was proven with a texted code
+	PhoneVerified bool `json:"phoneVerified"`
 }
 
 var (
@@ -143,7 +149,7 @@ func updateUserProfile(logger log.Logger, auth authable, userRepo userRepository
 		}
 
 		// Write user back
-		if err := userRepo.upsert(user); err != nil {
+		if err := userRepo.updateProfile(user); err != nil {
 			internalError(w, err)
 			return
 		}
@@ -163,11 +169,53 @@ type userRepository interface {
 	lookupByEmail(email string) (*User, error)
 
 	upsert(*User) error
+
+	// create saves a new user with their password and status, writing a user.created event.
+	create(u *User, password string) error
+
+	// updateProfile saves changes to the user's profile, writing a user.updated event.
+	updateProfile(*User) error
+
+	// transitionStatus moves userId to the status, recording who changed it and why.
+	// errInvalidStatusTransition is returned if the user can't move to status.
+	transitionStatus(userId, status, reason, changedBy string) error
+
+	// statusHistory returns every status change of userId, oldest first.
+	statusHistory(userId string) ([]*userStatusTransition, error)
+
+	// recordLoginFailure counts a failed login of userId, returning how many consecutive
+	// logins have failed.
+	recordLoginFailure(userId string) (int, error)
+
+	// clearLoginFailures resets the failed login count of userId after they login.
+	clearLoginFailures(userId string) error
+
+	// search returns up to limit users whose ID, email or name contains query.
+	search(query string, limit int) ([]*User, error)
+
+	// requestEmailChange returns a code which confirms userId's change to email.
+	requestEmailChange(userId, email string) (string, time.Time, error)
+
+	// confirmEmailChange consumes code, moving its user to the new email address.
+	confirmEmailChange(code string) (*emailChange, error)
+
+	// createPhoneCode returns a code which verifies userId owns phone.
+	createPhoneCode(userId, phone string) (string, error)
+
+	// verifyPhoneCode marks phone as verified for userId if code is the one sent to phone.
+	verifyPhoneCode(userId, phone, code string) error
+
+	// getVerifiedPhone returns the phone number userId last verified.
+	// This function can return nil, nil meaning they haven't verified one.
+	getVerifiedPhone(userId string) (*verifiedPhone, error)
 }
 
 type sqliteUserRepository struct {
 	db  *sql.DB
 	log log.Logger
+
+	// cache holds users by userId, it's cleared on upsert
+	cache *ttlCache
 }
 
 func (repo sqliteUserRepository) close() error {
@@ -175,10 +223,19 @@ func (repo sqliteUserRepository) close() error {
 }
 
 func (s *sqliteUserRepository) lookupByUserId(userId string) (*User, error) {
-	query := `select u.email, u.created_at, ud.first_name, ud.last_name, ud.phone, ud.company_url
+	if v, ok := s.cache.get(userId); ok {
+		u := *(v.(*User)) // callers can modify the returned User
+		return &u, nil
+	}
+
+	query := `select u.email, u.created_at, ud.first_name, ud.last_name, ud.phone, ud.company_url, us.status, uvp.phone
 from users as u
 inner join user_details as ud
 on u.user_id = ud.user_id
+left join user_status as us
+on u.user_id = us.user_id
+left join user_verified_phones as uvp
+on u.user_id = uvp.user_id
 where u.user_id = ?
 limit 1`
 	stmt, err := s.db.Prepare(query)
@@ -192,7 +249,8 @@ limit 1`
 	u := &User{}
 	u.ID = userId
 	var createdAt string // needs parsing
-	err = row.Scan(&u.Email, &createdAt, &u.FirstName, &u.LastName, &u.Phone, &u.CompanyURL)
+	var status, verifiedPhone sql.NullString
+	err = row.Scan(&u.Email, &createdAt, &u.FirstName, &u.LastName, &u.Phone, &u.CompanyURL, &status, &verifiedPhone)
 	if err != nil {
 		if strings.Contains(err.Error(), "no rows in result set") {
 			return nil, nil // no user found
@@ -205,9 +263,16 @@ limit 1`
 		s.log.Log("user", fmt.Sprintf("bad users.created_at format %q: %v", createdAt, err))
 	}
 	u.CreatedAt = base.NewTime(t)
+	u.Status = userStatusActive
+	if status.String != "" {
+		u.Status = status.String
+	}
+	u.PhoneVerified = u.Phone != "" && u.Phone == verifiedPhone.String // changing phone numbers un-verifies them
 	if u.Email == "" {
 		return nil, nil
 	}
+	cached := *u
+	s.cache.set(userId, &cached, 0, userId)
 	return u, nil
 }
 
@@ -241,38 +306,139 @@ func (s *sqliteUserRepository) upsert(inc *User) error {
 	if err != nil {
 		return err
 	}
+	if err := writeUser(tx, inc); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("%v, rollback err=%v", err, e)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.cache.remove(inc.ID)
+	return nil
+}
+
+// create saves a new user with their password and a user.created event in one transaction.
+func (s *sqliteUserRepository) create(inc *User, password string) error {
+	hashed, salt, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := writeUser(tx, inc); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("%v, rollback err=%v", err, e)
+	}
+	if _, err := tx.Exec(`replace into user_passwords (user_id, password, salt) values (?, ?, ?)`, inc.ID, hashed, salt); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem writing password of userId=%s, err=%v, rollback err=%v", inc.ID, err, e)
+	}
+	if inc.Status != "" && inc.Status != userStatusActive {
+		query := `replace into user_status (user_id, status, updated_at) values (?, ?, ?)`
+		if _, err := tx.Exec(query, inc.ID, inc.Status, inc.CreatedAt.Format(serializedTimestampFormat)); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem writing status of userId=%s, err=%v, rollback err=%v", inc.ID, err, e)
+		}
+	}
+	if err := writeOutbox(tx, eventUserCreated, inc.ID, userEventData(inc)); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("%v, rollback err=%v", err, e)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.cache.remove(inc.ID)
+	return nil
+}
+
+// updateProfile saves the user and a user.updated event in one transaction.
+func (s *sqliteUserRepository) updateProfile(inc *User) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := writeUser(tx, inc); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("%v, rollback err=%v", err, e)
+	}
+	if err := writeOutbox(tx, eventUserUpdated, inc.ID, userEventData(inc)); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("%v, rollback err=%v", err, e)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.cache.remove(inc.ID)
+	return nil
+}
 
+// writeUser inserts or updates the 'users' and 'user_details' rows of inc.
+func writeUser(tx *sql.Tx, inc *User) error {
 	// insert/update into 'users'
 	query := `replace into users (user_id, email, clean_email, created_at) values (?, ?, ?, ?)`
 	stmt, err := tx.Prepare(query)
 	if err != nil {
-		e := tx.Rollback()
-		return fmt.Errorf("problem preparing users query userId=%s, err=%v, rollback err=%v", inc.ID, err, e)
+		return fmt.Errorf("problem preparing users query userId=%s, err=%v", inc.ID, err)
 	}
 	_, err = stmt.Exec(inc.ID, inc.Email, inc.cleanEmail(), inc.CreatedAt.Format(serializedTimestampFormat))
+	stmt.Close()
 	if err != nil {
-		stmt.Close()
-		e := tx.Rollback()
-		return fmt.Errorf("problem upserting users userId=%s, err=%v, rollback err=%v", inc.ID, err, e)
+		return fmt.Errorf("problem upserting users userId=%s, err=%v", inc.ID, err)
 	}
-	stmt.Close()
 
 	// insert/update into 'user_details'
 	query = `replace into user_details (user_id, first_name, last_name, phone, company_url) values (?, ?, ?, ?, ?)`
 	stmt, err = tx.Prepare(query)
 	if err != nil {
-		e := tx.Rollback()
-		return fmt.Errorf("problem preparing user_details query userId=%s, err=%v, rollback err=%v", inc.ID, err, e)
+		return fmt.Errorf("problem preparing user_details query userId=%s, err=%v", inc.ID, err)
 	}
 	_, err = stmt.Exec(inc.ID, inc.FirstName, inc.LastName, inc.Phone, inc.CompanyURL)
+	stmt.Close()
 	if err != nil {
-		stmt.Close()
-		e := tx.Rollback()
-		return fmt.Errorf("problem upserting user_details userId=%s, err=%v, rollback err=%v", inc.ID, err, e)
+		return fmt.Errorf("problem upserting user_details userId=%s, err=%v", inc.ID, err)
 	}
-	stmt.Close()
+	return nil
+}
+
+func (s *sqliteUserRepository) search(query string, limit int) ([]*User, error) {
+	like := "%" + strings.ToLower(strings.TrimSpace(query)) + "%"
+	rows, err := s.db.Query(`select u.user_id from users as u
+inner join user_details as ud
+on u.user_id = ud.user_id
+where u.user_id = ? or lower(u.email) like ? or u.clean_email like ? or lower(ud.first_name || ' ' || ud.last_name) like ?
+order by u.created_at desc
+limit ?`, query, like, like, like, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	return tx.Commit()
+	var userIds []string
+	for rows.Next() {
+		var userId string
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	var users []*User
+	for i := range userIds {
+		u, err := s.lookupByUserId(userIds[i])
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			users = append(users, u)
+		}
+	}
+	return users, nil
 }
 
 // authable represents the interactions of a user's authentication
@@ -282,16 +448,31 @@ type authable interface {
 	invalidateCookies(userId string) error
 	writeCookie(userId string, cookie *http.Cookie) error
 
+	// activeSessions returns the unexpired sessions of userId, without their cookies.
+	activeSessions(userId string) ([]*userSession, error)
+
 	// checkPassword compares the provided password for the user.
 	// a non-nil error is returned if the passwords don't match
 	// or that the userId doesn't exist.
 	checkPassword(userId string, pass string) error
 	writePassword(userId string, pass string) error
+
+	// createPasswordReset returns a code, valid until the returned time, which sets
+	// the password of userId when used.
+	createPasswordReset(userId, createdBy string) (string, time.Time, error)
+	consumePasswordReset(code string) (string, error)
 }
 
 type auth struct {
 	db  *sql.DB
 	log log.Logger
+
+	// sessions, when set, stores cookies instead of the user_cookies table
+	sessions sessionStore
+
+	// cache holds the userId of cookie checksums, it's cleared for a user on logout,
+	// login and password changes
+	cache *ttlCache
 }
 
 // findUserId takes cookie data and returns the userId associated
@@ -306,6 +487,22 @@ func (a *auth) findUserId(data string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if v, ok := a.cache.get(data); ok {
+		return v.(string), nil
+	}
+	userId, err := a.lookupSession(data)
+	if err != nil || userId == "" {
+		return "", err
+	}
+	a.cache.set(data, userId, 0, userId)
+	return userId, nil
+}
+
+// lookupSession returns the userId of an unexpired cookie checksum
+func (a *auth) lookupSession(data string) (string, error) {
+	if a.sessions != nil {
+		return a.sessions.lookup(data)
+	}
 
 	query := `select user_id from user_cookies where data == ? and valid_until > ?`
 	stmt, err := a.db.Prepare(query)
@@ -332,7 +529,52 @@ func (a *auth) findUserId(data string) (string, error) {
 	return "", rows.Err()
 }
 
+// userSession is a signed in session of a user
+type userSession struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// activeSessions returns the user's session if it hasn't expired, users only have one session.
+func (a *auth) activeSessions(userId string) ([]*userSession, error) {
+	if a.sessions != nil {
+		expires, err := a.sessions.expiry(userId)
+		if err != nil || expires.IsZero() {
+			return nil, err
+		}
+		return []*userSession{{ExpiresAt: expires}}, nil
+	}
+
+	rows, err := a.db.Query(`select valid_until from user_cookies where user_id = ?`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*userSession
+	for rows.Next() {
+		var validUntil string
+		if err := rows.Scan(&validUntil); err != nil {
+			return nil, err
+		}
+		if expires := parseTimestamp(validUntil); expires.After(time.Now()) {
+			sessions = append(sessions, &userSession{ExpiresAt: expires})
+		}
+	}
+	return sessions, rows.Err()
+}
+
 func (a *auth) invalidateCookies(userId string) error {
+	defer a.cache.removeTagged(userId)
+
+	if a.sessions != nil {
+		n, err := a.sessions.invalidate(userId)
+		if err != nil {
+			return err
+		}
+		a.log.Log("user", fmt.Sprintf("deleted %d cookies for userId=%s", n, userId))
+		return nil
+	}
+
 	stmt, err := a.db.Prepare(`delete from user_cookies where user_id = ?`)
 	if err != nil {
 		return err
@@ -348,7 +590,34 @@ func (a *auth) invalidateCookies(userId string) error {
 	return nil
 }
 
+// purgeExpiredCookies deletes up to limit cookies which expired before the given time.
+func (a *auth) purgeExpiredCookies(before time.Time, limit int) (int64, error) {
+	query := `delete from user_cookies where rowid in (select rowid from user_cookies where valid_until < ? limit ?)`
+	stmt, err := a.db.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(before.Format(serializedTimestampFormat), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (a *auth) writeCookie(userId string, cookie *http.Cookie) error {
+	// each user has one cookie, the new cookie replaces any others
+	defer a.cache.removeTagged(userId)
+
+	if a.sessions != nil {
+		data, err := hash(cookie.Value)
+		if err != nil {
+			return err
+		}
+		return a.sessions.write(userId, data, cookie.Expires)
+	}
+
 	query := `insert or replace into user_cookies (user_id, data, valid_until) values (?, ?, ?)`
 	stmt, err := a.db.Prepare(query)
 	if err != nil {
@@ -397,8 +666,7 @@ func (a *auth) checkPassword(userId string, incoming string) error {
 // writePassword saves a user's password. This function performs no authn/z and generates a new
 // salt (which is also saved).
 func (a *auth) writePassword(userId string, pass string) error {
-	salt := generateID()
-	incomingPassword, err := bcrypt.GenerateFromPassword([]byte(pass+salt), bcryptCostFactor)
+	incomingPassword, salt, err := hashPassword(pass)
 	if err != nil {
 		return err
 	}
@@ -409,14 +677,25 @@ func (a *auth) writePassword(userId string, pass string) error {
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(userId, string(incomingPassword), salt)
+	_, err = stmt.Exec(userId, incomingPassword, salt)
 	if err != nil {
 		return err
 	}
+	a.cache.removeTagged(userId)
 	a.log.Log("user", fmt.Sprintf("userId=%s updated password", userId))
 	return nil
 }
 
+// hashPassword returns the bcrypt hash of pass with a new salt, and the salt.
+func hashPassword(pass string) (string, string, error) {
+	salt := generateID()
+	hashed, err := bcrypt.GenerateFromPassword([]byte(pass+salt), bcryptCostFactor)
+	if err != nil {
+		return "", "", err
+	}
+	return string(hashed), salt, nil
+}
+
 func hash(in string) (string, error) {
 	ss := sha256.New()
 	n, err := ss.Write([]byte(in))
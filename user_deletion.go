@@ -0,0 +1,571 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/moov-io/base"
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// userDeletionGracePeriod is how long users have to cancel their deletion before
+	// their data is purged.
+	userDeletionGracePeriod = 30 * 24 * time.Hour
+
+	errNoPasswordProvided = errors.New("no password provided")
+)
+
+func readDeletionConfig() error {
+	if v := os.Getenv("USER_DELETION_GRACE_PERIOD"); v != "" {
+		dur, err := time.ParseDuration(v)
+		if err != nil || dur < 0 {
+			return fmt.Errorf("invalid USER_DELETION_GRACE_PERIOD=%q", v)
+		}
+		userDeletionGracePeriod = dur
+	}
+	return nil
+}
+
+// userDataTable is a column in the auth database which references users. Rows of deleted users
+// are removed, or the reference is cleared when anonymize is set (the row belongs to someone else).
+type userDataTable struct {
+	table, column string
+	anonymize     bool
+
+	// clears is a column emptied on the user's rows, which are kept
+	clears string
+
+	// byEmail matches rows on the user's clean email instead of their userId
+	byEmail bool
+
+	// byAddress matches rows on the user's email address as entered, ignoring case
+	byAddress bool
+}
+
+// where returns the condition and argument matching the user's rows in the table. An empty
+// argument means the user has no rows to match, i.e. their email address isn't known.
+func (t userDataTable) where(userId, email, address string) (string, string) {
+	switch {
+	case t.byEmail:
+		return fmt.Sprintf("%s = ?", t.column), email
+	case t.byAddress:
+		return fmt.Sprintf("lower(%s) = lower(?)", t.column), address
+	default:
+		return fmt.Sprintf("%s = ?", t.column), userId
+	}
+}
+
+// userDataTables are purged when a user is deleted. Their status (user_status and
+// user_status_transitions without reasons), audit_events and deletion are kept under the userId,
+// which references nothing else. See pseudonymize for audit_events and the outbox.
+var userDataTables = []userDataTable{
+	{table: "users", column: "user_id"},
+	{table: "user_details", column: "user_id"},
+	{table: "user_passwords", column: "user_id"},
+	{table: "user_cookies", column: "user_id"},
+	{table: "user_approval_codes", column: "user_id"},
+	{table: "user_password_resets", column: "user_id"},
+	{table: "user_password_resets", column: "created_by", anonymize: true},
+	{table: "user_email_changes", column: "user_id"},
+	{table: "user_phone_verifications", column: "user_id"},
+	{table: "user_verified_phones", column: "user_id"},
+	{table: "user_login_fingerprints", column: "user_id"},
+	{table: "user_login_alerts", column: "user_id"},
+	{table: "user_login_failures", column: "user_id"},
+	{table: "user_roles", column: "user_id"},
+	{table: "personal_access_tokens", column: "user_id"},
+	{table: "organization_members", column: "user_id"},
+	{table: "organization_invites", column: "clean_email", byEmail: true},
+	{table: "organization_invites", column: "invited_by", anonymize: true},
+	{table: "organization_invites", column: "accepted_by", anonymize: true},
+	{table: "organizations", column: "created_by", anonymize: true},
+	{table: "webhooks", column: "created_by", anonymize: true},
+	{table: "webhook_deliveries", column: "user_id"},
+	{table: "notifications", column: "recipient", byAddress: true},
+	{table: "user_status_transitions", column: "user_id", clears: "reason"},
+}
+
+// userDeletion is a user's request to be deleted. Their data is purged once PurgeAfter passes,
+// after which Report lists what was removed from each store.
+type userDeletion struct {
+	UserID      string          `json:"userId"`
+	RequestedAt base.Time       `json:"requestedAt"`
+	PurgeAfter  base.Time       `json:"purgeAfter"`
+	PurgedAt    *time.Time      `json:"purgedAt,omitempty"`
+	Report      *deletionReport `json:"report,omitempty"`
+}
+
+// deletionReport records the rows removed or anonymized in every store. Verified is true when
+// each store was checked afterwards and no rows of the user remain.
+type deletionReport struct {
+	Stores   []deletionReportEntry `json:"stores"`
+	Verified bool                  `json:"verified"`
+}
+
+type deletionReportEntry struct {
+	Store  string `json:"store"`
+	Table  string `json:"table"`
+	Column string `json:"column"`
+
+	// Action is deleted, anonymized, cleared (the column was emptied) or pseudonymized
+	// (the data was erased and only a digest of it is kept)
+	Action string `json:"action"`
+	Rows   int64  `json:"rows"`
+
+	// Remaining is how many rows still referenced the user when checked after the purge
+	Remaining int64 `json:"remaining"`
+}
+
+// userDeleter schedules user deletions and purges a user's data across the auth database
+// and OAuth2 client and token stores.
+type userDeleter struct {
+	db     *sql.DB
+	logger log.Logger
+
+	auth  authable
+	users userRepository
+	oauth *oauth
+
+	// userCache and roleCache are cleared of the user once they're purged
+	userCache *ttlCache
+	roleCache *ttlCache
+}
+
+// schedule requests userId be deleted after the grace period. An existing request is returned as-is.
+func (d *userDeleter) schedule(userId string) (*userDeletion, error) {
+	existing, err := d.get(userId)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.PurgedAt == nil {
+		return existing, nil
+	}
+
+	now := time.Now()
+	deletion := &userDeletion{
+		UserID:      userId,
+		RequestedAt: base.NewTime(now),
+		PurgeAfter:  base.NewTime(now.Add(userDeletionGracePeriod)),
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	query := `replace into user_deletions (user_id, requested_at, purge_after) values (?, ?, ?)`
+	if _, err := tx.Exec(query, userId, now.Format(serializedTimestampFormat), deletion.PurgeAfter.Format(serializedTimestampFormat)); err != nil {
+		e := tx.Rollback()
+		return nil, fmt.Errorf("problem scheduling deletion of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	if err := writeOutbox(tx, eventUserDeletionRequested, userId, map[string]interface{}{"purgeAfter": deletion.PurgeAfter.Time}); err != nil {
+		e := tx.Rollback()
+		return nil, fmt.Errorf("%v, rollback err=%v", err, e)
+	}
+	return deletion, tx.Commit()
+}
+
+// get returns the deletion of userId, which can be nil if they haven't requested one.
+func (d *userDeleter) get(userId string) (*userDeletion, error) {
+	query := `select requested_at, purge_after, purged_at, report from user_deletions where user_id = ? limit 1`
+	var requestedAt, purgeAfter string
+	var purgedAt, report sql.NullString
+	if err := d.db.QueryRow(query, userId).Scan(&requestedAt, &purgeAfter, &purgedAt, &report); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	deletion := &userDeletion{
+		UserID:      userId,
+		RequestedAt: base.NewTime(parseTimestamp(requestedAt)),
+		PurgeAfter:  base.NewTime(parseTimestamp(purgeAfter)),
+	}
+	if purgedAt.String != "" {
+		t := parseTimestamp(purgedAt.String)
+		deletion.PurgedAt = &t
+	}
+	if report.String != "" {
+		var r deletionReport
+		if err := json.Unmarshal([]byte(report.String), &r); err != nil {
+			return nil, fmt.Errorf("problem reading deletion report of userId=%s: %v", userId, err)
+		}
+		deletion.Report = &r
+	}
+	return deletion, nil
+}
+
+// cancel removes a deletion of userId which hasn't been purged, returning false if there's none.
+func (d *userDeleter) cancel(userId string) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`delete from user_deletions where user_id = ? and purged_at is null`, userId)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, tx.Rollback()
+	}
+	if err := writeOutbox(tx, eventUserDeletionCancelled, userId, nil); err != nil {
+		e := tx.Rollback()
+		return false, fmt.Errorf("%v, rollback err=%v", err, e)
+	}
+	return true, tx.Commit()
+}
+
+// purgeDue purges up to limit users whose grace period ended before the given time, returning
+// how many users were purged.
+func (d *userDeleter) purgeDue(before time.Time, limit int) (int64, error) {
+	rows, err := d.db.Query(`select user_id, purge_after from user_deletions where purged_at is null`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var userIds []string
+	for rows.Next() && len(userIds) < limit {
+		var userId, purgeAfter string
+		if err := rows.Scan(&userId, &purgeAfter); err != nil {
+			return 0, err
+		}
+		if parseTimestamp(purgeAfter).Before(before) {
+			userIds = append(userIds, userId)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	var purged int64
+	for i := range userIds {
+		if _, err := d.purge(userIds[i]); err != nil {
+			return purged, fmt.Errorf("problem purging userId=%s: %v", userIds[i], err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purge permanently deletes (or anonymizes) the data of userId in every store and records the
+// report on their deletion. The user is moved to the deleted status first so they're signed out
+// of everything while the purge runs.
+func (d *userDeleter) purge(userId string) (*deletionReport, error) {
+	user, err := d.users.lookupByUserId(userId)
+	if err != nil {
+		return nil, err
+	}
+	var email, address string
+	if user != nil {
+		email, address = user.cleanEmail(), user.Email
+		if user.Status != userStatusDeleted {
+			if err := d.users.transitionStatus(userId, userStatusDeleted, "deletion requested", userId); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	report := &deletionReport{}
+	entries, err := d.purgeTables(userId, email, address)
+	if err != nil {
+		return nil, err
+	}
+	report.Stores = append(report.Stores, entries...)
+	entries, err = d.pseudonymize(userId)
+	if err != nil {
+		return nil, err
+	}
+	report.Stores = append(report.Stores, entries...)
+	if err := d.auth.invalidateCookies(userId); err != nil {
+		return nil, err
+	}
+	d.userCache.removeTagged(userId)
+	d.roleCache.removeTagged(userId)
+
+	entries, err = d.purgeOAuth2(userId)
+	if err != nil {
+		return nil, err
+	}
+	report.Stores = append(report.Stores, entries...)
+
+	report.Verified = true
+	for i := range report.Stores {
+		if report.Stores[i].Remaining > 0 {
+			report.Verified = false
+		}
+	}
+
+	bs, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	query := `update user_deletions set purged_at = ?, report = ? where user_id = ?`
+	if _, err := tx.Exec(query, time.Now().Format(serializedTimestampFormat), string(bs), userId); err != nil {
+		e := tx.Rollback()
+		return nil, fmt.Errorf("problem saving deletion report of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	if err := writeOutbox(tx, eventUserDeleted, userId, nil); err != nil {
+		e := tx.Rollback()
+		return nil, fmt.Errorf("%v, rollback err=%v", err, e)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.logger.Log("user-deletion", fmt.Sprintf("purged userId=%s verified=%v", userId, report.Verified))
+	return report, nil
+}
+
+// purgeTables removes the user from userDataTables in one transaction, then checks each table.
+func (d *userDeleter) purgeTables(userId, email, address string) ([]deletionReportEntry, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var entries []deletionReportEntry
+	for _, t := range userDataTables {
+		where, arg := t.where(userId, email, address)
+		entry := deletionReportEntry{Store: "auth", Table: t.table, Column: t.column, Action: "deleted"}
+		query := fmt.Sprintf(`delete from %s where %s`, t.table, where)
+		if t.anonymize {
+			entry.Action = "anonymized"
+			query = fmt.Sprintf(`update %s set %s = '' where %s`, t.table, t.column, where)
+		}
+		if t.clears != "" {
+			entry.Column, entry.Action = t.clears, "cleared"
+			query = fmt.Sprintf(`update %s set %s = '' where %s and %s != ''`, t.table, t.clears, where, t.clears)
+		}
+		if arg != "" {
+			res, err := tx.Exec(query, arg)
+			if err != nil {
+				e := tx.Rollback()
+				return nil, fmt.Errorf("problem purging %s of userId=%s, err=%v, rollback err=%v", t.table, userId, err, e)
+			}
+			entry.Rows, _ = res.RowsAffected()
+		}
+		entries = append(entries, entry)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for i, t := range userDataTables {
+		where, arg := t.where(userId, email, address)
+		if arg == "" {
+			continue
+		}
+		query := fmt.Sprintf(`select count(*) from %s where %s`, t.table, where)
+		if t.clears != "" {
+			query += fmt.Sprintf(` and %s != ''`, t.clears)
+		}
+		if err := d.db.QueryRow(query, arg).Scan(&entries[i].Remaining); err != nil {
+			return nil, fmt.Errorf("problem checking %s of userId=%s: %v", t.table, userId, err)
+		}
+	}
+	return entries, nil
+}
+
+// pseudonymize erases the personal data kept about userId in audit_events and the outbox.
+//
+// Audit events keep who did what, but their IP, User-Agent and details are erased (see
+// eraseAuditPersonalData). Outbox events are still published to every sink (the janitor removes
+// them afterwards) but without their data, which can be the user's profile.
+func (d *userDeleter) pseudonymize(userId string) ([]deletionReportEntry, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	erased, err := eraseAuditPersonalData(tx, userId, time.Now())
+	if err != nil {
+		e := tx.Rollback()
+		return nil, fmt.Errorf("problem erasing audit events of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	cleared, err := clearOutboxData(tx, userId)
+	if err != nil {
+		e := tx.Rollback()
+		return nil, fmt.Errorf("problem clearing outbox events of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	audit := deletionReportEntry{Store: "auth", Table: "audit_events", Column: "user_id", Action: "pseudonymized", Rows: erased}
+	query := `select count(*) from audit_events as e inner join audit_event_salts as s on e.event_id = s.event_id where (e.user_id = ? or e.actor_id = ?) and s.salt != ''`
+	if err := d.db.QueryRow(query, userId, userId).Scan(&audit.Remaining); err != nil {
+		return nil, fmt.Errorf("problem checking audit_events of userId=%s: %v", userId, err)
+	}
+	outbox := deletionReportEntry{Store: "auth", Table: "outbox", Column: "payload", Action: "cleared", Rows: cleared}
+	if err := d.db.QueryRow(`select count(*) from outbox where user_id = ? and instr(payload, '"data":') > 0`, userId).Scan(&outbox.Remaining); err != nil {
+		return nil, fmt.Errorf("problem checking outbox of userId=%s: %v", userId, err)
+	}
+	return []deletionReportEntry{audit, outbox}, nil
+}
+
+// purgeOAuth2 deletes the OAuth2 clients and tokens of userId, which can be in other databases.
+func (d *userDeleter) purgeOAuth2(userId string) ([]deletionReportEntry, error) {
+	if d.oauth == nil {
+		return nil, nil
+	}
+	var entries []deletionReportEntry
+
+	removed, anonymized, err := d.oauth.clientStore.PurgeByUserID(userId)
+	if err != nil {
+		return nil, err
+	}
+	remaining, err := d.oauth.clientStore.CountByUserID(userId)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries,
+		deletionReportEntry{Store: "oauth2_clients", Table: "oauth2_clients", Column: "user_id", Action: "deleted", Rows: removed, Remaining: remaining},
+		deletionReportEntry{Store: "oauth2_clients", Table: "oauth2_clients", Column: "user_id", Action: "anonymized", Rows: anonymized, Remaining: remaining},
+	)
+
+	purger, ok := d.oauth.tokenStore.(userTokenPurger)
+	if !ok {
+		return nil, errors.New("OAuth2 token store can't purge tokens by user")
+	}
+	removed, err = purger.PurgeByUserID(userId)
+	if err != nil {
+		return nil, err
+	}
+	remaining, err = purger.CountByUserID(userId)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, deletionReportEntry{Store: "oauth2_tokens", Table: "oauth2_tokens", Column: "user_id", Action: "deleted", Rows: removed, Remaining: remaining})
+
+	return entries, nil
+}
+
+func addUserDeletionRoutes(router *mux.Router, logger log.Logger, auth authable, deleter *userDeleter) {
+	router.Methods("DELETE").Path("/users/{user_id}").HandlerFunc(deleteUser(logger, auth, deleter))
+	router.Methods("GET").Path("/users/{user_id}/deletion").HandlerFunc(getUserDeletion(logger, auth, deleter))
+	router.Methods("DELETE").Path("/users/{user_id}/deletion").HandlerFunc(cancelUserDeletion(logger, auth, deleter))
+}
+
+// signedInUserId returns the route's {user_id}, which must be the signed in user.
+func signedInUserId(auth authable, r *http.Request) (string, error) {
+	userId, err := extractUserId(auth, r)
+	if err != nil {
+		return "", err
+	}
+	if mux.Vars(r)["user_id"] != userId {
+		return "", errUserNotFound
+	}
+	return userId, nil
+}
+
+func writeUserDeletion(w http.ResponseWriter, status int, deletion *userDeletion) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(deletion); err != nil {
+		internalError(w, err)
+		return
+	}
+}
+
+type deleteUserRequest struct {
+	Password string `json:"password"`
+}
+
+// deleteUser schedules the signed in user's deletion after they confirm their password.
+func deleteUser(logger log.Logger, auth authable, deleter *userDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "deleteUser")
+
+		userId, err := signedInUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req deleteUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if req.Password == "" {
+			moovhttp.Problem(w, errNoPasswordProvided)
+			return
+		}
+		if err := auth.checkPassword(userId, req.Password); err != nil {
+			authFailures.With("method", "web").Add(1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		deletion, err := deleter.schedule(userId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		logger.Log("user-deletion", fmt.Sprintf("userId=%s requested deletion, purging after %v", userId, deletion.PurgeAfter.Time))
+
+		writeUserDeletion(w, http.StatusAccepted, deletion)
+	}
+}
+
+func getUserDeletion(logger log.Logger, auth authable, deleter *userDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "getUserDeletion")
+
+		userId, err := signedInUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		deletion, err := deleter.get(userId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if deletion == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeUserDeletion(w, http.StatusOK, deletion)
+	}
+}
+
+func cancelUserDeletion(logger log.Logger, auth authable, deleter *userDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "cancelUserDeletion")
+
+		userId, err := signedInUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		found, err := deleter.cancel(userId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		logger.Log("user-deletion", fmt.Sprintf("userId=%s cancelled their deletion", userId))
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
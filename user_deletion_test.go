@@ -0,0 +1,231 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestUserDeletion__readDeletionConfig(t *testing.T) {
+	defer func(dur time.Duration) { userDeletionGracePeriod = dur }(userDeletionGracePeriod)
+
+	os.Setenv("USER_DELETION_GRACE_PERIOD", "24h")
+	defer os.Unsetenv("USER_DELETION_GRACE_PERIOD")
+	if err := readDeletionConfig(); err != nil || userDeletionGracePeriod != 24*time.Hour {
+		t.Errorf("grace period %v err=%v", userDeletionGracePeriod, err)
+	}
+
+	os.Setenv("USER_DELETION_GRACE_PERIOD", "-1h")
+	if err := readDeletionConfig(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestUserDeletion(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	auth := &auth{db: repo.db, log: log.NewNopLogger()}
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	roleRepo := &sqliteRoleRepository{db: repo.db, log: log.NewNopLogger(), cache: newTTLCache("roles")}
+	deleter := &userDeleter{
+		db:     repo.db,
+		logger: log.NewNopLogger(),
+		auth:   auth,
+		users:  repo,
+		oauth:  o.svc,
+
+		roleCache: roleRepo.cache,
+	}
+	router := mux.NewRouter()
+	addUserDeletionRoutes(router, log.NewNopLogger(), auth, deleter)
+
+	// give the user data in every store
+	user, other := createTestUser(t, repo, "jane@moov.io"), createTestUser(t, repo, "other@moov.io")
+	if err := auth.writePassword(user.ID, "password"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(user.ID, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orgRepo := &sqliteOrganizationRepository{db: repo.db, log: log.NewNopLogger()}
+	org := &organization{ID: generateID(), Name: "Moov", CreatedAt: base.NewTime(time.Now())}
+	if err := orgRepo.createOrganization(org, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	tokens := &sqlitePersonalTokenRepository{db: repo.db, log: log.NewNopLogger()}
+	if err := tokens.createToken(&personalToken{ID: generateID(), UserID: user.ID, Name: "script", CreatedAt: base.NewTime(time.Now())}, personalTokenPrefix+generateID()); err != nil {
+		t.Fatal(err)
+	}
+	createOAuthClient(t, o, user.ID)
+	createOAuthClient(t, o, other.ID)
+	for _, to := range []string{"Jane@moov.io", other.Email} {
+		query := `insert into notifications (notification_id, recipient, template, subject, body, attempts, created_at) values (?, ?, 'new_login', '', '', 0, '')`
+		if _, err := repo.db.Exec(query, generateID(), to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := roleRepo.assignRole(user.ID, adminRole, ""); err != nil {
+		t.Fatal(err)
+	}
+	if roles, err := roleNames(roleRepo, user.ID, ""); err != nil || len(roles.global) != 1 {
+		t.Fatalf("roles=%#v err=%v", roles, err)
+	}
+	audit := &sqliteAuditLog{db: repo.db, log: log.NewNopLogger()}
+	for _, userId := range []string{user.ID, other.ID} {
+		event := &auditEvent{Type: auditLoginSucceeded, ActorID: userId, UserID: userId, IP: "10.1.2.3", UserAgent: "curl", Details: map[string]string{"email": "jane@moov.io"}}
+		if err := audit.record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		r := httptest.NewRequest(method, path, &buf)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	// users can only delete themselves, after confirming their password
+	if w := do("DELETE", "/users/"+other.ID, deleteUserRequest{Password: "password"}); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("DELETE", "/users/"+user.ID, deleteUserRequest{Password: "wrong"}); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("GET", fmt.Sprintf("/users/%s/deletion", user.ID), nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	w := do("DELETE", "/users/"+user.ID, deleteUserRequest{Password: "password"})
+	var deletion userDeletion
+	if err := json.NewDecoder(w.Body).Decode(&deletion); w.Code != http.StatusAccepted || err != nil {
+		t.Fatalf("got %d err=%v", w.Code, err)
+	}
+	if !deletion.PurgeAfter.After(time.Now().Add(userDeletionGracePeriod - time.Minute)) {
+		t.Errorf("unexpected purgeAfter=%v", deletion.PurgeAfter)
+	}
+
+	// cancel and request again
+	if w := do("DELETE", fmt.Sprintf("/users/%s/deletion", user.ID), nil); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("DELETE", fmt.Sprintf("/users/%s/deletion", user.ID), nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("DELETE", "/users/"+user.ID, deleteUserRequest{Password: "password"}); w.Code != http.StatusAccepted {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("GET", fmt.Sprintf("/users/%s/deletion", user.ID), nil); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+
+	if err := repo.transitionStatus(user.ID, userStatusSuspended, "reported by jane@moov.io", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is purged during the grace period
+	if n, err := deleter.purgeDue(time.Now(), 10); err != nil || n != 0 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if n, err := deleter.purgeDue(time.Now().Add(userDeletionGracePeriod+time.Minute), 10); err != nil || n != 1 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+
+	found, err := deleter.get(user.ID)
+	if err != nil || found == nil || found.PurgedAt == nil || found.Report == nil {
+		t.Fatalf("unexpected deletion=%#v err=%v", found, err)
+	}
+	if !found.Report.Verified {
+		t.Errorf("expected verified report: %#v", found.Report)
+	}
+	rows := make(map[string]int64)
+	for _, e := range found.Report.Stores {
+		rows[e.Table+"."+e.Column+" "+e.Action] += e.Rows
+	}
+	for _, k := range []string{"users.user_id deleted", "user_passwords.user_id deleted", "personal_access_tokens.user_id deleted", "organization_members.user_id deleted", "organizations.created_by anonymized", "oauth2_clients.user_id deleted", "oauth2_tokens.user_id deleted", "notifications.recipient deleted", "audit_events.user_id pseudonymized"} {
+		if rows[k] != 1 {
+			t.Errorf("%s: got %d rows", k, rows[k])
+		}
+	}
+	if rows["user_status_transitions.reason cleared"] == 0 || rows["outbox.payload cleared"] == 0 {
+		t.Errorf("expected status reasons and outbox data to be cleared: %v", rows)
+	}
+
+	// personal data is erased from audit events without breaking the chain
+	events, _, err := audit.search(auditFilter{})
+	if err != nil || len(events) != 2 {
+		t.Fatalf("events=%#v err=%v", events, err)
+	}
+	for _, e := range events {
+		erased := e.IP == "" && e.UserAgent == "" && len(e.Details) == 0
+		if erased != (e.UserID == user.ID) {
+			t.Errorf("unexpected event: %#v", e)
+		}
+	}
+	if v, err := verifyAuditChain(repo.db, nil, 0); err != nil || len(v.Problems) != 0 {
+		t.Errorf("problems=%v err=%v", v.Problems, err)
+	}
+	var reasons int
+	if err := repo.db.QueryRow(`select count(*) from user_status_transitions where user_id = ? and reason != ''`, user.ID).Scan(&reasons); err != nil || reasons != 0 {
+		t.Errorf("expected reasons to be cleared, got %d err=%v", reasons, err)
+	}
+	var withData int
+	if err := repo.db.QueryRow(`select count(*) from outbox where user_id = ? and payload like '%"data":%'`, user.ID).Scan(&withData); err != nil || withData != 0 {
+		t.Errorf("expected outbox data to be cleared, got %d err=%v", withData, err)
+	}
+	if roles, err := roleNames(roleRepo, user.ID, ""); err != nil || len(roles.global) != 0 {
+		t.Errorf("expected cached roles to be removed, got %#v err=%v", roles, err)
+	}
+
+	if u, err := repo.lookupByUserId(user.ID); err != nil || u != nil {
+		t.Errorf("expected user to be purged, got %#v err=%v", u, err)
+	}
+	var status string
+	if err := repo.db.QueryRow(`select status from user_status where user_id = ?`, user.ID).Scan(&status); err != nil || status != userStatusDeleted {
+		t.Errorf("status=%s err=%v", status, err)
+	}
+	if id, _ := auth.findUserId(cookie.Value); id != "" {
+		t.Errorf("expected cookie to be removed, found userId=%s", id)
+	}
+	if u, _ := repo.lookupByUserId(other.ID); u == nil {
+		t.Error("expected other user to be kept")
+	}
+	if clients, err := o.svc.existingClients(other.ID, ""); err != nil || len(clients) != 1 {
+		t.Errorf("expected other user's client to be kept, got %d err=%v", len(clients), err)
+	}
+
+	// purged deletions can't be cancelled
+	if found, err := deleter.cancel(user.ID); err != nil || found {
+		t.Errorf("found=%v err=%v", found, err)
+	}
+}
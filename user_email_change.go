@@ -0,0 +1,260 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// emailChangeTTL is how long the confirmation link of an email change can be used for
+	emailChangeTTL = 24 * time.Hour
+)
+
+var (
+	errInvalidEmailChange = errors.New("invalid or expired email change code")
+	errEmailTaken         = errors.New("email address is already in use")
+	errEmailUnchanged     = errors.New("email address is unchanged")
+)
+
+// emailChange is a confirmed change of a user's email address.
+type emailChange struct {
+	UserID   string
+	OldEmail string
+	NewEmail string
+}
+
+// requestEmailChange returns a new code which confirms userId's change to email.
+// Only one change is pending for each user, requesting a change replaces any previous one.
+func (s *sqliteUserRepository) requestEmailChange(userId, email string) (string, time.Time, error) {
+	code := generateID()
+	if code == "" {
+		return "", time.Time{}, errors.New("problem generating email change code")
+	}
+	checksum, err := hash(code)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(emailChangeTTL)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if _, err := tx.Exec(`delete from user_email_changes where user_id = ?`, userId); err != nil {
+		e := tx.Rollback()
+		return "", time.Time{}, fmt.Errorf("problem clearing email changes of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	query := `insert into user_email_changes (code, user_id, email, clean_email, expires_at) values (?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, checksum, userId, email, cleanEmail(email), expires.Format(serializedTimestampFormat)); err != nil {
+		e := tx.Rollback()
+		return "", time.Time{}, fmt.Errorf("problem writing email change of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	return code, expires, tx.Commit()
+}
+
+// confirmEmailChange consumes code and moves its user to the new email address.
+//
+// errInvalidEmailChange is returned if no unexpired change exists for code and errEmailTaken
+// if another user has the address. Both emails are updated in one statement which only
+// matches when the address is unused, so two users can't confirm the same address.
+func (s *sqliteUserRepository) confirmEmailChange(code string) (*emailChange, error) {
+	checksum, err := hash(code)
+	if err != nil {
+		return nil, errInvalidEmailChange
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	change := &emailChange{}
+	var clean, expiresAt string
+	query := `select c.user_id, u.email, c.email, c.clean_email, c.expires_at from user_email_changes as c
+inner join users as u on c.user_id = u.user_id
+where c.code = ? limit 1`
+	if err := tx.QueryRow(query, checksum).Scan(&change.UserID, &change.OldEmail, &change.NewEmail, &clean, &expiresAt); err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, errInvalidEmailChange
+		}
+		return nil, err
+	}
+	if _, err := tx.Exec(`delete from user_email_changes where code = ?`, checksum); err != nil {
+		e := tx.Rollback()
+		return nil, fmt.Errorf("problem removing email change of userId=%s, err=%v, rollback err=%v", change.UserID, err, e)
+	}
+	if time.Now().After(parseTimestamp(expiresAt)) {
+		// the expired code is still removed
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidEmailChange
+	}
+
+	query = `update users set email = ?, clean_email = ? where user_id = ?
+and not exists (select 1 from users where clean_email = ? and user_id <> ?)`
+	res, err := tx.Exec(query, change.NewEmail, clean, change.UserID, clean, change.UserID)
+	if err != nil {
+		e := tx.Rollback()
+		return nil, fmt.Errorf("problem updating email of userId=%s, err=%v, rollback err=%v", change.UserID, err, e)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, errEmailTaken
+	}
+	data := map[string]interface{}{
+		"email":         change.NewEmail,
+		"previousEmail": change.OldEmail,
+	}
+	if err := writeOutbox(tx, eventUserEmailChanged, change.UserID, data); err != nil {
+		e := tx.Rollback()
+		return nil, fmt.Errorf("%v, rollback err=%v", err, e)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.cache.remove(change.UserID)
+	return change, nil
+}
+
+func addEmailChangeRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, notifier Notifier) {
+	router.Methods("POST").Path("/users/{user_id}/email").HandlerFunc(requestEmailChange(logger, auth, userService, notifier))
+	router.Methods("GET", "POST").Path("/users/email/confirm").HandlerFunc(confirmEmailChange(logger, userService, notifier))
+}
+
+type emailChangeRequest struct {
+	Email string `json:"email"`
+
+	// Password re-authenticates the user, a valid cookie alone can't change their email.
+	Password string `json:"password"`
+}
+
+// emailChangeLink returns the URL which confirms an email change, it's sent to the new address.
+func emailChangeLink(code string) string {
+	return fmt.Sprintf("https://%s/users/email/confirm?code=%s", Domain, code)
+}
+
+// requestEmailChange sends a confirmation link to the new address of the signed in user
+// after they confirm their password.
+func requestEmailChange(logger log.Logger, auth authable, userService userRepository, notifier Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "requestEmailChange")
+
+		userId, err := signedInUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req emailChangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if err := validateEmail(req.Email); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if req.Password == "" {
+			moovhttp.Problem(w, errNoPasswordProvided)
+			return
+		}
+		if err := auth.checkPassword(userId, req.Password); err != nil {
+			authFailures.With("method", "web").Add(1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		existing, err := userService.lookupByEmail(req.Email)
+		if err != nil {
+			internalError(w, fmt.Errorf("problem looking up user email %q: %v", req.Email, err))
+			return
+		}
+		if existing != nil {
+			if existing.ID == userId {
+				moovhttp.Problem(w, errEmailUnchanged)
+			} else {
+				moovhttp.Problem(w, errEmailTaken)
+			}
+			return
+		}
+
+		code, expires, err := userService.requestEmailChange(userId, req.Email)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		data := map[string]interface{}{
+			"Link":      emailChangeLink(code),
+			"ExpiresAt": expires.Format(time.RFC1123),
+		}
+		if err := notifier.Notify(req.Email, "email_change_confirm", data); err != nil {
+			internalError(w, fmt.Errorf("problem sending email change confirmation: %v", err))
+			return
+		}
+		logger.Log("email-change", fmt.Sprintf("userId=%s requested an email change", userId))
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+type confirmEmailChangeRequest struct {
+	Code string `json:"code"`
+}
+
+// confirmEmailChange moves a user to their new email address from the code in the
+// confirmation link and notifies their old address.
+func confirmEmailChange(logger log.Logger, userService userRepository, notifier Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "confirmEmailChange")
+
+		// links in emails are followed with GET, clients can POST the code instead
+		code := r.URL.Query().Get("code")
+		if code == "" && r.Method == "POST" {
+			var req confirmEmailChangeRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				moovhttp.Problem(w, err)
+				return
+			}
+			code = req.Code
+		}
+		if code = strings.TrimSpace(code); code == "" {
+			moovhttp.Problem(w, errInvalidEmailChange)
+			return
+		}
+
+		change, err := userService.confirmEmailChange(code)
+		if err != nil {
+			if err == errInvalidEmailChange || err == errEmailTaken {
+				moovhttp.Problem(w, err)
+			} else {
+				internalError(w, err)
+			}
+			return
+		}
+		logger.Log("email-change", fmt.Sprintf("userId=%s changed their email", change.UserID))
+
+		if err := notifier.Notify(change.OldEmail, "email_changed", map[string]interface{}{"NewEmail": change.NewEmail}); err != nil {
+			// the change is done, so don't fail the request
+			logger.Log("email-change", fmt.Sprintf("problem notifying previous email of userId=%s: %v", change.UserID, err))
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestEmailChange(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	auth := &auth{db: repo.db, log: log.NewNopLogger()}
+
+	notifier := &mockNotifier{}
+	router := mux.NewRouter()
+	addEmailChangeRoutes(router, log.NewNopLogger(), auth, repo, notifier)
+
+	user, other := createTestUser(t, repo, "jane@moov.io"), createTestUser(t, repo, "other@moov.io")
+	if err := auth.writePassword(user.ID, "password"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(user.ID, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	change := func(userId string, req emailChangeRequest) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(req)
+		r := httptest.NewRequest("POST", fmt.Sprintf("/users/%s/email", userId), &buf)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	confirm := func(code string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/users/email/confirm?code="+code, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	// users can only change their own email, after confirming their password
+	if w := change(other.ID, emailChangeRequest{Email: "new@moov.io", Password: "password"}); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := change(user.ID, emailChangeRequest{Email: "new@moov.io", Password: "wrong"}); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := change(user.ID, emailChangeRequest{Email: "new@moov.io"}); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := change(user.ID, emailChangeRequest{Email: "Other@moov.io", Password: "password"}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected taken email to be rejected, got %d", w.Code)
+	}
+	if len(notifier.sent) != 0 {
+		t.Fatalf("unexpected notifications: %#v", notifier.sent)
+	}
+
+	// the link goes to the new address
+	if w := change(user.ID, emailChangeRequest{Email: "new@moov.io", Password: "password"}); w.Code != http.StatusAccepted {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if len(notifier.sent) != 1 || notifier.sent[0].to != "new@moov.io" || notifier.sent[0].template != "email_change_confirm" {
+		t.Fatalf("unexpected notifications: %#v", notifier.sent)
+	}
+	link := notifier.sent[0].data["Link"].(string)
+	code := link[strings.Index(link, "code=")+len("code="):]
+
+	if w := confirm("invalid"); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := confirm(code); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if len(notifier.sent) != 2 || notifier.sent[1].to != "jane@moov.io" || notifier.sent[1].data["NewEmail"] != "new@moov.io" {
+		t.Errorf("expected old address to be notified: %#v", notifier.sent)
+	}
+	if u, err := repo.lookupByUserId(user.ID); err != nil || u.Email != "new@moov.io" {
+		t.Errorf("unexpected user=%#v err=%v", u, err)
+	}
+	if u, err := repo.lookupByEmail("NEW@moov.io"); err != nil || u == nil || u.ID != user.ID {
+		t.Errorf("unexpected user=%#v err=%v", u, err)
+	}
+	if u, err := repo.lookupByEmail("jane@moov.io"); err != nil || u != nil {
+		t.Errorf("expected old email to be free, got user=%#v err=%v", u, err)
+	}
+
+	// codes are single use
+	if w := confirm(code); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+}
+
+func TestEmailChange__confirm(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	user, other := createTestUser(t, repo, "jane@moov.io"), createTestUser(t, repo, "other@moov.io")
+
+	// requesting again replaces the earlier change
+	first, _, err := repo.requestEmailChange(user.ID, "first@moov.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, expires, err := repo.requestEmailChange(user.ID, "second@moov.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expires.After(time.Now().Add(emailChangeTTL - time.Minute)) {
+		t.Errorf("unexpected expiry: %v", expires)
+	}
+	if _, err := repo.confirmEmailChange(first); err != errInvalidEmailChange {
+		t.Errorf("expected errInvalidEmailChange, got %v", err)
+	}
+
+	// another user took the address after the change was requested
+	code, _, err := repo.requestEmailChange(other.ID, "second@moov.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change, err := repo.confirmEmailChange(code); err != nil || change.OldEmail != "other@moov.io" || change.NewEmail != "second@moov.io" {
+		t.Fatalf("unexpected change=%#v err=%v", change, err)
+	}
+	if _, err := repo.confirmEmailChange(second); err != errEmailTaken {
+		t.Errorf("expected errEmailTaken, got %v", err)
+	}
+	if u, err := repo.lookupByUserId(user.ID); err != nil || u.Email != "jane@moov.io" {
+		t.Errorf("unexpected user=%#v err=%v", u, err)
+	}
+
+	// expired codes aren't accepted
+	code, _, err = repo.requestEmailChange(user.ID, "third@moov.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, _ := hash(code)
+	if _, err := repo.db.Exec(`update user_email_changes set expires_at = ? where code = ?`, time.Now().Add(-time.Minute).Format(serializedTimestampFormat), checksum); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.confirmEmailChange(code); err != errInvalidEmailChange {
+		t.Errorf("expected errInvalidEmailChange, got %v", err)
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/moov-io/auth/pkg/oauthdb"
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// userExport is everything we hold about a user, for data-subject access requests.
+//
+// Secrets are never exported: cookies, passwords, OAuth2 client secrets (or their hints),
+// token values, invite and verification codes and hashes of any of them are left out.
+type userExport struct {
+	ExportedAt time.Time `json:"exportedAt"`
+
+	Profile        *User                   `json:"profile"`
+	VerifiedPhone  *verifiedPhone          `json:"verifiedPhone,omitempty"`
+	Deletion       *userDeletion           `json:"deletion,omitempty"`
+	Sessions       []*userSession          `json:"sessions"`
+	LoginLocations []*loginLocation        `json:"loginLocations"`
+	OAuthClients   []exportedOAuthClient   `json:"oauthClients"`
+	OAuthTokens    []exportedOAuthToken    `json:"oauthTokens"`
+	PersonalTokens []exportedPersonalToken `json:"personalAccessTokens"`
+
+	Organizations       []exportedMembership  `json:"organizations"`
+	OrganizationInvites []*organizationInvite `json:"organizationInvites"`
+	Roles               []*userRole           `json:"roles"`
+
+	SecurityEvents []securityEvent `json:"securityEvents"`
+	AuditEvents    []*auditEvent   `json:"auditEvents"`
+}
+
+type exportedMembership struct {
+	OrganizationID string    `json:"organizationId"`
+	Name           string    `json:"name"`
+	Role           string    `json:"role"`
+	JoinedAt       base.Time `json:"joinedAt"`
+}
+
+type exportedOAuthClient struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name,omitempty"`
+	Description    string    `json:"description,omitempty"`
+	Domain         string    `json:"domain"`
+	Scopes         []string  `json:"scopes,omitempty"`
+	RedirectURIs   []string  `json:"redirectUris,omitempty"`
+	OrganizationID string    `json:"organizationId,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+type exportedOAuthToken struct {
+	ClientID         string     `json:"clientId"`
+	RedirectURI      string     `json:"redirectUri,omitempty"`
+	Scope            string     `json:"scope,omitempty"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	RefreshExpiresAt *time.Time `json:"refreshExpiresAt,omitempty"`
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+}
+
+type exportedPersonalToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  base.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// securityEvent is a security relevant change to a user's account
+type securityEvent struct {
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	CreatedAt   base.Time `json:"createdAt"`
+}
+
+// userExporter assembles a userExport from each store holding data about users.
+type userExporter struct {
+	auth   authable
+	users  userRepository
+	tokens personalTokenRepository
+	oauth  *oauth
+
+	orgs      organizationRepository
+	roles     roleRepository
+	deletions *userDeleter
+	alerts    *loginAlerter
+	audit     auditLog
+}
+
+// export returns everything held about userId, which is nil if they don't exist.
+func (e *userExporter) export(userId string) (*userExport, error) {
+	user, err := e.users.lookupByUserId(userId)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	out := &userExport{
+		ExportedAt:          time.Now(),
+		Profile:             user,
+		LoginLocations:      []*loginLocation{},
+		OAuthClients:        []exportedOAuthClient{},
+		OAuthTokens:         []exportedOAuthToken{},
+		PersonalTokens:      []exportedPersonalToken{},
+		Organizations:       []exportedMembership{},
+		OrganizationInvites: []*organizationInvite{},
+		Roles:               []*userRole{},
+		SecurityEvents:      []securityEvent{},
+		AuditEvents:         []*auditEvent{},
+	}
+
+	out.VerifiedPhone, err = e.users.getVerifiedPhone(userId)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading verified phone: %v", err)
+	}
+	if e.deletions != nil {
+		out.Deletion, err = e.deletions.get(userId)
+		if err != nil {
+			return nil, fmt.Errorf("problem reading deletion: %v", err)
+		}
+	}
+
+	out.Sessions, err = e.auth.activeSessions(userId)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading sessions: %v", err)
+	}
+	if out.Sessions == nil {
+		out.Sessions = []*userSession{}
+	}
+	if e.alerts != nil {
+		locations, err := e.alerts.getLocations(userId)
+		if err != nil {
+			return nil, fmt.Errorf("problem reading login locations: %v", err)
+		}
+		out.LoginLocations = append(out.LoginLocations, locations...)
+	}
+
+	if e.oauth != nil {
+		clients, err := e.oauth.clientStore.GetByUserID(userId)
+		if err != nil {
+			return nil, err
+		}
+		for i := range clients {
+			c, ok := clients[i].(*oauthdb.Client)
+			if !ok {
+				continue
+			}
+			out.OAuthClients = append(out.OAuthClients, exportedOAuthClient{
+				ID:             c.ID,
+				Name:           c.Name,
+				Description:    c.Description,
+				Domain:         c.Domain,
+				Scopes:         c.Scopes,
+				RedirectURIs:   c.RedirectURIs,
+				OrganizationID: c.OrganizationID,
+				CreatedAt:      c.CreatedAt,
+			})
+		}
+
+		if md, ok := e.oauth.tokenStore.(userTokenMetadata); ok {
+			tokens, err := md.MetadataByUserID(userId)
+			if err != nil {
+				return nil, err
+			}
+			for i := range tokens {
+				out.OAuthTokens = append(out.OAuthTokens, exportedOAuthToken{
+					ClientID:         tokens[i].ClientID,
+					RedirectURI:      tokens[i].RedirectURI,
+					Scope:            tokens[i].Scope,
+					CreatedAt:        tokens[i].CreatedAt,
+					ExpiresAt:        tokens[i].AccessExpiresAt,
+					RefreshExpiresAt: tokens[i].RefreshExpiresAt,
+					RevokedAt:        tokens[i].RemovedAt,
+				})
+			}
+		}
+	}
+
+	personalTokens, err := e.tokens.getUserTokens(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range personalTokens {
+		out.PersonalTokens = append(out.PersonalTokens, exportedPersonalToken{
+			ID:         t.ID,
+			Name:       t.Name,
+			Scopes:     t.Scopes,
+			CreatedAt:  t.CreatedAt,
+			ExpiresAt:  t.ExpiresAt,
+			LastUsedAt: t.LastUsedAt,
+		})
+	}
+
+	if err := e.exportOrganizations(out, user); err != nil {
+		return nil, err
+	}
+
+	history, err := e.users.statusHistory(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range history {
+		desc := fmt.Sprintf("status changed from %s to %s", h.From, h.To)
+		if h.Reason != "" {
+			desc += ": " + h.Reason
+		}
+		out.SecurityEvents = append(out.SecurityEvents, securityEvent{
+			Type:        "status_changed",
+			Description: desc,
+			CreatedAt:   h.CreatedAt,
+		})
+	}
+
+	if e.audit != nil {
+		filter := auditFilter{UserID: userId, Limit: maxAuditLimit}
+		for {
+			events, cursor, err := e.audit.search(filter)
+			if err != nil {
+				return nil, fmt.Errorf("problem reading audit events: %v", err)
+			}
+			out.AuditEvents = append(out.AuditEvents, events...)
+			if cursor == "" {
+				break
+			}
+			filter.Cursor = cursor
+		}
+	}
+
+	return out, nil
+}
+
+// exportOrganizations adds the user's memberships, invites and roles to out.
+func (e *userExporter) exportOrganizations(out *userExport, user *User) error {
+	var orgIds []string
+	if e.orgs != nil {
+		orgs, err := e.orgs.getUserOrganizations(user.ID)
+		if err != nil {
+			return fmt.Errorf("problem reading organizations: %v", err)
+		}
+		for _, org := range orgs {
+			member, err := e.orgs.getMember(org.ID, user.ID)
+			if err != nil {
+				return fmt.Errorf("problem reading membership of organization=%s: %v", org.ID, err)
+			}
+			if member == nil {
+				continue
+			}
+			orgIds = append(orgIds, org.ID)
+			out.Organizations = append(out.Organizations, exportedMembership{
+				OrganizationID: org.ID,
+				Name:           org.Name,
+				Role:           member.Role,
+				JoinedAt:       member.CreatedAt,
+			})
+		}
+		invites, err := e.orgs.getUserInvites(user.Email, user.ID)
+		if err != nil {
+			return fmt.Errorf("problem reading organization invites: %v", err)
+		}
+		out.OrganizationInvites = append(out.OrganizationInvites, invites...)
+	}
+
+	if e.roles != nil {
+		global, err := e.roles.getUserRoles(user.ID, "")
+		if err != nil {
+			return fmt.Errorf("problem reading roles: %v", err)
+		}
+		out.Roles = append(out.Roles, global...)
+		for _, orgId := range orgIds {
+			roles, err := e.roles.getUserRoles(user.ID, orgId)
+			if err != nil {
+				return fmt.Errorf("problem reading roles in organization=%s: %v", orgId, err)
+			}
+			for i := range roles {
+				if roles[i].OrganizationID != "" {
+					out.Roles = append(out.Roles, roles[i])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func addUserExportRoutes(router *mux.Router, logger log.Logger, auth authable, exporter *userExporter) {
+	router.Methods("GET").Path("/users/{user_id}/export").HandlerFunc(exportUser(logger, auth, exporter))
+}
+
+// exportUser responds with everything held about the signed in user as a JSON attachment.
+func exportUser(logger log.Logger, auth authable, exporter *userExporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "exportUser")
+
+		userId, err := signedInUserId(auth, r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		out, err := exporter.export(userId)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if out == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		logger.Log("user-export", fmt.Sprintf("userId=%s exported their data", userId))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%s.json"`, userId))
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+}
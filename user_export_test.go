@@ -0,0 +1,194 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestUserExport(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	auth := &auth{db: repo.db, log: log.NewNopLogger()}
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	tokens := &sqlitePersonalTokenRepository{db: repo.db, log: log.NewNopLogger()}
+	orgRepo := &sqliteOrganizationRepository{db: repo.db, log: log.NewNopLogger()}
+	roleRepo := &sqliteRoleRepository{db: repo.db, log: log.NewNopLogger()}
+	audit := &sqliteAuditLog{db: repo.db, log: log.NewNopLogger()}
+	deletions := &userDeleter{db: repo.db, logger: log.NewNopLogger(), auth: auth, users: repo}
+	alerts := &loginAlerter{db: repo.db, logger: log.NewNopLogger(), auth: auth, notifier: &mockNotifier{}}
+	router := mux.NewRouter()
+	addUserExportRoutes(router, log.NewNopLogger(), auth, &userExporter{
+		auth:      auth,
+		users:     repo,
+		tokens:    tokens,
+		oauth:     o.svc,
+		orgs:      orgRepo,
+		roles:     roleRepo,
+		deletions: deletions,
+		alerts:    alerts,
+		audit:     audit,
+	})
+
+	user, other := createTestUser(t, repo, "jane@moov.io"), createTestUser(t, repo, "other@moov.io")
+	if err := auth.writePassword(user.ID, "password"); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := createCookie(user.ID, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, token := createOAuthClient(t, o, user.ID)
+	secret := personalTokenPrefix + generateID()
+	if err := tokens.createToken(&personalToken{ID: generateID(), UserID: user.ID, Name: "script", Scopes: []string{"read"}, CreatedAt: base.NewTime(time.Now())}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.transitionStatus(user.ID, userStatusLocked, "too many attempts", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// organizations, roles and invites
+	org := &organization{ID: generateID(), Name: "Moov", CreatedAt: base.NewTime(time.Now())}
+	if err := orgRepo.createOrganization(org, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleRepo.upsertRole(&role{Name: "billing", OrgAssignable: true, CreatedAt: base.NewTime(time.Now())}); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleRepo.assignRole(user.ID, "billing", org.ID); err != nil {
+		t.Fatal(err)
+	}
+	inviteCode := generateID()
+	invite := &organizationInvite{
+		ID:             generateID(),
+		OrganizationID: org.ID,
+		Email:          "friend@moov.io",
+		Role:           orgRoleMember,
+		InvitedBy:      user.ID,
+		CreatedAt:      base.NewTime(time.Now()),
+		ExpiresAt:      base.NewTime(time.Now().Add(time.Hour)),
+	}
+	if err := orgRepo.createInvite(invite, inviteCode); err != nil {
+		t.Fatal(err)
+	}
+
+	// verified phone, login locations, audit events and the pending deletion
+	if _, err := repo.db.Exec(`insert into user_verified_phones (user_id, phone, verified_at) values (?, '+15555555555', ?)`, user.ID, time.Now().Format(serializedTimestampFormat)); err != nil {
+		t.Fatal(err)
+	}
+	login := httptest.NewRequest("POST", "/users/login", nil)
+	login.Header.Set("User-Agent", "Firefox/70.0")
+	if err := alerts.check(user, login); err != nil {
+		t.Fatal(err)
+	}
+	recordAudit(audit, login, auditLoginSucceeded, user.ID, user.ID, nil)
+	if _, err := deletions.schedule(user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	export := func(userId string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", fmt.Sprintf("/users/%s/export", userId), nil)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	if w := export(other.ID); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+
+	w := export(user.ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+
+	var out userExport
+	if err := json.NewDecoder(strings.NewReader(body)).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Profile == nil || out.Profile.Email != user.Email || out.Profile.Status != userStatusLocked {
+		t.Errorf("unexpected profile: %#v", out.Profile)
+	}
+	if len(out.Sessions) != 1 {
+		t.Errorf("got %d sessions", len(out.Sessions))
+	}
+	if len(out.OAuthClients) != 1 || out.OAuthClients[0].ID != client.ID {
+		t.Errorf("unexpected clients: %#v", out.OAuthClients)
+	}
+	if len(out.OAuthTokens) != 1 || out.OAuthTokens[0].ClientID != client.ID || out.OAuthTokens[0].ExpiresAt == nil {
+		t.Errorf("unexpected tokens: %#v", out.OAuthTokens)
+	}
+	if len(out.PersonalTokens) != 1 || out.PersonalTokens[0].Name != "script" {
+		t.Errorf("unexpected personal tokens: %#v", out.PersonalTokens)
+	}
+	if len(out.SecurityEvents) != 1 || !strings.Contains(out.SecurityEvents[0].Description, "too many attempts") {
+		t.Errorf("unexpected security events: %#v", out.SecurityEvents)
+	}
+	if len(out.Organizations) != 1 || out.Organizations[0].OrganizationID != org.ID || out.Organizations[0].Role != orgRoleOwner {
+		t.Errorf("unexpected organizations: %#v", out.Organizations)
+	}
+	if len(out.OrganizationInvites) != 1 || out.OrganizationInvites[0].ID != invite.ID {
+		t.Errorf("unexpected invites: %#v", out.OrganizationInvites)
+	}
+	if len(out.Roles) != 1 || out.Roles[0].Role != "billing" || out.Roles[0].OrganizationID != org.ID {
+		t.Errorf("unexpected roles: %#v", out.Roles)
+	}
+	if out.VerifiedPhone == nil || out.VerifiedPhone.Phone != "+15555555555" {
+		t.Errorf("unexpected verified phone: %#v", out.VerifiedPhone)
+	}
+	if len(out.LoginLocations) != 1 || out.LoginLocations[0].IPRange != "192.0.2.0/24" {
+		t.Errorf("unexpected login locations: %#v", out.LoginLocations)
+	}
+	if len(out.AuditEvents) != 1 || out.AuditEvents[0].Type != auditLoginSucceeded {
+		t.Errorf("unexpected audit events: %#v", out.AuditEvents)
+	}
+	if out.Deletion == nil || out.Deletion.PurgeAfter.IsZero() {
+		t.Errorf("unexpected deletion: %#v", out.Deletion)
+	}
+
+	// no secrets or hashes of them
+	var password, salt string
+	if err := repo.db.QueryRow(`select password, salt from user_passwords where user_id = ?`, user.ID).Scan(&password, &salt); err != nil {
+		t.Fatal(err)
+	}
+	cookieHash, _ := hash(cookie.Value)
+	for name, v := range map[string]string{
+		"cookie":               cookie.Value,
+		"cookie hash":          cookieHash,
+		"password hash":        password,
+		"password salt":        salt,
+		"client secret":        client.Secret,
+		"access token":         token.Access,
+		"personal token":       secret,
+		"personal token start": secret[:len(personalTokenPrefix)+4],
+		"invite code":          inviteCode,
+	} {
+		if strings.Contains(body, v) {
+			t.Errorf("export contains %s", name)
+		}
+	}
+}
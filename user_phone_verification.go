@@ -0,0 +1,314 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// phoneCodeTTL is how long a phone verification code can be used for
+	phoneCodeTTL = 10 * time.Minute
+
+	// phoneCodeDigits is the length of each numeric phone verification code
+	phoneCodeDigits = 6
+
+	// phoneCodeMaxAttempts is how many wrong guesses a code allows before it's discarded
+	phoneCodeMaxAttempts = 5
+
+	// phoneCodeResendInterval is the least time between two codes sent to a user
+	phoneCodeResendInterval = time.Minute
+
+	// phoneCodeMaxSends is how many codes a user can be sent within phoneCodeSendWindow
+	phoneCodeMaxSends   = 5
+	phoneCodeSendWindow = time.Hour
+)
+
+var (
+	errInvalidPhoneCode     = errors.New("invalid or expired phone verification code")
+	errPhoneCodeRateLimited = errors.New("too many phone verification requests, try again later")
+	errNoPhoneNumber        = errors.New("user has no phone number")
+	errPhoneAlreadyVerified = errors.New("phone number is already verified")
+)
+
+// generatePhoneCode returns a random numeric code of phoneCodeDigits digits.
+func generatePhoneCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < phoneCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", phoneCodeDigits, n), nil
+}
+
+// createPhoneCode returns a new code which verifies userId owns phone, replacing any previous code.
+// errPhoneCodeRateLimited is returned if a code was sent too recently or too often.
+func (s *sqliteUserRepository) createPhoneCode(userId, phone string) (string, error) {
+	code, err := generatePhoneCode()
+	if err != nil {
+		return "", fmt.Errorf("problem generating phone verification code: %v", err)
+	}
+	checksum, err := hash(code)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	sends, windowStartedAt := 0, now
+	var sentAt, windowStarted string
+	query := `select sent_at, sends, window_started_at from user_phone_verifications where user_id = ? limit 1`
+	if err := tx.QueryRow(query, userId).Scan(&sentAt, &sends, &windowStarted); err != nil {
+		if !strings.Contains(err.Error(), "no rows in result set") {
+			tx.Rollback()
+			return "", err
+		}
+	} else {
+		if now.Before(parseTimestamp(sentAt).Add(phoneCodeResendInterval)) {
+			tx.Rollback()
+			return "", errPhoneCodeRateLimited
+		}
+		windowStartedAt = parseTimestamp(windowStarted)
+		if now.After(windowStartedAt.Add(phoneCodeSendWindow)) {
+			sends, windowStartedAt = 0, now // start a new window
+		}
+		if sends >= phoneCodeMaxSends {
+			tx.Rollback()
+			return "", errPhoneCodeRateLimited
+		}
+	}
+
+	query = `replace into user_phone_verifications (user_id, phone, code, expires_at, attempts, sent_at, sends, window_started_at) values (?, ?, ?, ?, 0, ?, ?, ?)`
+	_, err = tx.Exec(query, userId, phone, checksum, now.Add(phoneCodeTTL).Format(serializedTimestampFormat),
+		now.Format(serializedTimestampFormat), sends+1, windowStartedAt.Format(serializedTimestampFormat))
+	if err != nil {
+		e := tx.Rollback()
+		return "", fmt.Errorf("problem writing phone verification of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	return code, tx.Commit()
+}
+
+// verifyPhoneCode marks phone as verified for userId if code is the unexpired code sent to phone.
+//
+// Wrong guesses are counted, once phoneCodeMaxAttempts is reached the code is discarded and
+// errPhoneCodeRateLimited returned. errInvalidPhoneCode is returned for any other mismatch.
+func (s *sqliteUserRepository) verifyPhoneCode(userId, phone, code string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var sentTo, checksum, expiresAt string
+	var attempts int
+	query := `select phone, code, expires_at, attempts from user_phone_verifications where user_id = ? limit 1`
+	if err := tx.QueryRow(query, userId).Scan(&sentTo, &checksum, &expiresAt, &attempts); err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return errInvalidPhoneCode
+		}
+		return err
+	}
+	if checksum == "" || sentTo != phone || time.Now().After(parseTimestamp(expiresAt)) {
+		tx.Rollback()
+		return errInvalidPhoneCode
+	}
+	if attempts >= phoneCodeMaxAttempts {
+		tx.Rollback()
+		return errPhoneCodeRateLimited
+	}
+
+	if guess, err := hash(strings.TrimSpace(code)); err != nil || guess != checksum {
+		// count the wrong guess, discarding the code on the last attempt
+		query = `update user_phone_verifications set attempts = attempts + 1 where user_id = ?`
+		if attempts+1 >= phoneCodeMaxAttempts {
+			query = `update user_phone_verifications set attempts = attempts + 1, code = '' where user_id = ?`
+		}
+		if _, err := tx.Exec(query, userId); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem counting phone verification attempt of userId=%s, err=%v, rollback err=%v", userId, err, e)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if attempts+1 >= phoneCodeMaxAttempts {
+			return errPhoneCodeRateLimited
+		}
+		return errInvalidPhoneCode
+	}
+
+	// the row is kept (without a code) so the send limits still apply
+	if _, err := tx.Exec(`update user_phone_verifications set code = '' where user_id = ?`, userId); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem clearing phone verification of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	query = `replace into user_verified_phones (user_id, phone, verified_at) values (?, ?, ?)`
+	if _, err := tx.Exec(query, userId, phone, time.Now().Format(serializedTimestampFormat)); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem verifying phone of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	if err := writeOutbox(tx, eventUserPhoneVerified, userId, map[string]interface{}{"phone": phone}); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("%v, rollback err=%v", err, e)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.cache.remove(userId)
+	return nil
+}
+
+// verifiedPhone is the phone number a user last verified.
+type verifiedPhone struct {
+	Phone      string    `json:"phone"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+}
+
+func (s *sqliteUserRepository) getVerifiedPhone(userId string) (*verifiedPhone, error) {
+	var out verifiedPhone
+	var verifiedAt string
+	query := `select phone, verified_at from user_verified_phones where user_id = ? limit 1`
+	if err := s.db.QueryRow(query, userId).Scan(&out.Phone, &verifiedAt); err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	out.VerifiedAt = parseTimestamp(verifiedAt)
+	return &out, nil
+}
+
+func addPhoneVerificationRoutes(router *mux.Router, logger log.Logger, auth authable, userService userRepository, sender smsSender) {
+	router.Methods("POST").Path("/users/{user_id}/phone/verification").HandlerFunc(sendPhoneCode(logger, auth, userService, sender))
+	router.Methods("POST").Path("/users/{user_id}/phone/verify").HandlerFunc(verifyPhone(logger, auth, userService))
+}
+
+// signedInUser returns the signed in user of the route's {user_id}, responding when they're not found.
+func signedInUser(w http.ResponseWriter, r *http.Request, auth authable, userService userRepository) *User {
+	userId, err := signedInUserId(auth, r)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	user, err := userService.lookupByUserId(userId)
+	if err != nil {
+		internalError(w, err)
+		return nil
+	}
+	if user == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return user
+}
+
+func writePhoneCodeError(w http.ResponseWriter, err error) {
+	switch err {
+	case errPhoneCodeRateLimited:
+		w.WriteHeader(http.StatusTooManyRequests)
+	case errInvalidPhoneCode:
+		moovhttp.Problem(w, err)
+	default:
+		internalError(w, err)
+	}
+}
+
+// sendPhoneCode texts a verification code to the signed in user's phone number.
+func sendPhoneCode(logger log.Logger, auth authable, userService userRepository, sender smsSender) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "sendPhoneCode")
+
+		user := signedInUser(w, r, auth, userService)
+		if user == nil {
+			return
+		}
+		if user.Phone == "" {
+			moovhttp.Problem(w, errNoPhoneNumber)
+			return
+		}
+		if err := validatePhone(user.Phone); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if user.PhoneVerified {
+			moovhttp.Problem(w, errPhoneAlreadyVerified)
+			return
+		}
+
+		code, err := userService.createPhoneCode(user.ID, user.Phone)
+		if err != nil {
+			writePhoneCodeError(w, err)
+			return
+		}
+		body := fmt.Sprintf("Your Moov verification code is %s, it expires in %.0f minutes.", code, phoneCodeTTL.Minutes())
+		if err := sender.sendSMS(user.Phone, body); err != nil {
+			internalError(w, fmt.Errorf("problem sending phone verification code: %v", err))
+			return
+		}
+		logger.Log("phone-verification", fmt.Sprintf("sent code to userId=%s", user.ID))
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+type verifyPhoneRequest struct {
+	Code string `json:"code"`
+}
+
+// verifyPhone marks the signed in user's phone number as verified with the code texted to it,
+// which activates pending users.
+func verifyPhone(logger log.Logger, auth authable, userService userRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = wrapResponseWriter(w, r, "verifyPhone")
+
+		user := signedInUser(w, r, auth, userService)
+		if user == nil {
+			return
+		}
+
+		var req verifyPhoneRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if strings.TrimSpace(req.Code) == "" {
+			moovhttp.Problem(w, errInvalidPhoneCode)
+			return
+		}
+
+		if err := userService.verifyPhoneCode(user.ID, user.Phone, req.Code); err != nil {
+			writePhoneCodeError(w, err)
+			return
+		}
+		logger.Log("phone-verification", fmt.Sprintf("userId=%s verified their phone", user.ID))
+
+		if user.Status == userStatusPending {
+			if err := userService.transitionStatus(user.ID, userStatusActive, "phone verified", user.ID); err != nil {
+				internalError(w, err)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestPhoneVerification__generatePhoneCode(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code, err := generatePhoneCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := regexp.MatchString(`^\d{6}$`, code); !ok {
+			t.Fatalf("unexpected code %q", code)
+		}
+	}
+}
+
+func TestPhoneVerification(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	auth := &auth{db: repo.db, log: log.NewNopLogger()}
+
+	dir, err := ioutil.TempDir("", "sms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sms.jsonl")
+
+	router := mux.NewRouter()
+	addPhoneVerificationRoutes(router, log.NewNopLogger(), auth, repo, setupSMSSender(log.NewNopLogger(), path))
+
+	user, other := createTestUser(t, repo, "jane@moov.io"), createTestUser(t, repo, "other@moov.io")
+	cookie, err := createCookie(user.ID, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(path string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		r := httptest.NewRequest("POST", path, &buf)
+		r.Header.Set("Cookie", fmt.Sprintf("moov_auth=%s", cookie.Value))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+	send := func() *httptest.ResponseRecorder {
+		return do(fmt.Sprintf("/users/%s/phone/verification", user.ID), nil)
+	}
+	verify := func(code string) *httptest.ResponseRecorder {
+		return do(fmt.Sprintf("/users/%s/phone/verify", user.ID), verifyPhoneRequest{Code: code})
+	}
+
+	if w := do(fmt.Sprintf("/users/%s/phone/verification", other.ID), nil); w.Code != http.StatusForbidden {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := send(); w.Code != http.StatusBadRequest {
+		t.Errorf("expected missing phone to be rejected, got %d", w.Code)
+	}
+
+	user.Phone = "+1 555-555-5555"
+	if err := repo.upsert(user); err != nil {
+		t.Fatal(err)
+	}
+	if w := send(); w.Code != http.StatusAccepted {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	msgs := readSMSFile(t, path)
+	if len(msgs) != 1 || msgs[0].To != user.Phone {
+		t.Fatalf("unexpected messages: %#v", msgs)
+	}
+	code := regexp.MustCompile(`\d{6}`).FindString(msgs[0].Body)
+
+	// codes can't be sent again right away
+	if w := send(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got %d", w.Code)
+	}
+
+	if w := verify("000000x"); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	if _, err := repo.db.Exec(`insert into user_status (user_id, status, updated_at) values (?, ?, '')`, user.ID, userStatusPending); err != nil {
+		t.Fatal(err)
+	}
+	if w := verify(code); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if u, err := repo.lookupByUserId(user.ID); err != nil || !u.PhoneVerified || u.Status != userStatusActive {
+		t.Errorf("expected verified phone to activate the user, got %#v err=%v", u, err)
+	}
+	if w := verify(code); w.Code != http.StatusBadRequest {
+		t.Errorf("expected code to be used up, got %d", w.Code)
+	}
+
+	// changing the phone number un-verifies it
+	user.Phone = "+15555550000"
+	if err := repo.upsert(user); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := repo.lookupByUserId(user.ID); err != nil || u.PhoneVerified {
+		t.Errorf("expected unverified phone, got %#v err=%v", u, err)
+	}
+}
+
+func TestPhoneVerification__limits(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	user := createTestUser(t, repo, "jane@moov.io")
+	phone := "+15555555555"
+
+	// pretend the last code was sent long enough ago to send another
+	rewind := func() {
+		t.Helper()
+		if _, err := repo.db.Exec(`update user_phone_verifications set sent_at = ? where user_id = ?`, time.Now().Add(-phoneCodeResendInterval).Format(serializedTimestampFormat), user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// wrong guesses discard the code
+	code, err := repo.createPhoneCode(user.ID, phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < phoneCodeMaxAttempts; i++ {
+		if err := repo.verifyPhoneCode(user.ID, phone, "wrong"); err != errInvalidPhoneCode {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	if err := repo.verifyPhoneCode(user.ID, phone, "wrong"); err != errPhoneCodeRateLimited {
+		t.Errorf("expected errPhoneCodeRateLimited, got %v", err)
+	}
+	if err := repo.verifyPhoneCode(user.ID, phone, code); err != errInvalidPhoneCode {
+		t.Errorf("expected discarded code, got %v", err)
+	}
+
+	// codes only verify the number they were sent to
+	rewind()
+	code, err = repo.createPhoneCode(user.ID, phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.verifyPhoneCode(user.ID, "+15555550000", code); err != errInvalidPhoneCode {
+		t.Errorf("expected errInvalidPhoneCode, got %v", err)
+	}
+
+	// expired codes aren't accepted
+	if _, err := repo.db.Exec(`update user_phone_verifications set expires_at = ? where user_id = ?`, time.Now().Add(-time.Minute).Format(serializedTimestampFormat), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.verifyPhoneCode(user.ID, phone, code); err != errInvalidPhoneCode {
+		t.Errorf("expected errInvalidPhoneCode, got %v", err)
+	}
+
+	// only phoneCodeMaxSends codes are sent each window
+	for i := 3; i <= phoneCodeMaxSends; i++ {
+		rewind()
+		if _, err := repo.createPhoneCode(user.ID, phone); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	rewind()
+	if _, err := repo.createPhoneCode(user.ID, phone); err != errPhoneCodeRateLimited {
+		t.Errorf("expected errPhoneCodeRateLimited, got %v", err)
+	}
+	if _, err := repo.db.Exec(`update user_phone_verifications set window_started_at = ? where user_id = ?`, time.Now().Add(-phoneCodeSendWindow-time.Minute).Format(serializedTimestampFormat), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.createPhoneCode(user.ID, phone); err != nil {
+		t.Errorf("expected a new window, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moov-io/base"
+)
+
+// User lifecycle states
+//
+// Users without a recorded status are active. Pending users can login (to finish verifying
+// themselves) but aren't authorized anywhere else, they become active once they verify their
+// phone number. Users are locked after loginMaxFailures consecutive failed logins. Locked,
+// suspended and deleted users can't login or use their tokens. Deleted is final.
+const (
+	userStatusPending   = "pending_verification"
+	userStatusActive    = "active"
+	userStatusLocked    = "locked"
+	userStatusSuspended = "suspended"
+	userStatusDeleted   = "deleted"
+)
+
+var (
+	// userStatusTransitions lists which states a user can move to from each state
+	userStatusTransitions = map[string][]string{
+		userStatusPending:   {userStatusActive, userStatusSuspended, userStatusDeleted},
+		userStatusActive:    {userStatusLocked, userStatusSuspended, userStatusDeleted},
+		userStatusLocked:    {userStatusActive, userStatusSuspended, userStatusDeleted},
+		userStatusSuspended: {userStatusActive, userStatusDeleted},
+		userStatusDeleted:   {},
+	}
+
+	errInvalidStatusTransition = errors.New("invalid user status transition")
+	errUserInactive            = errors.New("user is not active")
+
+	// signupRequireVerification creates users as pending_verification until they verify their
+	// phone number. Set SIGNUP_REQUIRE_VERIFICATION to enable it.
+	signupRequireVerification = false
+
+	// loginMaxFailures is how many consecutive failed logins lock a user, 0 never locks them.
+	// Set LOGIN_MAX_FAILURES to override the default.
+	loginMaxFailures = 0
+)
+
+// readUserStatusConfig updates the user lifecycle settings from their environment variables if set.
+func readUserStatusConfig() error {
+	if v := os.Getenv("SIGNUP_REQUIRE_VERIFICATION"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid SIGNUP_REQUIRE_VERIFICATION=%q", v)
+		}
+		signupRequireVerification = b
+	}
+	if v := os.Getenv("LOGIN_MAX_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid LOGIN_MAX_FAILURES=%q", v)
+		}
+		loginMaxFailures = n
+	}
+	return nil
+}
+
+// validUserStatus returns true if status is one of our lifecycle states.
+func validUserStatus(status string) bool {
+	_, ok := userStatusTransitions[status]
+	return ok
+}
+
+// canTransition returns true if a user can move from one status to another.
+func canTransition(from, to string) bool {
+	for _, allowed := range userStatusTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// canLogin returns true if the user can login with their password and use their cookie.
+func (u *User) canLogin() bool {
+	return u.Status == userStatusActive || u.Status == userStatusPending
+}
+
+// canAccess returns true if the user is allowed through /auth/check and to use OAuth2 tokens.
+func (u *User) canAccess() bool {
+	return u.Status == userStatusActive
+}
+
+// userStatusTransition is a recorded change of a user's status.
+type userStatusTransition struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason,omitempty"`
+	ChangedBy string    `json:"changedBy,omitempty"`
+	CreatedAt base.Time `json:"createdAt"`
+}
+
+func (s *sqliteUserRepository) transitionStatus(userId, status, reason, changedBy string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	from := userStatusActive
+	var current string
+	if err := tx.QueryRow(`select status from user_status where user_id = ? limit 1`, userId).Scan(&current); err != nil {
+		if !strings.Contains(err.Error(), "no rows in result set") {
+			tx.Rollback()
+			return err
+		}
+	}
+	if current != "" {
+		from = current
+	}
+	if !canTransition(from, status) {
+		tx.Rollback()
+		return fmt.Errorf("%v: %s to %s", errInvalidStatusTransition, from, status)
+	}
+
+	now := time.Now().Format(serializedTimestampFormat)
+	if _, err := tx.Exec(`replace into user_status (user_id, status, updated_at) values (?, ?, ?)`, userId, status, now); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem updating status of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	query := `insert into user_status_transitions (user_id, from_status, to_status, reason, changed_by, created_at) values (?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, userId, from, status, reason, changedBy, now); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("problem recording status of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	if status == userStatusActive {
+		// unlocked users start over
+		if _, err := tx.Exec(`delete from user_login_failures where user_id = ?`, userId); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem clearing failed logins of userId=%s, err=%v, rollback err=%v", userId, err, e)
+		}
+	}
+	data := map[string]interface{}{
+		"status":         status,
+		"previousStatus": from,
+		"reason":         reason,
+	}
+	if err := writeOutbox(tx, eventUserStatusChanged, userId, data); err != nil {
+		e := tx.Rollback()
+		return fmt.Errorf("%v, rollback err=%v", err, e)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.cache.remove(userId)
+	return nil
+}
+
+func (s *sqliteUserRepository) recordLoginFailure(userId string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Format(serializedTimestampFormat)
+	if _, err := tx.Exec(`insert or ignore into user_login_failures (user_id, failures, last_failed_at) values (?, 0, ?)`, userId, now); err != nil {
+		e := tx.Rollback()
+		return 0, fmt.Errorf("problem counting failed login of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	if _, err := tx.Exec(`update user_login_failures set failures = failures + 1, last_failed_at = ? where user_id = ?`, now, userId); err != nil {
+		e := tx.Rollback()
+		return 0, fmt.Errorf("problem counting failed login of userId=%s, err=%v, rollback err=%v", userId, err, e)
+	}
+	var failures int
+	if err := tx.QueryRow(`select failures from user_login_failures where user_id = ?`, userId).Scan(&failures); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return failures, tx.Commit()
+}
+
+func (s *sqliteUserRepository) clearLoginFailures(userId string) error {
+	if _, err := s.db.Exec(`delete from user_login_failures where user_id = ?`, userId); err != nil {
+		return fmt.Errorf("problem clearing failed logins of userId=%s: %v", userId, err)
+	}
+	return nil
+}
+
+// lockAfterFailedLogin counts a failed login of u, locking them once they reach loginMaxFailures
+// consecutive failures. It returns true if u was locked.
+func lockAfterFailedLogin(userService userRepository, u *User) (bool, error) {
+	failures, err := userService.recordLoginFailure(u.ID)
+	if err != nil {
+		return false, err
+	}
+	if loginMaxFailures <= 0 || failures < loginMaxFailures || u.Status != userStatusActive {
+		return false, nil
+	}
+	reason := fmt.Sprintf("%d failed logins", failures)
+	if err := userService.transitionStatus(u.ID, userStatusLocked, reason, ""); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *sqliteUserRepository) statusHistory(userId string) ([]*userStatusTransition, error) {
+	query := `select from_status, to_status, reason, changed_by, created_at from user_status_transitions where user_id = ? order by rowid`
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []*userStatusTransition
+	for rows.Next() {
+		var t userStatusTransition
+		var createdAt string
+		if err := rows.Scan(&t.From, &t.To, &t.Reason, &t.ChangedBy, &createdAt); err != nil {
+			return nil, err
+		}
+		t.CreatedAt = base.NewTime(parseTimestamp(createdAt))
+		history = append(history, &t)
+	}
+	return history, rows.Err()
+}
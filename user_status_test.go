@@ -0,0 +1,207 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestUserStatus__transitions(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	user := createTestUser(t, repo, "jane@moov.io")
+	if user, _ := repo.lookupByUserId(user.ID); user.Status != userStatusActive {
+		t.Errorf("got status=%s", user.Status)
+	}
+
+	if err := repo.transitionStatus(user.ID, userStatusPending, "", ""); err == nil {
+		t.Error("expected error moving active user back to pending")
+	}
+	for _, status := range []string{userStatusLocked, userStatusActive, userStatusDeleted} {
+		if err := repo.transitionStatus(user.ID, status, "test", "admin"); err != nil {
+			t.Fatalf("%s: %v", status, err)
+		}
+	}
+	if err := repo.transitionStatus(user.ID, userStatusActive, "", ""); err == nil {
+		t.Error("expected error, deleted is final")
+	}
+
+	history, err := repo.statusHistory(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("got %d transitions", len(history))
+	}
+	if h := history[2]; h.From != userStatusActive || h.To != userStatusDeleted || h.ChangedBy != "admin" {
+		t.Errorf("unexpected transition: %#v", h)
+	}
+}
+
+func TestUserStatus__access(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	o, err := createTestOAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.cleanup()
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	o.svc.users = repo
+
+	// create a user who hasn't verified themselves
+	user := createTestUser(t, repo, "jane@moov.io")
+	if _, err := repo.db.Exec(`insert into user_status (user_id, status, updated_at) values (?, ?, '')`, user.ID, userStatusPending); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := repo.lookupByUserId(user.ID)
+	if !u.canLogin() || u.canAccess() {
+		t.Errorf("pending user: canLogin=%v canAccess=%v", u.canLogin(), u.canAccess())
+	}
+
+	cookie, err := createCookie(user.ID, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token := createOAuthClient(t, o, user.ID)
+
+	check := func(header, value string) int {
+		r := httptest.NewRequest("GET", "/auth/check", nil)
+		r.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		checkAuth(log.NewNopLogger(), auth, o.svc, repo, nil, nil)(w, r)
+		return w.Code
+	}
+	if code := check("Cookie", "moov_auth="+cookie.Value); code != http.StatusForbidden {
+		t.Errorf("pending user's cookie: got %d", code)
+	}
+	if code := check("Authorization", "Bearer "+token.Access); code != http.StatusForbidden {
+		t.Errorf("pending user's token: got %d", code)
+	}
+
+	if err := repo.transitionStatus(user.ID, userStatusActive, "verified", ""); err != nil {
+		t.Fatal(err)
+	}
+	if code := check("Cookie", "moov_auth="+cookie.Value); code != http.StatusOK {
+		t.Errorf("active user's cookie: got %d", code)
+	}
+	if code := check("Authorization", "Bearer "+token.Access); code != http.StatusOK {
+		t.Errorf("active user's token: got %d", code)
+	}
+
+	if err := repo.transitionStatus(user.ID, userStatusLocked, "too many attempts", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.svc.checkUserStatus(user.ID); err != errUserInactive {
+		t.Errorf("expected locked user to be inactive, got %v", err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", "moov_auth="+cookie.Value)
+	if _, err := getUserFromCookie(auth, repo, r); err != errUserInactive {
+		t.Errorf("expected locked user's cookie to be rejected, got %v", err)
+	}
+}
+
+func TestUserStatus__readUserStatusConfig(t *testing.T) {
+	defer func() {
+		signupRequireVerification, loginMaxFailures = false, 0
+		os.Unsetenv("SIGNUP_REQUIRE_VERIFICATION")
+		os.Unsetenv("LOGIN_MAX_FAILURES")
+	}()
+
+	os.Setenv("SIGNUP_REQUIRE_VERIFICATION", "true")
+	os.Setenv("LOGIN_MAX_FAILURES", "5")
+	if err := readUserStatusConfig(); err != nil || !signupRequireVerification || loginMaxFailures != 5 {
+		t.Errorf("signupRequireVerification=%v loginMaxFailures=%d err=%v", signupRequireVerification, loginMaxFailures, err)
+	}
+	os.Setenv("LOGIN_MAX_FAILURES", "-1")
+	if err := readUserStatusConfig(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestUserStatus__pendingSignup(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	u := &User{ID: generateID(), Email: "jane@moov.io", Status: userStatusPending, CreatedAt: base.NewTime(time.Now())}
+	if err := repo.create(u, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := repo.lookupByUserId(u.ID); err != nil || u.Status != userStatusPending {
+		t.Fatalf("unexpected user=%#v err=%v", u, err)
+	}
+	if err := repo.transitionStatus(u.ID, userStatusActive, "phone verified", u.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserStatus__lockAfterFailedLogins(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	max := loginMaxFailures
+	loginMaxFailures = 3
+	defer func() { loginMaxFailures = max }()
+
+	user := createTestUser(t, repo, "jane@moov.io")
+	user.Status = userStatusActive
+
+	// a login in between starts the count over
+	for i := 0; i < 2; i++ {
+		if locked, err := lockAfterFailedLogin(repo, user); err != nil || locked {
+			t.Fatalf("locked=%v err=%v", locked, err)
+		}
+	}
+	if err := repo.clearLoginFailures(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if locked, err := lockAfterFailedLogin(repo, user); err != nil || locked {
+			t.Fatalf("locked=%v err=%v", locked, err)
+		}
+	}
+	if locked, err := lockAfterFailedLogin(repo, user); err != nil || !locked {
+		t.Fatalf("locked=%v err=%v", locked, err)
+	}
+	if u, err := repo.lookupByUserId(user.ID); err != nil || u.Status != userStatusLocked {
+		t.Fatalf("unexpected user=%#v err=%v", u, err)
+	}
+
+	// unlocking clears the failures
+	if err := repo.transitionStatus(user.ID, userStatusActive, "unlocked", generateID()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := repo.recordLoginFailure(user.ID); err != nil || n != 1 {
+		t.Errorf("failures=%d err=%v", n, err)
+	}
+}
@@ -52,7 +52,7 @@ func createTestAuthable() (*testAuth, error) {
 		return nil, err
 	}
 
-	return &testAuth{auth{db, logger}, dir}, nil
+	return &testAuth{auth{db: db, log: logger}, dir}, nil
 }
 
 type testUserRepository struct {
@@ -86,7 +86,7 @@ func createTestUserRepository() (*testUserRepository, error) {
 		return nil, err
 	}
 
-	return &testUserRepository{sqliteUserRepository{db, logger}, dir}, nil
+	return &testUserRepository{sqliteUserRepository{db: db, log: logger}, dir}, nil
 }
 
 func TestUser__cleanEmail(t *testing.T) {
@@ -262,4 +262,34 @@ func TestUser__update(t *testing.T) {
 	if w.Code != http.StatusOK {
 		t.Errorf("got %d: %v", w.Code, w.Body.String())
 	}
+	events := readTestOutbox(t, repo.db)
+	if len(events) != 1 || events[0].Type != eventUserUpdated || events[0].Data["lastName"] != "last" {
+		t.Errorf("unexpected events: %#v", events)
+	}
+}
+
+func TestAuth__purgeExpiredCookies(t *testing.T) {
+	auth, err := createTestAuthable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.cleanup()
+
+	expired := &http.Cookie{Value: generateID(), Expires: time.Now().Add(-1 * time.Hour)}
+	if err := auth.writeCookie(generateID(), expired); err != nil {
+		t.Fatal(err)
+	}
+	userId := generateID()
+	cookie, err := createCookie(userId, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := auth.purgeExpiredCookies(time.Now(), 10)
+	if err != nil || n != 1 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if id, err := auth.findUserId(cookie.Value); err != nil || id != userId {
+		t.Errorf("expected cookie for userId=%s, got %q (err=%v)", userId, id, err)
+	}
 }
@@ -0,0 +1,624 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Identity event types, delivered to webhook subscriptions
+const (
+	eventUserCreated           = "user.created"
+	eventUserUpdated           = "user.updated"
+	eventUserEmailChanged      = "user.email_changed"
+	eventUserPhoneVerified     = "user.phone_verified"
+	eventUserStatusChanged     = "user.status_changed"
+	eventUserDeletionRequested = "user.deletion_requested"
+	eventUserDeletionCancelled = "user.deletion_cancelled"
+	eventUserDeleted           = "user.deleted"
+)
+
+var identityEventTypes = []string{
+	eventUserCreated,
+	eventUserUpdated,
+	eventUserEmailChanged,
+	eventUserPhoneVerified,
+	eventUserStatusChanged,
+	eventUserDeletionRequested,
+	eventUserDeletionCancelled,
+	eventUserDeleted,
+}
+
+const (
+	// webhookSignatureHeader holds the delivery's timestamp and HMAC-SHA256 signature, as
+	// "t=<unix seconds>,v1=<hex signature>". The signature covers "<timestamp>.<body>".
+	webhookSignatureHeader = "X-Webhook-Signature"
+
+	defaultWebhookDeliveryLimit = 50
+	maxWebhookDeliveryLimit     = 500
+)
+
+var (
+	// webhookMaxAttempts is how many times a delivery is tried before it's moved to the dead-letter list
+	webhookMaxAttempts = 8
+
+	errInvalidWebhookURL       = errors.New("webhook url must be an absolute http or https URL")
+	errUnknownIdentityEvent    = errors.New("unknown identity event type")
+	errWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+// identityEvent is a change to a user which downstream services subscribe to. Events are written
+// to the outbox with the change and relayed to webhooks and the other sinks.
+type identityEvent struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	UserID    string                 `json:"userId"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+}
+
+// eventPublisher is a sink of the outbox relay, it returns nil once it has accepted event.
+type eventPublisher interface {
+	publish(event *identityEvent) error
+}
+
+// userEventData is the profile of u included in user.created and user.updated events.
+func userEventData(u *User) map[string]interface{} {
+	return map[string]interface{}{
+		"email":      u.Email,
+		"firstName":  u.FirstName,
+		"lastName":   u.LastName,
+		"phone":      u.Phone,
+		"companyUrl": u.CompanyURL,
+		"status":     u.Status,
+	}
+}
+
+// webhook is a subscription to identity events, Events is empty to receive every type.
+type webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	// Secret signs each delivery, it's only returned when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+func (w *webhook) subscribed(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for i := range w.Events {
+		if w.Events[i] == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWebhook checks the URL and event types of a new subscription.
+func validateWebhook(w *webhook) error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errInvalidWebhookURL
+	}
+	for _, e := range w.Events {
+		if !validIdentityEventType(e) {
+			return fmt.Errorf("%v: %s", errUnknownIdentityEvent, e)
+		}
+	}
+	return nil
+}
+
+func validIdentityEventType(eventType string) bool {
+	for i := range identityEventTypes {
+		if identityEventTypes[i] == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery statuses
+const (
+	webhookDeliveryPending   = "pending"
+	webhookDeliveryDelivered = "delivered"
+	webhookDeliveryFailed    = "failed"
+)
+
+// webhookDelivery is an event being (or which was) delivered to a webhook. Failed deliveries
+// gave up after webhookMaxAttempts and are the dead-letter list.
+type webhookDelivery struct {
+	ID             string     `json:"id"`
+	WebhookID      string     `json:"webhookId"`
+	EventID        string     `json:"eventId"`
+	EventType      string     `json:"eventType"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseStatus int        `json:"responseStatus,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	NextAttemptAt  *time.Time `json:"nextAttemptAt,omitempty"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+	FailedAt       *time.Time `json:"failedAt,omitempty"`
+
+	payload string
+	url     string
+	secret  string
+}
+
+// webhookDeliveryFilter limits which deliveries are listed, empty fields match every delivery.
+type webhookDeliveryFilter struct {
+	WebhookID string
+	Status    string
+	Limit     int
+}
+
+// webhookDispatcher stores subscriptions and delivers identity events to them in the background,
+// retrying failures with backoff.
+type webhookDispatcher struct {
+	db     *sql.DB
+	logger log.Logger
+	client *http.Client
+
+	interval  time.Duration
+	batchSize int
+
+	// concurrency is how many webhooks are delivered to at once, so a slow endpoint doesn't
+	// hold up every other subscription
+	concurrency int
+
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func setupWebhookDispatcher(logger log.Logger, db *sql.DB) (*webhookDispatcher, error) {
+	d := newWebhookDispatcher(logger, db)
+	if v := os.Getenv("WEBHOOK_INTERVAL"); v != "" {
+		dur, err := time.ParseDuration(v)
+		if err != nil || dur <= 0 {
+			return nil, fmt.Errorf("invalid WEBHOOK_INTERVAL=%q", v)
+		}
+		d.interval = dur
+	}
+	if v := os.Getenv("WEBHOOK_MAX_ATTEMPTS"); v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts < 1 {
+			return nil, fmt.Errorf("invalid WEBHOOK_MAX_ATTEMPTS=%q", v)
+		}
+		webhookMaxAttempts = attempts
+	}
+	return d, nil
+}
+
+func newWebhookDispatcher(logger log.Logger, db *sql.DB) *webhookDispatcher {
+	return &webhookDispatcher{
+		db:     db,
+		logger: logger,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		interval:    10 * time.Second,
+		batchSize:   100,
+		concurrency: 8,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// createWebhook saves a new subscription, generating its ID and secret.
+func (d *webhookDispatcher) createWebhook(w *webhook) error {
+	w.ID = generateID()
+	w.Secret = "whsec_" + generateID()
+	if w.ID == "" || w.Secret == "whsec_" {
+		return errors.New("problem generating webhook ID or secret")
+	}
+	w.CreatedAt = time.Now()
+	query := `insert into webhooks (webhook_id, url, secret, event_types, created_by, created_at) values (?, ?, ?, ?, ?, ?)`
+	if _, err := d.db.Exec(query, w.ID, w.URL, w.Secret, strings.Join(w.Events, " "), w.CreatedBy, w.CreatedAt.Format(serializedTimestampFormat)); err != nil {
+		return fmt.Errorf("problem writing webhook: %v", err)
+	}
+	return nil
+}
+
+// webhooks returns every subscription which hasn't been deleted, without their secrets.
+func (d *webhookDispatcher) webhooks() ([]*webhook, error) {
+	rows, err := d.db.Query(`select webhook_id, url, event_types, created_by, created_at from webhooks where deleted_at is null order by created_at asc`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*webhook
+	for rows.Next() {
+		var events, createdAt string
+		w := &webhook{}
+		if err := rows.Scan(&w.ID, &w.URL, &events, &w.CreatedBy, &createdAt); err != nil {
+			return nil, err
+		}
+		w.Events = strings.Fields(events)
+		if w.Events == nil {
+			w.Events = []string{}
+		}
+		w.CreatedAt = parseTimestamp(createdAt)
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
+
+// deleteWebhook removes the subscription, its pending deliveries are moved to the dead-letter list.
+// False is returned if the webhook doesn't exist.
+func (d *webhookDispatcher) deleteWebhook(webhookId string) (bool, error) {
+	now := time.Now().Format(serializedTimestampFormat)
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`update webhooks set deleted_at = ? where webhook_id = ? and deleted_at is null`, now, webhookId)
+	if err != nil {
+		e := tx.Rollback()
+		return false, fmt.Errorf("problem deleting webhook %s, err=%v, rollback err=%v", webhookId, err, e)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, tx.Rollback()
+	}
+	query := `update webhook_deliveries set failed_at = ?, last_error = 'webhook deleted'
+where webhook_id = ? and delivered_at is null and failed_at is null`
+	if _, err := tx.Exec(query, now, webhookId); err != nil {
+		e := tx.Rollback()
+		return false, fmt.Errorf("problem failing deliveries of webhook %s, err=%v, rollback err=%v", webhookId, err, e)
+	}
+	return true, tx.Commit()
+}
+
+// publish queues a delivery of event to each subscribed webhook. Events the outbox relays again
+// aren't queued twice for a webhook.
+func (d *webhookDispatcher) publish(event *identityEvent) error {
+	if event.ID == "" {
+		event.ID = generateID()
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	webhooks, err := d.webhooks()
+	if err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	now := event.CreatedAt.Format(serializedTimestampFormat)
+	for _, w := range webhooks {
+		if !w.subscribed(event.Type) {
+			continue
+		}
+		query := `insert into webhook_deliveries (delivery_id, webhook_id, event_id, event_type, user_id, payload, attempts, next_attempt_at, created_at)
+select ?, ?, ?, ?, ?, ?, 0, ?, ? where not exists (select 1 from webhook_deliveries where webhook_id = ? and event_id = ?)`
+		if _, err := tx.Exec(query, generateID(), w.ID, event.ID, event.Type, event.UserID, string(payload), now, now, w.ID, event.ID); err != nil {
+			e := tx.Rollback()
+			return fmt.Errorf("problem queueing %s event for webhook %s, err=%v, rollback err=%v", event.Type, w.ID, err, e)
+		}
+	}
+	return tx.Commit()
+}
+
+// signWebhookPayload returns the webhookSignatureHeader value of body sent at the given time.
+func signWebhookPayload(secret string, at time.Time, body []byte) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// send POSTs a delivery's event to its webhook, returning the response status.
+func (d *webhookDispatcher) send(delivery *webhookDelivery) (int, error) {
+	body := []byte(delivery.payload)
+	req, err := http.NewRequest("POST", delivery.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", delivery.WebhookID)
+	req.Header.Set("X-Webhook-Delivery-Id", delivery.ID)
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(delivery.secret, time.Now(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliver sends up to limit deliveries which are due at now, returning how many succeeded.
+func (d *webhookDispatcher) deliver(now time.Time, limit int) (int64, error) {
+	query := `select d.delivery_id, d.webhook_id, d.event_id, d.event_type, d.payload, d.attempts, w.url, w.secret
+from webhook_deliveries as d inner join webhooks as w on d.webhook_id = w.webhook_id
+where d.delivered_at is null and d.failed_at is null and d.next_attempt_at <= ?
+order by d.next_attempt_at asc limit ?`
+	rows, err := d.db.Query(query, now.Format(serializedTimestampFormat), limit)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var pending []*webhookDelivery
+	for rows.Next() {
+		delivery := &webhookDelivery{}
+		if err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventID, &delivery.EventType, &delivery.payload, &delivery.Attempts, &delivery.url, &delivery.secret); err != nil {
+			return 0, err
+		}
+		pending = append(pending, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	// each webhook's deliveries are sent in order, different webhooks are sent to in parallel
+	var webhookIds []string
+	byWebhook := make(map[string][]*webhookDelivery)
+	for _, delivery := range pending {
+		if _, exists := byWebhook[delivery.WebhookID]; !exists {
+			webhookIds = append(webhookIds, delivery.WebhookID)
+		}
+		byWebhook[delivery.WebhookID] = append(byWebhook[delivery.WebhookID], delivery)
+	}
+
+	var (
+		mu        sync.Mutex
+		delivered int64
+		firstErr  error
+		wg        sync.WaitGroup
+	)
+	sem := make(chan struct{}, d.concurrency)
+	for _, webhookId := range webhookIds {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(deliveries []*webhookDelivery) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			n, err := d.deliverTo(deliveries, now)
+
+			mu.Lock()
+			defer mu.Unlock()
+			delivered += n
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(byWebhook[webhookId])
+	}
+	wg.Wait()
+	return delivered, firstErr
+}
+
+// deliverTo sends one webhook's deliveries in order. Once a delivery fails the rest are left for
+// the next batch, so a failing endpoint costs one timeout per batch rather than one per event.
+func (d *webhookDispatcher) deliverTo(deliveries []*webhookDelivery, now time.Time) (int64, error) {
+	var delivered int64
+	for _, delivery := range deliveries {
+		delivery.Attempts++
+		status, err := d.send(delivery)
+		if err != nil {
+			return delivered, d.failed(delivery, status, now, err)
+		}
+		query := `update webhook_deliveries set attempts = ?, response_status = ?, last_error = null, delivered_at = ? where delivery_id = ?`
+		if _, err := d.db.Exec(query, delivery.Attempts, status, time.Now().Format(serializedTimestampFormat), delivery.ID); err != nil {
+			return delivered, fmt.Errorf("problem marking webhook delivery %s delivered: %v", delivery.ID, err)
+		}
+		webhookDeliveries.With("event", delivery.EventType).Add(1)
+		delivered++
+	}
+	return delivered, nil
+}
+
+// failed records a delivery error, scheduling a retry with the same backoff as notifications or
+// moving the delivery to the dead-letter list after webhookMaxAttempts. The webhook's other
+// pending deliveries wait for the retry too, so they don't fill every batch while it's failing.
+func (d *webhookDispatcher) failed(delivery *webhookDelivery, status int, now time.Time, sendErr error) error {
+	webhookDeliveryErrors.With("event", delivery.EventType).Add(1)
+
+	var err error
+	if delivery.Attempts >= webhookMaxAttempts {
+		d.logger.Log("webhooks", fmt.Sprintf("giving up on webhook delivery %s after %d attempts: %v", delivery.ID, delivery.Attempts, sendErr))
+		query := `update webhook_deliveries set attempts = ?, response_status = ?, last_error = ?, failed_at = ? where delivery_id = ?`
+		_, err = d.db.Exec(query, delivery.Attempts, status, sendErr.Error(), now.Format(serializedTimestampFormat), delivery.ID)
+	} else {
+		next := now.Add(notificationBackoff(delivery.Attempts))
+		d.logger.Log("webhooks", fmt.Sprintf("problem delivering %s to webhook %s (attempt %d), retrying at %v: %v", delivery.ID, delivery.WebhookID, delivery.Attempts, next, sendErr))
+		query := `update webhook_deliveries set attempts = ?, response_status = ?, last_error = ?, next_attempt_at = ? where delivery_id = ?`
+		_, err = d.db.Exec(query, delivery.Attempts, status, sendErr.Error(), next.Format(serializedTimestampFormat), delivery.ID)
+		if err == nil {
+			query = `update webhook_deliveries set next_attempt_at = ?
+where webhook_id = ? and delivered_at is null and failed_at is null and next_attempt_at < ?`
+			_, err = d.db.Exec(query, next.Format(serializedTimestampFormat), delivery.WebhookID, next.Format(serializedTimestampFormat))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("problem recording failed webhook delivery %s: %v", delivery.ID, err)
+	}
+	return nil
+}
+
+// deliveries lists the deliveries matching filter, newest first.
+func (d *webhookDispatcher) deliveries(filter webhookDeliveryFilter) ([]*webhookDelivery, error) {
+	var where []string
+	var args []interface{}
+	if filter.WebhookID != "" {
+		where, args = append(where, "webhook_id = ?"), append(args, filter.WebhookID)
+	}
+	switch filter.Status {
+	case "":
+	case webhookDeliveryPending:
+		where = append(where, "delivered_at is null and failed_at is null")
+	case webhookDeliveryDelivered:
+		where = append(where, "delivered_at is not null")
+	case webhookDeliveryFailed:
+		where = append(where, "failed_at is not null")
+	default:
+		return nil, fmt.Errorf("unknown delivery status %q", filter.Status)
+	}
+	if filter.Limit < 1 {
+		filter.Limit = defaultWebhookDeliveryLimit
+	}
+
+	query := `select delivery_id, webhook_id, event_id, event_type, attempts, response_status, last_error, created_at, next_attempt_at, delivered_at, failed_at from webhook_deliveries`
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += " order by created_at desc limit ?"
+	args = append(args, filter.Limit)
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*webhookDelivery
+	for rows.Next() {
+		var status sql.NullInt64
+		var lastError, nextAttemptAt, deliveredAt, failedAt sql.NullString
+		var createdAt string
+		delivery := &webhookDelivery{}
+		if err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventID, &delivery.EventType, &delivery.Attempts, &status, &lastError, &createdAt, &nextAttemptAt, &deliveredAt, &failedAt); err != nil {
+			return nil, err
+		}
+		delivery.ResponseStatus = int(status.Int64)
+		delivery.LastError = lastError.String
+		delivery.CreatedAt = parseTimestamp(createdAt)
+		switch {
+		case deliveredAt.String != "":
+			delivery.Status = webhookDeliveryDelivered
+			t := parseTimestamp(deliveredAt.String)
+			delivery.DeliveredAt = &t
+		case failedAt.String != "":
+			delivery.Status = webhookDeliveryFailed
+			t := parseTimestamp(failedAt.String)
+			delivery.FailedAt = &t
+		default:
+			delivery.Status = webhookDeliveryPending
+			t := parseTimestamp(nextAttemptAt.String)
+			delivery.NextAttemptAt = &t
+		}
+		out = append(out, delivery)
+	}
+	return out, rows.Err()
+}
+
+// retry moves a delivery from the dead-letter list back to the queue with its attempts reset.
+// errWebhookDeliveryNotFound is returned unless the delivery failed and its webhook still exists.
+func (d *webhookDispatcher) retry(deliveryId string) error {
+	query := `update webhook_deliveries set attempts = 0, failed_at = null, next_attempt_at = ?
+where delivery_id = ? and failed_at is not null
+and webhook_id in (select webhook_id from webhooks where deleted_at is null)`
+	res, err := d.db.Exec(query, time.Now().Format(serializedTimestampFormat), deliveryId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errWebhookDeliveryNotFound
+	}
+	return nil
+}
+
+// purgeDelivered removes up to limit deliveries which succeeded before the given time. The
+// dead-letter list is kept until each delivery is retried.
+func (d *webhookDispatcher) purgeDelivered(before time.Time, limit int) (int64, error) {
+	query := `delete from webhook_deliveries where delivery_id in (select delivery_id from webhook_deliveries
+where delivered_at is not null and delivered_at < ? limit ?)`
+	res, err := d.db.Exec(query, before.Format(serializedTimestampFormat), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// start delivers due events every interval until shutdown is called.
+func (d *webhookDispatcher) start() {
+	d.started = true
+	d.logger.Log("webhooks", fmt.Sprintf("delivering webhooks every %v", d.interval))
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for {
+					delivered, err := d.deliver(time.Now(), d.batchSize)
+					if err != nil {
+						d.logger.Log("webhooks", fmt.Sprintf("problem delivering webhooks: %v", err))
+						break
+					}
+					if delivered < int64(d.batchSize) || d.stopping() {
+						break
+					}
+				}
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (d *webhookDispatcher) stopping() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops delivering webhooks and waits for an in-progress batch to finish.
+func (d *webhookDispatcher) shutdown() {
+	if d == nil || !d.started {
+		return
+	}
+	select {
+	case <-d.stop:
+	default:
+		close(d.stop)
+	}
+	<-d.done
+}
@@ -0,0 +1,328 @@
+// Copyright 2018 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// webhookReceiver is a test server recording each delivery, responding with status
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookReceiver() *webhookReceiver {
+	rec := &webhookReceiver{status: http.StatusOK}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.requests = append(rec.requests, r)
+		rec.bodies = append(rec.bodies, bs)
+		w.WriteHeader(rec.status)
+	}))
+	return rec
+}
+
+func TestWebhooks__signWebhookPayload(t *testing.T) {
+	at := time.Unix(1546300800, 0)
+	body := []byte(`{"type":"user.created"}`)
+	sig := signWebhookPayload("whsec_test", at, body)
+
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte("1546300800." + string(body)))
+	if expected := "t=1546300800,v1=" + hex.EncodeToString(mac.Sum(nil)); sig != expected {
+		t.Errorf("got %q, expected %q", sig, expected)
+	}
+	if signWebhookPayload("other", at, body) == sig {
+		t.Error("expected signature to depend on the secret")
+	}
+}
+
+func TestWebhooks__validateWebhook(t *testing.T) {
+	if err := validateWebhook(&webhook{URL: "https://billing.example.com/hooks", Events: []string{eventUserCreated}}); err != nil {
+		t.Error(err)
+	}
+	for _, w := range []*webhook{
+		{URL: "billing.example.com/hooks"},
+		{URL: "ftp://billing.example.com"},
+		{URL: "https://billing.example.com", Events: []string{"user.exploded"}},
+	} {
+		if err := validateWebhook(w); err == nil {
+			t.Errorf("expected error for %#v", w)
+		}
+	}
+}
+
+func TestWebhooks__deliver(t *testing.T) {
+	defer func(n int) { webhookMaxAttempts = n }(webhookMaxAttempts)
+	webhookMaxAttempts = 2
+
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	d := newWebhookDispatcher(log.NewNopLogger(), repo.db)
+	all := &webhook{URL: receiver.URL, CreatedBy: "admin"}
+	deletions := &webhook{URL: receiver.URL + "/deletions", Events: []string{eventUserDeleted}}
+	for _, w := range []*webhook{all, deletions} {
+		if err := d.createWebhook(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only subscribed webhooks get a delivery
+	if err := d.publish(&identityEvent{Type: eventUserCreated, UserID: "jane", Data: map[string]interface{}{"email": "jane@moov.io"}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(time.Second)
+	if n, err := d.deliver(now, 10); err != nil || n != 1 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	r, body := receiver.requests[0], receiver.bodies[0]
+	if r.Header.Get("X-Webhook-Event") != eventUserCreated || r.Header.Get("X-Webhook-Id") != all.ID {
+		t.Errorf("unexpected headers: %v", r.Header)
+	}
+	ts := strings.TrimPrefix(strings.Split(r.Header.Get(webhookSignatureHeader), ",")[0], "t=")
+	mac := hmac.New(sha256.New, []byte(all.Secret))
+	mac.Write([]byte(ts + "." + string(body)))
+	if !strings.HasSuffix(r.Header.Get(webhookSignatureHeader), ",v1="+hex.EncodeToString(mac.Sum(nil))) {
+		t.Errorf("invalid signature: %s", r.Header.Get(webhookSignatureHeader))
+	}
+	var event identityEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" || event.UserID != "jane" || event.Data["email"] != "jane@moov.io" {
+		t.Errorf("unexpected event=%#v err=%v", event, err)
+	}
+
+	// failures are retried after a backoff, then dead-lettered
+	receiver.status = http.StatusInternalServerError
+	if err := d.publish(&identityEvent{Type: eventUserDeleted, UserID: "jane"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.deliver(now, 10); err != nil || n != 0 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if n, err := d.deliver(now, 10); err != nil || n != 0 || len(receiver.requests) != 3 {
+		t.Fatalf("expected nothing due, n=%d err=%v requests=%d", n, err, len(receiver.requests))
+	}
+	pending, err := d.deliveries(webhookDeliveryFilter{Status: webhookDeliveryPending})
+	if err != nil || len(pending) != 2 || pending[0].Attempts != 1 || pending[0].ResponseStatus != http.StatusInternalServerError {
+		t.Fatalf("unexpected deliveries=%#v err=%v", pending, err)
+	}
+	now = now.Add(time.Hour)
+	if _, err := d.deliver(now, 10); err != nil {
+		t.Fatal(err)
+	}
+	failed, err := d.deliveries(webhookDeliveryFilter{Status: webhookDeliveryFailed})
+	if err != nil || len(failed) != 2 || failed[0].FailedAt == nil || failed[0].LastError == "" {
+		t.Fatalf("unexpected dead letters=%#v err=%v", failed, err)
+	}
+
+	// dead letters can be retried
+	receiver.status = http.StatusNoContent
+	for _, delivery := range failed {
+		if err := d.retry(delivery.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.retry(failed[0].ID); err != errWebhookDeliveryNotFound {
+		t.Errorf("expected errWebhookDeliveryNotFound, got %v", err)
+	}
+	if n, err := d.deliver(time.Now().Add(time.Second), 10); err != nil || n != 2 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if history, err := d.deliveries(webhookDeliveryFilter{WebhookID: all.ID}); err != nil || len(history) != 2 || history[0].Status != webhookDeliveryDelivered {
+		t.Errorf("unexpected history=%#v err=%v", history, err)
+	}
+
+	// deleting a webhook dead-letters its pending deliveries
+	if err := d.publish(&identityEvent{Type: eventUserDeleted, UserID: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := d.deleteWebhook(deletions.ID); err != nil || !found {
+		t.Fatalf("found=%v err=%v", found, err)
+	}
+	if found, err := d.deleteWebhook(deletions.ID); err != nil || found {
+		t.Errorf("found=%v err=%v", found, err)
+	}
+	failed, err = d.deliveries(webhookDeliveryFilter{WebhookID: deletions.ID, Status: webhookDeliveryFailed})
+	if err != nil || len(failed) != 1 || failed[0].LastError != "webhook deleted" {
+		t.Fatalf("unexpected dead letters=%#v err=%v", failed, err)
+	}
+	if err := d.retry(failed[0].ID); err != errWebhookDeliveryNotFound {
+		t.Errorf("expected errWebhookDeliveryNotFound, got %v", err)
+	}
+	if hooks, err := d.webhooks(); err != nil || len(hooks) != 1 || hooks[0].ID != all.ID || hooks[0].Secret != "" {
+		t.Errorf("unexpected webhooks=%#v err=%v", hooks, err)
+	}
+
+	// delivered events are purged, dead letters are kept
+	if n, err := d.purgeDelivered(time.Now().Add(time.Minute), 10); err != nil || n != 3 {
+		t.Errorf("n=%d err=%v", n, err)
+	}
+	if remaining, err := d.deliveries(webhookDeliveryFilter{}); err != nil || len(remaining) != 2 {
+		t.Errorf("unexpected deliveries=%#v err=%v", remaining, err)
+	}
+}
+
+func TestWebhooks__deliverFailingWebhook(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+
+	up, down := newWebhookReceiver(), newWebhookReceiver()
+	defer up.Close()
+	defer down.Close()
+	down.status = http.StatusServiceUnavailable
+
+	d := newWebhookDispatcher(log.NewNopLogger(), repo.db)
+	for _, url := range []string{up.URL, down.URL} {
+		if err := d.createWebhook(&webhook{URL: url}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, userId := range []string{"jane", "john", "other"} {
+		if err := d.publish(&identityEvent{Type: eventUserCreated, UserID: userId}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the failing webhook is tried once, its other deliveries wait for the retry
+	now := time.Now().Add(time.Second)
+	if n, err := d.deliver(now, 10); err != nil || n != 3 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if len(up.requests) != 3 || len(down.requests) != 1 {
+		t.Errorf("up=%d down=%d requests", len(up.requests), len(down.requests))
+	}
+	if n, err := d.deliver(now, 10); err != nil || n != 0 || len(down.requests) != 1 {
+		t.Errorf("expected nothing due, n=%d err=%v requests=%d", n, err, len(down.requests))
+	}
+	pending, err := d.deliveries(webhookDeliveryFilter{Status: webhookDeliveryPending})
+	if err != nil || len(pending) != 3 {
+		t.Fatalf("unexpected deliveries=%#v err=%v", pending, err)
+	}
+	for _, delivery := range pending {
+		if delivery.NextAttemptAt == nil || !delivery.NextAttemptAt.After(now) {
+			t.Errorf("expected %s to be held back, next attempt at %v", delivery.ID, delivery.NextAttemptAt)
+		}
+	}
+}
+
+func TestWebhooks__admin(t *testing.T) {
+	repo, err := createTestUserRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.cleanup()
+	auth := &auth{db: repo.db, log: log.NewNopLogger()}
+	roleRepo := &sqliteRoleRepository{db: repo.db, log: log.NewNopLogger()}
+	tokens := &sqlitePersonalTokenRepository{db: repo.db, log: log.NewNopLogger()}
+	webhooks := newWebhookDispatcher(log.NewNopLogger(), repo.db)
+
+	a := &userAdmin{
+		logger:   log.NewNopLogger(),
+		auth:     auth,
+		users:    repo,
+		roles:    roleRepo,
+		tokens:   tokens,
+		webhooks: webhooks,
+	}
+	router := mux.NewRouter()
+	a.register(func(path string, fn http.HandlerFunc) {
+		router.HandleFunc(path, fn)
+	})
+
+	admin, user := createTestUser(t, repo, "admin@moov.io"), createTestUser(t, repo, "jane@moov.io")
+	if err := roleRepo.assignRole(admin.ID, adminRole, ""); err != nil {
+		t.Fatal(err)
+	}
+	secret := personalTokenPrefix + generateID()
+	if err := tokens.createToken(&personalToken{ID: generateID(), UserID: admin.ID, Name: "admin", Scopes: []string{permUsersAdmin}, CreatedAt: base.NewTime(time.Now())}, secret); err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		r := httptest.NewRequest(method, path, &buf)
+		r.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		w.Flush()
+		return w
+	}
+
+	if w := do("POST", "/webhooks", createWebhookRequest{URL: "not a url"}); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	w := do("POST", "/webhooks", createWebhookRequest{URL: "https://crm.example.com/hooks", Events: []string{eventUserStatusChanged}})
+	var hook webhook
+	if err := json.NewDecoder(w.Body).Decode(&hook); err != nil || hook.ID == "" || !strings.HasPrefix(hook.Secret, "whsec_") || hook.CreatedBy != admin.ID {
+		t.Fatalf("unexpected webhook=%#v err=%v", hook, err)
+	}
+	w = do("GET", "/webhooks", nil)
+	var hooks []*webhook
+	if err := json.NewDecoder(w.Body).Decode(&hooks); err != nil || len(hooks) != 1 || hooks[0].Secret != "" {
+		t.Errorf("unexpected webhooks=%#v err=%v", hooks, err)
+	}
+
+	// status changes are published
+	if w := do("PUT", fmt.Sprintf("/users/%s/status", user.ID), updateUserStatusRequest{Status: userStatusSuspended, Reason: "abuse"}); w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	relay := newOutboxRelay(log.NewNopLogger(), repo.db, []outboxSink{{name: "webhook", publisher: webhooks}})
+	if n, err := relay.relay(time.Now(), 10); err != nil || n != 1 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	w = do("GET", "/webhook-deliveries?status=pending&webhookId="+hook.ID, nil)
+	var deliveries []*webhookDelivery
+	if err := json.NewDecoder(w.Body).Decode(&deliveries); err != nil || len(deliveries) != 1 || deliveries[0].EventType != eventUserStatusChanged {
+		t.Fatalf("unexpected deliveries=%#v err=%v", deliveries, err)
+	}
+	if w := do("GET", "/webhook-deliveries?status=lost", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("POST", fmt.Sprintf("/webhook-deliveries/%s/retry", deliveries[0].ID), nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected pending delivery to not be retried, got %d", w.Code)
+	}
+
+	if w := do("DELETE", "/webhooks/"+hook.ID, nil); w.Code != http.StatusOK {
+		t.Errorf("got %d", w.Code)
+	}
+	if w := do("DELETE", "/webhooks/"+hook.ID, nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+}